@@ -51,8 +51,38 @@ const (
 	FRAME_INTER = 2
 
 	VIDEO_H264 = 7
+	// Enhanced RTMP 의 FourCC 로 들어오는 코덱. FLV 레거시 코덱 ID 와 겹치지 않는 내부 값이다.
+	VIDEO_HEVC = 12
+	VIDEO_AV1  = 13
+	VIDEO_VP9  = 14
 )
 
+// Enhanced RTMP ExVideoTagHeader 의 VideoPacketType
+const (
+	PKTTYPE_SEQUENCE_START         = 0 // 코덱 설정 레코드 (HEVCDecoderConfigurationRecord 등)
+	PKTTYPE_CODED_FRAMES           = 1 // avc1/hvc1 은 3 바이트 composition time 이 붙는다.
+	PKTTYPE_SEQUENCE_END           = 2
+	PKTTYPE_CODED_FRAMESX          = 3 // composition time 이 0 인 프레임. 필드가 생략된다.
+	PKTTYPE_METADATA               = 4 // AMF 로 인코딩된 HDR colorInfo 등
+	PKTTYPE_MPEG2TS_SEQUENCE_START = 5
+)
+
+// Enhanced RTMP 의 비디오 FourCC
+const (
+	FOURCC_AVC  = "avc1"
+	FOURCC_HEVC = "hvc1"
+	FOURCC_AV1  = "av01"
+	FOURCC_VP9  = "vp09"
+)
+
+// FourCC 와 내부 코덱 ID 의 대응표. connect 응답의 fourCcList 에도 사용한다.
+var VideoFourCC = map[string]uint8{
+	FOURCC_AVC:  VIDEO_H264,
+	FOURCC_HEVC: VIDEO_HEVC,
+	FOURCC_AV1:  VIDEO_AV1,
+	FOURCC_VP9:  VIDEO_VP9,
+}
+
 var (
 	PUBLISH = "publish"
 	PLAY    = "play"
@@ -104,8 +134,12 @@ type VideoPacketHeader interface {
 	PacketHeader            // 공통 부모 인터페이스
 	IsKeyFrame() bool       // 키 프레임 여부 반환
 	IsSeq() bool            // 시퀀스 헤더 여부 반환
-	CodecID() uint8         // 비디오 코덱 ID 반환(H.264)
+	CodecID() uint8         // 비디오 코덱 ID 반환(H.264, Enhanced RTMP 의 HEVC/AV1/VP9)
 	CompositionTime() int32 // 컴포지션 타임 오프셋 반환
+	IsExHeader() bool       // Enhanced RTMP 확장 헤더(FourCC) 여부 반환
+	PacketType() uint8      // 패킷 타입 반환. 레거시 AVC 의 0~2 는 Enhanced RTMP 의 PKTTYPE_* 와 값이 같다.
+	IsSeqEnd() bool         // 시퀀스 종료 여부 반환
+	HeaderLen() int         // 태그 헤더 길이 반환. 코덱 데이터는 Data[HeaderLen():] 부터 시작한다.
 }
 
 type Demuxer interface {
@@ -129,6 +163,11 @@ type GetWriter interface {
 	GetWriter(Info) WriteCloser
 }
 
+// 스트림 키로 퍼블리셔가 보내는 비트레이트(bps)를 측정값에서 찾는다. 아직 측정되지 않았으면 ok 는 false 이다.
+type GetBandwidth interface {
+	GetBandwidth(key string) (bps int, ok bool)
+}
+
 type Handler interface {
 	HandleReader(ReadCloser)
 	HandleWriter(WriteCloser)
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"strings"
+	"sync"
 
 	"github.com/kr/pretty"
 	log "github.com/sirupsen/logrus"
@@ -33,47 +34,108 @@ import (
 
 // 스태틱 푸쉬는 여러개의 대상 URL(CDN, 백업 서버 등)에 스트림을 푸쉬할 수 있는 목적지를 말한다.
 type Application struct {
-	Appname    string   `mapstructure:"appname"`
-	Live       bool     `mapstructure:"live"`
-	Hls        bool     `mapstructure:"hls"`
-	Flv        bool     `mapstructure:"flv"`
-	Api        bool     `mapstructure:"api"`
-	Webrtc     bool     `mapstructure:"webrtc"`
-	StaticPush []string `mapstructure:"static_push"`
+	Appname          string   `mapstructure:"appname"`
+	Live             bool     `mapstructure:"live"`
+	Hls              bool     `mapstructure:"hls"`
+	HlsSegmentFormat string   `mapstructure:"hls_segment_format"` // HLS 세그먼트 형식. "ts"(기본값) 또는 "fmp4"
+	HlsDuration      int      `mapstructure:"hls_duration"`       // HLS 세그먼트 목표 길이(ms). 0 이면 3000
+	HlsWindow        int      `mapstructure:"hls_window"`         // 플레이리스트에 남길 세그먼트 수. 0 이면 3
+	HlsLowLatency    bool     `mapstructure:"hls_low_latency"`    // LL-HLS(부분 세그먼트, 블로킹 리로드) 사용 여부. fMP4 세그먼트를 쓴다.
+	HlsPartDuration  int      `mapstructure:"hls_part_duration"`  // LL-HLS 부분 세그먼트 목표 길이(ms). 0 이면 기본값
+	HlsRecord        bool     `mapstructure:"hls_record"`         // HLS 세그먼트를 hls_record_dir 에 녹화해 DVR/다시보기로 제공할지 여부
+	HlsEncryption    string   `mapstructure:"hls_encryption"`     // HLS 세그먼트 암호화 방식. ""(사용 안 함), "aes-128", "sample-aes"
+	HlsKeyRotation   int      `mapstructure:"hls_key_rotation"`   // 암호화 키를 바꾸는 세그먼트 간격. 0 이면 기본값
+	HlsAdMarkers     string   `mapstructure:"hls_ad_markers"`     // 광고 구간 태그 형식. "cue"(#EXT-X-CUE-OUT/IN, 기본값), "daterange"(#EXT-X-DATERANGE)
+	HlsCaptions      bool     `mapstructure:"hls_captions"`       // H.264 SEI 의 CEA-608 캡션을 WebVTT 자막 렌디션으로 내보낼지 여부
+	Flv              bool     `mapstructure:"flv"`
+	Api              bool     `mapstructure:"api"`
+	Webrtc           bool     `mapstructure:"webrtc"`
+	Dash             bool     `mapstructure:"dash"`        // MPEG-DASH 출력 사용 여부
+	PlayAuth         string   `mapstructure:"play_auth"`   // 재생 인증 방식. ""(사용 안 함), "sign"(서명 URL), "jwt", "any"(sign 또는 jwt)
+	PlaySecret       string   `mapstructure:"play_secret"` // 재생 URL 서명과 JWT 를 확인할 비밀키. 비어 있으면 jwt.secret
+	StaticPush       []string `mapstructure:"static_push"`
 }
 
+const (
+	HLSSegmentFormatTS   = "ts"
+	HLSSegmentFormatFMP4 = "fmp4"
+
+	DefaultHLSPartDuration = 500 // ms
+
+	HLSEncryptionAES128    = "aes-128"
+	HLSEncryptionSampleAES = "sample-aes"
+	DefaultHLSKeyRotation  = 10 // 세그먼트
+
+	HLSAdMarkersCue       = "cue"
+	HLSAdMarkersDateRange = "daterange"
+
+	PlayAuthSign = "sign"
+	PlayAuthJWT  = "jwt"
+	PlayAuthAny  = "any"
+)
+
 // 여러개의 application 구조체를 담는 슬라이스 입니다
 type Applications []Application
 
+// WebRTC 피어가 사용할 ICE 서버(STUN/TURN) 정보이다.
+// TURN 서버는 username/credential 로 인증하며, STUN 서버는 urls 만 지정하면 된다.
+type ICEServer struct {
+	URLs       []string `mapstructure:"urls"`
+	Username   string   `mapstructure:"username"`
+	Credential string   `mapstructure:"credential"`
+}
+
 type JWT struct {
 	Secret    string `mapstructure:"secret"`
 	Algorithm string `mapstructure:"algorithm"`
 }
 
+// 퍼블리시/재생 세션의 시작과 끝을 알릴 웹훅 URL. 비어 있는 이벤트는 보내지 않는다.
+type Hooks struct {
+	OnPublish   string `mapstructure:"on_publish"`   // 퍼블리시 시작. 2xx 가 아니면 퍼블리셔를 거절한다.
+	OnUnpublish string `mapstructure:"on_unpublish"` // 퍼블리시 종료
+	OnPlay      string `mapstructure:"on_play"`      // 재생 시작. 2xx 가 아니면 시청자를 거절한다.
+	OnStop      string `mapstructure:"on_stop"`      // 재생 종료
+	Timeout     int    `mapstructure:"timeout"`      // 요청 한 번의 제한 시간(ms). 0 이면 3000
+	Retries     int    `mapstructure:"retries"`      // 연결 오류나 5xx 응답에 다시 보낼 횟수
+}
+
 // 스트리밍 서버의 전반적 설정을 정의하는 구조체이다. 바이퍼 라이브러리를 통해 설정 파일이나 환경 변수에서 읽은 데이터를 매핑하여 사용된다.
 // mapstructure 는 go에서 구조체와 맵 데이터를 자동으로 변환하기 위해 사용하는 라이브러리 입니다.
 // 맵 데이터의 키를 구조체 필드 이름에 매핑해 구조체로 변환합니다.
 // 맵 값의 타입이 구조체 필드와 다를 경우에도 자동으로 변환합니다. str -> int
 
 type ServerCfg struct {
-	Level           string       `mapstructure:"level"`              // 로그레벨 지정.
-	ConfigFile      string       `mapstructure:"config_file"`        // 서버 설정 파일 이름. 서버 초기화시 설정값 로드에 사용한다.
-	FLVArchive      bool         `mapstructure:"flv_archive"`        //  FLV 형식의 스트림 데이터를 저장할지의 여부. hls와 비교해 세그먼트화를 하지 않기 때문에 저장에 더 적합하다.
-	FLVDir          string       `mapstructure:"flv_dir"`            // FLV 데이터 저장 디렉토리 경로
-	RTMPNoAuth      bool         `mapstructure:"rtmp_noauth"`        // RTMP 인증 비활성화 여부 rtmp 자체에는 내장 인증 메커니즘이 없기때문에, 인증없이 동작하는 경우 보안문제가 발생할 수 있다. 다만 테스트환경, 성능 최적화등의 상황에서는 필요한 옵션일 수 있다.
-	RTMPAddr        string       `mapstructure:"rtmp_addr"`          // RTMP 서버의 바인딩 주소. 바인딩 주소는 주로 보통 네트워크 인터페이스와, 포트번호를 포함해 0.0.0.0:1935, 127.0.0.1:1935같은 형태로 나타낸다.
-	HTTPFLVAddr     string       `mapstructure:"httpflv_addr"`       // HTTP-FLV 서버의 바인딩주소 :7001 HTTP-FLV는 HTTP를 쓰고 지연시간이 낮다는 이점이 있으나, 데이터 복구가 불가하다.
-	HLSAddr         string       `mapstructure:"hls_addr"`           // HLS 서버의 바인딩 주소 :7002 세그먼트 파일로 구성되어 저장보다는 재생에 최적화 되어있다.
-	HLSKeepAfterEnd bool         `mapstructure:"hls_keep_after_end"` // 스트림 종료후 세그먼트와 재생목록 파일의 유지여부. HLS 스트림의 유지 여부
-	APIAddr         string       `mapstructure:"api_addr"`           // api 서버의 바인딩 주소. :8090 스트리밍 서비스 설정 및 관리를 위해 동작. (상태확인, 스트림제어, 채널 키 생성등)
-	RedisAddr       string       `mapstructure:"redis_addr"`         // 레디스 서버의 주소  "127.0.0.1:6379"
-	RedisPwd        string       `mapstructure:"redis_pwd"`          // 레디스 서버의 비밀번호
-	ReadTimeout     int          `mapstructure:"read_timeout"`       // 스트림 읽기 타임아웃 설정
-	WriteTimeout    int          `mapstructure:"write_timeout"`      // 스트림 쓰기 타임아웃 설정
-	EnableTLSVerify bool         `mapstructure:"enable_tls_verify"`  // TLS 인증서 검증 활성화 여부 (SSL 의 향상 버전  RTMPS 등의 응용)
-	GopNum          int          `mapstructure:"gop_num"`            // gop 개수 설정. 키프레임 간격. 짧은 gop는 네트워크 지연과 복구속도 향상. 다만 키프레임이 더 자주 전송되므로 대역폭 사용량과 디코딩 부담이 증가한다.
-	JWT             JWT          `mapstructure:"jwt"`                // 스트리밍 서버에서 인증 및 세션관리를 위한 JWT 설정
-	Server          Applications `mapstructure:"server"`             // 스트리밍 서버의 애플리케이션 설정 리스트. 여러 스트리밍 앱 지원 가능
+	Level                string         `mapstructure:"level"`                  // 로그레벨 지정.
+	ConfigFile           string         `mapstructure:"config_file"`            // 서버 설정 파일 이름. 서버 초기화시 설정값 로드에 사용한다.
+	FLVArchive           bool           `mapstructure:"flv_archive"`            //  FLV 형식의 스트림 데이터를 저장할지의 여부. hls와 비교해 세그먼트화를 하지 않기 때문에 저장에 더 적합하다.
+	FLVDir               string         `mapstructure:"flv_dir"`                // FLV 데이터 저장 디렉토리 경로
+	RTMPNoAuth           bool           `mapstructure:"rtmp_noauth"`            // RTMP 인증 비활성화 여부 rtmp 자체에는 내장 인증 메커니즘이 없기때문에, 인증없이 동작하는 경우 보안문제가 발생할 수 있다. 다만 테스트환경, 성능 최적화등의 상황에서는 필요한 옵션일 수 있다.
+	RTMPAddr             string         `mapstructure:"rtmp_addr"`              // RTMP 서버의 바인딩 주소. 바인딩 주소는 주로 보통 네트워크 인터페이스와, 포트번호를 포함해 0.0.0.0:1935, 127.0.0.1:1935같은 형태로 나타낸다.
+	HTTPFLVAddr          string         `mapstructure:"httpflv_addr"`           // HTTP-FLV 서버의 바인딩주소 :7001 HTTP-FLV는 HTTP를 쓰고 지연시간이 낮다는 이점이 있으나, 데이터 복구가 불가하다.
+	HLSAddr              string         `mapstructure:"hls_addr"`               // HLS 서버의 바인딩 주소 :7002 세그먼트 파일로 구성되어 저장보다는 재생에 최적화 되어있다.
+	HLSKeepAfterEnd      bool           `mapstructure:"hls_keep_after_end"`     // 스트림 종료후 세그먼트와 재생목록 파일의 유지여부. HLS 스트림의 유지 여부
+	HLSRecordDir         string         `mapstructure:"hls_record_dir"`         // HLS 녹화 저장 디렉토리 경로. hls_record_dir/APP/NAME/ID/ 에 세그먼트와 플레이리스트를 쓴다.
+	DASHAddr             string         `mapstructure:"dash_addr"`              // MPEG-DASH 서버의 바인딩 주소 :7003
+	APIAddr              string         `mapstructure:"api_addr"`               // api 서버의 바인딩 주소. :8090 스트리밍 서비스 설정 및 관리를 위해 동작. (상태확인, 스트림제어, 채널 키 생성등)
+	RedisAddr            string         `mapstructure:"redis_addr"`             // 레디스 서버의 주소  "127.0.0.1:6379"
+	RedisPwd             string         `mapstructure:"redis_pwd"`              // 레디스 서버의 비밀번호
+	ReadTimeout          int            `mapstructure:"read_timeout"`           // 스트림 읽기 타임아웃 설정
+	WriteTimeout         int            `mapstructure:"write_timeout"`          // 스트림 쓰기 타임아웃 설정
+	EnableTLSVerify      bool           `mapstructure:"enable_tls_verify"`      // TLS 인증서 검증 활성화 여부 (SSL 의 향상 버전  RTMPS 등의 응용)
+	GopNum               int            `mapstructure:"gop_num"`                // gop 개수 설정. 키프레임 간격. 짧은 gop는 네트워크 지연과 복구속도 향상. 다만 키프레임이 더 자주 전송되므로 대역폭 사용량과 디코딩 부담이 증가한다.
+	WebRTCAddr           string         `mapstructure:"webrtc_addr"`            // WebRTC 시그널링(WHIP/WHEP) HTTP 서버의 바인딩 주소 :8080
+	WebRTCICEServers     []ICEServer    `mapstructure:"webrtc_ice_servers"`     // 피어에게 알려줄 STUN/TURN 서버 목록. 비어 있으면 호스트 후보만 사용한다.
+	WebRTCUDPPortMin     int            `mapstructure:"webrtc_udp_port_min"`    // 미디어용 UDP 포트 범위의 시작. 0 이면 OS 가 임의로 고른다. 방화벽에서 열어둘 포트를 제한할 때 사용한다.
+	WebRTCUDPPortMax     int            `mapstructure:"webrtc_udp_port_max"`    // 미디어용 UDP 포트 범위의 끝
+	WebRTCNAT1To1IPs     []string       `mapstructure:"webrtc_nat_1to1_ips"`    // NAT 뒤에서 운영할 때 호스트 후보 대신 광고할 공인 IP 목록 (1:1 NAT). STUN 없이도 ICE 를 완료할 수 있다.
+	WebRTCICELite        bool           `mapstructure:"webrtc_ice_lite"`        // ICE-lite 모드. 공인 IP 를 가진 서버에서 연결 검사를 클라이언트에 맡겨 연결 수립을 단순화한다.
+	WebRTCSessionTimeout int            `mapstructure:"webrtc_session_timeout"` // 연결되지 않은 WebRTC 세션을 정리하기까지의 시간(초). 0 이면 30초
+	AudioTranscoder      string         `mapstructure:"audio_transcoder"`       // WebRTC 오디오(Opus)와 AAC 를 서로 변환할 외부 인코더 경로. 기본값은 PATH 의 ffmpeg
+	JWT                  JWT            `mapstructure:"jwt"`                    // 스트리밍 서버에서 인증 및 세션관리를 위한 JWT 설정
+	Hooks                Hooks          `mapstructure:"hooks"`                  // 퍼블리시/재생 세션을 백엔드에 알리고 허가받을 웹훅 설정
+	Renditions           []RenditionSet `mapstructure:"renditions"`             // HLS 마스터 플레이리스트/DASH MPD 로 묶어 내보낼 화질별 스트림 키 묶음
+	Server               Applications   `mapstructure:"server"`                 // 스트리밍 서버의 애플리케이션 설정 리스트. 여러 스트리밍 앱 지원 가능
 }
 
 // default config
@@ -85,11 +147,14 @@ var defaultConf = ServerCfg{
 	HTTPFLVAddr:     ":7001",
 	HLSAddr:         ":7002",
 	HLSKeepAfterEnd: false,
+	HLSRecordDir:    "record",
+	DASHAddr:        ":7003",
 	APIAddr:         ":8090",
 	WriteTimeout:    10,
 	ReadTimeout:     10,
 	EnableTLSVerify: true,
 	GopNum:          1,
+	WebRTCAddr:      ":8080",
 	Server: Applications{{
 		Appname:    "live",
 		Live:       true,
@@ -154,11 +219,14 @@ func initDefault() {
 	pflag.String("rtmps_key", "server.key", "key file path required for RTMPS")
 	pflag.String("httpflv_addr", ":7001", "HTTP-FLV server listen address")
 	pflag.String("hls_addr", ":7002", "HLS server listen address")
+	pflag.String("dash_addr", ":7003", "MPEG-DASH server listen address")
 	pflag.String("api_addr", ":8090", "HTTP manage interface server listen address")
+	pflag.String("webrtc_addr", ":8080", "WebRTC (WHIP/WHEP) signaling server listen address")
 	pflag.String("config_file", "livego.yaml", "configure filename")
 	pflag.String("level", "info", "Log level")
 	pflag.Bool("hls_keep_after_end", false, "Maintains the HLS after the stream ends")
 	pflag.String("flv_dir", "tmp", "output flv file at flvDir/APP/KEY_TIME.flv")
+	pflag.String("hls_record_dir", "record", "output hls record at hlsRecordDir/APP/NAME/ID/index.m3u8")
 	pflag.Int("read_timeout", 10, "read time out")
 	pflag.Int("write_timeout", 10, "write time out")
 	pflag.Int("gop_num", 1, "gop num")
@@ -196,10 +264,48 @@ func initDefault() {
 	log.Debugf("Current configurations: \n%# v", pretty.Formatter(c))
 }
 
+// server 설정을 파싱한 결과. 스트림마다 앱 설정을 찾으므로 한 번만 읽어 두고 같이 쓴다.
+var (
+	appsLock   sync.RWMutex
+	appsCache  Applications
+	appsLoaded bool
+)
+
+func applications() Applications {
+	appsLock.RLock()
+	if appsLoaded {
+		apps := appsCache
+		appsLock.RUnlock()
+		return apps
+	}
+	appsLock.RUnlock()
+
+	appsLock.Lock()
+	defer appsLock.Unlock()
+	if !appsLoaded {
+		apps := Applications{}
+		Config.UnmarshalKey("server", &apps)
+		appsCache = apps
+		appsLoaded = true
+	}
+	return appsCache
+}
+
+// 캐시한 server 설정을 버린다. 설정을 다시 읽거나 바꾼 뒤 호출하면 다음 조회에서 새로 파싱한다.
+func InvalidateApplications() {
+	appsLock.Lock()
+	appsCache = nil
+	appsLoaded = false
+	appsLock.Unlock()
+}
+
+// 설정된 애플리케이션 목록
+func GetApplications() Applications {
+	return append(Applications(nil), applications()...)
+}
+
 func CheckAppName(appname string) bool {
-	apps := Applications{}
-	Config.UnmarshalKey("server", &apps)
-	for _, app := range apps {
+	for _, app := range applications() {
 		if app.Appname == appname {
 			return app.Live
 		}
@@ -207,10 +313,18 @@ func CheckAppName(appname string) bool {
 	return false
 }
 
+// 앱 이름으로 애플리케이션 설정을 찾는다. 앱별 옵션을 읽을 때 사용한다.
+func GetApplication(appname string) (Application, bool) {
+	for _, app := range applications() {
+		if app.Appname == appname {
+			return app, true
+		}
+	}
+	return Application{}, false
+}
+
 func GetStaticPushUrlList(appname string) ([]string, bool) {
-	apps := Applications{}
-	Config.UnmarshalKey("server", &apps)
-	for _, app := range apps {
+	for _, app := range applications() {
 		if (app.Appname == appname) && app.Live {
 			if len(app.StaticPush) > 0 {
 				return app.StaticPush, true
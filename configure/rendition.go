@@ -0,0 +1,116 @@
+package configure
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+/*
+렌디션 묶음
+같은 방송을 화질별로 다른 스트림 키(live/show_1080, live/show_720)로 퍼블리시할 때,
+이 키들을 하나의 이름(live/show)으로 묶어 HLS 마스터 플레이리스트와 DASH MPD 로 내보낸다.
+설정 파일의 renditions 로 미리 정하거나 API 로 추가/삭제할 수 있다. API 로 바꾼 내용은 메모리에만 남는다.
+*/
+type RenditionSet struct {
+	Name string   `mapstructure:"name" json:"name"` // 묶음 이름. 스트림 키와 같은 <APP>/<NAME> 형식
+	Keys []string `mapstructure:"keys" json:"keys"` // 묶을 스트림 키 목록. 마스터 플레이리스트에 이 순서대로 나온다.
+}
+
+var (
+	ErrInvalidRenditionSet = fmt.Errorf("rendition set needs <APP>/<NAME> name and at least one key")
+)
+
+type RenditionsType struct {
+	once sync.Once
+	lock sync.RWMutex
+	sets map[string][]string // 묶음 이름 -> 스트림 키 목록
+}
+
+var Renditions = &RenditionsType{}
+
+// 처음 쓸 때 설정 파일의 renditions 를 읽는다.
+func (r *RenditionsType) load() {
+	r.once.Do(func() {
+		var sets []RenditionSet
+		Config.UnmarshalKey("renditions", &sets)
+		r.sets = make(map[string][]string)
+		for _, set := range sets {
+			if validRenditionSet(set.Name, set.Keys) {
+				r.sets[set.Name] = set.Keys
+			}
+		}
+	})
+}
+
+func validRenditionSet(name string, keys []string) bool {
+	if len(keys) == 0 || len(strings.Split(name, "/")) != 2 {
+		return false
+	}
+	for _, key := range keys {
+		if key == name || len(strings.Split(key, "/")) != 2 {
+			return false
+		}
+	}
+	return true
+}
+
+// 렌디션 묶음을 추가하거나 바꾼다.
+func (r *RenditionsType) Set(name string, keys []string) error {
+	if !validRenditionSet(name, keys) {
+		return ErrInvalidRenditionSet
+	}
+	r.load()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.sets[name] = keys
+	return nil
+}
+
+// 렌디션 묶음을 삭제한다.
+func (r *RenditionsType) Delete(name string) bool {
+	r.load()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.sets[name]; !ok {
+		return false
+	}
+	delete(r.sets, name)
+	return true
+}
+
+// 묶음 이름으로 스트림 키 목록을 찾는다.
+func (r *RenditionsType) Get(name string) ([]string, bool) {
+	r.load()
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	keys, ok := r.sets[name]
+	return keys, ok
+}
+
+// 스트림 키가 속한 묶음의 스트림 키 목록을 찾는다.
+func (r *RenditionsType) Find(key string) ([]string, bool) {
+	r.load()
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for _, keys := range r.sets {
+		for _, k := range keys {
+			if k == key {
+				return keys, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// 모든 렌디션 묶음을 반환한다.
+func (r *RenditionsType) All() []RenditionSet {
+	r.load()
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	sets := make([]RenditionSet, 0, len(r.sets))
+	for name, keys := range r.sets {
+		sets = append(sets, RenditionSet{Name: name, Keys: keys})
+	}
+	return sets
+}
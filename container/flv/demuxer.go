@@ -7,7 +7,8 @@ import (
 )
 
 var (
-	ErrAvcEndSEQ = fmt.Errorf("avc end sequence")
+	ErrAvcEndSEQ     = fmt.Errorf("avc end sequence")
+	ErrVideoMetadata = fmt.Errorf("enhanced rtmp video metadata")
 )
 
 type Demuxer struct {
@@ -38,11 +39,15 @@ func (d *Demuxer) Demux(p *av.Packet) error {
 		return err
 	}
 
-	// avc 일시 첫번쨰 프레임과 두번쨰 프레임을 확인한다.
-	if tag.CodecID() == av.VIDEO_H264 &&
-		// 0001key 0111 avc 0000 0002 스트림 종료 신호
-		p.Data[0] == 0x17 && p.Data[1] == 0x02 {
-		return ErrAvcEndSEQ
+	if p.IsVideo {
+		// 레거시 avc 는 0x17 0x02, Enhanced RTMP 는 PacketTypeSequenceEnd 가 스트림 종료 신호이다.
+		if tag.IsSeqEnd() {
+			return ErrAvcEndSEQ
+		}
+		// HDR colorInfo 같은 AMF 메타데이터는 코덱 데이터가 아니므로 본문으로 넘기지 않는다.
+		if tag.IsExHeader() && tag.PacketType() == av.PKTTYPE_METADATA {
+			return ErrVideoMetadata
+		}
 	}
 	// 헤더는 파싱. 본문데이터 슬라이스 조정
 	p.Header = &tag
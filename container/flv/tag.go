@@ -129,6 +129,24 @@ type mediaTag struct {
 		DTS, PTS를 결정하는데 사용하는 값이다.compositionTime = PTS - DTS 의 계산.
 	*/
 	compositionTime int32
+
+	/*
+		Enhanced RTMP 의 ExVideoTagHeader 를 나타낸다.
+		첫 바이트의 최상위 비트(IsExHeader)가 1 이면 하위 4비트는 코덱 ID 대신 VideoPacketType 이고,
+		이어지는 4 바이트가 코덱을 나타내는 FourCC('avc1', 'hvc1', 'av01', 'vp09') 이다.
+
+		IsExHeader: UB[1]
+		FrameType: UB[3]
+		PacketType: UB[4]
+		FourCC: UI32
+		CompositionTime: SI24 (avc1/hvc1 의 CodedFrames 일 때만)
+	*/
+	isExHeader bool
+	packetType uint8
+	fourCC     string
+
+	// 코덱 데이터 앞의 태그 헤더 길이
+	headerLen int
 }
 
 type Tag struct {
@@ -145,14 +163,52 @@ func (tag *Tag) AACPacketType() uint8 {
 }
 
 func (tag *Tag) IsKeyFrame() bool {
+	if tag.mediat.isExHeader {
+		// 시퀀스 종료와 메타데이터는 프레임이 아니므로 키프레임으로 보지 않는다.
+		switch tag.mediat.packetType {
+		case av.PKTTYPE_SEQUENCE_END, av.PKTTYPE_METADATA:
+			return false
+		}
+	}
 	return tag.mediat.frameType == av.FRAME_KEY
 }
 
 func (tag *Tag) IsSeq() bool {
+	if tag.mediat.isExHeader {
+		return tag.mediat.packetType == av.PKTTYPE_SEQUENCE_START
+	}
 	return tag.mediat.frameType == av.FRAME_KEY &&
 		tag.mediat.avcPacketType == av.AVC_SEQHDR
 }
 
+func (tag *Tag) IsSeqEnd() bool {
+	if tag.mediat.isExHeader {
+		return tag.mediat.packetType == av.PKTTYPE_SEQUENCE_END
+	}
+	return tag.mediat.codecID == av.VIDEO_H264 &&
+		tag.mediat.avcPacketType == av.AVC_EOS
+}
+
+func (tag *Tag) IsExHeader() bool {
+	return tag.mediat.isExHeader
+}
+
+// Enhanced RTMP 의 VideoPacketType 을 반환한다. 확장 헤더가 아니면 avcPacketType 을 반환한다.
+func (tag *Tag) PacketType() uint8 {
+	if tag.mediat.isExHeader {
+		return tag.mediat.packetType
+	}
+	return tag.mediat.avcPacketType
+}
+
+func (tag *Tag) FourCC() string {
+	return tag.mediat.fourCC
+}
+
+func (tag *Tag) HeaderLen() int {
+	return tag.mediat.headerLen
+}
+
 func (tag *Tag) CodecID() uint8 {
 	return tag.mediat.codecID
 }
@@ -201,6 +257,11 @@ func (tag *Tag) parseVideoHeader(b []byte) (n int, err error) {
 		err = fmt.Errorf("invalid videodata len=%d", len(b))
 		return
 	}
+	if b[0]&0x80 != 0 {
+		n, err = tag.parseExVideoHeader(b)
+		tag.mediat.headerLen = n
+		return
+	}
 	flags := b[0]
 	tag.mediat.frameType = flags >> 4 // 상위 4비트
 	tag.mediat.codecID = flags & 0xf  // 하위 4비트
@@ -218,5 +279,44 @@ func (tag *Tag) parseVideoHeader(b []byte) (n int, err error) {
 		}
 		n += 4
 	}
+	tag.mediat.headerLen = n
+	return
+}
+
+// Enhanced RTMP 의 ExVideoTagHeader 를 파싱한다.
+// 코덱 ID 는 FourCC 에 대응하는 내부 값(av.VIDEO_HEVC 등)으로 바꾸고, 패킷 타입은 레거시 avcPacketType 에도 맞춰 둔다.
+func (tag *Tag) parseExVideoHeader(b []byte) (n int, err error) {
+	flags := b[0]
+	tag.mediat.isExHeader = true
+	tag.mediat.frameType = (flags >> 4) & 0x07
+	tag.mediat.packetType = flags & 0x0f
+	tag.mediat.fourCC = string(b[1:5])
+	n += 5
+
+	// 모르는 FourCC 는 코덱 ID 를 0 으로 두어, 그대로 중계만 하고 코덱을 해석하는 쪽에서는 건너뛰게 한다.
+	codecID := av.VideoFourCC[tag.mediat.fourCC]
+	tag.mediat.codecID = codecID
+
+	switch tag.mediat.packetType {
+	case av.PKTTYPE_SEQUENCE_START:
+		tag.mediat.avcPacketType = av.AVC_SEQHDR
+	case av.PKTTYPE_CODED_FRAMES:
+		tag.mediat.avcPacketType = av.AVC_NALU
+		// AV1, VP9 는 composition time 필드가 없다.
+		if codecID == av.VIDEO_H264 || codecID == av.VIDEO_HEVC {
+			if len(b) < n+3 {
+				err = fmt.Errorf("invalid videodata len=%d", len(b))
+				return
+			}
+			// SI24 이므로 부호를 확장한다.
+			cts := int32(b[5])<<16 | int32(b[6])<<8 | int32(b[7])
+			tag.mediat.compositionTime = cts << 8 >> 8
+			n += 3
+		}
+	case av.PKTTYPE_CODED_FRAMESX:
+		tag.mediat.avcPacketType = av.AVC_NALU
+	case av.PKTTYPE_SEQUENCE_END:
+		tag.mediat.avcPacketType = av.AVC_EOS
+	}
 	return
 }
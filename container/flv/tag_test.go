@@ -0,0 +1,92 @@
+package flv
+
+import (
+	"testing"
+
+	"github.com/gwuhaolin/livego/av"
+)
+
+func TestParseVideoHeader(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      []byte
+		err       bool
+		exHeader  bool
+		codecID   uint8
+		fourCC    string
+		key       bool
+		seq       bool
+		seqEnd    bool
+		pktType   uint8
+		cts       int32
+		headerLen int
+	}{
+		{name: "avc seq", data: []byte{0x17, 0x00, 0, 0, 0, 0x01}, codecID: av.VIDEO_H264, key: true, seq: true, pktType: av.AVC_SEQHDR, headerLen: 5},
+		{name: "avc nalu", data: []byte{0x27, 0x01, 0, 0x01, 0x02, 0xaa}, codecID: av.VIDEO_H264, pktType: av.AVC_NALU, cts: 258, headerLen: 5},
+		{name: "avc eos", data: []byte{0x17, 0x02, 0, 0, 0}, codecID: av.VIDEO_H264, key: true, seqEnd: true, pktType: av.AVC_EOS, headerLen: 5},
+		{name: "hevc seq start", data: []byte{0x90, 'h', 'v', 'c', '1', 0x01}, exHeader: true, codecID: av.VIDEO_HEVC, fourCC: "hvc1", key: true, seq: true, pktType: av.PKTTYPE_SEQUENCE_START, headerLen: 5},
+		{name: "hevc coded frames", data: []byte{0x91, 'h', 'v', 'c', '1', 0, 0, 0x28, 0xaa}, exHeader: true, codecID: av.VIDEO_HEVC, fourCC: "hvc1", key: true, pktType: av.PKTTYPE_CODED_FRAMES, cts: 40, headerLen: 8},
+		{name: "negative cts", data: []byte{0xa1, 'h', 'v', 'c', '1', 0xff, 0xff, 0xff, 0xaa}, exHeader: true, codecID: av.VIDEO_HEVC, fourCC: "hvc1", pktType: av.PKTTYPE_CODED_FRAMES, cts: -1, headerLen: 8},
+		{name: "hevc coded frames x", data: []byte{0xa3, 'h', 'v', 'c', '1', 0xaa}, exHeader: true, codecID: av.VIDEO_HEVC, fourCC: "hvc1", pktType: av.PKTTYPE_CODED_FRAMESX, headerLen: 5},
+		{name: "avc1 fourcc", data: []byte{0x91, 'a', 'v', 'c', '1', 0, 0, 0, 0xaa}, exHeader: true, codecID: av.VIDEO_H264, fourCC: "avc1", key: true, pktType: av.PKTTYPE_CODED_FRAMES, headerLen: 8},
+		{name: "av1 without cts", data: []byte{0x91, 'a', 'v', '0', '1', 0xaa}, exHeader: true, codecID: av.VIDEO_AV1, fourCC: "av01", key: true, pktType: av.PKTTYPE_CODED_FRAMES, headerLen: 5},
+		{name: "vp9 seq start", data: []byte{0x90, 'v', 'p', '0', '9', 0x01}, exHeader: true, codecID: av.VIDEO_VP9, fourCC: "vp09", key: true, seq: true, pktType: av.PKTTYPE_SEQUENCE_START, headerLen: 5},
+		{name: "seq end", data: []byte{0x92, 'h', 'v', 'c', '1'}, exHeader: true, codecID: av.VIDEO_HEVC, fourCC: "hvc1", seqEnd: true, pktType: av.PKTTYPE_SEQUENCE_END, headerLen: 5},
+		{name: "metadata", data: []byte{0x94, 'h', 'v', 'c', '1', 0x02}, exHeader: true, codecID: av.VIDEO_HEVC, fourCC: "hvc1", pktType: av.PKTTYPE_METADATA, headerLen: 5},
+		{name: "unknown fourcc", data: []byte{0x91, 'x', 'x', 'x', 'x', 0xaa}, exHeader: true, fourCC: "xxxx", key: true, pktType: av.PKTTYPE_CODED_FRAMES, headerLen: 5},
+		{name: "short hevc cts", data: []byte{0x91, 'h', 'v', 'c', '1', 0}, err: true},
+		{name: "short header", data: []byte{0x91, 'h', 'v'}, err: true},
+	}
+	for _, test := range tests {
+		var tag Tag
+		n, err := tag.ParseMediaTagHeader(test.data, true)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: no error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if n != test.headerLen || tag.HeaderLen() != test.headerLen {
+			t.Errorf("%s: header len = %d/%d, want %d", test.name, n, tag.HeaderLen(), test.headerLen)
+		}
+		if tag.IsExHeader() != test.exHeader || tag.CodecID() != test.codecID || tag.FourCC() != test.fourCC {
+			t.Errorf("%s: ex %v codec %d fourcc %q, want %v %d %q", test.name, tag.IsExHeader(), tag.CodecID(), tag.FourCC(), test.exHeader, test.codecID, test.fourCC)
+		}
+		if tag.IsKeyFrame() != test.key || tag.IsSeq() != test.seq || tag.IsSeqEnd() != test.seqEnd {
+			t.Errorf("%s: key %v seq %v seqEnd %v, want %v %v %v", test.name, tag.IsKeyFrame(), tag.IsSeq(), tag.IsSeqEnd(), test.key, test.seq, test.seqEnd)
+		}
+		if tag.PacketType() != test.pktType || tag.CompositionTime() != test.cts {
+			t.Errorf("%s: packet type %d cts %d, want %d %d", test.name, tag.PacketType(), tag.CompositionTime(), test.pktType, test.cts)
+		}
+	}
+}
+
+func TestDemuxVideo(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+		body []byte
+	}{
+		{"hevc frame", []byte{0x91, 'h', 'v', 'c', '1', 0, 0, 0, 0xaa, 0xbb}, nil, []byte{0xaa, 0xbb}},
+		{"avc frame", []byte{0x27, 0x01, 0, 0, 0, 0xaa}, nil, []byte{0xaa}},
+		{"ex seq end", []byte{0x92, 'h', 'v', 'c', '1'}, ErrAvcEndSEQ, nil},
+		{"avc eos", []byte{0x17, 0x02, 0, 0, 0}, ErrAvcEndSEQ, nil},
+		{"metadata", []byte{0x94, 'h', 'v', 'c', '1', 0x02}, ErrVideoMetadata, nil},
+	}
+	for _, test := range tests {
+		p := &av.Packet{IsVideo: true, Data: test.data}
+		err := NewDemuxer().Demux(p)
+		if err != test.err {
+			t.Errorf("%s: err = %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if err == nil && string(p.Data) != string(test.body) {
+			t.Errorf("%s: body = %x, want %x", test.name, p.Data, test.body)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package fmp4
+
+import (
+	"encoding/binary"
+)
+
+/*
+ISO BMFF(ISO/IEC 14496-12) 의 박스는 4 바이트 크기, 4 바이트 타입, 본문으로 이루어진다.
+FullBox 는 본문 앞에 1 바이트 version 과 3 바이트 flags 가 더 붙는다.
+박스는 중첩될 수 있으므로, 자식 박스를 먼저 만든 뒤 부모 박스의 본문으로 이어 붙인다.
+*/
+
+// 타입과 본문으로 박스를 만든다.
+func box(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	b := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(b[0:], uint32(size))
+	copy(b[4:8], typ)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// version 과 flags 를 앞에 붙인 FullBox 를 만든다.
+func fullBox(typ string, version byte, flags uint32, payload ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return box(typ, append([][]byte{header}, payload...)...)
+}
+
+func u8(v uint8) []byte {
+	return []byte{v}
+}
+
+func u16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func zeros(n int) []byte {
+	return make([]byte, n)
+}
+
+// 트랙/무비 헤더에 들어가는 단위 행렬
+var unityMatrix = []byte{
+	0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x40, 0x00, 0x00, 0x00,
+}
+
+// MPEG-4 디스크립터(esds 안의 ES_Descriptor 등)를 만든다. 길이는 4 바이트 확장 형식으로 쓴다.
+func descriptor(tag byte, payload ...[]byte) []byte {
+	size := 0
+	for _, p := range payload {
+		size += len(p)
+	}
+	b := []byte{tag,
+		0x80 | byte(size>>21&0x7f),
+		0x80 | byte(size>>14&0x7f),
+		0x80 | byte(size>>7&0x7f),
+		byte(size & 0x7f),
+	}
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
@@ -0,0 +1,426 @@
+package fmp4
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/gwuhaolin/livego/av"
+)
+
+const (
+	videoTrackID   = 1
+	audioTrackID   = 2
+	videoTimescale = 90000
+	aacFrameSize   = 1024
+
+	// 다음 샘플을 알 수 없을 때 마지막 비디오 샘플에 쓰는 길이 (30fps)
+	defaultVideoDuration = videoTimescale / 30
+
+	// trun 의 sample_flags
+	sampleFlagsKey    = 0x02000000 // sample_depends_on=2, 다른 샘플을 참조하지 않는다.
+	sampleFlagsNonKey = 0x01010000 // sample_depends_on=1, sample_is_non_sync_sample=1
+)
+
+var (
+	ErrUnsupportedCodec = fmt.Errorf("fmp4: unsupported codec")
+	ErrInvalidConfig    = fmt.Errorf("fmp4: invalid codec config")
+)
+
+// AAC 의 샘플 레이트 테이블. AudioSpecificConfig 의 samplingFrequencyIndex 로 참조한다.
+var aacRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+type sample struct {
+	dts      int64 // 트랙 timescale 단위
+	cts      int32 // pts - dts, 트랙 timescale 단위
+	duration uint32
+	key      bool
+	data     []byte
+}
+
+type track struct {
+	id        uint32
+	timescale uint32
+	codec     byte   // av.VIDEO_H264, av.VIDEO_HEVC, av.SOUND_AAC
+	config    []byte // avcC/hvcC 레코드 또는 AudioSpecificConfig
+	channels  int
+	inInit    bool // 마지막으로 만든 init 세그먼트에 포함되었는지. 포함되지 않은 트랙의 샘플은 버린다.
+	samples   []sample
+	lastDur   uint32
+
+	fragStart    int64  // 마지막 조각의 첫 샘플 dts
+	fragDuration uint64 // 마지막 조각의 샘플 길이 합
+}
+
+/*
+fMP4(CMAF) 세그먼트를 만드는 muxer 이다.
+init 세그먼트(ftyp + moov)에 코덱 설정을 담고, 미디어 세그먼트는 moof + mdat 조각으로 만든다.
+비디오는 FLV 와 같은 길이 프리픽스 NALU(AVCC) 를, 오디오는 ADTS 없는 AAC 프레임을 그대로 샘플로 쓴다.
+*/
+type Muxer struct {
+	video, audio  *track
+	width, height int
+	seq           uint32 // mfhd 의 sequence_number
+	changed       bool   // 마지막 InitSegment 이후 코덱 설정이 바뀌었는지
+}
+
+func NewMuxer() *Muxer {
+	return &Muxer{}
+}
+
+// FLV 비디오 시퀀스 헤더의 AVCDecoderConfigurationRecord / HEVCDecoderConfigurationRecord 를 설정한다.
+func (muxer *Muxer) SetVideoConfig(codecID byte, record []byte) error {
+	if codecID != av.VIDEO_H264 && codecID != av.VIDEO_HEVC {
+		return ErrUnsupportedCodec
+	}
+	if len(record) < 7 {
+		return ErrInvalidConfig
+	}
+	if muxer.video != nil && muxer.video.codec == codecID && bytes.Equal(muxer.video.config, record) {
+		return nil
+	}
+	muxer.video = &track{
+		id:        videoTrackID,
+		timescale: videoTimescale,
+		codec:     codecID,
+		config:    append([]byte(nil), record...),
+		lastDur:   defaultVideoDuration,
+	}
+	muxer.changed = true
+	return nil
+}
+
+// onMetaData 의 width/height 를 설정한다. 샘플 엔트리와 tkhd 에 쓰인다.
+func (muxer *Muxer) SetVideoSize(width, height int) {
+	if muxer.width == width && muxer.height == height {
+		return
+	}
+	muxer.width, muxer.height = width, height
+	if muxer.video != nil {
+		muxer.changed = true
+	}
+}
+
+// FLV AAC 시퀀스 헤더의 AudioSpecificConfig 를 설정한다.
+func (muxer *Muxer) SetAudioConfig(asc []byte) error {
+	if len(asc) < 2 {
+		return ErrInvalidConfig
+	}
+	index := int((asc[0]&0x07)<<1 | asc[1]>>7)
+	if index >= len(aacRates) {
+		return ErrInvalidConfig
+	}
+	if muxer.audio != nil && bytes.Equal(muxer.audio.config, asc) {
+		return nil
+	}
+	muxer.audio = &track{
+		id:        audioTrackID,
+		timescale: uint32(aacRates[index]),
+		codec:     av.SOUND_AAC,
+		config:    append([]byte(nil), asc...),
+		channels:  int(asc[1]>>3) & 0x0f,
+	}
+	muxer.changed = true
+	return nil
+}
+
+// 코덱 설정이 바뀌어 init 세그먼트를 다시 만들어야 하는지 반환한다.
+func (muxer *Muxer) Changed() bool {
+	return muxer.changed
+}
+
+// RFC 6381 형식의 코덱 문자열 목록을 반환한다. (avc1.64001f, hvc1.1.6.L93.B0, mp4a.40.2)
+func (muxer *Muxer) Codecs() []string {
+	var ret []string
+	if v := muxer.video; v != nil {
+		switch v.codec {
+		case av.VIDEO_H264:
+			ret = append(ret, fmt.Sprintf("avc1.%02x%02x%02x", v.config[1], v.config[2], v.config[3]))
+		case av.VIDEO_HEVC:
+			ret = append(ret, hevcCodecString(v.config))
+		}
+	}
+	if a := muxer.audio; a != nil {
+		ret = append(ret, fmt.Sprintf("mp4a.40.%d", a.config[0]>>3))
+	}
+	return ret
+}
+
+// hvcC 레코드에서 hvc1.<profile>.<compat>.<tier><level>.<constraints> 형식의 코덱 문자열을 만든다.
+func hevcCodecString(c []byte) string {
+	if len(c) < 13 {
+		return "hvc1"
+	}
+	profileSpace := []string{"", "A", "B", "C"}[c[1]>>6]
+	tier := "L"
+	if c[1]&0x20 != 0 {
+		tier = "H"
+	}
+	// general_profile_compatibility_flags 는 비트 순서를 뒤집어 16진수로 쓴다.
+	compat := uint32(c[2])<<24 | uint32(c[3])<<16 | uint32(c[4])<<8 | uint32(c[5])
+	var reversed uint32
+	for i := 0; i < 32; i++ {
+		reversed = reversed<<1 | compat&1
+		compat >>= 1
+	}
+	s := fmt.Sprintf("hvc1.%s%d.%X.%s%d", profileSpace, c[1]&0x1f, reversed, tier, c[12])
+	// 뒤쪽의 0 인 constraint 바이트는 생략한다.
+	constraints := c[6:12]
+	for len(constraints) > 0 && constraints[len(constraints)-1] == 0 {
+		constraints = constraints[:len(constraints)-1]
+	}
+	for _, b := range constraints {
+		s += fmt.Sprintf(".%X", b)
+	}
+	return s
+}
+
+// 설정된 트랙으로 init 세그먼트(ftyp + moov)를 만든다. 설정된 트랙이 없으면 nil 을 반환한다.
+func (muxer *Muxer) InitSegment() []byte {
+	var traks, trexs [][]byte
+	for _, t := range []*track{muxer.video, muxer.audio} {
+		if t == nil {
+			continue
+		}
+		t.inInit = true
+		traks = append(traks, muxer.trak(t))
+		trexs = append(trexs, fullBox("trex", 0, 0, u32(t.id), u32(1), u32(0), u32(0), u32(0)))
+	}
+	muxer.changed = false
+	if len(traks) == 0 {
+		return nil
+	}
+
+	ftyp := box("ftyp", []byte("iso6"), u32(0), []byte("iso6cmfcisommp41"))
+	mvhd := fullBox("mvhd", 0, 0,
+		u32(0), u32(0), // creation_time, modification_time
+		u32(1000), u32(0), // timescale, duration
+		u32(0x00010000), u16(0x0100), zeros(10), // rate, volume, reserved
+		unityMatrix, zeros(24),
+		u32(audioTrackID+1), // next_track_ID
+	)
+	moov := box("moov", append(append([][]byte{mvhd}, traks...), box("mvex", trexs...))...)
+	return append(ftyp, moov...)
+}
+
+func (muxer *Muxer) trak(t *track) []byte {
+	var width, height, volume uint16
+	var handler, handlerName string
+	var mhd, entry []byte
+	if t.codec == av.SOUND_AAC {
+		volume = 0x0100
+		handler, handlerName = "soun", "SoundHandler"
+		mhd = fullBox("smhd", 0, 0, zeros(4))
+		entry = muxer.mp4a(t)
+	} else {
+		width, height = uint16(muxer.width), uint16(muxer.height)
+		handler, handlerName = "vide", "VideoHandler"
+		mhd = fullBox("vmhd", 0, 1, zeros(8))
+		entry = muxer.visualEntry(t)
+	}
+
+	tkhd := fullBox("tkhd", 0, 3, // track_enabled | track_in_movie
+		u32(0), u32(0), u32(t.id), zeros(4), u32(0), // creation, modification, track_ID, reserved, duration
+		zeros(8), u16(0), u16(0), u16(volume), zeros(2), // reserved, layer, alternate_group, volume, reserved
+		unityMatrix,
+		u32(uint32(width)<<16), u32(uint32(height)<<16),
+	)
+	mdhd := fullBox("mdhd", 0, 0, u32(0), u32(0), u32(t.timescale), u32(0), u16(0x55c4), u16(0)) // language "und"
+	hdlr := fullBox("hdlr", 0, 0, u32(0), []byte(handler), zeros(12), []byte(handlerName), u8(0))
+	dinf := box("dinf", fullBox("dref", 0, 0, u32(1), fullBox("url ", 0, 1)))
+	stbl := box("stbl",
+		fullBox("stsd", 0, 0, u32(1), entry),
+		fullBox("stts", 0, 0, u32(0)),
+		fullBox("stsc", 0, 0, u32(0)),
+		fullBox("stsz", 0, 0, u32(0), u32(0)),
+		fullBox("stco", 0, 0, u32(0)),
+	)
+	return box("trak", tkhd, box("mdia", mdhd, hdlr, box("minf", mhd, dinf, stbl)))
+}
+
+// avc1/hvc1 샘플 엔트리. 파라미터 셋은 avcC/hvcC 에 담는다.
+func (muxer *Muxer) visualEntry(t *track) []byte {
+	typ, configType := "avc1", "avcC"
+	if t.codec == av.VIDEO_HEVC {
+		typ, configType = "hvc1", "hvcC"
+	}
+	return box(typ,
+		zeros(6), u16(1), // reserved, data_reference_index
+		zeros(16), // pre_defined, reserved
+		u16(uint16(muxer.width)), u16(uint16(muxer.height)),
+		u32(0x00480000), u32(0x00480000), // 72 dpi
+		zeros(4), u16(1), // reserved, frame_count
+		zeros(32),                // compressorname
+		u16(0x0018), u16(0xffff), // depth, pre_defined
+		box(configType, t.config),
+	)
+}
+
+// mp4a 샘플 엔트리. AudioSpecificConfig 는 esds 의 DecoderSpecificInfo 에 담는다.
+func (muxer *Muxer) mp4a(t *track) []byte {
+	esds := fullBox("esds", 0, 0,
+		descriptor(0x03, u16(uint16(t.id)), u8(0), // ES_Descriptor
+			descriptor(0x04, u8(0x40), u8(0x15), zeros(3), u32(0), u32(0), // DecoderConfigDescriptor: MPEG-4 Audio, AudioStream
+				descriptor(0x05, t.config), // DecoderSpecificInfo
+			),
+			descriptor(0x06, u8(0x02)), // SLConfigDescriptor
+		),
+	)
+	return box("mp4a",
+		zeros(6), u16(1), // reserved, data_reference_index
+		zeros(8), u16(uint16(t.channels)), u16(16), // reserved, channelcount, samplesize
+		zeros(4), u32(t.timescale<<16), // pre_defined, reserved, samplerate
+		esds,
+	)
+}
+
+// 비디오 샘플 하나를 추가한다. dts 와 cts 는 밀리초 단위이다.
+func (muxer *Muxer) WriteVideo(dts uint32, cts int32, key bool, data []byte) {
+	t := muxer.video
+	if t == nil || !t.inInit {
+		return
+	}
+	s := sample{
+		dts:  int64(dts) * videoTimescale / 1000,
+		cts:  cts * videoTimescale / 1000,
+		key:  key,
+		data: data,
+	}
+	t.append(s)
+}
+
+// ADTS 헤더가 없는 AAC 프레임 하나를 추가한다. dts 는 밀리초 단위이다.
+func (muxer *Muxer) WriteAudio(dts uint32, data []byte) {
+	t := muxer.audio
+	if t == nil || !t.inInit {
+		return
+	}
+	t.append(sample{
+		dts:      int64(dts) * int64(t.timescale) / 1000,
+		duration: aacFrameSize,
+		key:      true,
+		data:     data,
+	})
+}
+
+// 앞 샘플의 길이는 다음 샘플의 dts 로 정한다.
+func (t *track) append(s sample) {
+	if n := len(t.samples); n > 0 && t.codec != av.SOUND_AAC {
+		prev := &t.samples[n-1]
+		if s.dts > prev.dts {
+			prev.duration = uint32(s.dts - prev.dts)
+			t.lastDur = prev.duration
+		} else {
+			prev.duration = t.lastDur
+		}
+	}
+	t.samples = append(t.samples, s)
+}
+
+// 버퍼에 쌓인 샘플로 moof + mdat 조각을 만들고 버퍼를 비운다. 샘플이 없으면 nil 을 반환한다.
+// endDts(밀리초)는 이 조각 다음에 올 샘플의 dts 로, 마지막 비디오 샘플의 길이를 정하는 데 쓴다.
+func (muxer *Muxer) Fragment(endDts uint32) []byte {
+	var tracks []*track
+	for _, t := range []*track{muxer.video, muxer.audio} {
+		if t != nil && len(t.samples) > 0 {
+			tracks = append(tracks, t)
+		}
+	}
+	if len(tracks) == 0 {
+		return nil
+	}
+
+	if t := muxer.video; t != nil && len(t.samples) > 0 {
+		last := &t.samples[len(t.samples)-1]
+		if end := int64(endDts) * videoTimescale / 1000; end > last.dts {
+			last.duration = uint32(end - last.dts)
+		} else {
+			last.duration = t.lastDur
+		}
+	}
+
+	for _, t := range []*track{muxer.video, muxer.audio} {
+		if t != nil {
+			t.fragStart, t.fragDuration = 0, 0
+		}
+	}
+	for _, t := range tracks {
+		t.fragStart = t.samples[0].dts
+		for _, s := range t.samples {
+			t.fragDuration += uint64(s.duration)
+		}
+	}
+
+	muxer.seq++
+	// trun 의 data_offset 은 moof 시작 기준이므로, moof 크기를 알기 위해 한 번 만들어 본 뒤 다시 만든다.
+	offsets := make([]uint32, len(tracks))
+	moof := muxer.moof(tracks, offsets)
+	pos := uint32(len(moof) + 8)
+	var mdat [][]byte
+	for i, t := range tracks {
+		offsets[i] = pos
+		for _, s := range t.samples {
+			mdat = append(mdat, s.data)
+			pos += uint32(len(s.data))
+		}
+	}
+	moof = muxer.moof(tracks, offsets)
+
+	ret := append(moof, box("mdat", mdat...)...)
+	for _, t := range tracks {
+		t.samples = t.samples[:0]
+	}
+	return ret
+}
+
+// 마지막으로 만든 조각에서 트랙의 시작 시각(tfdt)과 길이를 트랙 timescale 단위로 반환한다.
+// 트랙이 없거나 조각에 트랙의 샘플이 없었으면 ok 는 false 이다.
+func (muxer *Muxer) FragmentTime(video bool) (start, duration uint64, ok bool) {
+	t := muxer.audio
+	if video {
+		t = muxer.video
+	}
+	if t == nil || t.fragDuration == 0 {
+		return 0, 0, false
+	}
+	return uint64(t.fragStart), t.fragDuration, true
+}
+
+// 트랙의 timescale 을 반환한다. 트랙이 없으면 0 이다.
+func (muxer *Muxer) Timescale(video bool) uint32 {
+	t := muxer.audio
+	if video {
+		t = muxer.video
+	}
+	if t == nil {
+		return 0
+	}
+	return t.timescale
+}
+
+func (muxer *Muxer) moof(tracks []*track, offsets []uint32) []byte {
+	trafs := [][]byte{fullBox("mfhd", 0, 0, u32(muxer.seq))}
+	for i, t := range tracks {
+		trafs = append(trafs, traf(t, offsets[i]))
+	}
+	return box("moof", trafs...)
+}
+
+func traf(t *track, dataOffset uint32) []byte {
+	// default-base-is-moof
+	tfhd := fullBox("tfhd", 0, 0x020000, u32(t.id))
+	tfdt := fullBox("tfdt", 1, 0, u64(uint64(t.samples[0].dts)))
+
+	// data-offset | sample-duration | sample-size | sample-flags | sample-composition-time-offset
+	flags := uint32(0x000001 | 0x000100 | 0x000200 | 0x000400 | 0x000800)
+	entries := [][]byte{u32(uint32(len(t.samples))), u32(dataOffset)}
+	for _, s := range t.samples {
+		sampleFlags := uint32(sampleFlagsNonKey)
+		if s.key {
+			sampleFlags = sampleFlagsKey
+		}
+		entries = append(entries, u32(s.duration), u32(uint32(len(s.data))), u32(sampleFlags), u32(uint32(s.cts)))
+	}
+	// version 1 은 composition time offset 을 부호 있는 값으로 해석한다.
+	trun := fullBox("trun", 1, flags, entries...)
+	return box("traf", tfhd, tfdt, trun)
+}
@@ -0,0 +1,251 @@
+package fmp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/gwuhaolin/livego/av"
+)
+
+var (
+	// AVC High 3.1, lengthSizeMinusOne=3, SPS/PPS 없음
+	testAvcC = []byte{0x01, 0x64, 0x00, 0x1f, 0xff, 0xe0, 0x00}
+	// AAC-LC, 44.1kHz, 스테레오
+	testASC = []byte{0x12, 0x10}
+)
+
+// b 안의 박스를 차례로 나눈다.
+func boxes(t *testing.T, b []byte) (types []string, bodies [][]byte) {
+	for len(b) > 0 {
+		if len(b) < 8 {
+			t.Fatalf("truncated box header %x", b)
+		}
+		size := int(binary.BigEndian.Uint32(b))
+		if size < 8 || size > len(b) {
+			t.Fatalf("bad box size %d of %d", size, len(b))
+		}
+		types = append(types, string(b[4:8]))
+		bodies = append(bodies, b[8:size])
+		b = b[size:]
+	}
+	return
+}
+
+// path(예: "moov/trak/mdia") 를 따라 내려가 마지막 타입인 박스들의 본문을 모두 돌려준다.
+func find(t *testing.T, b []byte, path string) [][]byte {
+	parts := strings.Split(path, "/")
+	current := [][]byte{b}
+	for _, part := range parts {
+		var next [][]byte
+		for _, c := range current {
+			types, bodies := boxes(t, c)
+			for i, typ := range types {
+				if typ == part {
+					next = append(next, bodies[i])
+				}
+			}
+		}
+		current = next
+	}
+	return current
+}
+
+func TestInitSegment(t *testing.T) {
+	tests := []struct {
+		name    string
+		video   byte // 0 이면 비디오 트랙 없음
+		audio   bool
+		entries []string
+		codecs  string
+	}{
+		{"avc and aac", av.VIDEO_H264, true, []string{"avc1", "mp4a"}, "avc1.64001f,mp4a.40.2"},
+		{"hevc only", av.VIDEO_HEVC, false, []string{"hvc1"}, "hvc1.1.0.L0"},
+		{"audio only", 0, true, []string{"mp4a"}, "mp4a.40.2"},
+	}
+	for _, test := range tests {
+		muxer := NewMuxer()
+		muxer.SetVideoSize(1280, 720)
+		if test.video != 0 {
+			record := testAvcC
+			if test.video == av.VIDEO_HEVC {
+				record = append([]byte{0x01, 0x01}, make([]byte, 21)...)
+			}
+			if err := muxer.SetVideoConfig(test.video, record); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if test.audio {
+			if err := muxer.SetAudioConfig(testASC); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !muxer.Changed() {
+			t.Errorf("%s: not changed after config", test.name)
+		}
+		init := muxer.InitSegment()
+		if muxer.Changed() {
+			t.Errorf("%s: changed after InitSegment", test.name)
+		}
+
+		if types, _ := boxes(t, init); fmt.Sprint(types) != "[ftyp moov]" {
+			t.Errorf("%s: top level boxes = %v", test.name, types)
+		}
+		types, _ := boxes(t, find(t, init, "moov")[0])
+		want := []string{"mvhd"}
+		for range test.entries {
+			want = append(want, "trak")
+		}
+		want = append(want, "mvex")
+		if fmt.Sprint(types) != fmt.Sprint(want) {
+			t.Errorf("%s: moov boxes = %v, want %v", test.name, types, want)
+		}
+		if n := len(find(t, init, "moov/mvex/trex")); n != len(test.entries) {
+			t.Errorf("%s: %d trex, want %d", test.name, n, len(test.entries))
+		}
+
+		// stsd 본문은 version/flags 와 entry_count 뒤에 샘플 엔트리가 온다.
+		var entries []string
+		for _, stsd := range find(t, init, "moov/trak/mdia/minf/stbl/stsd") {
+			types, _ := boxes(t, stsd[8:])
+			entries = append(entries, types...)
+		}
+		if fmt.Sprint(entries) != fmt.Sprint(test.entries) {
+			t.Errorf("%s: sample entries = %v, want %v", test.name, entries, test.entries)
+		}
+		if got := strings.Join(muxer.Codecs(), ","); got != test.codecs {
+			t.Errorf("%s: codecs = %s, want %s", test.name, got, test.codecs)
+		}
+	}
+}
+
+func TestSetConfig(t *testing.T) {
+	muxer := NewMuxer()
+	tests := []struct {
+		name string
+		err  error
+		set  func() error
+	}{
+		{"unsupported codec", ErrUnsupportedCodec, func() error { return muxer.SetVideoConfig(av.VIDEO_AV1, testAvcC) }},
+		{"short record", ErrInvalidConfig, func() error { return muxer.SetVideoConfig(av.VIDEO_H264, testAvcC[:4]) }},
+		{"short asc", ErrInvalidConfig, func() error { return muxer.SetAudioConfig(testASC[:1]) }},
+		{"bad sample rate index", ErrInvalidConfig, func() error { return muxer.SetAudioConfig([]byte{0x17, 0x90}) }},
+		{"avc", nil, func() error { return muxer.SetVideoConfig(av.VIDEO_H264, testAvcC) }},
+	}
+	for _, test := range tests {
+		if err := test.set(); err != test.err {
+			t.Errorf("%s: err = %v, want %v", test.name, err, test.err)
+		}
+	}
+	muxer.InitSegment()
+	if muxer.SetVideoConfig(av.VIDEO_H264, testAvcC); muxer.Changed() {
+		t.Error("same config marked changed")
+	}
+}
+
+type trun struct {
+	dataOffset uint32
+	durations  []uint32
+	sizes      []uint32
+	flags      []uint32
+	cts        []int32
+}
+
+func parseTrun(b []byte) trun {
+	count := binary.BigEndian.Uint32(b[4:])
+	r := trun{dataOffset: binary.BigEndian.Uint32(b[8:])}
+	b = b[12:]
+	for i := uint32(0); i < count; i++ {
+		r.durations = append(r.durations, binary.BigEndian.Uint32(b))
+		r.sizes = append(r.sizes, binary.BigEndian.Uint32(b[4:]))
+		r.flags = append(r.flags, binary.BigEndian.Uint32(b[8:]))
+		r.cts = append(r.cts, int32(binary.BigEndian.Uint32(b[12:])))
+		b = b[16:]
+	}
+	return r
+}
+
+func TestFragment(t *testing.T) {
+	muxer := NewMuxer()
+	muxer.SetVideoConfig(av.VIDEO_H264, testAvcC)
+	muxer.SetAudioConfig(testASC)
+
+	// init 세그먼트를 만들기 전의 샘플은 버린다.
+	muxer.WriteVideo(0, 0, true, []byte{0xee})
+	if muxer.Fragment(0) != nil {
+		t.Fatal("fragment before init segment")
+	}
+	muxer.InitSegment()
+
+	video := []struct {
+		dts  uint32
+		cts  int32
+		key  bool
+		data []byte
+	}{
+		{1000, 40, true, []byte{0x01, 0x02, 0x03}},
+		{1040, 0, false, []byte{0x04}},
+		{1080, -40, false, []byte{0x05, 0x06}},
+	}
+	for _, v := range video {
+		muxer.WriteVideo(v.dts, v.cts, v.key, v.data)
+	}
+	audio := [][]byte{{0xa1, 0xa2}, {0xa3}}
+	muxer.WriteAudio(1000, audio[0])
+	muxer.WriteAudio(1023, audio[1])
+
+	frag := muxer.Fragment(1120)
+	if types, _ := boxes(t, frag); fmt.Sprint(types) != "[moof mdat]" {
+		t.Fatalf("fragment boxes = %v", types)
+	}
+	if seq := binary.BigEndian.Uint32(find(t, frag, "moof/mfhd")[0][4:]); seq != 1 {
+		t.Errorf("sequence_number = %d, want 1", seq)
+	}
+
+	trafs := find(t, frag, "moof/traf")
+	if len(trafs) != 2 {
+		t.Fatalf("%d traf, want 2", len(trafs))
+	}
+	tests := []struct {
+		id        uint32
+		tfdt      uint64
+		durations []uint32
+		flags     []uint32
+		cts       []int32
+		data      [][]byte
+	}{
+		{videoTrackID, 90000, []uint32{3600, 3600, 3600}, []uint32{sampleFlagsKey, sampleFlagsNonKey, sampleFlagsNonKey}, []int32{3600, 0, -3600},
+			[][]byte{video[0].data, video[1].data, video[2].data}},
+		{audioTrackID, 44100, []uint32{aacFrameSize, aacFrameSize}, []uint32{sampleFlagsKey, sampleFlagsKey}, []int32{0, 0}, audio},
+	}
+	for i, test := range tests {
+		traf := trafs[i]
+		if id := binary.BigEndian.Uint32(find(t, traf, "tfhd")[0][4:]); id != test.id {
+			t.Errorf("track %d: tfhd track_ID = %d", test.id, id)
+		}
+		if tfdt := binary.BigEndian.Uint64(find(t, traf, "tfdt")[0][4:]); tfdt != test.tfdt {
+			t.Errorf("track %d: tfdt = %d, want %d", test.id, tfdt, test.tfdt)
+		}
+		r := parseTrun(find(t, traf, "trun")[0])
+		if fmt.Sprint(r.durations) != fmt.Sprint(test.durations) || fmt.Sprint(r.flags) != fmt.Sprint(test.flags) || fmt.Sprint(r.cts) != fmt.Sprint(test.cts) {
+			t.Errorf("track %d: trun %+v, want durations %v flags %v cts %v", test.id, r, test.durations, test.flags, test.cts)
+		}
+		// data_offset 은 moof 의 시작부터 센다.
+		pos := r.dataOffset
+		for j, data := range test.data {
+			if r.sizes[j] != uint32(len(data)) || !bytes.Equal(frag[pos:pos+r.sizes[j]], data) {
+				t.Errorf("track %d sample %d at %d = %x, want %x", test.id, j, pos, frag[pos:pos+r.sizes[j]], data)
+			}
+			pos += r.sizes[j]
+		}
+	}
+
+	if start, duration, ok := muxer.FragmentTime(true); !ok || start != 90000 || duration != 3*3600 {
+		t.Errorf("video FragmentTime = %d %d %v", start, duration, ok)
+	}
+	if muxer.Fragment(1200) != nil {
+		t.Error("second fragment without samples")
+	}
+}
@@ -11,10 +11,12 @@ const (
 	tsPacketLen      = 188
 	h264DefaultHZ    = 90
 
-	videoPID = 0x100
-	audioPID = 0x101
-	videoSID = 0xe0
-	audioSID = 0xc0
+	videoPID    = 0x100
+	audioPID    = 0x101
+	metadataPID = 0x102
+	videoSID    = 0xe0
+	audioSID    = 0xc0
+	metadataSID = 0xbd // private_stream_1
 )
 
 /*
@@ -44,13 +46,21 @@ type Muxer struct {
 	audioCc  byte              // 오디오 스트림의 CC
 	patCc    byte              // Packet Association Table의 CC
 	pmtCc    byte              // Program Map Table의 CC
+	metaCc   byte              // 타임드 메타데이터 스트림의 CC
 	pat      [tsPacketLen]byte // PAT.
 	pmt      [tsPacketLen]byte // PMT. 프로그램 번호, 스트림의 데이터 위치(비디오 오디오등), 스트림 타입
 	tsPacket [tsPacketLen]byte // 최종으로 생성되는 TS 패킷 이다
+
+	sampleAES   bool   // HLS SAMPLE-AES 로 암호화한 스트림인지 여부. PMT 의 스트림 타입과 디스크립터가 바뀐다.
+	audioConfig []byte // SAMPLE-AES 오디오 설정 정보에 담을 AAC AudioSpecificConfig
+
+	timedMetadata bool // PMT 에 ID3 타임드 메타데이터 스트림을 선언할지 여부
+	pcrPID        int  // PCR 을 싣는 PID. 비디오가 없으면 오디오 PID 에 싣는다.
+	pmtVersion    byte // PMT 의 version_number. 선언하는 스트림이 바뀌면 올린다.
 }
 
 func NewMuxer() *Muxer {
-	return &Muxer{}
+	return &Muxer{pcrPID: videoPID}
 }
 
 func (muxer *Muxer) Mux(p *av.Packet, w io.Writer) error {
@@ -82,6 +92,8 @@ func (muxer *Muxer) Mux(p *av.Packet, w io.Writer) error {
 		pid = videoPID
 		videoH, _ = p.Header.(av.VideoPacketHeader)
 		pts = dts + int64(videoH.CompositionTime())*int64(h264DefaultHZ)
+	} else if p.IsMetadata {
+		pid = metadataPID
 	}
 	// 리턴은 없으나 내부 구조체 데이터를 바꾼다
 	// pes 패킷은 조각으로 나뉘어 TS 패킷의 페이로드에 담겨 전송된다.
@@ -104,6 +116,11 @@ func (muxer *Muxer) Mux(p *av.Packet, w io.Writer) error {
 			if muxer.videoCc > 0xf {
 				muxer.videoCc = 0
 			}
+		} else if p.IsMetadata {
+			muxer.metaCc++
+			if muxer.metaCc > 0xf {
+				muxer.metaCc = 0
+			}
 		} else {
 			muxer.audioCc++
 			if muxer.audioCc > 0xf {
@@ -136,6 +153,8 @@ func (muxer *Muxer) Mux(p *av.Packet, w io.Writer) error {
 		//scram control, adaptation control, counter
 		if p.IsVideo {
 			muxer.tsPacket[i] = 0x10 | byte(muxer.videoCc&0x0f)
+		} else if p.IsMetadata {
+			muxer.tsPacket[i] = 0x10 | byte(muxer.metaCc&0x0f)
 		} else {
 			muxer.tsPacket[i] = 0x10 | byte(muxer.audioCc&0x0f)
 		}
@@ -144,7 +163,8 @@ func (muxer *Muxer) Mux(p *av.Packet, w io.Writer) error {
 		//TS패킷에 PCR 정보를 추가한다. PCR 은 MPEG-TS 에서 디코딩 및 재생 동기화를 위해 사용하는 중요한 시간 정보이다.
 		// key Frame인 경우에만 PCR을 추가하며 이는  동기화의 기준점 역할을 한다. program clock reference.
 		//关键帧需要加pcr
-		if first && p.IsVideo && videoH.IsKeyFrame() {
+		// 비디오가 없는 스트림은 오디오 PES 마다 PCR 을 싣는다.
+		if first && (p.IsVideo && videoH.IsKeyFrame() || pid == audioPID && muxer.pcrPID == audioPID) {
 			//TS 헤더의 Adaptation Field 플래그를 설정한다.
 			//Adaptation Field 가 포함됨을 나타내기 위해 0x 20 추가.
 			muxer.tsPacket[3] |= 0x20
@@ -258,21 +278,98 @@ func (muxer *Muxer) PAT() []byte {
 	return muxer.pat[0:]
 }
 
+// HLS SAMPLE-AES 암호화 여부를 정한다. audioConfig 는 AAC 의 AudioSpecificConfig 이다.
+// 암호화한 스트림은 PMT 에 H.264 0xdb, AAC 0xcf 스트림 타입과 private_data_indicator 디스크립터를 쓰고,
+// 오디오에는 복호화에 필요한 audio_setup_information 을 registration 디스크립터('apad')로 함께 쓴다.
+func (muxer *Muxer) SetSampleAES(enable bool, audioConfig []byte) {
+	muxer.sampleAES = enable
+	muxer.audioConfig = audioConfig
+}
+
+// PMT 에 ID3 타임드 메타데이터 스트림을 선언할지 정한다. (Apple Timed Metadata for HTTP Live Streaming)
+// 값이 바뀌면 PMT 의 version_number 를 올려 디먹서가 바뀐 PMT 를 다시 읽게 한다.
+func (muxer *Muxer) SetTimedMetadata(enable bool) {
+	if muxer.timedMetadata != enable {
+		muxer.pmtVersion = (muxer.pmtVersion + 1) & 0x1f
+	}
+	muxer.timedMetadata = enable
+}
+
+func (muxer *Muxer) TimedMetadata() bool {
+	return muxer.timedMetadata
+}
+
+// ID3 메타데이터의 metadata_application_format, metadata_format
+var id3Format = []byte{0xff, 0xff, 'I', 'D', '3', ' ', 0xff, 'I', 'D', '3', ' '}
+
+// 프로그램 정보의 metadata_pointer_descriptor
+func metadataPointer() []byte {
+	b := append([]byte{0x25, 0x0f}, id3Format...)
+	return append(b, 0x00, 0x1f, 0x00, 0x01) // metadata_service_id, flags, program_number
+}
+
+// 메타데이터 스트림 항목. stream_type 0x15 (PES 로 실은 메타데이터) 와 metadata_descriptor
+func metadataInfo() []byte {
+	b := append([]byte{0x26, 0x0d}, id3Format...)
+	return esInfo(0x15, metadataPID, append(b, 0x00, 0x0f)) // metadata_service_id, flags
+}
+
+// PMT 의 엘리멘터리 스트림 항목. stream_type, PID, ES_info_length 뒤에 디스크립터가 이어진다.
+func esInfo(streamType byte, pid int, descriptors []byte) []byte {
+	b := []byte{streamType, 0xe0 | byte(pid>>8), byte(pid), 0xf0 | byte(len(descriptors)>>8), byte(len(descriptors))}
+	return append(b, descriptors...)
+}
+
+func (muxer *Muxer) videoInfo(videoCodecID byte) []byte {
+	if muxer.sampleAES {
+		return esInfo(0xdb, videoPID, []byte{0x0f, 0x04, 'z', 'a', 'v', 'c'})
+	}
+	if videoCodecID == av.VIDEO_HEVC {
+		return esInfo(0x24, videoPID, nil)
+	}
+	return esInfo(0x1b, videoPID, nil)
+}
+
+func (muxer *Muxer) audioInfo(soundFormat byte) []byte {
+	if soundFormat == 2 || soundFormat == 14 {
+		return esInfo(0x04, audioPID, nil) // mp3
+	}
+	if !muxer.sampleAES {
+		return esInfo(0x0f, audioPID, nil)
+	}
+	// audio_type, priming, version, setup_data_length, setup_data
+	setup := []byte{'z', 'a', 'a', 'c', 0x00, 0x00, 0x01, byte(len(muxer.audioConfig))}
+	setup = append(setup, muxer.audioConfig...)
+	descriptors := []byte{0x0f, 0x04, 'a', 'a', 'c', 'd', 0x05, byte(4 + len(setup)), 'a', 'p', 'a', 'd'}
+	return esInfo(0xcf, audioPID, append(descriptors, setup...))
+}
+
 // PMT return pmt data
-func (muxer *Muxer) PMT(soundFormat byte, hasVideo bool) []byte {
+// 실제로 있는 트랙만 선언한다. 비디오가 없으면 PCR 을 오디오 PID 에 싣는다.
+// soundFormat 은 av.SOUND_AAC 또는 av.SOUND_MP3, videoCodecID 는 av.VIDEO_H264 또는 av.VIDEO_HEVC 이며, 각각 스트림 타입을 결정한다.
+func (muxer *Muxer) PMT(soundFormat byte, hasAudio bool, videoCodecID byte, hasVideo bool) []byte {
 	i := int(0)
 	j := int(0)
 	var progInfo []byte
 	remainBytes := int(0)
 	tsHeader := []byte{0x47, 0x50, 0x01, 0x10, 0x00}
 	pmtHeader := []byte{0x02, 0xb0, 0xff, 0x00, 0x01, 0xc1, 0x00, 0x00, 0xe1, 0x00, 0xf0, 0x00}
-	if !hasVideo {
-		pmtHeader[9] = 0x01
-		progInfo = []byte{0x0f, 0xe1, 0x01, 0xf0, 0x00}
+	muxer.pcrPID = videoPID
+	if hasVideo {
+		progInfo = append(progInfo, muxer.videoInfo(videoCodecID)...) //h264 or h265
 	} else {
-		progInfo = []byte{0x1b, 0xe1, 0x00, 0xf0, 0x00, //h264 or h265*
-			0x0f, 0xe1, 0x01, 0xf0, 0x00, //mp3 or aac
-		}
+		muxer.pcrPID = audioPID
+	}
+	if hasAudio {
+		progInfo = append(progInfo, muxer.audioInfo(soundFormat)...) //mp3 or aac
+	}
+	pmtHeader[5] = 0xc1 | muxer.pmtVersion<<1
+	pmtHeader[8] = 0xe0 | byte(muxer.pcrPID>>8)
+	pmtHeader[9] = byte(muxer.pcrPID)
+	if muxer.timedMetadata {
+		pointer := metadataPointer()
+		pmtHeader[11] = byte(len(pointer)) // program_info_length
+		progInfo = append(append(pointer, progInfo...), metadataInfo()...)
 	}
 	pmtHeader[2] = byte(len(progInfo) + 9 + 4)
 
@@ -282,15 +379,6 @@ func (muxer *Muxer) PMT(soundFormat byte, hasVideo bool) []byte {
 	tsHeader[3] |= muxer.pmtCc & 0x0f
 	muxer.pmtCc++
 
-	if soundFormat == 2 ||
-		soundFormat == 14 {
-		if hasVideo {
-			progInfo[5] = 0x4
-		} else {
-			progInfo[0] = 0x4
-		}
-	}
-
 	copy(muxer.pmt[i:], tsHeader)
 	i += len(tsHeader)
 
@@ -377,6 +465,8 @@ func (header *pesHeader) packet(p *av.Packet, pts, dts int64) error {
 	sid := audioSID
 	if p.IsVideo {
 		sid = videoSID
+	} else if p.IsMetadata {
+		sid = metadataSID
 	}
 	header.data[i] = byte(sid)
 	i++
@@ -406,6 +496,9 @@ func (header *pesHeader) packet(p *av.Packet, pts, dts int64) error {
 	i++
 
 	header.data[i] = 0x80
+	if p.IsMetadata {
+		header.data[i] |= 0x04 // data_alignment_indicator. PES 하나가 ID3 태그 하나이다.
+	}
 	i++
 	header.data[i] = byte(flag)
 	i++
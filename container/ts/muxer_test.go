@@ -0,0 +1,85 @@
+package ts
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gwuhaolin/livego/av"
+)
+
+// PMT 패킷에서 version_number 와 엘리멘터리 스트림의 (stream_type, PID) 를 읽는다. CRC 가 맞지 않으면 실패한다.
+func parsePMT(t *testing.T, pkt []byte) (version byte, streams [][2]int) {
+	section := pkt[5:]
+	length := int(section[1]&0x0f)<<8 | int(section[2])
+	end := 3 + length
+	crc := uint32(section[end-4])<<24 | uint32(section[end-3])<<16 | uint32(section[end-2])<<8 | uint32(section[end-1])
+	if GenCrc32(section[:end-4]) != crc {
+		t.Fatalf("pmt crc mismatch")
+	}
+	version = section[5] >> 1 & 0x1f
+	i := 12 + (int(section[10]&0x0f)<<8 | int(section[11]))
+	for i < end-4 {
+		pid := int(section[i+1]&0x1f)<<8 | int(section[i+2])
+		streams = append(streams, [2]int{int(section[i]), pid})
+		i += 5 + (int(section[i+3]&0x0f)<<8 | int(section[i+4]))
+	}
+	return
+}
+
+func TestPMTTimedMetadata(t *testing.T) {
+	muxer := NewMuxer()
+	tests := []struct {
+		timedMetadata bool
+		version       byte
+		streams       [][2]int
+	}{
+		{false, 0, [][2]int{{0x1b, videoPID}, {0x0f, audioPID}}},
+		{true, 1, [][2]int{{0x1b, videoPID}, {0x0f, audioPID}, {0x15, metadataPID}}},
+		{true, 1, [][2]int{{0x1b, videoPID}, {0x0f, audioPID}, {0x15, metadataPID}}},
+		{false, 2, [][2]int{{0x1b, videoPID}, {0x0f, audioPID}}},
+	}
+	for i, test := range tests {
+		muxer.SetTimedMetadata(test.timedMetadata)
+		version, streams := parsePMT(t, muxer.PMT(av.SOUND_AAC, true, av.VIDEO_H264, true))
+		if version != test.version {
+			t.Errorf("%d: version = %d, want %d", i, version, test.version)
+		}
+		if len(streams) != len(test.streams) {
+			t.Fatalf("%d: streams = %x, want %x", i, streams, test.streams)
+		}
+		for j := range streams {
+			if streams[j] != test.streams[j] {
+				t.Errorf("%d: stream %d = %x, want %x", i, j, streams[j], test.streams[j])
+			}
+		}
+	}
+}
+
+func TestPMTTracks(t *testing.T) {
+	tests := []struct {
+		name        string
+		soundFormat byte
+		hasAudio    bool
+		videoCodec  byte
+		hasVideo    bool
+		pcrPID      int
+		streams     [][2]int
+	}{
+		{"avc and aac", av.SOUND_AAC, true, av.VIDEO_H264, true, videoPID, [][2]int{{0x1b, videoPID}, {0x0f, audioPID}}},
+		{"hevc and mp3", av.SOUND_MP3, true, av.VIDEO_HEVC, true, videoPID, [][2]int{{0x24, videoPID}, {0x04, audioPID}}},
+		{"aac only", av.SOUND_AAC, true, 0, false, audioPID, [][2]int{{0x0f, audioPID}}},
+		{"mp3 only", av.SOUND_MP3, true, 0, false, audioPID, [][2]int{{0x04, audioPID}}},
+		{"avc only", 0, false, av.VIDEO_H264, true, videoPID, [][2]int{{0x1b, videoPID}}},
+	}
+	for _, test := range tests {
+		pkt := NewMuxer().PMT(test.soundFormat, test.hasAudio, test.videoCodec, test.hasVideo)
+		_, streams := parsePMT(t, pkt)
+		if fmt.Sprint(streams) != fmt.Sprint(test.streams) {
+			t.Errorf("%s: streams = %x, want %x", test.name, streams, test.streams)
+		}
+		// PCR_PID 는 섹션의 8, 9 번째 바이트에 있다.
+		if pcr := int(pkt[5+8]&0x1f)<<8 | int(pkt[5+9]); pcr != test.pcrPID {
+			t.Errorf("%s: PCR_PID = %x, want %x", test.name, pcr, test.pcrPID)
+		}
+	}
+}
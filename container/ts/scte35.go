@@ -0,0 +1,42 @@
+package ts
+
+/*
+SCTE-35 splice_info_section
+광고 구간의 시작(out of network)과 끝을 알리는 splice_insert 명령을 만든다.
+HLS 의 #EXT-X-DATERANGE SCTE35-OUT/SCTE35-IN 속성에 16 진수로 쓴다. 스플라이스 지점은 세그먼트 경계이므로 splice_immediate 로 쓴다.
+*/
+func SpliceInsert(eventID uint32, out bool, durationMs uint32) []byte {
+	cmd := []byte{
+		byte(eventID >> 24), byte(eventID >> 16), byte(eventID >> 8), byte(eventID),
+		0x7f, // splice_event_cancel_indicator 0, reserved
+		0x5f, // out_of_network_indicator, program_splice_flag 1, duration_flag, splice_immediate_flag 1, reserved
+	}
+	if out {
+		cmd[5] |= 0x80
+	}
+	if out && durationMs > 0 {
+		cmd[5] |= 0x20
+		// break_duration: auto_return 1, reserved, 33 비트 90kHz 길이
+		d := uint64(durationMs) * 90
+		cmd = append(cmd, 0xfe|byte(d>>32&0x01), byte(d>>24), byte(d>>16), byte(d>>8), byte(d))
+	}
+	cmd = append(cmd, 0x00, 0x00, 0x00, 0x00) // unique_program_id, avail_num, avails_expected
+
+	section := []byte{
+		0xfc,       // table_id
+		0x30, 0x00, // section_syntax_indicator 0, private_indicator 0, sap_type 3, section_length
+		0x00,                         // protocol_version
+		0x00, 0x00, 0x00, 0x00, 0x00, // encrypted_packet, encryption_algorithm, pts_adjustment
+		0x00,                                           // cw_index
+		0xff, 0xf0 | byte(len(cmd)>>8), byte(len(cmd)), // tier 0xfff, splice_command_length
+		0x05, // splice_command_type: splice_insert
+	}
+	section = append(section, cmd...)
+	section = append(section, 0x00, 0x00) // descriptor_loop_length
+
+	length := len(section) + 4 - 3
+	section[1] |= byte(length >> 8)
+	section[2] = byte(length)
+	crc := GenCrc32(section)
+	return append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}
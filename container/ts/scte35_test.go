@@ -0,0 +1,62 @@
+package ts
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestSpliceInsert(t *testing.T) {
+	tests := []struct {
+		name       string
+		eventID    uint32
+		out        bool
+		durationMs uint32
+		flags      byte
+		duration   uint64 // 90kHz, duration_flag 가 없으면 0
+	}{
+		{"out with duration", 1, true, 30000, 0xff, 30000 * 90},
+		{"out without duration", 0x12345678, true, 0, 0xdf, 0},
+		{"in", 7, false, 30000, 0x5f, 0},
+		{"33 bit duration", 2, true, 24 * 3600 * 1000, 0xff, 24 * 3600 * 1000 * 90},
+	}
+	for _, test := range tests {
+		section := SpliceInsert(test.eventID, test.out, test.durationMs)
+		if section[0] != 0xfc {
+			t.Errorf("%s: table_id = %#x", test.name, section[0])
+		}
+		if length := int(section[1]&0x0f)<<8 | int(section[2]); length != len(section)-3 {
+			t.Errorf("%s: section_length = %d, want %d", test.name, length, len(section)-3)
+		}
+		crc := binary.BigEndian.Uint32(section[len(section)-4:])
+		if GenCrc32(section[:len(section)-4]) != crc {
+			t.Errorf("%s: crc mismatch", test.name)
+		}
+		if section[13] != 0x05 {
+			t.Errorf("%s: splice_command_type = %#x", test.name, section[13])
+		}
+		cmdLen := int(section[11]&0x0f)<<8 | int(section[12])
+		cmd := section[14 : 14+cmdLen]
+		if id := binary.BigEndian.Uint32(cmd); id != test.eventID {
+			t.Errorf("%s: splice_event_id = %d, want %d", test.name, id, test.eventID)
+		}
+		if cmd[5] != test.flags {
+			t.Errorf("%s: flags = %#x, want %#x", test.name, cmd[5], test.flags)
+		}
+		var duration uint64
+		if cmd[5]&0x20 != 0 {
+			if cmd[6]&0xfe != 0xfe {
+				t.Errorf("%s: auto_return/reserved = %#x", test.name, cmd[6])
+			}
+			duration = uint64(cmd[6]&0x01)<<32 | uint64(binary.BigEndian.Uint32(cmd[7:]))
+		}
+		if duration != test.duration {
+			t.Errorf("%s: break_duration = %d, want %d", test.name, duration, test.duration)
+		}
+		if rest := cmd[len(cmd)-4:]; binary.BigEndian.Uint32(rest) != 0 {
+			t.Errorf("%s: unique_program_id/avail = %x", test.name, rest)
+		}
+		if loop := section[14+cmdLen : 16+cmdLen]; loop[0] != 0 || loop[1] != 0 {
+			t.Errorf("%s: descriptor_loop_length = %x", test.name, loop)
+		}
+	}
+}
@@ -12,10 +12,10 @@ require (
 	github.com/patrickmn/go-cache v2.1.0+incompatible
 	github.com/pion/datachannel v1.5.10 // indirect
 	github.com/pion/ice/v2 v2.3.37 // indirect
-	github.com/pion/interceptor v0.1.37 // indirect
+	github.com/pion/interceptor v0.1.37
 	github.com/pion/logging v0.2.3 // indirect
-	github.com/pion/rtcp v1.2.15 // indirect
-	github.com/pion/rtp v1.8.11 // indirect
+	github.com/pion/rtcp v1.2.15
+	github.com/pion/rtp v1.8.11
 	github.com/pion/sdp/v3 v3.0.10 // indirect
 	github.com/pion/webrtc/v3 v3.3.5
 	github.com/satori/go.uuid v1.2.0
@@ -24,5 +24,5 @@ require (
 	github.com/spf13/viper v1.6.3
 	github.com/urfave/negroni v1.0.0 // indirect
 	github.com/wlynxg/anet v0.0.5 // indirect
-	golang.org/x/net v0.34.0 // indirect
+	golang.org/x/net v0.34.0
 )
@@ -8,10 +8,13 @@ import (
 	"runtime"
 	"time"
 
+	"github.com/gwuhaolin/livego/av"
 	"github.com/gwuhaolin/livego/configure"
 	"github.com/gwuhaolin/livego/protocol/api"
+	"github.com/gwuhaolin/livego/protocol/dash"
 	"github.com/gwuhaolin/livego/protocol/hls"
 	"github.com/gwuhaolin/livego/protocol/httpflv"
+	"github.com/gwuhaolin/livego/protocol/metrics"
 	"github.com/gwuhaolin/livego/protocol/rtmp"
 	"github.com/gwuhaolin/livego/protocol/webrtc"
 
@@ -20,7 +23,7 @@ import (
 
 var VERSION = "master"
 
-func startHls() *hls.Server {
+func startHls(stream *rtmp.RtmpStream) *hls.Server {
 	// hls 서버 주소 읽어오기
 	hlsAddr := configure.Config.GetString("hls_addr")
 	// 서버주소로 tcp 연결 생성
@@ -29,7 +32,7 @@ func startHls() *hls.Server {
 		log.Fatal(err)
 	}
 
-	hlsServer := hls.NewServer()
+	hlsServer := hls.NewServer(stream)
 	go func() {
 		defer func() {
 			if r := recover(); r != nil {
@@ -42,7 +45,39 @@ func startHls() *hls.Server {
 	return hlsServer
 }
 
-func startRtmp(stream *rtmp.RtmpStream, hlsServer *hls.Server) {
+func startDash() *dash.Server {
+	dashAddr := configure.Config.GetString("dash_addr")
+	dashListen, err := net.Listen("tcp", dashAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dashServer := dash.NewServer()
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Error("DASH server panic: ", r)
+			}
+		}()
+		log.Info("DASH listen On ", dashAddr)
+		dashServer.Serve(dashListen)
+	}()
+	return dashServer
+}
+
+// 퍼블리셔가 들어올 때 함께 붙일 writer 목록. nil 서버가 인터페이스에 담기면 nil 비교가 되지 않으므로 걸러서 담는다.
+func writerGetters(hlsServer *hls.Server, dashServer *dash.Server) []av.GetWriter {
+	var getters []av.GetWriter
+	if hlsServer != nil {
+		getters = append(getters, hlsServer)
+	}
+	if dashServer != nil {
+		getters = append(getters, dashServer)
+	}
+	return getters
+}
+
+func startRtmp(stream *rtmp.RtmpStream, getters []av.GetWriter) {
 	rtmpAddr := configure.Config.GetString("rtmp_addr")
 	isRtmps := configure.Config.GetBool("enable_rtmps")
 
@@ -69,15 +104,7 @@ func startRtmp(stream *rtmp.RtmpStream, hlsServer *hls.Server) {
 		}
 	}
 
-	var rtmpServer *rtmp.Server
-
-	if hlsServer == nil {
-		rtmpServer = rtmp.NewRtmpServer(stream, nil)
-		log.Info("HLS server disable....")
-	} else {
-		rtmpServer = rtmp.NewRtmpServer(stream, hlsServer)
-		log.Info("HLS server enable....")
-	}
+	rtmpServer := rtmp.NewRtmpServer(stream, getters...)
 
 	defer func() {
 		if r := recover(); r != nil {
@@ -112,7 +139,7 @@ func startHTTPFlv(stream *rtmp.RtmpStream) {
 	}()
 }
 
-func startAPI(stream *rtmp.RtmpStream) {
+func startAPI(stream *rtmp.RtmpStream, webrtcServer *webrtc.Server) {
 	apiAddr := configure.Config.GetString("api_addr")
 	rtmpAddr := configure.Config.GetString("rtmp_addr")
 
@@ -121,7 +148,7 @@ func startAPI(stream *rtmp.RtmpStream) {
 		if err != nil {
 			log.Fatal(err)
 		}
-		opServer := api.NewServer(stream, rtmpAddr)
+		opServer := api.NewServer(stream, rtmpAddr, webrtcServer)
 		go func() {
 			defer func() {
 				if r := recover(); r != nil {
@@ -134,6 +161,30 @@ func startAPI(stream *rtmp.RtmpStream) {
 	}
 }
 
+func startWebRTC(stream *rtmp.RtmpStream, getters []av.GetWriter) *webrtc.Server {
+	webrtcAddr := configure.Config.GetString("webrtc_addr")
+
+	webrtcListen, err := net.Listen("tcp", webrtcAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	webrtcServer, err := webrtc.NewServer(stream, getters...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Error("WebRTC server panic: ", r)
+			}
+		}()
+		log.Info("WebRTC listen On ", webrtcAddr)
+		webrtcServer.Serve(webrtcListen)
+	}()
+	return webrtcServer
+}
+
 // 택스트 포매터 구조체 포인터를 전달해 로거의 포매터를 설정한다.
 // 익명 함수 정의. 호출 함수와 관련된 구조체를 전달 하여 커스터 마이징 함수의 이름과, 파일 이름 및 라인 번호를 반환한다.
 func init() {
@@ -179,6 +230,9 @@ func main() {
 	apps := configure.Applications{}
 	configure.Config.UnmarshalKey("server", &apps)
 
+	// 오래 바뀌지 않은 메트릭 시리즈를 지운다.
+	go metrics.ExpireLoop()
+
 	// apps 에서 각 앱 설정을 처리 합니다.
 	// 앱네임이 여러개가 되는 예로
 	// 스트리머가 여러 채널을 운영하여 각기 다른 콘텐츠를 선택적으로 볼수 있게 하는경우 (음악, 게임)
@@ -191,24 +245,28 @@ func main() {
 
 		// app 구조체에 hls가 true 이면 hls 서버를 실행한다.
 		if app.Hls {
-			hlsServer = startHls()
+			hlsServer = startHls(stream)
+			log.Info("HLS server enable....")
+		} else {
+			log.Info("HLS server disable....")
 		}
+		var dashServer *dash.Server
+		if app.Dash {
+			dashServer = startDash()
+		}
+		getters := writerGetters(hlsServer, dashServer)
 		// 느슨한 결합
 		if app.Flv {
 			startHTTPFlv(stream)
 		}
-		if app.Api {
-			startAPI(stream)
-		}
-
+		var webrtcServer *webrtc.Server
 		if app.Webrtc {
-			go func() {
-				if err := webrtc.StartWebRTCServer(":8080"); err != nil {
-					log.Printf("WebRTC server failed: %v", err)
-				}
-			}()
+			webrtcServer = startWebRTC(stream, getters)
+		}
+		if app.Api {
+			startAPI(stream, webrtcServer)
 		}
 
-		startRtmp(stream, hlsServer)
+		startRtmp(stream, getters)
 	}
 }
@@ -132,3 +132,26 @@ func (parser *Parser) Parse(b []byte, packetType uint8, w io.Writer) (err error)
 	}
 	return
 }
+
+// ADTS 헤더로부터 FLV 시퀀스 헤더에 쓰이는 AudioSpecificConfig 와 헤더 길이를 구한다.
+// 외부 인코더가 출력한 ADTS 스트림을 FLV(RTMP) 오디오 태그로 바꿀 때 사용한다.
+func ParseADTSHeader(b []byte) (specific []byte, headerLen int, err error) {
+	if len(b) < adtsHeaderLen || b[0] != 0xff || b[1]&0xf0 != 0xf0 {
+		return nil, 0, audioBufInvalid
+	}
+	headerLen = adtsHeaderLen
+	// protection_absent 가 0 이면 CRC 2바이트가 더 붙는다.
+	if b[1]&0x01 == 0 {
+		headerLen += 2
+	}
+
+	objectType := (b[2]>>6)&0x03 + 1
+	sampleRate := (b[2] >> 2) & 0x0f
+	channel := (b[2]&0x01)<<2 | (b[3]>>6)&0x03
+
+	specific = []byte{
+		objectType<<3 | sampleRate>>1,
+		(sampleRate&0x01)<<7 | channel<<3,
+	}
+	return specific, headerLen, nil
+}
@@ -0,0 +1,32 @@
+package cea608
+
+// 기본 문자 집합(0x20-0x7F) 중 ASCII 와 다른 문자
+var basicChars = map[byte]rune{
+	0x2a: 'á',
+	0x5c: 'é',
+	0x5e: 'í',
+	0x5f: 'ó',
+	0x60: 'ú',
+	0x7b: 'ç',
+	0x7c: '÷',
+	0x7d: 'Ñ',
+	0x7e: 'ñ',
+	0x7f: '█',
+}
+
+// 특수 문자. 0x11(0x19) 0x30-0x3F
+var specialChars = []rune("®°½¿™¢£♪à èâêîôû")
+
+// 확장 문자. 0x12(0x1A) 0x20-0x3F 는 스페인어/기타/프랑스어, 0x13(0x1B) 0x20-0x3F 는 포르투갈어/독일어/덴마크어.
+// 확장 문자 앞에는 이를 지원하지 않는 디코더를 위한 대체 문자가 오므로, 확장 문자는 앞 문자를 덮어쓴다.
+var extendedChars = [2][]rune{
+	[]rune("ÁÉÓÚÜü‘¡*'—©℠•“”ÀÂÇÈÊËëÎÏïÔÙùÛ«»"),
+	[]rune("ÃãÍÌìÒòÕõ{}\\^_|~ÄäÖöß¥¤│ÅåØø┌┐└┘"),
+}
+
+func basicChar(b byte) rune {
+	if r, ok := basicChars[b]; ok {
+		return r
+	}
+	return rune(b)
+}
@@ -0,0 +1,275 @@
+package cea608
+
+import "strings"
+
+/*
+CEA-608 캡션 디코더
+H.264 SEI 로 받은 필드 1 바이트 쌍을 화면 메모리에 그려, 화면에 표시된 글자가 바뀔 때마다 큐(표시 구간과 글자)를 만든다.
+CC1 채널만 해석하며, 팝온(pop-on), 롤업(roll-up), 페인트온(paint-on) 방식을 지원한다. 색상, 밑줄, 기울임 등의 속성은 버린다.
+글자 하나마다 큐를 만들지 않도록 표시된 글자는 제어 코드를 받을 때와 Flush 에서만 확인한다.
+롤업 방식은 CR 에서 줄을 완성한 화면을 다음 CR 까지 표시한다.
+*/
+
+const (
+	rows = 15
+	cols = 32
+)
+
+// 캡션 표시 방식
+const (
+	popOn = iota
+	rollUp
+	paintOn
+)
+
+// 화면에 표시된 캡션. Start, End 는 표시를 시작하고 끝낸 PTS(ms)이다.
+type Cue struct {
+	Start uint32
+	End   uint32
+	Text  string
+}
+
+type screen [rows][cols]rune
+
+// 화면에 보이는 글자. 빈 줄은 건너뛰고 줄마다 앞뒤 공백을 지운다.
+func (s *screen) text() string {
+	var lines []string
+	for _, row := range s {
+		line := strings.TrimSpace(strings.Map(func(r rune) rune {
+			if r == 0 {
+				return ' '
+			}
+			return r
+		}, string(row[:])))
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+type Decoder struct {
+	mode      int
+	rollRows  int    // 롤업 방식에서 보이는 줄 수
+	displayed screen // 화면에 표시된 메모리
+	buffered  screen // 팝온 방식에서 EOC 전까지 글자를 쓰는 메모리
+	row, col  int    // 커서 위치
+	channel   int    // 마지막 제어 코드의 채널. 1 이 아니면 글자를 버린다.
+	last      [2]byte
+	text      string // 표시 중인 글자
+	start     uint32 // text 를 표시하기 시작한 PTS(ms)
+	cues      []Cue
+}
+
+func NewDecoder() *Decoder {
+	return &Decoder{rollRows: 2, row: rows - 1, channel: 1}
+}
+
+// 바이트 쌍을 해석한다. pts 는 쌍을 실은 프레임의 PTS(ms)이다.
+func (d *Decoder) Decode(pts uint32, b1, b2 byte) {
+	b1, b2 = b1&0x7f, b2&0x7f // 홀수 패리티 비트
+	if b1 == 0 && b2 == 0 {
+		return
+	}
+	if b1 < 0x10 || b1 > 0x1f {
+		d.last = [2]byte{}
+		if d.channel != 1 {
+			return
+		}
+		for _, b := range []byte{b1, b2} {
+			if b >= 0x20 {
+				d.put(basicChar(b))
+			}
+		}
+		return
+	}
+
+	// 제어 코드는 전송 오류에 대비해 두 번씩 보내므로 연속된 같은 코드는 한 번만 처리한다.
+	if d.last == [2]byte{b1, b2} {
+		d.last = [2]byte{}
+		return
+	}
+	d.last = [2]byte{b1, b2}
+	if b1&0x08 != 0 {
+		d.channel = 2
+		return
+	}
+	d.channel = 1
+
+	switch {
+	case b1 == 0x14 && b2 >= 0x20 && b2 <= 0x2f:
+		d.command(pts, b2)
+	case b1 == 0x17 && b2 >= 0x21 && b2 <= 0x23:
+		// 탭 오프셋
+		d.col += int(b2 - 0x20)
+		if d.col >= cols {
+			d.col = cols - 1
+		}
+	case b1 == 0x11 && b2 >= 0x20 && b2 <= 0x2f:
+		// 줄 중간 속성 코드는 공백 한 칸을 차지한다.
+		d.put(' ')
+	case b1 == 0x11 && b2 >= 0x30 && b2 <= 0x3f:
+		d.put(specialChars[b2-0x30])
+	case (b1 == 0x12 || b1 == 0x13) && b2 >= 0x20 && b2 <= 0x3f:
+		if d.col > 0 {
+			d.col--
+		}
+		d.put(extendedChars[b1-0x12][b2-0x20])
+	case b2 >= 0x40:
+		d.preamble(b1, b2)
+	}
+	if d.mode != rollUp {
+		d.update(pts)
+	}
+}
+
+// 글자를 쓰는 메모리. 팝온 방식이면 화면에 보이지 않는 메모리에 쓴다.
+func (d *Decoder) memory() *screen {
+	if d.mode == popOn {
+		return &d.buffered
+	}
+	return &d.displayed
+}
+
+func (d *Decoder) put(r rune) {
+	d.memory()[d.row][d.col] = r
+	if d.col < cols-1 {
+		d.col++
+	}
+}
+
+// 기타 제어 코드 (0x14 0x20-0x2F)
+func (d *Decoder) command(pts uint32, b2 byte) {
+	switch b2 {
+	case 0x20: // RCL: 팝온 방식
+		d.mode = popOn
+	case 0x21: // BS
+		if d.col > 0 {
+			d.col--
+			d.memory()[d.row][d.col] = 0
+		}
+	case 0x24: // DER: 줄 끝까지 지움
+		for i := d.col; i < cols; i++ {
+			d.memory()[d.row][i] = 0
+		}
+	case 0x25, 0x26, 0x27: // RU2, RU3, RU4: 롤업 방식
+		if d.mode != rollUp {
+			d.displayed = screen{}
+			d.buffered = screen{}
+			d.row = rows - 1
+			d.update(pts)
+		}
+		d.mode = rollUp
+		d.rollRows = int(b2-0x25) + 2
+		d.col = 0
+	case 0x29: // RDC: 페인트온 방식
+		d.mode = paintOn
+	case 0x2a, 0x2b: // TR, RTD: 텍스트 채널은 캡션이 아니다.
+		d.channel = 0
+	case 0x2c: // EDM: 화면 지움
+		d.displayed = screen{}
+		d.update(pts)
+	case 0x2d: // CR
+		if d.mode == rollUp {
+			d.update(pts)
+			d.carriageReturn()
+		}
+	case 0x2e: // ENM: 보이지 않는 메모리 지움
+		d.buffered = screen{}
+	case 0x2f: // EOC: 메모리를 맞바꿔 팝온 캡션을 표시
+		d.displayed, d.buffered = d.buffered, d.displayed
+		d.mode = popOn
+	}
+}
+
+// 롤업 방식의 줄 바꿈. 기준 줄 위로 rollRows 줄만 남기고 한 줄씩 올린다.
+func (d *Decoder) carriageReturn() {
+	top := d.row - d.rollRows + 1
+	if top < 0 {
+		top = 0
+	}
+	for i := range d.displayed {
+		if i < top || i > d.row {
+			d.displayed[i] = [cols]rune{}
+		}
+	}
+	for i := top; i < d.row; i++ {
+		d.displayed[i] = d.displayed[i+1]
+	}
+	d.displayed[d.row] = [cols]rune{}
+	d.col = 0
+}
+
+// PAC 코드의 첫 바이트와 두 번째 바이트 0x20 비트로 줄 번호(1-15)를 정한다.
+var preambleRows = map[byte][2]int{
+	0x10: {11, 0},
+	0x11: {1, 2},
+	0x12: {3, 4},
+	0x13: {12, 13},
+	0x14: {14, 15},
+	0x15: {5, 6},
+	0x16: {7, 8},
+	0x17: {9, 10},
+}
+
+// PAC: 커서를 줄 처음(들여쓰기가 있으면 4 칸 단위)으로 옮긴다.
+func (d *Decoder) preamble(b1, b2 byte) {
+	r, ok := preambleRows[b1]
+	if !ok {
+		return
+	}
+	row := r[0]
+	if b2&0x20 != 0 {
+		row = r[1]
+	}
+	if row == 0 {
+		return
+	}
+	if d.mode == rollUp && row-1 != d.row {
+		// 롤업 중 기준 줄이 바뀌면 보이던 줄을 함께 옮긴다.
+		moved := screen{}
+		for i := 0; i < d.rollRows; i++ {
+			from, to := d.row-i, row-1-i
+			if from >= 0 && to >= 0 {
+				moved[to] = d.displayed[from]
+			}
+		}
+		d.displayed = moved
+	}
+	d.row = row - 1
+	d.col = 0
+	if b2&0x10 != 0 {
+		d.col = int(b2&0x0e) << 1
+	}
+}
+
+// 표시된 글자가 바뀌었으면 이전 글자의 큐를 끝낸다.
+func (d *Decoder) update(pts uint32) {
+	text := d.displayed.text()
+	if text == d.text {
+		return
+	}
+	d.end(pts)
+	d.text = text
+	d.start = pts
+}
+
+func (d *Decoder) end(pts uint32) {
+	if d.text != "" && pts > d.start {
+		d.cues = append(d.cues, Cue{Start: d.start, End: pts, Text: d.text})
+	}
+}
+
+// pts 까지 끝난 큐를 반환한다. 아직 표시 중인 글자는 pts 에서 끊어 큐로 만들고, pts 부터 다시 표시하는 것으로 본다.
+func (d *Decoder) Flush(pts uint32) []Cue {
+	if d.mode != rollUp {
+		d.update(pts)
+	}
+	d.end(pts)
+	if pts > d.start {
+		d.start = pts
+	}
+	cues := d.cues
+	d.cues = nil
+	return cues
+}
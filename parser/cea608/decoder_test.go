@@ -0,0 +1,158 @@
+package cea608
+
+import (
+	"fmt"
+	"testing"
+)
+
+const (
+	rcl = 0x1420 // 팝온 방식
+	bs  = 0x1421
+	ru2 = 0x1425
+	rdc = 0x1429 // 페인트온 방식
+	edm = 0x142c
+	cr  = 0x142d
+	enm = 0x142e
+	eoc = 0x142f
+	pac = 0x1470 // 15 번째 줄, 들여쓰기 없음
+)
+
+// pts 에 보낼 바이트 쌍들
+type step struct {
+	pts   uint32
+	pairs [][2]byte
+}
+
+// 제어 코드는 두 번씩 보낸다.
+func ctrl(pts uint32, codes ...uint16) step {
+	s := step{pts: pts}
+	for _, code := range codes {
+		pair := [2]byte{byte(code >> 8), byte(code)}
+		s.pairs = append(s.pairs, pair, pair)
+	}
+	return s
+}
+
+// 글자를 두 개씩 묶어 보낸다.
+func chars(pts uint32, text string) step {
+	s := step{pts: pts}
+	for i := 0; i < len(text); i += 2 {
+		pair := [2]byte{text[i], 0}
+		if i+1 < len(text) {
+			pair[1] = text[i+1]
+		}
+		s.pairs = append(s.pairs, pair)
+	}
+	return s
+}
+
+func pairs(pts uint32, codes ...uint16) step {
+	s := step{pts: pts}
+	for _, code := range codes {
+		s.pairs = append(s.pairs, [2]byte{byte(code >> 8), byte(code)})
+	}
+	return s
+}
+
+func TestDecoder(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []step
+		flush uint32
+		want  []Cue
+	}{
+		{
+			name:  "pop-on",
+			steps: []step{ctrl(0, rcl, pac), chars(0, "HELLO"), ctrl(1000, eoc), ctrl(3000, edm)},
+			flush: 4000,
+			want:  []Cue{{1000, 3000, "HELLO"}},
+		},
+		{
+			name: "pop-on replaced",
+			steps: []step{
+				ctrl(0, rcl, pac), chars(0, "ONE"), ctrl(1000, eoc),
+				ctrl(1500, enm, rcl, pac), chars(1500, "TWO"), ctrl(2000, eoc),
+			},
+			flush: 3000,
+			want:  []Cue{{1000, 2000, "ONE"}, {2000, 3000, "TWO"}},
+		},
+		{
+			name: "roll-up",
+			steps: []step{
+				ctrl(0, ru2, cr), chars(100, "ONE"), ctrl(1000, cr),
+				chars(1500, "TWO"), ctrl(2000, cr),
+			},
+			flush: 2500,
+			want:  []Cue{{1000, 2000, "ONE"}, {2000, 2500, "ONE\nTWO"}},
+		},
+		{
+			name:  "paint-on",
+			steps: []step{ctrl(0, rdc, pac), chars(0, "HI"), ctrl(500, pac), ctrl(2000, edm)},
+			flush: 3000,
+			want:  []Cue{{500, 2000, "HI"}},
+		},
+		{
+			name:  "backspace and special characters",
+			steps: []step{ctrl(0, rcl, pac), chars(0, "ABC"), ctrl(0, bs), pairs(0, 0x1137, 0x5c00), chars(0, "a"), pairs(0, 0x1220), ctrl(1000, eoc)},
+			flush: 2000,
+			want:  []Cue{{1000, 2000, "AB♪éÁ"}},
+		},
+		{
+			name: "second channel ignored",
+			steps: []step{
+				ctrl(0, rcl, pac), chars(0, "CC1"),
+				ctrl(0, 0x1c20), chars(0, "CC2"), // CC2 의 RCL
+				ctrl(500, eoc),
+			},
+			flush: 1000,
+			want:  []Cue{{500, 1000, "CC1"}},
+		},
+		{
+			name:  "undoubled control codes",
+			steps: []step{pairs(0, rcl, pac), chars(0, "X"), pairs(1000, eoc, eoc, eoc)},
+			flush: 2000,
+			// 세 번째 EOC 는 짝이 없는 새 코드이므로 메모리를 다시 맞바꾼다.
+			want: nil,
+		},
+		{
+			name:  "odd parity",
+			steps: []step{ctrl(0, 0x9420, 0x94f0), pairs(0, 0xc1c2), ctrl(1000, 0x94af)},
+			flush: 2000,
+			want:  []Cue{{1000, 2000, "AB"}},
+		},
+	}
+	for _, test := range tests {
+		d := NewDecoder()
+		for _, s := range test.steps {
+			for _, pair := range s.pairs {
+				d.Decode(s.pts, pair[0], pair[1])
+			}
+		}
+		got := d.Flush(test.flush)
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: cues = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFlushSplitsCue(t *testing.T) {
+	d := NewDecoder()
+	for _, s := range []step{ctrl(0, rcl, pac), chars(0, "LIVE"), ctrl(1000, eoc)} {
+		for _, pair := range s.pairs {
+			d.Decode(s.pts, pair[0], pair[1])
+		}
+	}
+	tests := []struct {
+		flush uint32
+		want  []Cue
+	}{
+		{2000, []Cue{{1000, 2000, "LIVE"}}},
+		{2000, nil},
+		{3000, []Cue{{2000, 3000, "LIVE"}}},
+	}
+	for _, test := range tests {
+		if got := d.Flush(test.flush); fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("Flush(%d) = %v, want %v", test.flush, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package h264
+
+import (
+	"bytes"
+
+	"github.com/gwuhaolin/livego/utils/pio"
+)
+
+const (
+	seiUserDataRegistered = 4 // user_data_registered_itu_t_t35
+
+	ccTypeNTSCField1 = 0 // CEA-608 필드 1 (CC1, CC2)
+)
+
+// ATSC A/53 캡션의 itu_t_t35_country_code, provider_code, user_identifier, user_data_type_code
+var atscCaptionHeader = []byte{0xb5, 0x00, 0x31, 'G', 'A', '9', '4', 0x03}
+
+// AVCC 프레임의 SEI NALU 에서 CEA-608 필드 1 캡션 바이트 쌍을 꺼낸다.
+// SEI 의 user_data_registered_itu_t_t35 에 실린 ATSC A/53 cc_data 중 유효한 NTSC 필드 1 쌍만 순서대로 이어 붙인다.
+func CaptionData(avcc []byte) []byte {
+	var pairs []byte
+	for len(avcc) >= naluBytesLen {
+		size := int(avcc[0])<<24 | int(avcc[1])<<16 | int(avcc[2])<<8 | int(avcc[3])
+		avcc = avcc[naluBytesLen:]
+		if size <= 0 || size > len(avcc) {
+			break
+		}
+		nalu := avcc[:size]
+		avcc = avcc[size:]
+		if len(nalu) > 1 && nalu[0]&0x1f == nalu_type_sei {
+			pairs = append(pairs, seiCaptions(pio.RBSP(nalu[1:]))...)
+		}
+	}
+	return pairs
+}
+
+// SEI RBSP 의 메시지를 돌며 캡션 바이트 쌍을 꺼낸다.
+func seiCaptions(rbsp []byte) []byte {
+	var pairs []byte
+	for len(rbsp) > 2 {
+		payloadType, payloadSize := 0, 0
+		for len(rbsp) > 0 && rbsp[0] == 0xff {
+			payloadType += 255
+			rbsp = rbsp[1:]
+		}
+		if len(rbsp) == 0 {
+			break
+		}
+		payloadType += int(rbsp[0])
+		rbsp = rbsp[1:]
+		for len(rbsp) > 0 && rbsp[0] == 0xff {
+			payloadSize += 255
+			rbsp = rbsp[1:]
+		}
+		if len(rbsp) == 0 {
+			break
+		}
+		payloadSize += int(rbsp[0])
+		rbsp = rbsp[1:]
+		if payloadSize > len(rbsp) {
+			break
+		}
+		if payloadType == seiUserDataRegistered {
+			pairs = append(pairs, ccData(rbsp[:payloadSize])...)
+		}
+		rbsp = rbsp[payloadSize:]
+	}
+	return pairs
+}
+
+// ATSC A/53 cc_data() 에서 유효한 NTSC 필드 1 바이트 쌍을 꺼낸다.
+func ccData(payload []byte) []byte {
+	if !bytes.HasPrefix(payload, atscCaptionHeader) || len(payload) < len(atscCaptionHeader)+2 {
+		return nil
+	}
+	b := payload[len(atscCaptionHeader):]
+	if b[0]&0x40 == 0 { // process_cc_data_flag
+		return nil
+	}
+	count := int(b[0] & 0x1f)
+	b = b[2:] // em_data
+	var pairs []byte
+	for i := 0; i < count && len(b) >= 3; i++ {
+		valid := b[0]&0x04 != 0
+		if valid && b[0]&0x03 == ccTypeNTSCField1 {
+			pairs = append(pairs, b[1], b[2])
+		}
+		b = b[3:]
+	}
+	return pairs
+}
@@ -0,0 +1,117 @@
+package h264
+
+import (
+	"github.com/gwuhaolin/livego/utils/pio"
+)
+
+// High 계열 프로파일은 SPS 에 크로마 포맷과 비트 깊이, 스케일링 매트릭스가 더 들어 있다.
+var highProfiles = map[uint]bool{
+	100: true, 110: true, 122: true, 244: true, 44: true, 83: true,
+	86: true, 118: true, 128: true, 138: true, 139: true, 134: true, 135: true,
+}
+
+// AVCDecoderConfigurationRecord(FLV 비디오 시퀀스 헤더)의 첫 SPS 에서 화면 크기를 읽는다.
+func Resolution(record []byte) (width, height int, err error) {
+	if len(record) < 8 || record[5]&0x1f == 0 {
+		return 0, 0, decDataNil
+	}
+	spsLen := int(record[6])<<8 | int(record[7])
+	if len(record[8:]) < spsLen || spsLen <= 0 {
+		return 0, 0, spsDataError
+	}
+	return ParseSPS(record[8 : 8+spsLen])
+}
+
+// SPS NALU 에서 크롭을 반영한 화면 크기를 읽는다.
+func ParseSPS(sps []byte) (width, height int, err error) {
+	if len(sps) < 4 || sps[0]&0x1f != nalu_type_sps {
+		return 0, 0, spsDataError
+	}
+	r := pio.NewBitReader(pio.RBSP(sps[1:]))
+	profile := r.ReadBits(8)
+	r.Skip(16) // constraint_set_flags, level_idc
+	r.ReadUE() // seq_parameter_set_id
+
+	chromaFormat := uint(1)
+	if highProfiles[profile] {
+		chromaFormat = r.ReadUE()
+		if chromaFormat == 3 {
+			r.Skip(1) // separate_colour_plane_flag
+		}
+		r.ReadUE() // bit_depth_luma_minus8
+		r.ReadUE() // bit_depth_chroma_minus8
+		r.Skip(1)  // qpprime_y_zero_transform_bypass_flag
+		if r.ReadBit() == 1 {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.ReadBit() == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				skipScalingList(r, size)
+			}
+		}
+	}
+
+	r.ReadUE() // log2_max_frame_num_minus4
+	switch r.ReadUE() {
+	case 0:
+		r.ReadUE() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.Skip(1)  // delta_pic_order_always_zero_flag
+		r.ReadSE() // offset_for_non_ref_pic
+		r.ReadSE() // offset_for_top_to_bottom_field
+		n := r.ReadUE()
+		for i := uint(0); i < n && !r.Overflow; i++ {
+			r.ReadSE()
+		}
+	}
+	r.ReadUE() // max_num_ref_frames
+	r.Skip(1)  // gaps_in_frame_num_value_allowed_flag
+
+	widthInMbs := int(r.ReadUE()) + 1
+	heightInMapUnits := int(r.ReadUE()) + 1
+	frameMbsOnly := int(r.ReadBit())
+	if frameMbsOnly == 0 {
+		r.Skip(1) // mb_adaptive_frame_field_flag
+	}
+	r.Skip(1) // direct_8x8_inference_flag
+
+	width = widthInMbs * 16
+	height = (2 - frameMbsOnly) * heightInMapUnits * 16
+	if r.ReadBit() == 1 {
+		left, right := int(r.ReadUE()), int(r.ReadUE())
+		top, bottom := int(r.ReadUE()), int(r.ReadUE())
+		cropX, cropY := 1, 2-frameMbsOnly
+		switch chromaFormat {
+		case 1:
+			cropX, cropY = 2, 2*(2-frameMbsOnly)
+		case 2:
+			cropX = 2
+		}
+		width -= cropX * (left + right)
+		height -= cropY * (top + bottom)
+	}
+	if r.Overflow || width <= 0 || height <= 0 {
+		return 0, 0, spsDataError
+	}
+	return width, height, nil
+}
+
+func skipScalingList(r *pio.BitReader, size int) {
+	last, next := 8, 8
+	for j := 0; j < size; j++ {
+		if next != 0 {
+			next = (last + r.ReadSE() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package h265
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+/*
+HEVC(H.265) 의 NALU 헤더는 2 바이트이며, 첫 바이트의 1~6 번째 비트가 NAL 유닛 타입이다.
+forbidden_zero_bit(1) | nal_unit_type(6) | nuh_layer_id(6) | nuh_temporal_id_plus1(3)
+
+H.264 의 SPS/PPS 에 더해 VPS(Video Parameter Set) 가 있으며, 디코더는 VPS -> SPS -> PPS 순서로 읽는다.
+
+IRAP(Intra Random Access Point)
+BLA, IDR, CRA 처럼 이전 프레임 참조 없이 디코딩을 시작할 수 있는 픽쳐이다. H.264 의 IDR 에 해당하며,
+HLS 세그먼트는 IRAP 에서 시작해야 중간에 들어온 시청자도 재생할 수 있다.
+*/
+const (
+	nalu_type_bla_w_lp   byte = 16
+	nalu_type_rsv_irap23 byte = 23 // 16~23 이 IRAP 이다.
+	nalu_type_vps        byte = 32
+	nalu_type_sps        byte = 33
+	nalu_type_pps        byte = 34
+	nalu_type_aud        byte = 35
+)
+
+const (
+	maxParamSetsLen int = 2 * 1024
+)
+
+var (
+	decDataNil       = fmt.Errorf("hvcc data is nil")
+	hvccDataError    = fmt.Errorf("hvcc data error")
+	videoDataInvalid = fmt.Errorf("video data not match")
+	naluBodyLenError = fmt.Errorf("nalu body len error")
+)
+
+var startCode = []byte{0x00, 0x00, 0x00, 0x01}
+
+// AUD, pic_type=2 (I, P, B 슬라이스 모두 가능)
+var naluAud = []byte{0x00, 0x00, 0x00, 0x01, 0x46, 0x01, 0x50}
+
+type Parser struct {
+	naluLen      int           // NALU 길이 필드 크기 (lengthSizeMinusOne + 1)
+	specificInfo []byte        // hvcC 에서 꺼낸 Annex B 형태의 VPS/SPS/PPS
+	paramSets    *bytes.Buffer // 프레임 안에 들어온 VPS/SPS/PPS
+}
+
+func NewParser() *Parser {
+	return &Parser{
+		naluLen:   4,
+		paramSets: bytes.NewBuffer(make([]byte, 0, maxParamSetsLen)),
+	}
+}
+
+func naluType(b byte) byte {
+	return (b >> 1) & 0x3f
+}
+
+func isIRAP(nalType byte) bool {
+	return nalType >= nalu_type_bla_w_lp && nalType <= nalu_type_rsv_irap23
+}
+
+// HEVCDecoderConfigurationRecord(hvcC) 에서 NALU 길이 필드 크기와 VPS/SPS/PPS 를 꺼낸다.
+// 앞의 22 바이트는 프로파일, 레벨 등 고정 필드이고, 그 뒤에 NALU 배열이 이어진다.
+func (parser *Parser) parseSpecificInfo(src []byte) error {
+	if len(src) < 23 {
+		return decDataNil
+	}
+	naluLen := int(src[21]&0x03) + 1
+	numArrays := int(src[22])
+	src = src[23:]
+
+	var info []byte
+	for i := 0; i < numArrays; i++ {
+		if len(src) < 3 {
+			return hvccDataError
+		}
+		nalType := src[0] & 0x3f
+		numNalus := int(src[1])<<8 | int(src[2])
+		src = src[3:]
+		for j := 0; j < numNalus; j++ {
+			if len(src) < 2 {
+				return hvccDataError
+			}
+			size := int(src[0])<<8 | int(src[1])
+			if len(src[2:]) < size || size <= 0 {
+				return hvccDataError
+			}
+			switch nalType {
+			case nalu_type_vps, nalu_type_sps, nalu_type_pps:
+				info = append(info, startCode...)
+				info = append(info, src[2:2+size]...)
+			}
+			src = src[2+size:]
+		}
+	}
+
+	// 시퀀스 헤더가 다시 오면 새 파라미터로 바꾼다.
+	parser.naluLen = naluLen
+	parser.specificInfo = info
+	return nil
+}
+
+// 길이 프리픽스 NALU 들을 Annex B 로 바꾼다.
+// 맨 앞에 AUD 를 넣고, 첫 번째 IRAP 앞에는 VPS/SPS/PPS 를 넣는다.
+// 프레임 안에 파라미터 셋이 들어 있으면 그것을, 없으면 시퀀스 헤더의 것을 사용한다.
+func (parser *Parser) getAnnexbH265(src []byte, w io.Writer) error {
+	if len(src) < parser.naluLen {
+		return videoDataInvalid
+	}
+	parser.paramSets.Reset()
+	if _, err := w.Write(naluAud); err != nil {
+		return err
+	}
+
+	hasWriteParamSets := false
+	for len(src) > 0 {
+		if len(src) < parser.naluLen {
+			return naluBodyLenError
+		}
+		nalLen := 0
+		for i := 0; i < parser.naluLen; i++ {
+			nalLen = nalLen<<8 | int(src[i])
+		}
+		src = src[parser.naluLen:]
+		if nalLen <= 0 || len(src) < nalLen {
+			return naluBodyLenError
+		}
+
+		nal := src[:nalLen]
+		switch nalType := naluType(nal[0]); {
+		case nalType == nalu_type_aud:
+			// AUD 는 이미 앞에서 추가했다.
+		case nalType == nalu_type_vps, nalType == nalu_type_sps, nalType == nalu_type_pps:
+			parser.paramSets.Write(startCode)
+			parser.paramSets.Write(nal)
+		default:
+			if isIRAP(nalType) && !hasWriteParamSets {
+				hasWriteParamSets = true
+				paramSets := parser.specificInfo
+				if parser.paramSets.Len() > 0 {
+					paramSets = parser.paramSets.Bytes()
+				}
+				if _, err := w.Write(paramSets); err != nil {
+					return err
+				}
+			}
+			if _, err := w.Write(startCode); err != nil {
+				return err
+			}
+			if _, err := w.Write(nal); err != nil {
+				return err
+			}
+		}
+		src = src[nalLen:]
+	}
+	return nil
+}
+
+// 주어진 바이트 스트림을 annex b 포맷으로 변환하거나 그대로 출력한다.
+func (parser *Parser) Parse(b []byte, isSeq bool, w io.Writer) (err error) {
+	switch isSeq {
+	case true:
+		err = parser.parseSpecificInfo(b)
+	case false:
+		if bytes.HasPrefix(b, startCode) {
+			_, err = w.Write(b)
+		} else {
+			err = parser.getAnnexbH265(b, w)
+		}
+	}
+	return
+}
+
+// Annex B 프레임에 IRAP 픽쳐가 들어 있는지 확인한다.
+// FLV 의 프레임 타입은 인코더에 따라 CRA 를 키프레임으로 표시하지 않기도 하므로, 세그먼트 경계는 이 값으로 정한다.
+func HasIRAP(b []byte) bool {
+	for {
+		i := bytes.Index(b, startCode[1:])
+		if i < 0 || i+3 >= len(b) {
+			return false
+		}
+		b = b[i+3:]
+		if isIRAP(naluType(b[0])) {
+			return true
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package h265
+
+import (
+	"bytes"
+	"testing"
+)
+
+// NAL 유닛 타입이 typ 인 2 바이트 헤더와 본문
+func nalu(typ byte, body ...byte) []byte {
+	return append([]byte{typ << 1, 0x01}, body...)
+}
+
+// 4 바이트 길이 프리픽스를 붙여 이어 붙인다.
+func avcc(nalus ...[]byte) []byte {
+	var b []byte
+	for _, n := range nalus {
+		b = append(b, byte(len(n)>>24), byte(len(n)>>16), byte(len(n)>>8), byte(len(n)))
+		b = append(b, n...)
+	}
+	return b
+}
+
+// 스타트 코드를 붙여 이어 붙인다.
+func annexb(nalus ...[]byte) []byte {
+	var b []byte
+	for _, n := range nalus {
+		b = append(b, startCode...)
+		b = append(b, n...)
+	}
+	return b
+}
+
+// 22 바이트 고정 필드 뒤에 NALU 배열을 하나씩 두는 hvcC
+func hvcc(nalus ...[]byte) []byte {
+	b := make([]byte, 22)
+	b[21] = 0x03 // lengthSizeMinusOne
+	b = append(b, byte(len(nalus)))
+	for _, n := range nalus {
+		b = append(b, naluType(n[0]), 0, 1, byte(len(n)>>8), byte(len(n)))
+		b = append(b, n...)
+	}
+	return b
+}
+
+var (
+	vps     = nalu(nalu_type_vps, 0x0a)
+	sps     = nalu(nalu_type_sps, 0x0b)
+	pps     = nalu(nalu_type_pps, 0x0c)
+	idr     = nalu(19, 0xaa)
+	cra     = nalu(21, 0xab)
+	trail   = nalu(1, 0xbb)
+	aud     = nalu(nalu_type_aud, 0x50)
+	bandVps = nalu(nalu_type_vps, 0x1a)
+	bandSps = nalu(nalu_type_sps, 0x1b)
+	bandPps = nalu(nalu_type_pps, 0x1c)
+)
+
+func TestGetAnnexbH265(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		want  []byte
+		err   error
+	}{
+		{"irap gets sequence params", avcc(idr), append(naluAud, annexb(vps, sps, pps, idr)...), nil},
+		{"cra is irap", avcc(cra), append(naluAud, annexb(vps, sps, pps, cra)...), nil},
+		{"inter frame", avcc(trail), append(naluAud, annexb(trail)...), nil},
+		{"in-band params", avcc(bandVps, bandSps, bandPps, idr), append(naluAud, annexb(bandVps, bandSps, bandPps, idr)...), nil},
+		{"aud dropped", avcc(aud, trail), append(naluAud, annexb(trail)...), nil},
+		{"params once", avcc(idr, idr), append(naluAud, annexb(vps, sps, pps, idr, idr)...), nil},
+		{"annex b passthrough", annexb(idr), annexb(idr), nil},
+		{"short frame", []byte{0, 0}, nil, videoDataInvalid},
+		{"truncated nalu", append(avcc(trail), 0, 0, 0, 9, 0x02), nil, naluBodyLenError},
+		{"zero length", []byte{0, 0, 0, 0}, nil, naluBodyLenError},
+	}
+	for _, test := range tests {
+		parser := NewParser()
+		if err := parser.Parse(hvcc(vps, sps, pps), true, nil); err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		err := parser.Parse(test.frame, false, &out)
+		if err != test.err {
+			t.Errorf("%s: err = %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if err == nil && !bytes.Equal(out.Bytes(), test.want) {
+			t.Errorf("%s:\n got %x\nwant %x", test.name, out.Bytes(), test.want)
+		}
+	}
+}
+
+func TestParseSpecificInfo(t *testing.T) {
+	tests := []struct {
+		name string
+		hvcc []byte
+		want []byte
+		err  error
+	}{
+		{"vps sps pps", hvcc(vps, sps, pps), annexb(vps, sps, pps), nil},
+		{"other arrays skipped", hvcc(vps, nalu(39, 0x01), sps, pps), annexb(vps, sps, pps), nil},
+		{"short", make([]byte, 10), nil, decDataNil},
+		{"truncated array", append(hvcc(vps)[:23], 0x20), nil, hvccDataError},
+		{"truncated nalu", hvcc(vps)[:27], nil, hvccDataError},
+	}
+	for _, test := range tests {
+		parser := NewParser()
+		err := parser.parseSpecificInfo(test.hvcc)
+		if err != test.err {
+			t.Errorf("%s: err = %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if err == nil && !bytes.Equal(parser.specificInfo, test.want) {
+			t.Errorf("%s: params = %x, want %x", test.name, parser.specificInfo, test.want)
+		}
+	}
+}
+
+func TestHasIRAP(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		want  bool
+	}{
+		{"idr", annexb(idr), true},
+		{"cra", annexb(cra), true},
+		{"bla", annexb(nalu(16)), true},
+		{"reserved irap", annexb(nalu(23)), true},
+		{"trail", annexb(trail), false},
+		{"params only", annexb(vps, sps, pps), false},
+		{"irap after aud and params", append(naluAud, annexb(vps, sps, pps, idr)...), true},
+		{"3 byte start code", append([]byte{0, 0, 1}, idr...), true},
+		{"start code at end", []byte{0xaa, 0, 0, 1}, false},
+		{"empty", nil, false},
+	}
+	for _, test := range tests {
+		if got := HasIRAP(test.frame); got != test.want {
+			t.Errorf("%s: HasIRAP = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
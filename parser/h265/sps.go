@@ -0,0 +1,92 @@
+package h265
+
+import (
+	"github.com/gwuhaolin/livego/utils/pio"
+)
+
+// HEVCDecoderConfigurationRecord(hvcC) 의 첫 SPS 에서 화면 크기를 읽는다.
+func Resolution(record []byte) (width, height int, err error) {
+	if len(record) < 23 {
+		return 0, 0, decDataNil
+	}
+	numArrays := int(record[22])
+	src := record[23:]
+	for i := 0; i < numArrays; i++ {
+		if len(src) < 3 {
+			return 0, 0, hvccDataError
+		}
+		nalType := src[0] & 0x3f
+		numNalus := int(src[1])<<8 | int(src[2])
+		src = src[3:]
+		for j := 0; j < numNalus; j++ {
+			if len(src) < 2 {
+				return 0, 0, hvccDataError
+			}
+			size := int(src[0])<<8 | int(src[1])
+			if len(src[2:]) < size || size <= 0 {
+				return 0, 0, hvccDataError
+			}
+			if nalType == nalu_type_sps {
+				return ParseSPS(src[2 : 2+size])
+			}
+			src = src[2+size:]
+		}
+	}
+	return 0, 0, hvccDataError
+}
+
+// SPS NALU 에서 conformance window 를 반영한 화면 크기를 읽는다.
+func ParseSPS(sps []byte) (width, height int, err error) {
+	if len(sps) < 3 || naluType(sps[0]) != nalu_type_sps {
+		return 0, 0, hvccDataError
+	}
+	r := pio.NewBitReader(pio.RBSP(sps[2:]))
+	r.Skip(4) // sps_video_parameter_set_id
+	maxSubLayersMinus1 := int(r.ReadBits(3))
+	r.Skip(1) // sps_temporal_id_nesting_flag
+
+	// profile_tier_level: general 프로파일 88 비트 + general_level_idc 8 비트
+	r.Skip(96)
+	profilePresent := make([]bool, maxSubLayersMinus1)
+	levelPresent := make([]bool, maxSubLayersMinus1)
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		profilePresent[i] = r.ReadBit() == 1
+		levelPresent[i] = r.ReadBit() == 1
+	}
+	if maxSubLayersMinus1 > 0 {
+		r.Skip(2 * (8 - maxSubLayersMinus1)) // reserved_zero_2bits
+	}
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		if profilePresent[i] {
+			r.Skip(88)
+		}
+		if levelPresent[i] {
+			r.Skip(8)
+		}
+	}
+
+	r.ReadUE() // sps_seq_parameter_set_id
+	chromaFormat := r.ReadUE()
+	if chromaFormat == 3 {
+		r.Skip(1) // separate_colour_plane_flag
+	}
+	width = int(r.ReadUE())
+	height = int(r.ReadUE())
+	if r.ReadBit() == 1 {
+		left, right := int(r.ReadUE()), int(r.ReadUE())
+		top, bottom := int(r.ReadUE()), int(r.ReadUE())
+		subWidth, subHeight := 1, 1
+		switch chromaFormat {
+		case 1:
+			subWidth, subHeight = 2, 2
+		case 2:
+			subWidth = 2
+		}
+		width -= subWidth * (left + right)
+		height -= subHeight * (top + bottom)
+	}
+	if r.Overflow || width <= 0 || height <= 0 {
+		return 0, 0, hvccDataError
+	}
+	return width, height, nil
+}
@@ -7,6 +7,7 @@ import (
 // 샘플링 주기.
 type Parser struct {
 	samplingFrequency int
+	samplesPerFrame   int // 프레임 하나의 샘플 수. MPEG 버전과 레이어에 따라 다르다.
 }
 
 // 생성 함수.
@@ -37,6 +38,23 @@ func (parser *Parser) Parse(src []byte) error {
 	if index <= byte(len(mp3Rates)-1) {
 		// 2비트만 예약되어있다. 2비트를 넘어갈시 에러 출력
 		parser.samplingFrequency = mp3Rates[index]
+		parser.samplesPerFrame = 1152
+		// 2번째 바이트의 버전(MPEG-1, 2, 2.5)과 레이어. MPEG-2, 2.5 는 샘플링 주파수가 1/2, 1/4 이다.
+		if src[0] == 0xff && src[1]&0xe0 == 0xe0 {
+			version, layer := (src[1]>>3)&0x3, (src[1]>>1)&0x3
+			switch version {
+			case 0: // MPEG-2.5
+				parser.samplingFrequency /= 4
+			case 2: // MPEG-2
+				parser.samplingFrequency /= 2
+			}
+			switch {
+			case layer == 3: // Layer I
+				parser.samplesPerFrame = 384
+			case layer == 1 && version != 3: // MPEG-2, 2.5 Layer III
+				parser.samplesPerFrame = 576
+			}
+		}
 		return nil
 	}
 	return errIndexInvalid
@@ -49,3 +67,11 @@ func (parser *Parser) SampleRate() int {
 	}
 	return parser.samplingFrequency
 }
+
+// 프레임 하나의 샘플 수. 디폴트 1152(MPEG-1 Layer III)를 반환.
+func (parser *Parser) SamplesPerFrame() int {
+	if parser.samplesPerFrame == 0 {
+		parser.samplesPerFrame = 1152
+	}
+	return parser.samplesPerFrame
+}
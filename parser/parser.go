@@ -7,6 +7,7 @@ import (
 	"github.com/gwuhaolin/livego/av"
 	"github.com/gwuhaolin/livego/parser/aac"
 	"github.com/gwuhaolin/livego/parser/h264"
+	"github.com/gwuhaolin/livego/parser/h265"
 	"github.com/gwuhaolin/livego/parser/mp3"
 )
 
@@ -14,10 +15,13 @@ var (
 	errNoAudio = fmt.Errorf("demuxer no audio")
 )
 
+const aacSamplesPerFrame = 1024
+
 type CodecParser struct {
 	aac  *aac.Parser
 	mp3  *mp3.Parser
 	h264 *h264.Parser
+	h265 *h265.Parser
 }
 
 func NewCodecParser() *CodecParser {
@@ -34,17 +38,34 @@ func (codeParser *CodecParser) SampleRate() (int, error) {
 	return codeParser.mp3.SampleRate(), nil
 }
 
+// 오디오 프레임 하나의 샘플 수. AAC 는 1024 이다.
+func (codeParser *CodecParser) SamplesPerFrame() (int, error) {
+	if codeParser.aac == nil && codeParser.mp3 == nil {
+		return 0, errNoAudio
+	}
+	if codeParser.aac != nil {
+		return aacSamplesPerFrame, nil
+	}
+	return codeParser.mp3.SamplesPerFrame(), nil
+}
+
 func (codeParser *CodecParser) Parse(p *av.Packet, w io.Writer) (err error) {
 
 	switch p.IsVideo {
 	case true:
 		f, ok := p.Header.(av.VideoPacketHeader)
 		if ok {
-			if f.CodecID() == av.VIDEO_H264 {
+			switch f.CodecID() {
+			case av.VIDEO_H264:
 				if codeParser.h264 == nil {
 					codeParser.h264 = h264.NewParser()
 				}
 				err = codeParser.h264.Parse(p.Data, f.IsSeq(), w)
+			case av.VIDEO_HEVC:
+				if codeParser.h265 == nil {
+					codeParser.h265 = h265.NewParser()
+				}
+				err = codeParser.h265.Parse(p.Data, f.IsSeq(), w)
 			}
 		}
 	case false:
@@ -60,7 +81,10 @@ func (codeParser *CodecParser) Parse(p *av.Packet, w io.Writer) (err error) {
 				if codeParser.mp3 == nil {
 					codeParser.mp3 = mp3.NewParser()
 				}
-				err = codeParser.mp3.Parse(p.Data)
+				// MP3 프레임은 헤더를 갖고 있으므로 그대로 쓴다.
+				if err = codeParser.mp3.Parse(p.Data); err == nil {
+					_, err = w.Write(p.Data)
+				}
 			}
 		}
 
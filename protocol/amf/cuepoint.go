@@ -0,0 +1,103 @@
+package amf
+
+import (
+	"bytes"
+	"strings"
+)
+
+const OnCuePoint string = "onCuePoint"
+
+/*
+광고 구간(SCTE-35 splice)을 알리는 onCuePoint 데이터 메시지.
+API 로 넣은 큐와 퍼블리셔가 보낸 큐를 같은 형식으로 다룬다.
+
+	onCuePoint {name: "splice", type: "event", time: <초>, parameters: {cue: "out"|"in", id: <ID>, duration: <초>}}
+
+퍼블리셔가 보낸 큐는 parameters.cue 가 없으면 type/name 의 "out", "cue-out", "spliceOut" 등으로 방향을 정한다.
+*/
+type CuePoint struct {
+	ID       uint32 // splice_event_id
+	Out      bool   // true 면 광고 시작(CUE-OUT), false 면 본방송 복귀(CUE-IN)
+	Time     uint32 // 스플라이스 지점의 스트림 타임스탬프(ms)
+	Duration uint32 // 광고 길이(ms). 0 이면 CUE-IN 을 따로 받을 때까지 광고가 이어진다.
+}
+
+func EncodeCuePoint(cue CuePoint) []byte {
+	dir := "in"
+	if cue.Out {
+		dir = "out"
+	}
+	b := bytes.NewBuffer(nil)
+	encoder := &Encoder{}
+	encoder.EncodeBatch(b, AMF0, OnCuePoint, Object{
+		"name": "splice",
+		"type": "event",
+		"time": float64(cue.Time) / 1000,
+		"parameters": Object{
+			"cue":      dir,
+			"id":       float64(cue.ID),
+			"duration": float64(cue.Duration) / 1000,
+		},
+	})
+	return b.Bytes()
+}
+
+// AMF0 데이터 메시지가 onCuePoint 면 큐로 읽는다. ts 는 메시지의 타임스탬프로, time 이 없을 때 스플라이스 지점이 된다.
+func DecodeCuePoint(b []byte, ts uint32) (CuePoint, bool) {
+	vs, _ := NewDecoder().DecodeBatch(bytes.NewReader(b), AMF0)
+	if len(vs) > 0 && vs[0] == SetDataFrame {
+		vs = vs[1:]
+	}
+	if len(vs) < 2 || vs[0] != OnCuePoint {
+		return CuePoint{}, false
+	}
+	obj, ok := vs[1].(Object)
+	if !ok {
+		return CuePoint{}, false
+	}
+	params, _ := obj["parameters"].(Object)
+	if params == nil {
+		params = Object{}
+	}
+
+	cue := CuePoint{Time: ts}
+	dir, _ := params["cue"].(string)
+	if dir == "" {
+		dir, _ = obj["type"].(string)
+	}
+	if dir == "" || dir == "event" {
+		dir, _ = obj["name"].(string)
+	}
+	dir = strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(dir), "cue-"), "splice")
+	switch dir {
+	case "out":
+		cue.Out = true
+	case "in":
+	default:
+		return CuePoint{}, false
+	}
+	if v, ok := params["id"].(float64); ok {
+		cue.ID = uint32(v)
+	}
+	if v, ok := params["duration"].(float64); ok && v > 0 {
+		cue.Duration = uint32(v * 1000)
+	} else if v, ok := obj["duration"].(float64); ok && v > 0 {
+		cue.Duration = uint32(v * 1000)
+	}
+	if v, ok := obj["time"].(float64); ok && v > 0 {
+		cue.Time = uint32(v * 1000)
+	}
+	return cue, true
+}
+
+// AMF0 데이터 메시지의 이벤트 이름(onMetaData, onCuePoint 등). @setDataFrame 은 건너뛴다.
+func DataEventName(b []byte) string {
+	d := NewDecoder()
+	r := bytes.NewReader(b)
+	v, _ := d.Decode(r, AMF0)
+	if v == SetDataFrame {
+		v, _ = d.Decode(r, AMF0)
+	}
+	name, _ := v.(string)
+	return name
+}
@@ -5,11 +5,19 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gwuhaolin/livego/av"
 	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/protocol/amf"
+	"github.com/gwuhaolin/livego/protocol/auth"
+	"github.com/gwuhaolin/livego/protocol/event"
+	"github.com/gwuhaolin/livego/protocol/hls"
 	"github.com/gwuhaolin/livego/protocol/rtmp"
 	"github.com/gwuhaolin/livego/protocol/rtmp/rtmprelay"
+	"github.com/gwuhaolin/livego/protocol/webrtc"
 
 	jwtmiddleware "github.com/auth0/go-jwt-middleware"
 	"github.com/dgrijalva/jwt-go"
@@ -52,13 +60,15 @@ type Server struct {
 	handler  av.Handler
 	session  map[string]*rtmprelay.RtmpRelay
 	rtmpAddr string
+	webrtc   *webrtc.Server // WebRTC 가 비활성화된 앱에서는 nil 이다.
 }
 
-func NewServer(h av.Handler, rtmpAddr string) *Server {
+func NewServer(h av.Handler, rtmpAddr string, webrtcServer *webrtc.Server) *Server {
 	return &Server{
 		handler:  h,
 		session:  make(map[string]*rtmprelay.RtmpRelay),
 		rtmpAddr: rtmpAddr,
+		webrtc:   webrtcServer,
 	}
 }
 
@@ -120,9 +130,33 @@ func (s *Server) Serve(l net.Listener) error {
 	mux.HandleFunc("/control/delete", func(w http.ResponseWriter, r *http.Request) {
 		s.handleDelete(w, r)
 	})
+	mux.HandleFunc("/control/message", func(w http.ResponseWriter, r *http.Request) {
+		s.handleMessage(w, r)
+	})
+	mux.HandleFunc("/control/rendition", func(w http.ResponseWriter, r *http.Request) {
+		s.handleRendition(w, r)
+	})
+	mux.HandleFunc("/control/cue", func(w http.ResponseWriter, r *http.Request) {
+		s.handleCue(w, r)
+	})
+	mux.HandleFunc("/control/sign", func(w http.ResponseWriter, r *http.Request) {
+		s.handleSign(w, r)
+	})
+	mux.HandleFunc("/control/keytoken", func(w http.ResponseWriter, r *http.Request) {
+		s.handleKeyToken(w, r)
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		s.handleEvents(w, r)
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		s.handleMetrics(w, r)
+	})
 	mux.HandleFunc("/stat/livestat", func(w http.ResponseWriter, r *http.Request) {
 		s.GetLiveStatics(w, r)
 	})
+	mux.HandleFunc("/stat/webrtc", func(w http.ResponseWriter, r *http.Request) {
+		s.GetWebRTCSessions(w, r)
+	})
 	http.Serve(l, JWTMiddleware(mux))
 	return nil
 }
@@ -194,6 +228,11 @@ func (server *Server) GetLiveStatics(w http.ResponseWriter, req *http.Request) {
 							msg := stream{key.(string), v.Info().URL, v.WriteBWInfo.StreamId, v.WriteBWInfo.VideoDatainBytes, v.WriteBWInfo.VideoSpeedInBytesperMS,
 								v.WriteBWInfo.AudioDatainBytes, v.WriteBWInfo.AudioSpeedInBytesperMS}
 							msgs.Players = append(msgs.Players, msg)
+						case *webrtc.Writer:
+							v := pw.GetWriter().(*webrtc.Writer)
+							msg := stream{key.(string), v.Info().URL, v.WriteBWInfo.StreamId, v.WriteBWInfo.VideoDatainBytes, v.WriteBWInfo.VideoSpeedInBytesperMS,
+								v.WriteBWInfo.AudioDatainBytes, v.WriteBWInfo.AudioSpeedInBytesperMS}
+							msgs.Players = append(msgs.Players, msg)
 						}
 					}
 				}
@@ -230,6 +269,11 @@ func (server *Server) GetLiveStatics(w http.ResponseWriter, req *http.Request) {
 							msg := stream{room, v.Info().URL, v.WriteBWInfo.StreamId, v.WriteBWInfo.VideoDatainBytes, v.WriteBWInfo.VideoSpeedInBytesperMS,
 								v.WriteBWInfo.AudioDatainBytes, v.WriteBWInfo.AudioSpeedInBytesperMS}
 							msgs.Players = append(msgs.Players, msg)
+						case *webrtc.Writer:
+							v := pw.GetWriter().(*webrtc.Writer)
+							msg := stream{room, v.Info().URL, v.WriteBWInfo.StreamId, v.WriteBWInfo.VideoDatainBytes, v.WriteBWInfo.VideoSpeedInBytesperMS,
+								v.WriteBWInfo.AudioDatainBytes, v.WriteBWInfo.AudioSpeedInBytesperMS}
+							msgs.Players = append(msgs.Players, msg)
 						}
 					}
 				}
@@ -242,6 +286,83 @@ func (server *Server) GetLiveStatics(w http.ResponseWriter, req *http.Request) {
 	res.Data = msgs
 }
 
+// http://127.0.0.1:8090/stat/webrtc?id=xxx
+func (s *Server) GetWebRTCSessions(w http.ResponseWriter, req *http.Request) {
+	res := &Response{
+		w:      w,
+		Data:   nil,
+		Status: 200,
+	}
+
+	defer res.SendJson()
+
+	if s.webrtc == nil {
+		res.Status = 404
+		res.Data = "webrtc is not enabled"
+		return
+	}
+
+	id := ""
+	if err := req.ParseForm(); err == nil {
+		id = req.Form.Get("id")
+	}
+
+	sessions := s.webrtc.Sessions()
+	if id == "" {
+		res.Data = sessions
+		return
+	}
+	for _, session := range sessions {
+		if session.ID == id {
+			res.Data = session
+			return
+		}
+	}
+	res.Status = 404
+	res.Data = "session not found"
+}
+
+// http://127.0.0.1:8090/control/message?room=live/movie&text=hello
+// WebRTC 데이터 채널 방(app/name)에 서버 공지를 보낸다.
+func (s *Server) handleMessage(w http.ResponseWriter, r *http.Request) {
+	res := &Response{
+		w:      w,
+		Data:   nil,
+		Status: 200,
+	}
+	defer res.SendJson()
+
+	if s.webrtc == nil {
+		res.Status = 404
+		res.Data = "webrtc is not enabled"
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		res.Status = 400
+		res.Data = "url: /control/message?room=<APP>/<NAME>&text=<TEXT>"
+		return
+	}
+
+	room := r.Form.Get("room")
+	text := r.Form.Get("text")
+	if len(room) == 0 || len(text) == 0 {
+		res.Status = 400
+		res.Data = "url: /control/message?room=<APP>/<NAME>&text=<TEXT>"
+		return
+	}
+
+	if err := s.webrtc.PostMessage(room, text); err != nil {
+		res.Status = 400
+		if err == webrtc.ErrRoomNotFound {
+			res.Status = 404
+		}
+		res.Data = err.Error()
+		return
+	}
+	res.Data = "Ok"
+}
+
 // http://127.0.0.1:8090/control/pull?&oper=start&app=live&name=123456&url=rtmp://192.168.16.136/live/123456
 func (s *Server) handlePull(w http.ResponseWriter, req *http.Request) {
 	var retString string
@@ -401,6 +522,16 @@ func (s *Server) handleReset(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		msg = err.Error()
 		res.Status = 400
+	} else {
+		// 채널 키는 앱 구분 없이 쓰이므로 라이브 앱마다 그 앱의 스트림 키로 알린다. 새 키는 이벤트에 싣지 않는다.
+		for _, app := range configure.GetApplications() {
+			if !app.Live {
+				continue
+			}
+			e := event.New(event.KeyReset, app.Appname+"/"+room, "")
+			e.Data = map[string]interface{}{"room": room}
+			event.Publish(e)
+		}
 	}
 
 	res.Data = msg
@@ -437,6 +568,90 @@ func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
 	res.Data = msg
 }
 
+var errInvalidSignRequest = fmt.Errorf("invalid room or ttl")
+
+// /control/sign 과 /control/keytoken 의 room 과 ttl(초)을 읽는다. ttl 이 없으면 1시간 뒤에 만료된다. expires 는 UNIX 초이다.
+func parseSignRequest(r *http.Request) (room string, expires int64, err error) {
+	if err = r.ParseForm(); err != nil {
+		return
+	}
+	room = r.Form.Get("room")
+	ttl := 3600
+	if v := r.Form.Get("ttl"); v != "" {
+		if ttl, err = strconv.Atoi(v); err != nil {
+			return
+		}
+	}
+	if len(strings.Split(room, "/")) != 2 || ttl <= 0 {
+		err = errInvalidSignRequest
+		return
+	}
+	expires = time.Now().Add(time.Duration(ttl) * time.Second).Unix()
+	return
+}
+
+// http://127.0.0.1:8090/control/sign?room=live/movie&ttl=3600
+// 재생 URL 서명을 만든다. ttl(초)이 없으면 1시간 동안 유효하며, 재생 URL 뒤에 query 를 붙이면 된다.
+func (s *Server) handleSign(w http.ResponseWriter, r *http.Request) {
+	res := &Response{
+		w:      w,
+		Data:   nil,
+		Status: 200,
+	}
+	defer res.SendJson()
+
+	usage := "url: /control/sign?room=<APP>/<NAME>[&ttl=<SEC>]"
+	room, expires, err := parseSignRequest(r)
+	if err != nil {
+		res.Status = 400
+		res.Data = usage
+		return
+	}
+
+	sign, err := auth.SignPlay(room, time.Unix(expires, 0))
+	if err != nil {
+		res.Status = 400
+		res.Data = err.Error()
+		return
+	}
+	res.Data = map[string]interface{}{
+		"expires": expires,
+		"sign":    sign,
+		"query":   fmt.Sprintf("expires=%d&sign=%s", expires, sign),
+	}
+}
+
+// http://127.0.0.1:8090/control/keytoken?room=live/movie&ttl=3600
+// 암호화한 HLS 스트림의 키 요청 토큰을 만든다. ttl(초)이 없으면 1시간 동안 유효하며, 플레이리스트 URL 뒤에 query 를 붙이면 키 URI 에도 전달된다.
+func (s *Server) handleKeyToken(w http.ResponseWriter, r *http.Request) {
+	res := &Response{
+		w:      w,
+		Data:   nil,
+		Status: 200,
+	}
+	defer res.SendJson()
+
+	usage := "url: /control/keytoken?room=<APP>/<NAME>[&ttl=<SEC>]"
+	room, expires, err := parseSignRequest(r)
+	if err != nil {
+		res.Status = 400
+		res.Data = usage
+		return
+	}
+
+	token, err := hls.SignKeyToken(room, time.Unix(expires, 0))
+	if err != nil {
+		res.Status = 400
+		res.Data = err.Error()
+		return
+	}
+	res.Data = map[string]interface{}{
+		"expires": expires,
+		"token":   token,
+		"query":   fmt.Sprintf("expires=%d&token=%s", expires, token),
+	}
+}
+
 // http://127.0.0.1:8090/control/delete?room=ROOM_NAME
 func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
 	res := &Response{
@@ -467,3 +682,126 @@ func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
 	res.Status = 404
 	res.Data = "room not found"
 }
+
+// http://127.0.0.1:8090/control/rendition?oper=set&name=live/show&keys=live/show_1080,live/show_720
+// 화질별 스트림 키를 렌디션 묶음으로 묶는다. 묶음 이름으로 HLS 마스터 플레이리스트와 DASH MPD 를 받을 수 있다.
+// oper=get 은 name 이 없으면 모든 묶음을, oper=delete 는 묶음을 지운다.
+func (s *Server) handleRendition(w http.ResponseWriter, r *http.Request) {
+	res := &Response{
+		w:      w,
+		Data:   nil,
+		Status: 200,
+	}
+	defer res.SendJson()
+
+	usage := "url: /control/rendition?oper=set|get|delete&name=<APP>/<NAME>[&keys=<APP>/<NAME>,...]"
+	if err := r.ParseForm(); err != nil {
+		res.Status = 400
+		res.Data = usage
+		return
+	}
+	name := r.Form.Get("name")
+
+	switch r.Form.Get("oper") {
+	case "set":
+		var keys []string
+		if v := r.Form.Get("keys"); v != "" {
+			keys = strings.Split(v, ",")
+		}
+		if err := configure.Renditions.Set(name, keys); err != nil {
+			res.Status = 400
+			res.Data = err.Error()
+			return
+		}
+		res.Data = "Ok"
+	case "get":
+		if name == "" {
+			res.Data = configure.Renditions.All()
+			return
+		}
+		keys, ok := configure.Renditions.Get(name)
+		if !ok {
+			res.Status = 404
+			res.Data = "rendition set not found"
+			return
+		}
+		res.Data = configure.RenditionSet{Name: name, Keys: keys}
+	case "delete":
+		if !configure.Renditions.Delete(name) {
+			res.Status = 404
+			res.Data = "rendition set not found"
+			return
+		}
+		res.Data = "Ok"
+	default:
+		res.Status = 400
+		res.Data = usage
+	}
+}
+
+// http://127.0.0.1:8090/control/cue?room=live/movie&duration=30[&type=out|in][&at=<MS>][&id=<ID>]
+// 광고 구간(SCTE-35 splice)을 예약한다. at 이 없으면 바로, 있으면 그 스트림 타임스탬프(ms)에서 시작한다.
+// HLS 는 그 지점에서 세그먼트를 자르고 광고 태그를 쓰며, RTMP/HTTP-FLV 시청자는 onCuePoint 데이터 메시지를 받는다.
+func (s *Server) handleCue(w http.ResponseWriter, r *http.Request) {
+	res := &Response{
+		w:      w,
+		Data:   nil,
+		Status: 200,
+	}
+	defer res.SendJson()
+
+	usage := "url: /control/cue?room=<APP>/<NAME>[&type=out|in][&duration=<SEC>][&at=<MS>][&id=<ID>]"
+	if err := r.ParseForm(); err != nil {
+		res.Status = 400
+		res.Data = usage
+		return
+	}
+	room := r.Form.Get("room")
+	cue := amf.CuePoint{
+		ID:  uint32(time.Now().UnixNano() / 1e6),
+		Out: r.Form.Get("type") != "in",
+	}
+	var err error
+	if v := r.Form.Get("id"); v != "" {
+		var id uint64
+		id, err = strconv.ParseUint(v, 10, 32)
+		cue.ID = uint32(id)
+	}
+	if v := r.Form.Get("duration"); v != "" && err == nil {
+		var d float64
+		d, err = strconv.ParseFloat(v, 64)
+		cue.Duration = uint32(d * 1000)
+	}
+	if v := r.Form.Get("at"); v != "" && err == nil {
+		var at uint64
+		at, err = strconv.ParseUint(v, 10, 32)
+		cue.Time = uint32(at)
+	}
+	if len(room) == 0 || err != nil {
+		res.Status = 400
+		res.Data = usage
+		return
+	}
+
+	rtmpStream, ok := s.handler.(*rtmp.RtmpStream)
+	if !ok {
+		res.Status = 500
+		res.Data = "Get rtmp stream information error"
+		return
+	}
+	if err := rtmpStream.InjectCue(room, cue); err != nil {
+		res.Status = 404
+		res.Data = err.Error()
+		return
+	}
+	cueType := "out"
+	if !cue.Out {
+		cueType = "in"
+	}
+	res.Data = map[string]interface{}{
+		"id":       cue.ID,
+		"type":     cueType,
+		"duration": cue.Duration,
+		"at":       cue.Time,
+	}
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gwuhaolin/livego/protocol/event"
+
+	"golang.org/x/net/websocket"
+)
+
+// SSE 연결을 프록시가 끊지 않도록 보내는 주석 줄의 간격
+const eventKeepAlive = 15 * time.Second
+
+// ?key=<APP>/<NAME>&type=<TYPE>,<TYPE> 로 받을 이벤트를 거른다. 비어 있으면 모두 받는다.
+type eventFilter struct {
+	key   string
+	types map[string]bool
+}
+
+func newEventFilter(r *http.Request) eventFilter {
+	filter := eventFilter{key: r.URL.Query().Get("key")}
+	if v := r.URL.Query().Get("type"); v != "" {
+		filter.types = map[string]bool{}
+		for _, t := range strings.Split(v, ",") {
+			filter.types[t] = true
+		}
+	}
+	return filter
+}
+
+func (filter eventFilter) match(e event.Event) bool {
+	if filter.key != "" && e.Key != filter.key {
+		return false
+	}
+	return filter.types == nil || filter.types[e.Type]
+}
+
+// http://127.0.0.1:8090/events[?key=live/movie][&type=publish_start,publish_stop]
+// 스트림 수명 주기 이벤트를 Server-Sent Events 로 보낸다. event 필드는 이벤트 종류, data 필드는 JSON 이다.
+// WebSocket 업그레이드 요청이면 이벤트마다 JSON 텍스트 프레임 하나를 보낸다.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	filter := newEventFilter(r)
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		websocket.Server{Handler: func(conn *websocket.Conn) {
+			serveEventSocket(conn, filter)
+		}}.ServeHTTP(w, r)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch := event.Default.Subscribe()
+	defer event.Default.Unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e := <-ch:
+			if !filter.match(e) {
+				continue
+			}
+			data, _ := json.Marshal(e)
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func serveEventSocket(conn *websocket.Conn, filter eventFilter) {
+	ch := event.Default.Subscribe()
+	defer event.Default.Unsubscribe(ch)
+
+	// 클라이언트가 보내는 메시지는 버리고, 연결이 끊기면 끝낸다.
+	done := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(done)
+	}()
+	for {
+		select {
+		case e := <-ch:
+			if !filter.match(e) {
+				continue
+			}
+			if err := websocket.JSON.Send(conn, e); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
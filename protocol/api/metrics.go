@@ -0,0 +1,45 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gwuhaolin/livego/protocol/event"
+	"github.com/gwuhaolin/livego/protocol/metrics"
+	"github.com/gwuhaolin/livego/protocol/rtmp"
+)
+
+// http://127.0.0.1:8090/metrics
+// Prometheus 텍스트 형식으로 스트림별, 프로토콜별 메트릭을 보낸다.
+// 퍼블리셔와 시청자 수는 이벤트 버스에 열려 있는 세션으로, GOP 캐시 크기는 스트림의 캐시로 센다.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	publishers := metrics.NewGauge(metrics.Publishers)
+	viewers := metrics.NewGauge(metrics.Viewers)
+	for _, e := range event.Default.Sessions() {
+		switch e.Type {
+		case event.PublishStart:
+			publishers.Add(e.Key, "", 1)
+		case event.PlayerJoin:
+			viewers.Add(e.Key, e.Protocol, 1)
+		}
+	}
+
+	gopPackets := metrics.NewGauge(metrics.GOPCachePackets)
+	gopBytes := metrics.NewGauge(metrics.GOPCacheBytes)
+	if rtmpStream, ok := s.handler.(*rtmp.RtmpStream); ok {
+		rtmpStream.GetStreams().Range(func(key, val interface{}) bool {
+			if stream, ok := val.(*rtmp.Stream); ok && stream.GetReader() != nil {
+				packets, bytes := stream.GetCache().GopSize()
+				gopPackets.Add(key.(string), "", int64(packets))
+				gopBytes.Add(key.(string), "", int64(bytes))
+			}
+			return true
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	publishers.Export(w)
+	viewers.Export(w)
+	gopPackets.Export(w)
+	gopBytes.Export(w)
+	metrics.Default.Export(w)
+}
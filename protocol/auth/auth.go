@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gwuhaolin/livego/configure"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+/*
+재생 인증
+RTMP play, HTTP-FLV, HLS, WebRTC(WHEP) 시청자의 재생 요청을 앱의 play_auth 정책으로 확인한다.
+
+  ""      인증하지 않는다.
+  "sign"  ?expires=<UNIX>&sign=<HEX>   HEX = hex(HMAC-SHA256(secret, "<APP>/<NAME>:<UNIX>"))
+  "jwt"   ?jwt=<JWT> 또는 Authorization: Bearer <JWT>. stream 클레임이 있으면 "<APP>/<NAME>" 과 같아야 한다.
+  "any"   sign, jwt 중 하나
+
+secret 은 앱의 play_secret 이며, 비어 있으면 jwt.secret 을 쓴다. 정책이 있는데 비밀키가 없으면 재생을 허용하지 않는다.
+RTMP 는 tcUrl 의 앱 이름이나 play 명령의 스트림 이름 뒤에 쿼리를 붙인다. rtmp://host/live/movie?expires=<UNIX>&sign=<HEX>
+*/
+
+var (
+	ErrPlayDenied   = fmt.Errorf("play not authorized")
+	ErrNoPlaySecret = fmt.Errorf("play secret is not configured")
+)
+
+// 재생 인증에 쓰는 쿼리 파라미터
+var PlayParams = []string{"jwt", "expires", "sign"}
+
+// stream 에 대해 expires 까지 유효한 HMAC-SHA256 서명을 만든다.
+func Sign(secret, stream string, expires time.Time) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s:%d", stream, expires.Unix())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sign 으로 만든 서명과 만료 시각(UNIX 초 문자열)을 확인한다.
+func VerifySign(secret, stream, sign, expires string) error {
+	if secret == "" || sign == "" {
+		return ErrPlayDenied
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return ErrPlayDenied
+	}
+	sig, err := hex.DecodeString(sign)
+	if err != nil {
+		return ErrPlayDenied
+	}
+	expected, _ := hex.DecodeString(Sign(secret, stream, time.Unix(unix, 0)))
+	if !hmac.Equal(sig, expected) {
+		return ErrPlayDenied
+	}
+	return nil
+}
+
+// jwt.algorithm 으로 서명한 JWT 를 확인한다. stream 클레임이 있으면 stream 과 같아야 한다.
+func VerifyJWT(secret, tokenString, stream string) error {
+	if secret == "" || tokenString == "" {
+		return ErrPlayDenied
+	}
+	algorithm := jwt.GetSigningMethod(configure.Config.GetString("jwt.algorithm"))
+	if algorithm == nil {
+		algorithm = jwt.SigningMethodHS256
+	}
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if token.Method.Alg() != algorithm.Alg() {
+			return nil, ErrPlayDenied
+		}
+		return []byte(secret), nil
+	})
+	if err != nil || !token.Valid {
+		return ErrPlayDenied
+	}
+	if claims, ok := token.Claims.(jwt.MapClaims); ok {
+		if v, ok := claims["stream"]; ok && v != stream {
+			return ErrPlayDenied
+		}
+	}
+	return nil
+}
+
+// 스트림 키(<APP>/<NAME>)가 속한 앱의 재생 인증 정책과 비밀키
+func playPolicy(stream string) (policy, secret string) {
+	app, _ := configure.GetApplication(strings.SplitN(stream, "/", 2)[0])
+	secret = app.PlaySecret
+	if secret == "" {
+		secret = configure.Config.GetString("jwt.secret")
+	}
+	return app.PlayAuth, secret
+}
+
+// 스트림 키에 대해 expires 까지 유효한 재생 URL 서명을 만든다.
+func SignPlay(stream string, expires time.Time) (string, error) {
+	_, secret := playPolicy(stream)
+	if secret == "" {
+		return "", ErrNoPlaySecret
+	}
+	return Sign(secret, stream, expires), nil
+}
+
+// 쿼리의 재생 URL 서명이 스트림 키에 대해 유효한지 확인한다.
+func VerifyPlaySign(stream string, query url.Values) error {
+	_, secret := playPolicy(stream)
+	return VerifySign(secret, stream, query.Get("sign"), query.Get("expires"))
+}
+
+// 요청 쿼리의 재생 토큰(PlayParams)을 stream 의 URL 에 붙일 쿼리로 만든다. from 은 요청한 스트림 키이다.
+// 서명은 스트림에 묶여 있으므로 다른 스트림(같은 묶음의 렌디션)이면 요청의 서명이 유효할 때만 그 스트림의 서명을 새로 만들어 붙인다.
+func PlayQuery(query url.Values, from, stream string) url.Values {
+	v := url.Values{}
+	for _, name := range PlayParams {
+		if query.Get(name) != "" {
+			v.Set(name, query.Get(name))
+		}
+	}
+	if stream != from && v.Get("sign") != "" {
+		v.Del("sign")
+		if VerifyPlaySign(from, query) == nil {
+			expires, _ := strconv.ParseInt(query.Get("expires"), 10, 64)
+			if sign, err := SignPlay(stream, time.Unix(expires, 0)); err == nil {
+				v.Set("sign", sign)
+			}
+		}
+	}
+	return v
+}
+
+// 스트림 키의 재생 요청을 앱의 정책으로 확인한다. bearer 는 Authorization 헤더의 토큰이며 없으면 "" 이다.
+func CheckPlay(stream string, query url.Values, bearer string) error {
+	policy, secret := playPolicy(stream)
+	if policy == "" {
+		return nil
+	}
+	if secret == "" {
+		return ErrNoPlaySecret
+	}
+	tokenString := query.Get("jwt")
+	if tokenString == "" {
+		tokenString = bearer
+	}
+	switch policy {
+	case configure.PlayAuthSign:
+		return VerifySign(secret, stream, query.Get("sign"), query.Get("expires"))
+	case configure.PlayAuthJWT:
+		return VerifyJWT(secret, tokenString, stream)
+	case configure.PlayAuthAny:
+		if VerifySign(secret, stream, query.Get("sign"), query.Get("expires")) == nil {
+			return nil
+		}
+		return VerifyJWT(secret, tokenString, stream)
+	}
+	return ErrPlayDenied
+}
+
+// HTTP 재생 요청을 확인한다. 쿼리와 Authorization: Bearer 헤더를 읽는다.
+func CheckPlayRequest(r *http.Request, stream string) error {
+	bearer := ""
+	if v := r.Header.Get("Authorization"); strings.HasPrefix(v, "Bearer ") {
+		bearer = strings.TrimPrefix(v, "Bearer ")
+	}
+	return CheckPlay(stream, r.URL.Query(), bearer)
+}
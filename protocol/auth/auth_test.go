@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/configure"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const testSecret = "secret"
+
+// 앱마다 재생 인증 정책을 달리 둔다. own 앱만 play_secret 을 따로 쓴다. 돌려준 함수로 설정을 되돌린다.
+func setPlayAuth() (restore func()) {
+	server := configure.Config.Get("server")
+	jwtSecret := configure.Config.GetString("jwt.secret")
+	restore = func() {
+		configure.Config.Set("server", server)
+		configure.Config.Set("jwt.secret", jwtSecret)
+		configure.InvalidateApplications()
+	}
+	configure.Config.Set("jwt.secret", testSecret)
+	configure.Config.Set("server", []map[string]interface{}{
+		{"appname": "open", "live": true},
+		{"appname": "sign", "live": true, "play_auth": configure.PlayAuthSign},
+		{"appname": "jwt", "live": true, "play_auth": configure.PlayAuthJWT},
+		{"appname": "any", "live": true, "play_auth": configure.PlayAuthAny},
+		{"appname": "own", "live": true, "play_auth": configure.PlayAuthSign, "play_secret": "own"},
+	})
+	configure.InvalidateApplications()
+	return restore
+}
+
+func signQuery(secret, stream string, expires time.Time) url.Values {
+	return url.Values{
+		"expires": {fmt.Sprint(expires.Unix())},
+		"sign":    {Sign(secret, stream, expires)},
+	}
+}
+
+func signJWT(t *testing.T, secret string, method jwt.SigningMethod, claims jwt.MapClaims) string {
+	token, err := jwt.NewWithClaims(method, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestVerifySign(t *testing.T) {
+	expires := time.Now().Add(time.Hour)
+	sign := Sign(testSecret, "live/movie", expires)
+	tests := []struct {
+		name    string
+		secret  string
+		stream  string
+		sign    string
+		expires string
+		ok      bool
+	}{
+		{"valid", testSecret, "live/movie", sign, fmt.Sprint(expires.Unix()), true},
+		{"other stream", testSecret, "live/other", sign, fmt.Sprint(expires.Unix()), false},
+		{"other secret", "other", "live/movie", sign, fmt.Sprint(expires.Unix()), false},
+		{"changed expires", testSecret, "live/movie", sign, fmt.Sprint(expires.Unix() + 1), false},
+		{"expired", testSecret, "live/movie", Sign(testSecret, "live/movie", time.Unix(1, 0)), "1", false},
+		{"bad expires", testSecret, "live/movie", sign, "soon", false},
+		{"bad hex", testSecret, "live/movie", "xyz", fmt.Sprint(expires.Unix()), false},
+		{"no sign", testSecret, "live/movie", "", fmt.Sprint(expires.Unix()), false},
+		{"no secret", "", "live/movie", Sign("", "live/movie", expires), fmt.Sprint(expires.Unix()), false},
+	}
+	for _, test := range tests {
+		if err := VerifySign(test.secret, test.stream, test.sign, test.expires); (err == nil) != test.ok {
+			t.Errorf("%s: VerifySign = %v, want ok %v", test.name, err, test.ok)
+		}
+	}
+}
+
+func TestVerifyJWT(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+	tests := []struct {
+		name   string
+		secret string
+		token  string
+		ok     bool
+	}{
+		{"valid", testSecret, signJWT(t, testSecret, jwt.SigningMethodHS256, jwt.MapClaims{"exp": exp}), true},
+		{"stream claim", testSecret, signJWT(t, testSecret, jwt.SigningMethodHS256, jwt.MapClaims{"stream": "live/movie"}), true},
+		{"other stream claim", testSecret, signJWT(t, testSecret, jwt.SigningMethodHS256, jwt.MapClaims{"stream": "live/other"}), false},
+		{"expired", testSecret, signJWT(t, testSecret, jwt.SigningMethodHS256, jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}), false},
+		{"other secret", testSecret, signJWT(t, "other", jwt.SigningMethodHS256, jwt.MapClaims{"exp": exp}), false},
+		{"other algorithm", testSecret, signJWT(t, testSecret, jwt.SigningMethodHS512, jwt.MapClaims{"exp": exp}), false},
+		{"malformed", testSecret, "a.b.c", false},
+		{"no token", testSecret, "", false},
+		{"no secret", "", signJWT(t, "", jwt.SigningMethodHS256, jwt.MapClaims{"exp": exp}), false},
+	}
+	for _, test := range tests {
+		if err := VerifyJWT(test.secret, test.token, "live/movie"); (err == nil) != test.ok {
+			t.Errorf("%s: VerifyJWT = %v, want ok %v", test.name, err, test.ok)
+		}
+	}
+}
+
+func TestCheckPlay(t *testing.T) {
+	defer setPlayAuth()()
+	expires := time.Now().Add(time.Hour)
+	token := signJWT(t, testSecret, jwt.SigningMethodHS256, jwt.MapClaims{"exp": expires.Unix()})
+	tests := []struct {
+		stream string
+		query  url.Values
+		bearer string
+		ok     bool
+	}{
+		{"open/movie", nil, "", true},
+		{"unknown/movie", nil, "", true},
+		{"sign/movie", signQuery(testSecret, "sign/movie", expires), "", true},
+		{"sign/movie", signQuery(testSecret, "sign/other", expires), "", false},
+		{"sign/movie", url.Values{"jwt": {token}}, "", false},
+		{"sign/movie", nil, "", false},
+		{"jwt/movie", url.Values{"jwt": {token}}, "", true},
+		{"jwt/movie", nil, token, true},
+		{"jwt/movie", signQuery(testSecret, "jwt/movie", expires), "", false},
+		{"any/movie", signQuery(testSecret, "any/movie", expires), "", true},
+		{"any/movie", nil, token, true},
+		{"any/movie", nil, "", false},
+		{"own/movie", signQuery("own", "own/movie", expires), "", true},
+		{"own/movie", signQuery(testSecret, "own/movie", expires), "", false},
+	}
+	for _, test := range tests {
+		if err := CheckPlay(test.stream, test.query, test.bearer); (err == nil) != test.ok {
+			t.Errorf("%s %v %q: CheckPlay = %v, want ok %v", test.stream, test.query, test.bearer, err, test.ok)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/jwt/movie.mpd", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	if err := CheckPlayRequest(r, "jwt/movie"); err != nil {
+		t.Errorf("CheckPlayRequest with bearer = %v", err)
+	}
+}
+
+func TestCheckPlayWithoutSecret(t *testing.T) {
+	defer setPlayAuth()()
+	configure.Config.Set("jwt.secret", "")
+	if err := CheckPlay("sign/movie", signQuery("", "sign/movie", time.Now().Add(time.Hour)), ""); err != ErrNoPlaySecret {
+		t.Fatalf("CheckPlay = %v, want %v", err, ErrNoPlaySecret)
+	}
+	if _, err := SignPlay("sign/movie", time.Now().Add(time.Hour)); err != ErrNoPlaySecret {
+		t.Fatalf("SignPlay = %v, want %v", err, ErrNoPlaySecret)
+	}
+}
+
+func TestPlayQuery(t *testing.T) {
+	defer setPlayAuth()()
+	expires := time.Now().Add(time.Hour)
+	signed := signQuery(testSecret, "sign/set", expires)
+	signed.Set("token", "key")
+	tests := []struct {
+		name   string
+		query  url.Values
+		stream string
+		want   url.Values
+	}{
+		{"same stream", signed, "sign/set", signQuery(testSecret, "sign/set", expires)},
+		{"other stream", signed, "sign/movie", signQuery(testSecret, "sign/movie", expires)},
+		{"invalid sign", signQuery("other", "sign/set", expires), "sign/movie", url.Values{"expires": {fmt.Sprint(expires.Unix())}}},
+		{"jwt", url.Values{"jwt": {"token"}, "other": {"x"}}, "sign/movie", url.Values{"jwt": {"token"}}},
+		{"none", url.Values{}, "sign/movie", url.Values{}},
+	}
+	for _, test := range tests {
+		if got := PlayQuery(test.query, "sign/set", test.stream); got.Encode() != test.want.Encode() {
+			t.Errorf("%s: PlayQuery = %s, want %s", test.name, got.Encode(), test.want.Encode())
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package dash
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/protocol/auth"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	segmentDuration = 3000 // ms
+	maxSegmentNum   = 5    // 슬라이딩 윈도우에 남겨 둘 세그먼트 수
+)
+
+var (
+	ErrNoPublisher         = fmt.Errorf("no publisher")
+	ErrInvalidReq          = fmt.Errorf("invalid req url path")
+	ErrNoSupportVideoCodec = fmt.Errorf("no support video codec")
+	ErrNoSupportAudioCodec = fmt.Errorf("no support audio codec")
+)
+
+// 세그먼트 확장자별 Content-Type
+var segmentContentTypes = map[string]string{
+	".m4s": "video/iso.segment",
+	".mp4": "video/mp4",
+}
+
+/*
+MPEG-DASH 스트리밍 서버이다.
+hls.Server 와 같이 RtmpStream 에 GetWriter 로 붙어 스트림마다 Source 를 만들고,
+Source 가 만든 fMP4 세그먼트와 동적(dynamic) MPD 를 HTTP 로 내보낸다.
+
+/<APP>/<NAME>.mpd                  MPD. <APP>/<NAME> 이 렌디션 묶음이면 묶인 스트림을 모두 담는다.
+/<APP>/<NAME>/init-*.mp4           트랙별 init 세그먼트
+/<APP>/<NAME>/<video|audio>-*.m4s  미디어 세그먼트
+
+모든 요청은 HLS 와 같이 앱의 play_auth 정책으로 확인한다. (protocol/auth)
+확인을 통과한 요청은 시청자 세션과 스트림별 요청 수, 보낸 바이트로 센다. (viewer.go)
+플레이어는 MPD URL 에만 토큰을 붙이므로, MPD 의 init/미디어 세그먼트 URL 템플릿에 요청의 재생 토큰을 붙여 준다.
+*/
+type Server struct {
+	listener net.Listener
+	conns    *sync.Map // 스트림 키 -> *Source
+	viewers  *sync.Map // 이벤트 세션을 연 시청자. "<IP>|<APP>/<NAME>" → *viewer
+}
+
+func NewServer() *Server {
+	ret := &Server{
+		conns:   &sync.Map{},
+		viewers: &sync.Map{},
+	}
+	go ret.checkStop()
+	return ret
+}
+
+func (server *Server) Serve(listener net.Listener) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		server.handle(w, r)
+	})
+	server.listener = listener
+	http.Serve(listener, mux)
+	return nil
+}
+
+// 퍼블리셔가 들어오면 스트림의 Source 를 만든다. 같은 키의 이전 Source 가 끝났으면 새로 만든다.
+func (server *Server) GetWriter(info av.Info) av.WriteCloser {
+	if v, ok := server.conns.Load(info.Key); ok && !v.(*Source).closed {
+		return v.(*Source)
+	}
+	log.Debug("new dash source")
+	s := NewSource(info)
+	server.conns.Store(info.Key, s)
+	return s
+}
+
+func (server *Server) getConn(key string) *Source {
+	v, ok := server.conns.Load(key)
+	if !ok {
+		return nil
+	}
+	return v.(*Source)
+}
+
+func (server *Server) checkStop() {
+	for {
+		<-time.After(5 * time.Second)
+
+		server.conns.Range(func(key, val interface{}) bool {
+			v := val.(*Source)
+			if !v.Alive() {
+				log.Debug("check stop and remove: ", v.Info())
+				server.conns.Delete(key)
+			}
+			return true
+		})
+		server.expireViewers()
+	}
+}
+
+func (server *Server) handle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	switch path.Ext(r.URL.Path) {
+	case ".mpd":
+		key := strings.TrimSuffix(strings.TrimLeft(r.URL.Path, "/"), ".mpd")
+		if err := auth.CheckPlayRequest(r, key); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		w = server.countRequest(w, r, key)
+		// 세그먼트 URL 에 붙일 요청의 재생 토큰
+		query := func(stream string) string {
+			return auth.PlayQuery(r.URL.Query(), key, stream).Encode()
+		}
+		var body []byte
+		var err error
+		if keys, ok := configure.Renditions.Get(key); ok {
+			// 렌디션 묶음이면 화질별 스트림을 한 MPD 의 Representation 으로 묶는다.
+			var sources []*Source
+			for _, k := range keys {
+				if conn := server.getConn(k); conn != nil {
+					sources = append(sources, conn)
+				}
+			}
+			body, err = renditionMPD(sources, query)
+		} else {
+			conn := server.getConn(key)
+			if conn == nil {
+				http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
+				return
+			}
+			body, err = conn.MPD(query(key))
+		}
+		if err != nil {
+			log.Debug("MPD error: ", err)
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Content-Type", "application/dash+xml")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write(body)
+	case ".m4s", ".mp4":
+		key, err := parseSegment(r.URL.Path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := auth.CheckPlayRequest(r, key); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		w = server.countRequest(w, r, key)
+		conn := server.getConn(key)
+		if conn == nil {
+			http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
+			return
+		}
+		data, err := conn.GetItem(r.URL.Path)
+		if err != nil {
+			log.Debug("GetItem error: ", err)
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", segmentContentTypes[path.Ext(r.URL.Path)])
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	default:
+		http.Error(w, ErrInvalidReq.Error(), http.StatusBadRequest)
+	}
+}
+
+// /<APP>/<NAME>/<FILE> 에서 스트림 키를 꺼낸다.
+func parseSegment(pathstr string) (key string, err error) {
+	paths := strings.SplitN(strings.TrimLeft(pathstr, "/"), "/", 3)
+	if len(paths) != 3 {
+		return "", ErrInvalidReq
+	}
+	return paths[0] + "/" + paths[1], nil
+}
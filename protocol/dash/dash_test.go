@@ -0,0 +1,91 @@
+package dash
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/protocol/auth"
+	"github.com/gwuhaolin/livego/protocol/event"
+	"github.com/gwuhaolin/livego/protocol/metrics"
+)
+
+func TestHandlePlayAuth(t *testing.T) {
+	server := configure.Config.Get("server")
+	jwtSecret := configure.Config.GetString("jwt.secret")
+	defer func() {
+		configure.Config.Set("server", server)
+		configure.Config.Set("jwt.secret", jwtSecret)
+		configure.InvalidateApplications()
+	}()
+	configure.Config.Set("jwt.secret", "secret")
+	configure.Config.Set("server", []map[string]interface{}{
+		{"appname": "live", "live": true, "play_auth": configure.PlayAuthSign},
+	})
+	configure.InvalidateApplications()
+
+	source := &Source{
+		info:    av.Info{Key: "live/movie"},
+		RWBaser: av.NewRWBaser(time.Second * 10),
+		videoWin: &window{
+			id:        "video",
+			timescale: 90000,
+			codecs:    "avc1.64001f",
+			segments:  []segment{{t: 0, d: 270000, name: "/live/movie/video-0.m4s", size: 1000}},
+		},
+		items:             map[string][]byte{"/live/movie/video-0.m4s": {0x00}},
+		availabilityStart: time.Now(),
+	}
+	s := &Server{conns: &sync.Map{}, viewers: &sync.Map{}}
+	s.conns.Store("live/movie", source)
+
+	expires := time.Now().Add(time.Hour)
+	query := fmt.Sprintf("expires=%d&sign=%s", expires.Unix(), auth.Sign("secret", "live/movie", expires))
+	tests := []struct {
+		url    string
+		status int
+		body   []string
+	}{
+		{"/live/movie.mpd", 403, nil},
+		{"/live/movie.mpd?expires=1&sign=00", 403, nil},
+		{"/live/movie.mpd?" + query, 200, []string{
+			`initialization="movie/init-video-0.mp4?` + strings.Replace(query, "&", "&amp;", 1) + `"`,
+			`media="movie/video-$Time$.m4s?` + strings.Replace(query, "&", "&amp;", 1) + `"`,
+		}},
+		{"/live/movie/video-0.m4s", 403, nil},
+		{"/live/movie/video-0.m4s?" + query, 200, nil},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		s.handle(w, httptest.NewRequest("GET", test.url, nil))
+		if w.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.url, w.Code, test.status)
+		}
+		for _, want := range test.body {
+			if !strings.Contains(w.Body.String(), want) {
+				t.Errorf("%s: body missing %s\n%s", test.url, want, w.Body.String())
+			}
+		}
+	}
+	// 인증을 통과한 요청만 센다.
+	if n := metrics.GetCounter(metrics.DASHRequests, "live/movie", event.ProtocolDASH).Value(); n != 2 {
+		t.Errorf("%d requests counted, want 2", n)
+	}
+	if n := metrics.GetCounter(metrics.EgressBytes, "live/movie", event.ProtocolDASH).Value(); n == 0 {
+		t.Error("no egress bytes counted")
+	}
+	viewers := 0
+	for _, e := range event.Default.Sessions() {
+		if e.Type == event.PlayerJoin && e.Protocol == event.ProtocolDASH {
+			viewers++
+		}
+	}
+	if viewers != 1 {
+		t.Errorf("%d dash viewer sessions, want 1", viewers)
+	}
+}
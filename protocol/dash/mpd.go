@@ -0,0 +1,284 @@
+package dash
+
+import (
+	"encoding/xml"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNoSegment = fmt.Errorf("no segment yet")
+)
+
+type segment struct {
+	t, d uint64 // 시작 시각(tfdt)과 길이. 트랙 timescale 단위
+	name string
+	size int
+}
+
+// AdaptationSet 하나에 해당하는 트랙의 세그먼트 슬라이딩 윈도우이다.
+type window struct {
+	id        string // Representation ID (video, audio)
+	timescale uint32
+	codecs    string
+	segments  []segment
+}
+
+// 윈도우의 첫 세그먼트 시작부터 마지막 세그먼트 끝까지의 길이
+func (win *window) depth() time.Duration {
+	if len(win.segments) == 0 {
+		return 0
+	}
+	first, last := win.segments[0], win.segments[len(win.segments)-1]
+	return toDuration(last.t+last.d-first.t, win.timescale)
+}
+
+// 트랙 timescale 단위의 값을 time.Duration 으로 바꾼다. 긴 스트림에서 넘치지 않도록 실수로 계산한다.
+func toDuration(v uint64, timescale uint32) time.Duration {
+	return time.Duration(float64(v) / float64(timescale) * float64(time.Second))
+}
+
+// 윈도우에 있는 세그먼트의 평균 비트레이트(bps)
+func (win *window) bandwidth() int {
+	var size int
+	var d uint64
+	for _, s := range win.segments {
+		size += s.size
+		d += s.d
+	}
+	if d == 0 {
+		return 0
+	}
+	return int(uint64(size) * 8 * uint64(win.timescale) / d)
+}
+
+type mpd struct {
+	XMLName                    xml.Name `xml:"MPD"`
+	Xmlns                      string   `xml:"xmlns,attr"`
+	Profiles                   string   `xml:"profiles,attr"`
+	Type                       string   `xml:"type,attr"`
+	AvailabilityStartTime      string   `xml:"availabilityStartTime,attr"`
+	PublishTime                string   `xml:"publishTime,attr"`
+	MinimumUpdatePeriod        string   `xml:"minimumUpdatePeriod,attr"`
+	MinBufferTime              string   `xml:"minBufferTime,attr"`
+	TimeShiftBufferDepth       string   `xml:"timeShiftBufferDepth,attr"`
+	SuggestedPresentationDelay string   `xml:"suggestedPresentationDelay,attr"`
+	MaxSegmentDuration         string   `xml:"maxSegmentDuration,attr"`
+	Period                     period   `xml:"Period"`
+}
+
+type period struct {
+	ID             string          `xml:"id,attr"`
+	Start          string          `xml:"start,attr"`
+	AdaptationSets []adaptationSet `xml:"AdaptationSet"`
+}
+
+type adaptationSet struct {
+	ContentType      string           `xml:"contentType,attr"`
+	MimeType         string           `xml:"mimeType,attr"`
+	SegmentAlignment bool             `xml:"segmentAlignment,attr"`
+	StartWithSAP     int              `xml:"startWithSAP,attr"`
+	SegmentTemplate  *segmentTemplate `xml:"SegmentTemplate,omitempty"`
+	Representations  []representation `xml:"Representation"`
+}
+
+type segmentTemplate struct {
+	Timescale              uint32            `xml:"timescale,attr"`
+	PresentationTimeOffset uint64            `xml:"presentationTimeOffset,attr,omitempty"`
+	Initialization         string            `xml:"initialization,attr"`
+	Media                  string            `xml:"media,attr"`
+	Timeline               []segmentTimeline `xml:"SegmentTimeline>S"`
+}
+
+type segmentTimeline struct {
+	T uint64 `xml:"t,attr"`
+	D uint64 `xml:"d,attr"`
+}
+
+type representation struct {
+	ID                string           `xml:"id,attr"`
+	Codecs            string           `xml:"codecs,attr"`
+	Bandwidth         int              `xml:"bandwidth,attr"`
+	Width             int              `xml:"width,attr,omitempty"`
+	Height            int              `xml:"height,attr,omitempty"`
+	AudioSamplingRate uint32           `xml:"audioSamplingRate,attr,omitempty"`
+	SegmentTemplate   *segmentTemplate `xml:"SegmentTemplate,omitempty"` // 렌디션 묶음에서는 Representation 마다 세그먼트가 다르다.
+}
+
+// Source 의 트랙 하나를 나타내는 Representation 과 그 세그먼트 정보
+type track struct {
+	contentType string
+	rep         representation
+	tmpl        segmentTemplate
+	depth       time.Duration // 윈도우 길이
+	maxSegment  time.Duration // 가장 긴 세그먼트 길이
+}
+
+// ISO 8601 기간 형식 (PT3.000S)
+func isoDuration(d time.Duration) string {
+	return fmt.Sprintf("PT%.3fS", d.Seconds())
+}
+
+// 현재 윈도우의 트랙 목록을 만든다. base 는 세그먼트 URL 앞에 붙일 경로, query 는 뒤에 붙일 쿼리이며, 호출하는 쪽에서 lock 을 잡는다.
+func (source *Source) tracks(base, query string) []track {
+	if query != "" {
+		query = "?" + query
+	}
+	var tracks []track
+	for _, win := range []*window{source.videoWin, source.audioWin} {
+		if win == nil || len(win.segments) == 0 {
+			continue
+		}
+		t := track{
+			contentType: win.id,
+			depth:       win.depth(),
+			rep: representation{
+				ID:        win.id,
+				Codecs:    win.codecs,
+				Bandwidth: win.bandwidth(),
+			},
+			tmpl: segmentTemplate{
+				Timescale:      win.timescale,
+				Initialization: fmt.Sprintf("%s/init-%s-%d.mp4%s", base, win.id, source.period, query),
+				Media:          fmt.Sprintf("%s/%s-$Time$.m4s%s", base, win.id, query),
+			},
+		}
+		for _, s := range win.segments {
+			t.tmpl.Timeline = append(t.tmpl.Timeline, segmentTimeline{T: s.t, D: s.d})
+			if d := toDuration(s.d, win.timescale); d > t.maxSegment {
+				t.maxSegment = d
+			}
+		}
+		if win == source.videoWin {
+			t.rep.Width, t.rep.Height = source.width, source.height
+		} else {
+			t.rep.AudioSamplingRate = win.timescale
+		}
+		tracks = append(tracks, t)
+	}
+	return tracks
+}
+
+// 현재 윈도우로 동적 MPD 를 만든다.
+// availabilityStartTime 과 timeShiftBufferDepth 는 벽시계가 아니라 세그먼트의 타임스탬프로 계산하므로,
+// 플레이어는 SegmentTimeline 의 시각에 availabilityStartTime 을 더해 라이브 끝을 찾는다.
+// query 는 세그먼트 URL 에 붙일 재생 토큰이다.
+func (source *Source) MPD(query string) ([]byte, error) {
+	source.lock.RLock()
+	defer source.lock.RUnlock()
+	if source.availabilityStart.IsZero() {
+		return nil, ErrNoSegment
+	}
+
+	var sets []adaptationSet
+	tracks := source.tracks(path.Base(source.info.Key), query)
+	for i := range tracks {
+		t := &tracks[i]
+		sets = append(sets, adaptationSet{
+			ContentType:      t.contentType,
+			MimeType:         t.contentType + "/mp4",
+			SegmentAlignment: true,
+			StartWithSAP:     1,
+			SegmentTemplate:  &t.tmpl,
+			Representations:  []representation{t.rep},
+		})
+	}
+	return marshalMPD(source.availabilityStart, fmt.Sprint(source.period), tracks, sets)
+}
+
+// 렌디션 묶음의 스트림들을 한 MPD 로 만든다. 같은 종류의 트랙은 한 AdaptationSet 의 Representation 이 된다.
+// 스트림마다 타임스탬프 0 의 벽시계 시각이 다르므로, 가장 늦은 시각을 availabilityStartTime 으로 쓰고
+// 나머지 스트림은 그 차이만큼 presentationTimeOffset 을 주어 시각을 맞춘다.
+// query 는 스트림 키마다 그 스트림의 세그먼트 URL 에 붙일 재생 토큰을 돌려준다.
+func renditionMPD(sources []*Source, query func(stream string) string) ([]byte, error) {
+	var availabilityStart time.Time
+	for _, source := range sources {
+		source.lock.RLock()
+		if source.availabilityStart.After(availabilityStart) {
+			availabilityStart = source.availabilityStart
+		}
+		source.lock.RUnlock()
+	}
+	if availabilityStart.IsZero() {
+		return nil, ErrNoSegment
+	}
+
+	var tracks []track
+	var periods []string
+	var sets []adaptationSet
+	for _, source := range sources {
+		source.lock.RLock()
+		if source.availabilityStart.IsZero() {
+			source.lock.RUnlock()
+			continue
+		}
+		offset := availabilityStart.Sub(source.availabilityStart)
+		periods = append(periods, fmt.Sprint(source.period))
+		for _, t := range source.tracks("/"+source.info.Key, query(source.info.Key)) {
+			tmpl := t.tmpl
+			tmpl.PresentationTimeOffset = uint64(offset.Seconds() * float64(tmpl.Timescale))
+			t.rep.ID = path.Base(source.info.Key) + "-" + t.contentType
+			t.rep.SegmentTemplate = &tmpl
+			tracks = append(tracks, t)
+		}
+		source.lock.RUnlock()
+	}
+	for _, t := range tracks {
+		found := false
+		for i := range sets {
+			if sets[i].ContentType == t.contentType {
+				sets[i].Representations = append(sets[i].Representations, t.rep)
+				found = true
+				break
+			}
+		}
+		if !found {
+			sets = append(sets, adaptationSet{
+				ContentType:      t.contentType,
+				MimeType:         t.contentType + "/mp4",
+				SegmentAlignment: true,
+				StartWithSAP:     1,
+				Representations:  []representation{t.rep},
+			})
+		}
+	}
+	return marshalMPD(availabilityStart, strings.Join(periods, "-"), tracks, sets)
+}
+
+func marshalMPD(availabilityStart time.Time, periodID string, tracks []track, sets []adaptationSet) ([]byte, error) {
+	var depth, maxSegment time.Duration
+	for _, t := range tracks {
+		if t.depth > depth {
+			depth = t.depth
+		}
+		if t.maxSegment > maxSegment {
+			maxSegment = t.maxSegment
+		}
+	}
+
+	segment := time.Duration(segmentDuration) * time.Millisecond
+	doc := mpd{
+		Xmlns:                      "urn:mpeg:dash:schema:mpd:2011",
+		Profiles:                   "urn:mpeg:dash:profile:isoff-live:2011",
+		Type:                       "dynamic",
+		AvailabilityStartTime:      availabilityStart.UTC().Format(time.RFC3339Nano),
+		PublishTime:                time.Now().UTC().Format(time.RFC3339Nano),
+		MinimumUpdatePeriod:        isoDuration(segment),
+		MinBufferTime:              isoDuration(segment),
+		TimeShiftBufferDepth:       isoDuration(depth),
+		SuggestedPresentationDelay: isoDuration(3 * segment),
+		MaxSegmentDuration:         isoDuration(maxSegment),
+		Period: period{
+			ID:             periodID,
+			Start:          "PT0S",
+			AdaptationSets: sets,
+		},
+	}
+	b, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
@@ -0,0 +1,312 @@
+package dash
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/container/fmp4"
+	"github.com/gwuhaolin/livego/protocol/amf"
+	"github.com/gwuhaolin/livego/protocol/event"
+	"github.com/gwuhaolin/livego/protocol/metrics"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	maxQueueNum = 512
+)
+
+var (
+	ErrNoKey = fmt.Errorf("No key for cache")
+)
+
+// 스트림 하나를 DASH 로 내보내는 writer 이다.
+// FLV 패킷을 트랙별 fMP4 조각으로 만들고, 비디오 키프레임마다 segmentDuration 이 지났으면 세그먼트를 자른다.
+// 비디오와 오디오는 각각의 AdaptationSet 으로 내보내므로 muxer 도 트랙마다 따로 둔다.
+type Source struct {
+	av.RWBaser
+	info        av.Info
+	demuxer     *flv.Demuxer
+	video       *fmp4.Muxer // 비디오 트랙만 담는 muxer
+	audio       *fmp4.Muxer // 오디오 트랙만 담는 muxer
+	hasVideo    bool        // 비디오 시퀀스 헤더를 받았는지. 오디오 전용 스트림은 오디오 타임스탬프로 세그먼트를 자른다.
+	started     bool        // 첫 세그먼트가 시작되었는지. 그 전의 샘플은 버린다.
+	segStart    uint32      // 현재 세그먼트의 시작 타임스탬프(ms)
+	closed      bool
+	packetQueue chan *av.Packet
+
+	lock              sync.RWMutex
+	period            int               // Period 번호. 코덱 설정이 바뀌면 새 Period 를 시작한다.
+	videoWin          *window           // 비디오 AdaptationSet 의 세그먼트 윈도우
+	audioWin          *window           // 오디오 AdaptationSet 의 세그먼트 윈도우
+	items             map[string][]byte // 이름 -> init/미디어 세그먼트
+	availabilityStart time.Time         // 스트림 타임스탬프 0 에 해당하는 벽시계 시각
+	width, height     int
+}
+
+func NewSource(info av.Info) *Source {
+	info.Inter = true
+	s := &Source{
+		info:        info,
+		RWBaser:     av.NewRWBaser(time.Second * 10),
+		demuxer:     flv.NewDemuxer(),
+		video:       fmp4.NewMuxer(),
+		audio:       fmp4.NewMuxer(),
+		items:       make(map[string][]byte),
+		packetQueue: make(chan *av.Packet, maxQueueNum),
+	}
+	go func() {
+		err := s.SendPacket()
+		if err != nil {
+			log.Debug("send packet error: ", err)
+			s.closed = true
+		}
+	}()
+	return s
+}
+
+// 패킷 큐가 가득 차면 시퀀스 헤더와 키프레임, 오디오를 남기고 비디오 프레임을 버린다.
+func (source *Source) DropPacket(pktQue chan *av.Packet, info av.Info) {
+	log.Warningf("[%v] packet queue max!!!", info)
+	e := event.New(event.PacketDrop, info.Key, info.UID)
+	e.Protocol = event.ProtocolDASH
+	event.Publish(e)
+	queued := len(pktQue)
+	for i := 0; i < maxQueueNum-84; i++ {
+		tmpPkt, ok := <-pktQue
+		if ok && tmpPkt.IsAudio {
+			if len(pktQue) > maxQueueNum-2 {
+				<-pktQue
+			} else {
+				pktQue <- tmpPkt
+			}
+		}
+
+		if ok && tmpPkt.IsVideo {
+			videoPkt, ok := tmpPkt.Header.(av.VideoPacketHeader)
+			if ok && (videoPkt.IsSeq() || videoPkt.IsKeyFrame()) {
+				pktQue <- tmpPkt
+			}
+			if len(pktQue) > maxQueueNum-10 {
+				<-pktQue
+			}
+		}
+	}
+	// 큐에서 줄어든 패킷과 큐에 넣지 못한 새 패킷
+	metrics.Add(metrics.DroppedPackets, info.Key, event.ProtocolDASH, uint64(queued-len(pktQue)+1))
+	log.Debug("packet queue len: ", len(pktQue))
+}
+
+func (source *Source) Write(p *av.Packet) (err error) {
+	if source.closed {
+		return fmt.Errorf("dash source closed")
+	}
+	source.SetPreTime()
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("dash source has already been closed:%v", e)
+		}
+	}()
+	if len(source.packetQueue) >= maxQueueNum-24 {
+		source.DropPacket(source.packetQueue, source.info)
+	} else {
+		source.packetQueue <- p
+	}
+	return
+}
+
+func (source *Source) SendPacket() error {
+	defer func() {
+		log.Debugf("[%v] dash sender stop", source.info)
+		if r := recover(); r != nil {
+			log.Warning("dash SendPacket panic: ", r)
+		}
+	}()
+
+	log.Debugf("[%v] dash sender start", source.info)
+	for {
+		p, ok := <-source.packetQueue
+		if !ok {
+			return fmt.Errorf("closed")
+		}
+		if p.IsMetadata {
+			source.parseMetadata(p)
+			continue
+		}
+
+		err := source.demuxer.Demux(p)
+		if err == flv.ErrAvcEndSEQ || err == flv.ErrVideoMetadata {
+			continue
+		} else if err != nil {
+			log.Warning(err)
+			return err
+		}
+		if err := source.mux(p); err != nil {
+			log.Warning(err)
+		}
+	}
+}
+
+func (source *Source) Info() av.Info {
+	return source.info
+}
+
+func (source *Source) Close(err error) {
+	log.Debug("dash source closed: ", source.info)
+	if !source.closed {
+		source.closed = true
+		close(source.packetQueue)
+	}
+}
+
+// onMetaData 의 width/height 를 init 세그먼트와 MPD 에 반영한다.
+func (source *Source) parseMetadata(p *av.Packet) {
+	vs, _ := amf.NewDecoder().DecodeBatch(bytes.NewReader(p.Data), amf.AMF0)
+	for i, v := range vs {
+		if v != amf.OnMetaData || i+1 >= len(vs) {
+			continue
+		}
+		obj, ok := vs[i+1].(amf.Object)
+		if !ok {
+			return
+		}
+		width, _ := obj["width"].(float64)
+		height, _ := obj["height"].(float64)
+		source.video.SetVideoSize(int(width), int(height))
+		source.lock.Lock()
+		source.width, source.height = int(width), int(height)
+		source.lock.Unlock()
+		return
+	}
+}
+
+// FLV 의 코덱 데이터를 그대로 fMP4 샘플로 쓴다.
+func (source *Source) mux(p *av.Packet) error {
+	if p.IsVideo {
+		vh := p.Header.(av.VideoPacketHeader)
+		if vh.CodecID() != av.VIDEO_H264 && vh.CodecID() != av.VIDEO_HEVC {
+			return ErrNoSupportVideoCodec
+		}
+		if vh.IsSeq() {
+			source.hasVideo = true
+			return source.video.SetVideoConfig(vh.CodecID(), p.Data)
+		}
+		if vh.IsKeyFrame() {
+			source.cut(p.TimeStamp)
+		}
+		if source.started {
+			source.video.WriteVideo(p.TimeStamp, vh.CompositionTime(), vh.IsKeyFrame(), p.Data)
+		}
+		return nil
+	}
+
+	ah := p.Header.(av.AudioPacketHeader)
+	if ah.SoundFormat() != av.SOUND_AAC {
+		return ErrNoSupportAudioCodec
+	}
+	if ah.AACPacketType() == av.AAC_SEQHDR {
+		return source.audio.SetAudioConfig(p.Data)
+	}
+	if !source.hasVideo {
+		source.cut(p.TimeStamp)
+	}
+	if source.started {
+		source.audio.WriteAudio(p.TimeStamp, p.Data)
+	}
+	return nil
+}
+
+// ts 에서 새 세그먼트를 시작한다. 현재 세그먼트가 segmentDuration 보다 짧으면 자르지 않는다.
+func (source *Source) cut(ts uint32) {
+	if source.started {
+		if ts-source.segStart < segmentDuration {
+			return
+		}
+		source.flush(ts)
+	}
+	if source.video.Changed() || source.audio.Changed() {
+		source.newPeriod()
+	}
+	source.started = true
+	source.segStart = ts
+}
+
+// 버퍼에 쌓인 샘플로 트랙별 세그먼트를 만들어 윈도우에 넣는다. ts 는 다음 세그먼트의 시작 타임스탬프이다.
+func (source *Source) flush(ts uint32) {
+	videoData := source.video.Fragment(ts)
+	audioData := source.audio.Fragment(ts)
+
+	source.lock.Lock()
+	defer source.lock.Unlock()
+	source.addSegment(source.videoWin, source.video, true, videoData)
+	source.addSegment(source.audioWin, source.audio, false, audioData)
+
+	// 첫 세그먼트가 끝난 시각을 기준으로, 스트림 타임스탬프 0 이 벽시계로 언제였는지 계산한다.
+	if source.availabilityStart.IsZero() {
+		for _, win := range []*window{source.videoWin, source.audioWin} {
+			if win == nil || len(win.segments) == 0 {
+				continue
+			}
+			last := win.segments[len(win.segments)-1]
+			source.availabilityStart = time.Now().Add(-toDuration(last.t+last.d, win.timescale))
+			break
+		}
+	}
+}
+
+func (source *Source) addSegment(win *window, muxer *fmp4.Muxer, video bool, data []byte) {
+	if win == nil || data == nil {
+		return
+	}
+	t, d, ok := muxer.FragmentTime(video)
+	if !ok {
+		return
+	}
+	name := fmt.Sprintf("/%s/%s-%d.m4s", source.info.Key, win.id, t)
+	source.items[name] = data
+	win.segments = append(win.segments, segment{t: t, d: d, name: name, size: len(data)})
+	if len(win.segments) > maxSegmentNum {
+		delete(source.items, win.segments[0].name)
+		win.segments = win.segments[1:]
+	}
+}
+
+// 코덱 설정이 바뀌면 이전 세그먼트를 버리고, 새 init 세그먼트로 새 Period 를 시작한다.
+func (source *Source) newPeriod() {
+	source.lock.Lock()
+	defer source.lock.Unlock()
+	source.period++
+	source.items = make(map[string][]byte)
+	source.videoWin = source.newWindow("video", source.video, true)
+	source.audioWin = source.newWindow("audio", source.audio, false)
+}
+
+func (source *Source) newWindow(id string, muxer *fmp4.Muxer, video bool) *window {
+	init := muxer.InitSegment()
+	if init == nil {
+		return nil
+	}
+	name := fmt.Sprintf("/%s/init-%s-%d.mp4", source.info.Key, id, source.period)
+	source.items[name] = init
+	return &window{
+		id:        id,
+		timescale: muxer.Timescale(video),
+		codecs:    strings.Join(muxer.Codecs(), ","),
+	}
+}
+
+// init 또는 미디어 세그먼트를 찾는다.
+func (source *Source) GetItem(name string) ([]byte, error) {
+	source.lock.RLock()
+	defer source.lock.RUnlock()
+	data, ok := source.items[name]
+	if !ok {
+		return nil, ErrNoKey
+	}
+	return data, nil
+}
@@ -0,0 +1,57 @@
+package dash
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gwuhaolin/livego/protocol/event"
+	"github.com/gwuhaolin/livego/protocol/metrics"
+	"github.com/gwuhaolin/livego/utils/uid"
+)
+
+/*
+DASH 시청자 세션
+HLS 와 같이 요청마다 연결이 끝나므로 클라이언트 IP 와 스트림 키로 시청자를 구분해 이벤트 세션을 만든다.
+처음 보는 시청자의 요청에서 player_join 을 보내고, viewerTimeout 동안 요청이 없으면 player_leave 를 보낸다.
+*/
+
+const viewerTimeout = 30 * time.Second
+
+type viewer struct {
+	id   string
+	last int64 // 마지막 요청 시각(UnixNano)
+}
+
+// 요청한 시청자의 세션을 열거나 마지막 요청 시각을 갱신하고, 스트림의 DASH 요청 수와 보낸 바이트를 센다.
+func (server *Server) countRequest(w http.ResponseWriter, r *http.Request, stream string) http.ResponseWriter {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	v := &viewer{id: uid.NewId(), last: time.Now().UnixNano()}
+	if old, loaded := server.viewers.LoadOrStore(host+"|"+stream, v); loaded {
+		atomic.StoreInt64(&old.(*viewer).last, time.Now().UnixNano())
+	} else {
+		e := event.New(event.PlayerJoin, stream, v.id)
+		e.Protocol, e.ClientIP = event.ProtocolDASH, r.RemoteAddr
+		event.Open(e)
+	}
+
+	metrics.Add(metrics.DASHRequests, stream, event.ProtocolDASH, 1)
+	return metrics.NewResponseWriter(w, metrics.GetCounter(metrics.EgressBytes, stream, event.ProtocolDASH))
+}
+
+// viewerTimeout 동안 요청이 없는 시청자의 세션을 닫는다.
+func (server *Server) expireViewers() {
+	deadline := time.Now().Add(-viewerTimeout).UnixNano()
+	server.viewers.Range(func(key, val interface{}) bool {
+		v := val.(*viewer)
+		if atomic.LoadInt64(&v.last) < deadline {
+			server.viewers.Delete(key)
+			event.Close(v.id)
+		}
+		return true
+	})
+}
@@ -0,0 +1,147 @@
+package event
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+이벤트 버스
+스트림 수명 주기 이벤트(퍼블리시 시작/종료, 시청자 입장/퇴장, 릴레이 상태, 패킷 버림, 키 재설정)를 구독자에게 전달한다.
+발행하는 쪽은 기다리지 않으며, 구독자의 버퍼가 차면 그 구독자에게 갈 이벤트는 버린다.
+퍼블리시와 재생처럼 시작과 끝이 있는 세션은 Open 으로 시작을 알리고, 같은 ID 로 여러 번 Close 를 불러도 끝 이벤트는 한 번만 보낸다.
+*/
+
+const (
+	PublishStart = "publish_start"
+	PublishStop  = "publish_stop"
+	PlayerJoin   = "player_join"
+	PlayerLeave  = "player_leave"
+	RelayState   = "relay_state"
+	PacketDrop   = "packet_drop"
+	KeyReset     = "key_reset"
+
+	subscriberBuffer = 256
+)
+
+// 프로토콜 이름. 이벤트, 웹훅 세션과 메트릭의 protocol 값으로 쓴다.
+const (
+	ProtocolRTMP    = "rtmp"
+	ProtocolHTTPFLV = "httpflv"
+	ProtocolHLS     = "hls"
+	ProtocolDASH    = "dash"
+	ProtocolWebRTC  = "webrtc"
+)
+
+// 시작 이벤트에 짝지어 보낼 끝 이벤트
+var endTypes = map[string]string{
+	PublishStart: PublishStop,
+	PlayerJoin:   PlayerLeave,
+}
+
+type Event struct {
+	Type     string                 `json:"type"`
+	Time     int64                  `json:"time"`                // UNIX ms
+	Key      string                 `json:"key,omitempty"`       // 스트림 키 <APP>/<NAME>
+	ID       string                 `json:"id,omitempty"`        // 퍼블리셔/시청자 세션 ID
+	Protocol string                 `json:"protocol,omitempty"`  // 시청자 프로토콜
+	ClientIP string                 `json:"client_ip,omitempty"` // 시청자 IP
+	Data     map[string]interface{} `json:"data,omitempty"`
+}
+
+func New(typ, key, id string) Event {
+	return Event{
+		Type: typ,
+		Time: time.Now().UnixNano() / 1e6,
+		Key:  key,
+		ID:   id,
+	}
+}
+
+type Bus struct {
+	lock     sync.Mutex
+	subs     map[chan Event]struct{}
+	sessions map[string]Event // 시작 이벤트를 보낸 세션. 세션 ID → 시작 이벤트
+}
+
+func NewBus() *Bus {
+	return &Bus{
+		subs:     map[chan Event]struct{}{},
+		sessions: map[string]Event{},
+	}
+}
+
+// 서버 전체가 함께 쓰는 버스
+var Default = NewBus()
+
+func (bus *Bus) Publish(e Event) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	for ch := range bus.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func (bus *Bus) Subscribe() chan Event {
+	ch := make(chan Event, subscriberBuffer)
+	bus.lock.Lock()
+	bus.subs[ch] = struct{}{}
+	bus.lock.Unlock()
+	return ch
+}
+
+func (bus *Bus) Unsubscribe(ch chan Event) {
+	bus.lock.Lock()
+	delete(bus.subs, ch)
+	bus.lock.Unlock()
+}
+
+// 세션 시작 이벤트를 보내고 끝 이벤트를 보낼 수 있도록 기억한다.
+func (bus *Bus) Open(e Event) {
+	bus.lock.Lock()
+	bus.sessions[e.ID] = e
+	bus.lock.Unlock()
+	bus.Publish(e)
+}
+
+// 세션 끝 이벤트를 보낸다. data.duration 은 세션 길이(ms)이다. 열지 않았거나 이미 닫은 세션이면 무시한다.
+func (bus *Bus) Close(id string) {
+	bus.lock.Lock()
+	start, ok := bus.sessions[id]
+	delete(bus.sessions, id)
+	bus.lock.Unlock()
+	if !ok {
+		return
+	}
+	end := start
+	end.Type = endTypes[start.Type]
+	end.Time = time.Now().UnixNano() / 1e6
+	end.Data = map[string]interface{}{"duration": end.Time - start.Time}
+	bus.Publish(end)
+}
+
+// 열려 있는 세션의 시작 이벤트 목록
+func (bus *Bus) Sessions() []Event {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	list := make([]Event, 0, len(bus.sessions))
+	for _, e := range bus.sessions {
+		list = append(list, e)
+	}
+	return list
+}
+
+func Publish(e Event) {
+	Default.Publish(e)
+}
+
+func Open(e Event) {
+	Default.Open(e)
+}
+
+func Close(id string) {
+	Default.Close(id)
+}
@@ -0,0 +1,78 @@
+package hls
+
+import (
+	"bytes"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gwuhaolin/livego/protocol/auth"
+)
+
+/*
+재생 인증
+플레이리스트, 세그먼트, 키, 자막 요청 모두 앱의 play_auth 정책으로 확인한다. (protocol/auth)
+플레이어는 플레이리스트 URL 에만 토큰을 붙이므로, 플레이리스트의 URI 에 요청의 토큰 파라미터를 그대로 붙여 준다.
+*/
+
+// 요청 경로의 스트림 키(<APP>/<NAME>). 렌디션 묶음의 마스터 플레이리스트면 묶음 이름이며, 스트림 경로가 아니면 "" 이다.
+func playStream(pathstr string) string {
+	pathstr = strings.TrimLeft(pathstr, "/")
+	paths := strings.SplitN(strings.TrimSuffix(pathstr, path.Ext(pathstr)), "/", 3)
+	if len(paths) < 2 {
+		return ""
+	}
+	return paths[0] + "/" + paths[1]
+}
+
+// 요청의 토큰 파라미터를 stream 의 URI 에 붙일 쿼리로 만든다. from 은 요청한 스트림 키이다.
+// 재생 토큰은 auth.PlayQuery 로 넘기고, 키 요청 토큰(token)은 같은 스트림의 URI 에만 붙인다.
+func tokenQuery(r *http.Request, from, stream string) string {
+	query := r.URL.Query()
+	v := auth.PlayQuery(query, from, stream)
+	if stream == from && query.Get("token") != "" {
+		v.Set("token", query.Get("token"))
+	}
+	return v.Encode()
+}
+
+// 플레이리스트의 URI(세그먼트 줄과 태그의 URI 속성)에 쿼리를 붙인다.
+func appendQuery(body []byte, query string) []byte {
+	if query == "" {
+		return body
+	}
+	lines := bytes.Split(body, []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] != '#' {
+			lines[i] = withQuery(line, query)
+			continue
+		}
+		start := bytes.Index(line, []byte("URI=\""))
+		if start < 0 {
+			continue
+		}
+		start += len("URI=\"")
+		end := bytes.IndexByte(line[start:], '"')
+		if end < 0 {
+			continue
+		}
+		end += start
+		out := append([]byte{}, line[:start]...)
+		out = append(out, withQuery(line[start:end], query)...)
+		lines[i] = append(out, line[end:]...)
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+func withQuery(uri []byte, query string) []byte {
+	sep := byte('?')
+	if bytes.IndexByte(uri, '?') >= 0 {
+		sep = '&'
+	}
+	out := append([]byte{}, uri...)
+	out = append(out, sep)
+	return append(out, query...)
+}
@@ -4,48 +4,91 @@ import (
 	"bytes"
 	"container/list"
 	"fmt"
+	"io"
 	"sync"
+	"time"
+
+	"github.com/gwuhaolin/livego/container/ts"
 )
 
 const (
 	maxTSCacheNum = 3
+
+	programDateTimeFormat = "2006-01-02T15:04:05.000Z07:00"
 )
 
 var (
-	ErrNoKey = fmt.Errorf("No key for cache")
+	ErrNoKey              = fmt.Errorf("No key for cache")
+	ErrBlockingTimeout    = fmt.Errorf("blocking request timeout")
+	ErrInvalidBlockingReq = fmt.Errorf("_HLS_msn is too far ahead of the playlist")
 )
 
 // 세그먼트 생성을 위해 TS 패킷을 캐싱하고 관리한다. 실시간 스트리밍에서 효율적으로 TS 데이터를 관리하고 동기화 유지를 위한 캐시 역할을 함.
 type TSCacheItem struct {
-	id   string            // 현재 캐시에 대한 고유 식별자이다. 특정 스트림 또는 세그먼트를 식별한다.
-	num  int               // 캐시에 저장된 TS 패킷의 개수이다.
-	lock sync.RWMutex      // 읽기 쓰기 락으로 다중 고루틴 환경에서 캐시를 안전하게 접근 및 수정한다.
-	ll   *list.List        // go의 패키지에서 제공하는 이중 연결리스트. TS 패킷은 재생 순서를 보장해야하므로, 이중 연결리스트를 사용해. 추가 삭제 순회를 처리한다.
-	lm   map[string]TSItem // 맵 자료구조로 TS 패킷 데이터를 빠르게 검색할 수 있게 사용하고 있다. 특정 패킷을 식별하거나, 특정 조건에 따라 삭제/검색할때 사용.
+	id     string            // 현재 캐시에 대한 고유 식별자이다. 특정 스트림 또는 세그먼트를 식별한다.
+	num    int               // 캐시에 저장된 TS 패킷의 개수이다.
+	lock   sync.RWMutex      // 읽기 쓰기 락으로 다중 고루틴 환경에서 캐시를 안전하게 접근 및 수정한다.
+	ll     *list.List        // go의 패키지에서 제공하는 이중 연결리스트. TS 패킷은 재생 순서를 보장해야하므로, 이중 연결리스트를 사용해. 추가 삭제 순회를 처리한다.
+	lm     map[string]TSItem // 맵 자료구조로 TS 패킷 데이터를 빠르게 검색할 수 있게 사용하고 있다. 특정 패킷을 식별하거나, 특정 조건에 따라 삭제/검색할때 사용.
+	maps   map[string]TSItem // fMP4 init 세그먼트. 이를 참조하는 세그먼트가 캐시에 남아 있는 동안 유지한다.
+	cur    string            // 가장 최근에 추가한 init 세그먼트 이름
+	keys   map[string][]byte // 세그먼트 암호화 키. 이를 참조하는 세그먼트가 캐시에 남아 있는 동안 유지한다.
+	curKey string            // 가장 최근에 추가한 키 이름
+	disc   int               // 캐시에서 빠진 세그먼트의 #EXT-X-DISCONTINUITY 수 (#EXT-X-DISCONTINUITY-SEQUENCE)
+
+	// LL-HLS
+	partTarget int               // 부분 세그먼트 목표 길이(ms). 0 이면 LL-HLS 태그를 쓰지 않는다.
+	parts      map[string]TSItem // 캐시에 남은 세그먼트와 진행 중인 세그먼트의 부분 세그먼트
+	pending    []TSItem          // 아직 끝나지 않은 세그먼트의 부분 세그먼트
+	preload    string            // 다음에 만들어질 부분 세그먼트 이름 (#EXT-X-PRELOAD-HINT)
+	lastSeq    int               // 마지막으로 완성된 세그먼트의 시퀀스 번호
+	notify     chan struct{}     // 캐시가 바뀔 때마다 닫고 새로 만든다. 블로킹 요청이 이를 기다린다.
 }
 
-func NewTSCacheItem(id string) *TSCacheItem {
+// num 은 플레이리스트에 남길 세그먼트 수이다. 0 이하면 maxTSCacheNum 을 쓴다.
+func NewTSCacheItem(id string, num int) *TSCacheItem {
+	if num <= 0 {
+		num = maxTSCacheNum
+	}
 	return &TSCacheItem{
-		id:  id,
-		ll:  list.New(),
-		num: maxTSCacheNum,
-		lm:  make(map[string]TSItem),
+		id:     id,
+		ll:     list.New(),
+		num:    num,
+		lm:     make(map[string]TSItem),
+		maps:   make(map[string]TSItem),
+		keys:   make(map[string][]byte),
+		parts:  make(map[string]TSItem),
+		notify: make(chan struct{}),
 	}
 }
 
+// LL-HLS 를 켜고 부분 세그먼트 목표 길이(ms)를 정한다.
+func (tcCacheItem *TSCacheItem) SetPartTarget(ms int) {
+	tcCacheItem.lock.Lock()
+	defer tcCacheItem.lock.Unlock()
+	tcCacheItem.partTarget = ms
+}
+
 // ts 캐시의 고유 식별자를 반환하는 메서드이다.
 func (tcCacheItem *TSCacheItem) ID() string {
 	return tcCacheItem.id
 }
 
 // 세그먼트 데이터를 기반으로 M3U8 플레이리스트 생성하는 기능을 한다.
-// TODO: found data race, fix it
+// LL-HLS 를 쓰면 최근 세그먼트의 부분 세그먼트(#EXT-X-PART)와 다음 부분 세그먼트의 힌트(#EXT-X-PRELOAD-HINT)를 함께 쓴다.
 func (tcCacheItem *TSCacheItem) GenM3U8PlayList() ([]byte, error) {
+	tcCacheItem.lock.RLock()
+	defer tcCacheItem.lock.RUnlock()
+
 	var seq int         // 플레이리스트 첫번쨰 세그먼트 시퀀스 번호 #EXT-X-MEDIA-SEQUENCE
 	var getSeq bool     // 첫 번쨰 시퀀스 번호가 설정되었는가?
 	var maxDuration int // 첫 번째 순회 시 seq 값을 설정하는 데 사용.
+	var tags tagState   // 마지막으로 쓴 #EXT-X-MAP, #EXT-X-KEY
 	m3u8body := bytes.NewBuffer(nil)
+	llhls := tcCacheItem.partTarget > 0
+	partsFrom := tcCacheItem.partsFrom()
 	// 세그먼트 듀레이션과 파일 이름을 나타낸다.
+	i := 0
 	for e := tcCacheItem.ll.Front(); e != nil; e = e.Next() { // 연결리스트의 첫번쨰 요소를 반환한다.
 		key := e.Value.(string) // ll의 인터페이스도 interface {} 타입으로, 타입 단언이 필요하다.
 		v, ok := tcCacheItem.lm[key]
@@ -57,38 +100,379 @@ func (tcCacheItem *TSCacheItem) GenM3U8PlayList() ([]byte, error) {
 				getSeq = true
 				seq = v.SeqNum
 			}
+			writeTags(m3u8body, v, &tags)
+			if llhls && i >= partsFrom {
+				for _, part := range v.Parts {
+					writePart(m3u8body, part)
+				}
+			}
 
 			// 파일이나 소켓, 버퍼등 특정 서식에 저장하고 프린트한다.
 			fmt.Fprintf(m3u8body, "#EXTINF:%.3f,\n%s\n", float64(v.Duration)/float64(1000), v.Name)
 		}
+		i++
+	}
+	if llhls {
+		// 진행 중인 세그먼트는 부분 세그먼트로만 알린다.
+		for i, part := range tcCacheItem.pending {
+			if !getSeq {
+				getSeq = true
+				seq = part.SeqNum
+			}
+			if i == 0 {
+				writeTags(m3u8body, part, &tags)
+			}
+			writePart(m3u8body, part)
+		}
+		if tcCacheItem.preload != "" {
+			fmt.Fprintf(m3u8body, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s\"\n", tcCacheItem.preload)
+		}
 	}
 	w := bytes.NewBuffer(nil)
 	// m3u 는 mp3 url 의 약자로, 원래 mp3파일에서 재생 목록을 정의하기위해 개발된 텍스트 파일 형식이다. m3u8은 그 확장버전으로 utf8 인코딩을 지원하고 hls 에서 사용된다.
 	// ext-x-는 hls 에서만 사용되는 확장 태그로, 스트리밍 세그먼트와 재생 정보를 정의한다. 가장 긴 세그먼트보다 크거나 같아야 하므로 1 을 더해준다.( 버림 방지)
 	fmt.Fprintf(w,
-		"#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-ALLOW-CACHE:NO\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:%d\n\n",
-		maxDuration/1000+1, seq)
+		"#EXTM3U\n#EXT-X-VERSION:%d\n#EXT-X-ALLOW-CACHE:NO\n#EXT-X-TARGETDURATION:%d\n",
+		tags.version(), maxDuration/1000+1)
+	if llhls {
+		// 플레이어는 라이브 끝에서 부분 세그먼트 목표 길이의 세 배 이상 떨어져 재생을 시작해야 한다.
+		partTarget := float64(tcCacheItem.partTarget) / 1000
+		fmt.Fprintf(w, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n#EXT-X-PART-INF:PART-TARGET=%.3f\n",
+			3*partTarget, partTarget)
+	}
+	fmt.Fprintf(w, "#EXT-X-MEDIA-SEQUENCE:%d\n", seq)
+	if tcCacheItem.disc > 0 {
+		fmt.Fprintf(w, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", tcCacheItem.disc)
+	}
+	fmt.Fprint(w, "\n")
 	w.Write(m3u8body.Bytes())
 	return w.Bytes(), nil
 }
 
+// 플레이리스트를 쓰면서 마지막으로 쓴 #EXT-X-MAP 과 #EXT-X-KEY 를 기억한다.
+type tagState struct {
+	mapName   string // 마지막으로 쓴 init 세그먼트 이름
+	keyName   string // 마지막으로 쓴 키 URI
+	sampleAES bool   // SAMPLE-AES 로 암호화한 세그먼트가 있는지 여부
+}
+
+// 플레이리스트에 필요한 #EXT-X-VERSION.
+// #EXT-X-MAP 을 쓰는 fMP4 플레이리스트는 버전 7, SAMPLE-AES 는 버전 5 가 필요하다.
+func (st *tagState) version() int {
+	if st.mapName != "" {
+		return 7
+	}
+	if st.sampleAES {
+		return 5
+	}
+	return 3
+}
+
+// 세그먼트(또는 진행 중인 세그먼트의 첫 부분 세그먼트) 앞에 붙는 태그를 쓴다.
+// fMP4 세그먼트는 init 세그먼트가 바뀔 때마다 그 앞에 #EXT-X-MAP 을, 암호화한 세그먼트는 키가 바뀔 때마다 #EXT-X-KEY 를 쓴다.
+func writeTags(w io.Writer, v TSItem, st *tagState) {
+	if v.Discontinuity {
+		fmt.Fprint(w, "#EXT-X-DISCONTINUITY\n")
+	}
+	if v.KeyName != st.keyName {
+		st.keyName = v.KeyName
+		if v.KeyName == "" {
+			fmt.Fprint(w, "#EXT-X-KEY:METHOD=NONE\n")
+		} else {
+			fmt.Fprintf(w, "#EXT-X-KEY:METHOD=%s,URI=\"%s\"\n", v.KeyMethod, v.KeyName)
+		}
+	}
+	if v.KeyMethod == "SAMPLE-AES" {
+		st.sampleAES = true
+	}
+	if v.MapName != "" && v.MapName != st.mapName {
+		st.mapName = v.MapName
+		fmt.Fprintf(w, "#EXT-X-MAP:URI=\"%s\"\n", st.mapName)
+	}
+	if !v.ProgramDateTime.IsZero() {
+		fmt.Fprintf(w, "#EXT-X-PROGRAM-DATE-TIME:%s\n", v.ProgramDateTime.Format(programDateTimeFormat))
+	}
+	if v.Cue != nil {
+		writeCue(w, v.Cue)
+	}
+}
+
+// 광고 구간 태그를 쓴다.
+// cue 형식은 광고 시작에 #EXT-X-CUE-OUT, 중간 세그먼트마다 #EXT-X-CUE-OUT-CONT, 끝에 #EXT-X-CUE-IN 을 쓴다.
+// daterange 형식은 광고 시작과 끝에 같은 ID 의 #EXT-X-DATERANGE 를 SCTE-35 splice_insert 와 함께 쓴다.
+func writeCue(w io.Writer, cue *CueTag) {
+	seconds := func(ms uint32) float64 { return float64(ms) / 1000 }
+	if !cue.DateRange {
+		switch cue.Type {
+		case cueOut:
+			if cue.Duration > 0 {
+				fmt.Fprintf(w, "#EXT-X-CUE-OUT:DURATION=%.3f\n", seconds(cue.Duration))
+			} else {
+				fmt.Fprint(w, "#EXT-X-CUE-OUT\n")
+			}
+		case cueCont:
+			fmt.Fprintf(w, "#EXT-X-CUE-OUT-CONT:ElapsedTime=%.3f", seconds(cue.Elapsed))
+			if cue.Duration > 0 {
+				fmt.Fprintf(w, ",Duration=%.3f", seconds(cue.Duration))
+			}
+			fmt.Fprint(w, "\n")
+		case cueIn:
+			fmt.Fprint(w, "#EXT-X-CUE-IN\n")
+		}
+		return
+	}
+	switch cue.Type {
+	case cueOut:
+		fmt.Fprintf(w, "#EXT-X-DATERANGE:ID=\"splice-%d\",START-DATE=\"%s\"", cue.ID, cue.Start.Format(programDateTimeFormat))
+		if cue.Duration > 0 {
+			fmt.Fprintf(w, ",PLANNED-DURATION=%.3f", seconds(cue.Duration))
+		}
+		fmt.Fprintf(w, ",SCTE35-OUT=0x%X\n", ts.SpliceInsert(cue.ID, true, cue.Duration))
+	case cueIn:
+		fmt.Fprintf(w, "#EXT-X-DATERANGE:ID=\"splice-%d\",START-DATE=\"%s\",END-DATE=\"%s\",DURATION=%.3f,SCTE35-IN=0x%X\n",
+			cue.ID, cue.Start.Format(programDateTimeFormat),
+			cue.Start.Add(time.Duration(cue.Elapsed)*time.Millisecond).Format(programDateTimeFormat),
+			seconds(cue.Elapsed), ts.SpliceInsert(cue.ID, false, 0))
+	}
+}
+
+func writePart(w io.Writer, part TSItem) {
+	fmt.Fprintf(w, "#EXT-X-PART:DURATION=%.3f,URI=\"%s\"", float64(part.Duration)/float64(1000), part.Name)
+	if part.Independent {
+		fmt.Fprint(w, ",INDEPENDENT=YES")
+	}
+	fmt.Fprint(w, "\n")
+}
+
+// 부분 세그먼트를 쓸 첫 세그먼트의 위치를 반환한다.
+// 플레이리스트 끝에서 목표 길이(가장 긴 세그먼트)의 세 배보다 오래된 세그먼트는 부분 세그먼트를 쓰지 않는다.
+func (tcCacheItem *TSCacheItem) partsFrom() int {
+	var maxDuration int
+	for _, v := range tcCacheItem.lm {
+		if v.Duration > maxDuration {
+			maxDuration = v.Duration
+		}
+	}
+	i := tcCacheItem.ll.Len()
+	total := 0
+	for e := tcCacheItem.ll.Back(); e != nil; e = e.Prev() {
+		total += tcCacheItem.lm[e.Value.(string)].Duration
+		if total > 3*maxDuration {
+			break
+		}
+		i--
+	}
+	return i
+}
+
 // 새로운 항목 key, item 을 캐시에 추가한다. 캐시 크기가 초과되면 오래된 항목을 제거한다.
+// LL-HLS 에서는 그동안 추가한 부분 세그먼트를 이 세그먼트의 것으로 묶는다.
 func (tcCacheItem *TSCacheItem) SetItem(key string, item TSItem) {
+	tcCacheItem.lock.Lock()
+	defer tcCacheItem.lock.Unlock()
+
 	if tcCacheItem.ll.Len() == tcCacheItem.num {
 		e := tcCacheItem.ll.Front() // 가장 오래된 항목 (리스트 첫 번쨰 요소)
 		tcCacheItem.ll.Remove(e)    // 리스트에서 제거한다.
 		k := e.Value.(string)       // 제거된 항목의 키를 가져온다.
-		delete(tcCacheItem.lm, k)   // 맵에서 해당 키를 삭제한다.
+		for _, part := range tcCacheItem.lm[k].Parts {
+			delete(tcCacheItem.parts, part.Name)
+		}
+		if tcCacheItem.lm[k].Discontinuity {
+			tcCacheItem.disc++
+		}
+		delete(tcCacheItem.lm, k) // 맵에서 해당 키를 삭제한다.
+	}
+	if len(tcCacheItem.pending) > 0 {
+		// 세그먼트 길이는 부분 세그먼트 길이의 합과 같아야 한다.
+		item.Parts = tcCacheItem.pending
+		item.Duration = 0
+		for _, part := range item.Parts {
+			item.Duration += part.Duration
+		}
+		tcCacheItem.pending = nil
 	}
 	tcCacheItem.lm[key] = item
 	tcCacheItem.ll.PushBack(key)
+	tcCacheItem.lastSeq = item.SeqNum
+	tcCacheItem.pruneMaps()
+	tcCacheItem.pruneKeys()
+	tcCacheItem.changed()
+}
+
+// 진행 중인 세그먼트에 부분 세그먼트를 추가한다. preload 는 다음에 만들어질 부분 세그먼트 이름이다.
+func (tcCacheItem *TSCacheItem) SetPart(item TSItem, preload string) {
+	tcCacheItem.lock.Lock()
+	defer tcCacheItem.lock.Unlock()
+	tcCacheItem.pending = append(tcCacheItem.pending, item)
+	tcCacheItem.parts[item.Name] = item
+	tcCacheItem.preload = preload
+	tcCacheItem.changed()
+}
+
+// 끝나지 않은 세그먼트의 부분 세그먼트를 버린다. 퍼블리셔가 다시 들어와 세그먼트를 처음부터 다시 만들 때 사용한다.
+func (tcCacheItem *TSCacheItem) DropPending() {
+	tcCacheItem.lock.Lock()
+	defer tcCacheItem.lock.Unlock()
+	for _, part := range tcCacheItem.pending {
+		delete(tcCacheItem.parts, part.Name)
+	}
+	tcCacheItem.pending = nil
+	tcCacheItem.preload = ""
+	tcCacheItem.changed()
+}
+
+// fMP4 init 세그먼트를 추가한다. 이후 SetItem 으로 추가하는 세그먼트는 MapName 으로 이를 참조한다.
+func (tcCacheItem *TSCacheItem) SetMap(key string, item TSItem) {
+	tcCacheItem.lock.Lock()
+	defer tcCacheItem.lock.Unlock()
+	tcCacheItem.maps[key] = item
+	tcCacheItem.cur = key
+}
+
+// 캐시에 남은 세그먼트가 더 이상 참조하지 않는 init 세그먼트를 지운다.
+// 가장 최근의 init 세그먼트는 아직 세그먼트가 없더라도 남겨 둔다.
+func (tcCacheItem *TSCacheItem) pruneMaps() {
+	used := map[string]bool{tcCacheItem.cur: true}
+	for _, item := range tcCacheItem.lm {
+		used[item.MapName] = true
+	}
+	for _, item := range tcCacheItem.pending {
+		used[item.MapName] = true
+	}
+	for k := range tcCacheItem.maps {
+		if !used[k] {
+			delete(tcCacheItem.maps, k)
+		}
+	}
+}
+
+// 세그먼트 암호화 키를 추가한다. 이후 SetItem 으로 추가하는 세그먼트는 KeyName 으로 이를 참조한다.
+func (tcCacheItem *TSCacheItem) SetKey(key string, b []byte) {
+	tcCacheItem.lock.Lock()
+	defer tcCacheItem.lock.Unlock()
+	tcCacheItem.keys[key] = b
+	tcCacheItem.curKey = key
+}
+
+// 세그먼트 암호화 키를 조회한다.
+func (tcCacheItem *TSCacheItem) GetKey(key string) ([]byte, error) {
+	tcCacheItem.lock.RLock()
+	defer tcCacheItem.lock.RUnlock()
+	if b, ok := tcCacheItem.keys[key]; ok {
+		return b, nil
+	}
+	return nil, ErrNoKey
+}
+
+// 캐시에 남은 세그먼트가 더 이상 참조하지 않는 키를 지운다. 가장 최근의 키는 남겨 둔다.
+func (tcCacheItem *TSCacheItem) pruneKeys() {
+	used := map[string]bool{tcCacheItem.curKey: true}
+	for _, item := range tcCacheItem.lm {
+		used[item.KeyName] = true
+	}
+	for _, item := range tcCacheItem.pending {
+		used[item.KeyName] = true
+	}
+	for k := range tcCacheItem.keys {
+		if !used[k] {
+			delete(tcCacheItem.keys, k)
+		}
+	}
+}
+
+// 블로킹 요청을 깨운다. lock 을 잡은 상태에서 호출한다.
+func (tcCacheItem *TSCacheItem) changed() {
+	close(tcCacheItem.notify)
+	tcCacheItem.notify = make(chan struct{})
 }
 
 // TS 캐시에서 특정 항목을 조회하는 메서드이다. 주어진 키(key)에 해당하는 항목을 반환하거나 항목이 존재하지 않을 경우 에러를 반환한다.
 func (tcCacheItem *TSCacheItem) GetItem(key string) (TSItem, error) {
-	item, ok := tcCacheItem.lm[key]
-	if !ok {
-		return item, ErrNoKey
+	tcCacheItem.lock.RLock()
+	defer tcCacheItem.lock.RUnlock()
+	return tcCacheItem.getItem(key)
+}
+
+func (tcCacheItem *TSCacheItem) getItem(key string) (TSItem, error) {
+	if item, ok := tcCacheItem.lm[key]; ok {
+		return item, nil
+	}
+	if item, ok := tcCacheItem.parts[key]; ok {
+		return item, nil
+	}
+	if item, ok := tcCacheItem.maps[key]; ok {
+		return item, nil
+	}
+	return TSItem{}, ErrNoKey
+}
+
+// 항목을 조회하되, #EXT-X-PRELOAD-HINT 로 알린 부분 세그먼트면 만들어질 때까지 기다린다.
+func (tcCacheItem *TSCacheItem) WaitItem(key string, timeout time.Duration) (TSItem, error) {
+	deadline := time.After(timeout)
+	for {
+		tcCacheItem.lock.RLock()
+		item, err := tcCacheItem.getItem(key)
+		hinted := key == tcCacheItem.preload
+		notify := tcCacheItem.notify
+		tcCacheItem.lock.RUnlock()
+		if err == nil || !hinted {
+			return item, err
+		}
+		select {
+		case <-notify:
+		case <-deadline:
+			return item, ErrBlockingTimeout
+		}
+	}
+}
+
+// 블로킹 플레이리스트 리로드(_HLS_msn, _HLS_part)를 처리한다.
+// 플레이리스트에 msn 세그먼트(part 가 0 이상이면 그 부분 세그먼트)가 들어올 때까지 기다린다.
+func (tcCacheItem *TSCacheItem) WaitPlaylist(msn, part int, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for {
+		tcCacheItem.lock.RLock()
+		ready, err := tcCacheItem.hasPart(msn, part)
+		notify := tcCacheItem.notify
+		tcCacheItem.lock.RUnlock()
+		if ready || err != nil {
+			return err
+		}
+		select {
+		case <-notify:
+		case <-deadline:
+			return ErrBlockingTimeout
+		}
+	}
+}
+
+func (tcCacheItem *TSCacheItem) hasPart(msn, part int) (bool, error) {
+	next := tcCacheItem.lastSeq + 1 // 진행 중인 세그먼트
+	// 마지막 세그먼트보다 둘 이상 앞선 요청은 기다리지 않는다.
+	if msn > next+1 {
+		return false, ErrInvalidBlockingReq
+	}
+	if msn < next {
+		return true, nil
+	}
+	if msn > next || part < 0 {
+		return false, nil
+	}
+	return len(tcCacheItem.pending) > part, nil
+}
+
+// 마지막 세그먼트 번호와 그 안의 마지막 부분 세그먼트 번호를 반환한다. 부분 세그먼트가 없으면 part 는 -1 이다.
+// 다른 렌디션의 플레이리스트에 #EXT-X-RENDITION-REPORT 로 쓴다.
+func (tcCacheItem *TSCacheItem) LastPart() (msn, part int) {
+	tcCacheItem.lock.RLock()
+	defer tcCacheItem.lock.RUnlock()
+	if len(tcCacheItem.pending) > 0 {
+		return tcCacheItem.pending[0].SeqNum, len(tcCacheItem.pending) - 1
+	}
+	part = -1
+	if e := tcCacheItem.ll.Back(); e != nil {
+		part = len(tcCacheItem.lm[e.Value.(string)].Parts) - 1
 	}
-	return item, nil
+	return tcCacheItem.lastSeq, part
 }
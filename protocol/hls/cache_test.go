@@ -0,0 +1,158 @@
+package hls
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// seq 번 세그먼트를 부분 세그먼트 둘(첫째는 키프레임으로 시작)로 채워 넣는다.
+func addPartedSegment(c *TSCacheItem, seq int) {
+	for i := 0; i < 2; i++ {
+		part := NewTSItem(fmt.Sprintf("%d.%d.ts", seq, i), 500, seq, nil)
+		part.Independent = i == 0
+		c.SetPart(part, fmt.Sprintf("%d.%d.ts", seq, i+1))
+	}
+	c.SetItem(fmt.Sprintf("%d.ts", seq), NewTSItem(fmt.Sprintf("%d.ts", seq), 0, seq, nil))
+}
+
+func partLines(seq int) string {
+	return fmt.Sprintf("#EXT-X-PART:DURATION=0.500,URI=\"%d.0.ts\",INDEPENDENT=YES\n#EXT-X-PART:DURATION=0.500,URI=\"%d.1.ts\"\n", seq, seq)
+}
+
+func segmentLines(seq int) string {
+	return fmt.Sprintf("#EXTINF:1.000,\n%d.ts\n", seq)
+}
+
+func TestGenM3U8PlayListLLHLS(t *testing.T) {
+	header := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-ALLOW-CACHE:NO\n#EXT-X-TARGETDURATION:2\n"
+	tests := []struct {
+		name       string
+		partTarget int
+		want       string
+	}{
+		{
+			name:       "ll-hls",
+			partTarget: 500,
+			want: header +
+				"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=1.500\n#EXT-X-PART-INF:PART-TARGET=0.500\n" +
+				"#EXT-X-MEDIA-SEQUENCE:2\n\n" +
+				// 끝에서 목표 길이의 세 배보다 오래된 세그먼트에는 부분 세그먼트를 쓰지 않는다.
+				segmentLines(2) +
+				partLines(3) + segmentLines(3) +
+				partLines(4) + segmentLines(4) +
+				partLines(5) + segmentLines(5) +
+				"#EXT-X-PART:DURATION=0.400,URI=\"6.0.ts\",INDEPENDENT=YES\n" +
+				"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"6.1.ts\"\n",
+		},
+		{
+			name: "plain",
+			want: header + "#EXT-X-MEDIA-SEQUENCE:2\n\n" +
+				segmentLines(2) + segmentLines(3) + segmentLines(4) + segmentLines(5),
+		},
+	}
+	for _, test := range tests {
+		c := NewTSCacheItem("live/movie", 4)
+		c.SetPartTarget(test.partTarget)
+		for seq := 1; seq <= 5; seq++ {
+			addPartedSegment(c, seq)
+		}
+		part := NewTSItem("6.0.ts", 400, 6, nil)
+		part.Independent = true
+		c.SetPart(part, "6.1.ts")
+
+		body, err := c.GenM3U8PlayList()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != test.want {
+			t.Errorf("%s:\n%s\nwant\n%s", test.name, body, test.want)
+		}
+	}
+}
+
+func TestCacheParts(t *testing.T) {
+	c := NewTSCacheItem("live/movie", 2)
+	c.SetPartTarget(500)
+	for seq := 1; seq <= 3; seq++ {
+		addPartedSegment(c, seq)
+	}
+	tests := []struct {
+		key string
+		ok  bool
+	}{
+		{"1.ts", false},
+		{"1.0.ts", false},
+		{"2.ts", true},
+		{"2.1.ts", true},
+		{"3.0.ts", true},
+		{"4.0.ts", false},
+	}
+	for _, test := range tests {
+		if _, err := c.GetItem(test.key); (err == nil) != test.ok {
+			t.Errorf("GetItem(%s) = %v, want ok %v", test.key, err, test.ok)
+		}
+	}
+	item, _ := c.GetItem("3.ts")
+	if item.Duration != 1000 || len(item.Parts) != 2 {
+		t.Errorf("segment duration %d with %d parts, want 1000 with 2", item.Duration, len(item.Parts))
+	}
+	if msn, part := c.LastPart(); msn != 3 || part != 1 {
+		t.Errorf("LastPart = %d %d, want 3 1", msn, part)
+	}
+}
+
+func TestWaitPlaylist(t *testing.T) {
+	c := NewTSCacheItem("live/movie", 3)
+	c.SetPartTarget(500)
+	for seq := 1; seq <= 5; seq++ {
+		addPartedSegment(c, seq)
+	}
+	c.SetPart(NewTSItem("6.0.ts", 500, 6, nil), "6.1.ts")
+
+	tests := []struct {
+		name      string
+		msn, part int
+		err       error
+	}{
+		{"old segment", 4, -1, nil},
+		{"last segment", 5, 1, nil},
+		{"pending part", 6, 0, nil},
+		{"next part", 6, 1, ErrBlockingTimeout},
+		{"pending segment", 6, -1, ErrBlockingTimeout},
+		{"segment after pending", 7, 0, ErrBlockingTimeout},
+		{"too far ahead", 8, 0, ErrInvalidBlockingReq},
+	}
+	for _, test := range tests {
+		if err := c.WaitPlaylist(test.msn, test.part, 20*time.Millisecond); err != test.err {
+			t.Errorf("%s: WaitPlaylist(%d, %d) = %v, want %v", test.name, test.msn, test.part, err, test.err)
+		}
+	}
+
+	// 기다리던 부분 세그먼트가 들어오면 깨어난다.
+	done := make(chan error, 2)
+	go func() { done <- c.WaitPlaylist(6, 1, time.Second) }()
+	go func() {
+		_, err := c.WaitItem("6.1.ts", time.Second)
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	c.SetPart(NewTSItem("6.1.ts", 500, 6, nil), "6.2.ts")
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Errorf("blocking request = %v", err)
+		}
+	}
+
+	if _, err := c.WaitItem("9.0.ts", time.Second); err != ErrNoKey {
+		t.Errorf("WaitItem for a part that is not hinted = %v, want %v", err, ErrNoKey)
+	}
+
+	// 퍼블리셔가 다시 들어와 진행 중인 세그먼트를 버리면 힌트도 지운다.
+	c.DropPending()
+	body, _ := c.GenM3U8PlayList()
+	if strings.Contains(string(body), "6.0.ts") || strings.Contains(string(body), "PRELOAD-HINT") {
+		t.Errorf("pending parts left after DropPending:\n%s", body)
+	}
+}
@@ -0,0 +1,152 @@
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gwuhaolin/livego/parser/cea608"
+	"github.com/gwuhaolin/livego/parser/h264"
+)
+
+/*
+WebVTT 자막
+H.264 SEI 에 실린 CEA-608 캡션을 해석해, 비디오 세그먼트와 같은 시퀀스 번호와 구간의 WebVTT 세그먼트로 만든다.
+자막 플레이리스트는 /<APP>/<NAME>/captions.m3u8 이고, 마스터 플레이리스트 /<APP>/<NAME>/master.m3u8 이 이를 #EXT-X-MEDIA:TYPE=SUBTITLES 로 알린다.
+큐 시각은 비디오 PTS(ms) 이며, 세그먼트의 PTS 는 타임스탬프에 오프셋 없이 90kHz 를 곱한 값이므로 X-TIMESTAMP-MAP 은 0 과 0 을 맞춘다.
+*/
+
+const (
+	captionPlaylistName = "captions"
+	masterPlaylistName  = "master"
+	subtitleGroup       = "subs"
+
+	webVTTHeader = "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:0,LOCAL:00:00:00.000\n"
+)
+
+// 캡션 바이트 쌍을 실은 비디오 프레임
+type captionFrame struct {
+	pts   uint32
+	pairs []byte
+}
+
+type captionTrack struct {
+	decoder *cea608.Decoder
+	frames  []captionFrame // 아직 디코더에 넣지 않은 프레임. PTS 순서이다.
+	cache   *TSCacheItem   // WebVTT 세그먼트
+}
+
+func newCaptionTrack(key string, num int) *captionTrack {
+	return &captionTrack{
+		decoder: cea608.NewDecoder(),
+		cache:   NewTSCacheItem(key, num),
+	}
+}
+
+// AVCC 비디오 프레임의 캡션을 읽는다.
+// 캡션은 표시 순서(PTS)로 해석해야 하므로, B 프레임 때문에 디코딩 순서와 다르게 온 프레임은 DTS 가 PTS 를 지날 때까지 모아 둔다.
+func (track *captionTrack) write(dts, pts uint32, avcc []byte) {
+	if pairs := h264.CaptionData(avcc); len(pairs) > 0 {
+		i := len(track.frames)
+		for i > 0 && track.frames[i-1].pts > pts {
+			i--
+		}
+		track.frames = append(track.frames, captionFrame{})
+		copy(track.frames[i+1:], track.frames[i:])
+		track.frames[i] = captionFrame{pts: pts, pairs: pairs}
+	}
+	track.release(dts)
+}
+
+// PTS 가 end 보다 앞선 프레임을 디코더에 넣는다.
+func (track *captionTrack) release(end uint32) {
+	n := 0
+	for ; n < len(track.frames) && track.frames[n].pts < end; n++ {
+		f := track.frames[n]
+		for i := 0; i+1 < len(f.pairs); i += 2 {
+			track.decoder.Decode(f.pts, f.pairs[i], f.pairs[i+1])
+		}
+	}
+	track.frames = track.frames[n:]
+}
+
+// 비디오 세그먼트 item 과 같은 구간의 WebVTT 세그먼트를 만든다. end 는 세그먼트가 끝나는 타임스탬프이다.
+// 타임스탬프가 끊기면 남은 프레임을 모두 넣고 디코더를 새로 만든다.
+func (track *captionTrack) segment(item TSItem, end uint32, discontinuity bool) {
+	if discontinuity {
+		track.release(^uint32(0))
+	} else {
+		track.release(end)
+	}
+	cues := track.decoder.Flush(end)
+	if discontinuity {
+		track.decoder = cea608.NewDecoder()
+	}
+
+	name := strings.TrimSuffix(item.Name, path.Ext(item.Name)) + ".vtt"
+	vtt := NewTSItem(name, item.Duration, item.SeqNum, webVTT(cues))
+	vtt.Discontinuity = item.Discontinuity
+	vtt.ProgramDateTime = item.ProgramDateTime
+	track.cache.SetItem(name, vtt)
+}
+
+func webVTT(cues []cea608.Cue) []byte {
+	w := bytes.NewBufferString(webVTTHeader)
+	escape := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	for _, cue := range cues {
+		fmt.Fprintf(w, "\n%s --> %s\n%s\n", vttTime(cue.Start), vttTime(cue.End), escape.Replace(cue.Text))
+	}
+	return w.Bytes()
+}
+
+// WebVTT 타임스탬프 (hh:mm:ss.ttt)
+func vttTime(ms uint32) string {
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// /<APP>/<NAME>/captions.m3u8 는 자막 플레이리스트, /<APP>/<NAME>/master.m3u8 은 스트림과 자막을 묶은 마스터 플레이리스트이다.
+func (server *Server) handleCaptionPlaylist(w http.ResponseWriter, r *http.Request, key, name string) {
+	conn := server.getConn(key)
+	if conn == nil || conn.captions == nil {
+		http.Error(w, ErrNoPublisher.Error(), http.StatusNotFound)
+		return
+	}
+	var body []byte
+	var err error
+	if name == masterPlaylistName {
+		body, err = server.masterPlaylist(r, key, []string{key})
+	} else {
+		body, err = conn.captions.cache.GenM3U8PlayList()
+		body = appendQuery(body, tokenQuery(r, key, key))
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "application/x-mpegURL")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+}
+
+func (server *Server) handleCaptionSegment(w http.ResponseWriter, r *http.Request) {
+	key, _ := server.parseTs(r.URL.Path)
+	conn := server.getConn(key)
+	if conn == nil || conn.captions == nil {
+		http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
+		return
+	}
+	item, err := conn.captions.cache.GetItem(r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "text/vtt")
+	w.Header().Set("Content-Length", strconv.Itoa(len(item.Data)))
+	w.Write(item.Data)
+}
@@ -1,6 +1,7 @@
 package hls
 
 import (
+	"bytes"
 	"fmt"
 	"net"
 	"net/http"
@@ -11,6 +12,9 @@ import (
 	"time"
 
 	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/protocol/auth"
+	"github.com/gwuhaolin/livego/protocol/event"
+	"github.com/gwuhaolin/livego/protocol/metrics"
 
 	"github.com/gwuhaolin/livego/av"
 
@@ -26,6 +30,7 @@ var (
 	ErrInvalidReq          = fmt.Errorf("invalid req url path")
 	ErrNoSupportVideoCodec = fmt.Errorf("no support video codec")
 	ErrNoSupportAudioCodec = fmt.Errorf("no support audio codec")
+	ErrNoRendition         = fmt.Errorf("no rendition measured yet")
 )
 
 // crossdomain.xml 파일의 내용을 미리 정의한 바이트 배열이다.
@@ -39,15 +44,26 @@ var crossdomainxml = []byte(`<?xml version="1.0" ?>
 	<allow-http-request-headers-from domain="*" headers="*"/>
 </cross-domain-policy>`)
 
+// 세그먼트 확장자별 Content-Type
+var segmentContentTypes = map[string]string{
+	".ts":  "video/mp2ts",
+	".m4s": "video/iso.segment",
+	".mp4": "video/mp4",
+}
+
 // 네트워크 서버의 동작을 관리하기 위해 설계된 구조체. 이 구조체는 클라이언트 연결과 네트워크 리스너를 관리한다.
 type Server struct {
-	listener net.Listener // 네트워크 연결을 수신 대기하는 리스너
-	conns    *sync.Map    // 연결된 클라이언트들을 관리하기 위한 동시성 맵
+	listener net.Listener    // 네트워크 연결을 수신 대기하는 리스너
+	conns    *sync.Map       // 연결된 클라이언트들을 관리하기 위한 동시성 맵
+	bw       av.GetBandwidth // 마스터 플레이리스트의 BANDWIDTH 로 쓸 퍼블리셔 비트레이트 측정값
+	viewers  *sync.Map       // 웹훅 세션을 연 시청자. "<IP>|<APP>/<NAME>" → *viewer
 }
 
-func NewServer() *Server {
+func NewServer(bw av.GetBandwidth) *Server {
 	ret := &Server{
-		conns: &sync.Map{},
+		conns:   &sync.Map{},
+		bw:      bw,
+		viewers: &sync.Map{},
 	}
 	go ret.checkStop()
 	return ret
@@ -80,8 +96,14 @@ func (server *Server) GetWriter(info av.Info) av.WriteCloser {
 		log.Debug("new hls source")
 		s = NewSource(info)
 		server.conns.Store(info.Key, s)
+	} else if old := v.(*Source); old.closed {
+		// 퍼블리셔가 다시 들어왔다. 이전 플레이리스트를 이어서 쓴다.
+		log.Debug("resume hls source")
+		s = NewSource(info)
+		s.resume(old)
+		server.conns.Store(info.Key, s)
 	} else {
-		s = v.(*Source)
+		s = old
 	}
 	return s
 }
@@ -106,6 +128,7 @@ func (server *Server) checkStop() {
 			}
 			return true
 		})
+		server.expireViewers()
 	}
 }
 
@@ -122,6 +145,24 @@ func (server *Server) handle(w http.ResponseWriter, r *http.Request) {
 		w.Write(crossdomainxml)
 		return
 	}
+	// 디스크에 녹화된 플레이리스트와 세그먼트
+	if strings.HasPrefix(r.URL.Path, recordPrefix) {
+		server.handleRecord(w, r)
+		return
+	}
+	// 재생 인증과 웹훅 세션
+	stream := playStream(r.URL.Path)
+	if err := auth.CheckPlayRequest(r, stream); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := server.checkViewer(r, stream); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if stream != "" {
+		w = countRequest(w, stream)
+	}
 	// 요청 경로에서 파일 확장자 추출. ex ) .m3u8, .ts 등
 	switch path.Ext(r.URL.Path) {
 	// .m3u8 파일은 스트리밍의 메타데이터(총 지속시간, 세그먼트 길이), ts파일의 url 및 경로, 스트림 재생 순서와 관한 정보를 가지고 있다.
@@ -129,6 +170,25 @@ func (server *Server) handle(w http.ResponseWriter, r *http.Request) {
 	case ".m3u8":
 		// 요청경로를 분석해 스트림 키를 추출한다.
 		key, _ := server.parseM3u8(r.URL.Path)
+		// 렌디션 묶음 이름이면 화질별 플레이리스트를 가리키는 마스터 플레이리스트를 보낸다.
+		if keys, ok := configure.Renditions.Get(key); ok {
+			body, err := server.masterPlaylist(r, key, keys)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("Content-Type", "application/x-mpegURL")
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			w.Write(body)
+			return
+		}
+		// 스트림 아래의 자막 플레이리스트와 마스터 플레이리스트
+		if parts := strings.Split(key, "/"); len(parts) == 3 {
+			server.handleCaptionPlaylist(w, r, parts[0]+"/"+parts[1], parts[2])
+			return
+		}
 		// 키에 해당하는 스트림 연결 객체를 탐색한다. 서버에서 특정 스트림 데이터를 식별하기 위한 고유 식별자 역할을 한다.
 		// ex ) 여기서 스트림 키는 단순 파일을 지칭하는게 아닌, 특정 스트림 세션을 의미한다. live/stream
 		conn := server.getConn(key)
@@ -141,19 +201,34 @@ func (server *Server) handle(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
 			return
 		}
+		// LL-HLS 블로킹 플레이리스트 리로드. 요청한 세그먼트/부분 세그먼트가 생길 때까지 응답을 미룬다.
+		if msn, part, ok := parseBlockingReq(r); ok {
+			if err := tsCache.WaitPlaylist(msn, part, conn.blockingTimeout()); err != nil {
+				status := http.StatusServiceUnavailable
+				if err == ErrInvalidBlockingReq {
+					status = http.StatusBadRequest
+				}
+				http.Error(w, err.Error(), status)
+				return
+			}
+		}
 		body, err := tsCache.GenM3U8PlayList()
 		if err != nil {
 			log.Debug("GenM3U8PlayList error: ", err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		// 세그먼트와 키 URI 에 플레이리스트 요청의 토큰을 붙인다.
+		body = appendQuery(body, tokenQuery(r, key, key))
+		body = append(body, server.renditionReports(r, key)...)
 
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Cache-Control", "no-cache")
 		w.Header().Set("Content-Type", "application/x-mpegURL")
 		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
 		w.Write(body)
-	case ".ts":
+	// fMP4 형식은 init 세그먼트(.mp4)와 미디어 세그먼트(.m4s)를 같은 캐시에서 찾는다.
+	case ".ts", ".m4s", ".mp4":
 		key, _ := server.parseTs(r.URL.Path)
 		conn := server.getConn(key)
 		if conn == nil {
@@ -161,17 +236,121 @@ func (server *Server) handle(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		tsCache := conn.GetCacheInc()
-		item, err := tsCache.GetItem(r.URL.Path)
+		if tsCache == nil {
+			http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
+			return
+		}
+		// #EXT-X-PRELOAD-HINT 로 알린 부분 세그먼트는 만들어질 때까지 기다렸다가 보낸다.
+		item, err := tsCache.WaitItem(r.URL.Path, conn.blockingTimeout())
 		if err != nil {
 			log.Debug("GetItem error: ", err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Content-Type", "video/mp2ts")
+		w.Header().Set("Content-Type", segmentContentTypes[path.Ext(r.URL.Path)])
 		w.Header().Set("Content-Length", strconv.Itoa(len(item.Data)))
 		w.Write(item.Data)
+	// 세그먼트 암호화 키
+	case ".key":
+		server.handleKey(w, r)
+	// WebVTT 자막 세그먼트
+	case ".vtt":
+		server.handleCaptionSegment(w, r)
+	}
+}
+
+// _HLS_msn, _HLS_part 쿼리를 읽는다. _HLS_part 없이 _HLS_msn 만 오면 part 는 -1 이다.
+func parseBlockingReq(r *http.Request) (msn, part int, ok bool) {
+	query := r.URL.Query()
+	msn, err := strconv.Atoi(query.Get("_HLS_msn"))
+	if err != nil || msn < 0 {
+		return 0, 0, false
+	}
+	part = -1
+	if v := query.Get("_HLS_part"); v != "" {
+		if part, err = strconv.Atoi(v); err != nil || part < 0 {
+			return 0, 0, false
+		}
+	}
+	return msn, part, true
+}
+
+// 같은 마스터 플레이리스트에 묶인 다른 렌디션의 스트림 키를 반환한다.
+func (server *Server) renditions(key string) []string {
+	keys, ok := configure.Renditions.Find(key)
+	if !ok {
+		return nil
+	}
+	var others []string
+	for _, other := range keys {
+		if other != key {
+			others = append(others, other)
+		}
+	}
+	return others
+}
+
+// 렌디션 묶음의 마스터 플레이리스트를 만든다. 자막을 만드는 렌디션이 있으면 자막 그룹도 알린다.
+// BANDWIDTH 는 퍼블리셔의 측정 비트레이트, RESOLUTION 은 SPS 에서 읽은 화면 크기이며, 비트레이트를 아직 측정하지 못한 렌디션은 빠진다.
+// 각 URI 에는 from 스트림(요청한 묶음 이름이나 스트림 키)에 대한 요청의 토큰을 해당 스트림에 맞게 붙인다.
+func (server *Server) masterPlaylist(r *http.Request, from string, keys []string) ([]byte, error) {
+	w := bytes.NewBuffer(nil)
+	fmt.Fprint(w, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-INDEPENDENT-SEGMENTS\n")
+	// 캡션을 자막으로 내보내는 첫 렌디션의 자막 플레이리스트를 모든 렌디션이 함께 쓴다.
+	subtitles := false
+	for _, key := range keys {
+		if conn := server.getConn(key); conn != nil && conn.captions != nil {
+			uri := appendQuery([]byte(fmt.Sprintf("/%s/%s.m3u8", key, captionPlaylistName)), tokenQuery(r, from, key))
+			fmt.Fprintf(w, "#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"%s\",NAME=\"CC1\",DEFAULT=YES,AUTOSELECT=YES,URI=\"%s\"\n",
+				subtitleGroup, uri)
+			subtitles = true
+			break
+		}
+	}
+	n := 0
+	for _, key := range keys {
+		conn := server.getConn(key)
+		if conn == nil || server.bw == nil {
+			continue
+		}
+		bps, ok := server.bw.GetBandwidth(key)
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(w, "#EXT-X-STREAM-INF:BANDWIDTH=%d", bps)
+		if width, height := conn.Resolution(); width > 0 && height > 0 {
+			fmt.Fprintf(w, ",RESOLUTION=%dx%d", width, height)
+		}
+		if subtitles {
+			fmt.Fprintf(w, ",SUBTITLES=\"%s\"", subtitleGroup)
+		}
+		fmt.Fprintf(w, "\n%s\n", appendQuery([]byte("/"+key+".m3u8"), tokenQuery(r, from, key)))
+		n++
+	}
+	if n == 0 {
+		return nil, ErrNoRendition
 	}
+	return w.Bytes(), nil
+}
+
+// 다른 렌디션의 마지막 세그먼트/부분 세그먼트를 #EXT-X-RENDITION-REPORT 로 알려, 플레이어가 렌디션을 바꿀 때 바로 블로킹 요청을 보낼 수 있게 한다.
+func (server *Server) renditionReports(r *http.Request, key string) []byte {
+	w := bytes.NewBuffer(nil)
+	for _, other := range server.renditions(key) {
+		conn := server.getConn(other)
+		if conn == nil || conn.GetCacheInc() == nil {
+			continue
+		}
+		msn, part := conn.GetCacheInc().LastPart()
+		uri := appendQuery([]byte("/"+other+".m3u8"), tokenQuery(r, key, other))
+		fmt.Fprintf(w, "#EXT-X-RENDITION-REPORT:URI=\"%s\",LAST-MSN=%d", uri, msn)
+		if part >= 0 {
+			fmt.Fprintf(w, ",LAST-PART=%d", part)
+		}
+		fmt.Fprint(w, "\n")
+	}
+	return w.Bytes()
 }
 
 // HLS 스트리밍 서버에서 요청한 경로를 분석해 스트림 키를 추출한다.
@@ -195,3 +374,9 @@ func (server *Server) parseTs(pathstr string) (key string, err error) {
 
 	return
 }
+
+// 스트림의 HLS 요청 수를 세고, 응답으로 보낸 바이트를 셀 ResponseWriter 를 돌려준다.
+func countRequest(w http.ResponseWriter, stream string) http.ResponseWriter {
+	metrics.Add(metrics.HLSRequests, stream, event.ProtocolHLS, 1)
+	return metrics.NewResponseWriter(w, metrics.GetCounter(metrics.EgressBytes, stream, event.ProtocolHLS))
+}
@@ -0,0 +1,69 @@
+package hls
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+)
+
+/*
+ID3 타임드 메타데이터
+RTMP 데이터 메시지(onTextData, onCuePoint, @setDataFrame 으로 보낸 사용자 이벤트)를 ID3v2.4 태그로 바꿔 TS 세그먼트의 메타데이터 스트림에 싣는다.
+태그에는 TXXX 프레임 하나가 들어가며, 설명(description)은 이벤트 이름, 값은 이벤트 데이터를 JSON 으로 쓴 것이다.
+코덱 정보인 onMetaData 는 싣지 않는다.
+*/
+
+// AMF0 데이터 메시지를 ID3 태그로 바꾼다. 실을 이벤트가 아니면 false 를 반환한다.
+func id3Metadata(b []byte) ([]byte, bool) {
+	vs, _ := amf.NewDecoder().DecodeBatch(bytes.NewReader(b), amf.AMF0)
+	if len(vs) > 0 && vs[0] == amf.SetDataFrame {
+		vs = vs[1:]
+	}
+	if len(vs) == 0 {
+		return nil, false
+	}
+	event, ok := vs[0].(string)
+	if !ok || event == "" || event == amf.OnMetaData {
+		return nil, false
+	}
+
+	var data interface{}
+	switch len(vs) {
+	case 1:
+	case 2:
+		data = vs[1]
+	default:
+		data = vs[1:]
+	}
+	value, err := json.Marshal(data)
+	if err != nil {
+		value = []byte(fmt.Sprint(data))
+	}
+	return id3Tag(id3TXXX(event, value)), true
+}
+
+// TXXX(사용자 정의 텍스트) 프레임. UTF-8 인코딩, 설명, NUL, 값 순서이다.
+func id3TXXX(description string, value []byte) []byte {
+	body := make([]byte, 0, 1+len(description)+1+len(value))
+	body = append(body, 0x03)
+	body = append(body, description...)
+	body = append(body, 0x00)
+	body = append(body, value...)
+
+	frame := append([]byte("TXXX"), syncsafe(len(body))...)
+	frame = append(frame, 0x00, 0x00) // flags
+	return append(frame, body...)
+}
+
+// ID3v2.4 헤더를 붙인다.
+func id3Tag(frames []byte) []byte {
+	tag := append([]byte{'I', 'D', '3', 0x04, 0x00, 0x00}, syncsafe(len(frames))...)
+	return append(tag, frames...)
+}
+
+// ID3 크기 필드. 바이트마다 7 비트만 쓴다.
+func syncsafe(n int) []byte {
+	return []byte{byte(n>>21) & 0x7f, byte(n>>14) & 0x7f, byte(n>>7) & 0x7f, byte(n) & 0x7f}
+}
@@ -0,0 +1,64 @@
+package hls
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+)
+
+func amf0(t *testing.T, vals ...interface{}) []byte {
+	var buf bytes.Buffer
+	if _, err := (&amf.Encoder{}).EncodeBatch(&buf, amf.AMF0, vals...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// ID3v2.4 태그 하나에 TXXX 프레임 하나
+func txxxTag(description, value string) []byte {
+	body := append(append([]byte{0x03}, description...), 0x00)
+	body = append(body, value...)
+	frame := append([]byte{'T', 'X', 'X', 'X', 0, 0, 0, byte(len(body)), 0, 0}, body...)
+	return append([]byte{'I', 'D', '3', 0x04, 0x00, 0x00, 0, 0, 0, byte(len(frame))}, frame...)
+}
+
+func TestID3Metadata(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+		tag  []byte
+	}{
+		{"text data", amf0(t, "onTextData", amf.Object{"text": "hello"}), true, txxxTag("onTextData", `{"text":"hello"}`)},
+		{"set data frame", amf0(t, amf.SetDataFrame, "onScore", 3.0), true, txxxTag("onScore", `3`)},
+		{"no data", amf0(t, "onPing"), true, txxxTag("onPing", `null`)},
+		{"several values", amf0(t, "onVote", "a", 2.0), true, txxxTag("onVote", `["a",2]`)},
+		{"metadata", amf0(t, amf.SetDataFrame, amf.OnMetaData, amf.Object{"width": 1280.0}), false, nil},
+		{"not a string", amf0(t, 1.0), false, nil},
+		{"empty", nil, false, nil},
+	}
+	for _, test := range tests {
+		tag, ok := id3Metadata(test.data)
+		if ok != test.ok || !bytes.Equal(tag, test.tag) {
+			t.Errorf("%s: id3Metadata = %q %v, want %q %v", test.name, tag, ok, test.tag, test.ok)
+		}
+	}
+}
+
+func TestSyncsafe(t *testing.T) {
+	tests := []struct {
+		n    int
+		want []byte
+	}{
+		{0, []byte{0, 0, 0, 0}},
+		{0x7f, []byte{0, 0, 0, 0x7f}},
+		{0x80, []byte{0, 0, 0x01, 0x00}},
+		{0x0fffffff, []byte{0x7f, 0x7f, 0x7f, 0x7f}},
+	}
+	for _, test := range tests {
+		if got := syncsafe(test.n); !bytes.Equal(got, test.want) {
+			t.Errorf("syncsafe(%#x) = %x, want %x", test.n, got, test.want)
+		}
+	}
+}
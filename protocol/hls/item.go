@@ -1,11 +1,40 @@
 package hls
 
+import "time"
+
 // HLS 스트리밍에서 TS 패킷의 메타데이터와 데이터를 관리하기 위한 구조체이다.
 type TSItem struct {
 	Name     string // TS 파일 이름("segment1.ts")
 	SeqNum   int    // TS 파일의 고유 시퀀스 번호이다.
 	Duration int    // 재생 지속 시간
 	Data     []byte // 실제 바이너리 데이터
+	MapName  string // fMP4 세그먼트가 참조하는 init 세그먼트 이름 (#EXT-X-MAP). TS 세그먼트는 비어 있다.
+
+	KeyName   string // 세그먼트를 암호화한 키의 URI (#EXT-X-KEY). 암호화하지 않으면 비어 있다.
+	KeyMethod string // 암호화 방식 (AES-128, SAMPLE-AES)
+
+	Parts       []TSItem // LL-HLS 에서 이 세그먼트를 이루는 부분 세그먼트
+	Independent bool     // 부분 세그먼트가 키프레임으로 시작하는지 여부 (INDEPENDENT=YES)
+
+	Discontinuity   bool      // 앞 세그먼트와 타임스탬프가 이어지지 않는지 여부 (#EXT-X-DISCONTINUITY)
+	ProgramDateTime time.Time // 세그먼트 첫 샘플의 벽시계 시각 (#EXT-X-PROGRAM-DATE-TIME)
+	Cue             *CueTag   // 세그먼트가 광고 구간의 시작, 중간, 끝인지 여부. 광고와 관계없으면 nil 이다.
+}
+
+const (
+	cueOut  = "out"  // 광고 구간이 이 세그먼트에서 시작한다.
+	cueCont = "cont" // 광고 구간 중간의 세그먼트
+	cueIn   = "in"   // 이 세그먼트부터 본방송으로 돌아온다.
+)
+
+// 세그먼트 앞에 쓰는 광고 구간(SCTE-35 splice) 태그
+type CueTag struct {
+	Type      string    // cueOut, cueCont, cueIn
+	ID        uint32    // splice_event_id
+	Duration  uint32    // 광고 길이(ms). 0 이면 모른다.
+	Elapsed   uint32    // 광고 시작부터 이 세그먼트까지 지난 시간(ms)
+	Start     time.Time // 광고 시작 시각 (#EXT-X-DATERANGE START-DATE)
+	DateRange bool      // #EXT-X-CUE-OUT/IN 대신 #EXT-X-DATERANGE 로 쓴다.
 }
 
 func NewTSItem(name string, duration, seqNum int, b []byte) TSItem {
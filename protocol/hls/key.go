@@ -0,0 +1,220 @@
+package hls
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/protocol/auth"
+	"github.com/gwuhaolin/livego/utils/pio"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+HLS 세그먼트 암호화
+
+AES-128     세그먼트 전체를 AES-128-CBC(PKCS7 패딩)로 암호화한다. TS, fMP4 모두 쓸 수 있다.
+SAMPLE-AES  TS 의 H.264 슬라이스 NALU 와 AAC 프레임의 일부 블록만 암호화한다. (Apple MPEG-2 Stream Encryption Format)
+            컨테이너 헤더는 그대로 두므로 플레이어가 복호화 전에 스트림을 파싱할 수 있다.
+
+키는 hls_key_rotation 세그먼트마다 새로 만들고, 플레이리스트에 #EXT-X-KEY 로 키 URI(/<APP>/<NAME>/<SEQ>.key)를 알린다.
+IV 를 따로 쓰지 않으므로 세그먼트의 시퀀스 번호가 IV 가 된다.
+
+키 요청은 jwt.secret 으로 서명한 토큰이 있어야 받을 수 있다.
+  ?jwt=<JWT> 또는 Authorization: Bearer <JWT>
+  ?expires=<UNIX>&token=<HEX>   HEX = hex(HMAC-SHA256(jwt.secret, "<APP>/<NAME>:<UNIX>"))
+플레이리스트 요청에 붙은 토큰은 키 URI 에도 그대로 붙여 준다.
+*/
+
+const (
+	keyLen = 16
+
+	sampleAESLeader = 32 // SAMPLE-AES 에서 NALU 앞부분의 암호화하지 않는 바이트 수
+	sampleAESSkip   = 144
+)
+
+var (
+	ErrInvalidKeyToken = fmt.Errorf("invalid key token")
+	ErrNoKeySecret     = fmt.Errorf("jwt.secret is not configured")
+)
+
+// 플레이리스트의 #EXT-X-KEY METHOD 값
+func keyMethod(encryption string) string {
+	if encryption == configure.HLSEncryptionSampleAES {
+		return "SAMPLE-AES"
+	}
+	return "AES-128"
+}
+
+func newKey() []byte {
+	key := make([]byte, keyLen)
+	if _, err := rand.Read(key); err != nil {
+		log.Warning("hls key generate error: ", err)
+	}
+	return key
+}
+
+// IV 속성이 없으면 세그먼트 시퀀스 번호를 128 비트 빅엔디언으로 쓴 값이 IV 이다.
+func segmentIV(seq int) []byte {
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], uint64(seq))
+	return iv
+}
+
+// 세그먼트 전체를 AES-128-CBC 로 암호화한다.
+func encryptSegment(key []byte, seq int, data []byte) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		log.Warning("hls encrypt error: ", err)
+		return data
+	}
+	pad := aes.BlockSize - len(data)%aes.BlockSize
+	out := make([]byte, len(data), len(data)+pad)
+	copy(out, data)
+	out = append(out, bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, segmentIV(seq)).CryptBlocks(out, out)
+	return out
+}
+
+// Annex B H.264 프레임의 슬라이스 NALU 를 SAMPLE-AES 로 암호화한다.
+// 48 바이트가 넘는 슬라이스(타입 1, 5)만 암호화하며, 앞 32 바이트를 건너뛴 뒤 16 바이트 암호화, 144 바이트 평문을 반복한다.
+// 남은 데이터가 16 바이트 이하면 평문으로 둔다. 암호화는 에뮬레이션 방지 바이트를 뺀 데이터에 하고 다시 넣는다.
+func encryptNALUs(key, iv, frame []byte) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		log.Warning("hls encrypt error: ", err)
+		return frame
+	}
+	out := make([]byte, 0, len(frame)+64)
+	for len(frame) > 0 {
+		start, codeLen := findStartCode(frame)
+		if start < 0 {
+			break
+		}
+		out = append(out, frame[:start+codeLen]...)
+		frame = frame[start+codeLen:]
+		end, _ := findStartCode(frame)
+		if end < 0 {
+			end = len(frame)
+		}
+		nalu := frame[:end]
+		frame = frame[end:]
+
+		naluType := nalu[0] & 0x1f
+		if (naluType != 1 && naluType != 5) || len(nalu) <= 48 {
+			out = append(out, nalu...)
+			continue
+		}
+		rbsp := pio.RBSP(nalu)
+		enc := cipher.NewCBCEncrypter(block, iv)
+		for i := sampleAESLeader; len(rbsp)-i > aes.BlockSize; i += aes.BlockSize + sampleAESSkip {
+			enc.CryptBlocks(rbsp[i:i+aes.BlockSize], rbsp[i:i+aes.BlockSize])
+		}
+		out = append(out, pio.EBSP(rbsp)...)
+	}
+	return out
+}
+
+// 00 00 01 또는 00 00 00 01 시작 코드의 위치와 길이
+func findStartCode(b []byte) (int, int) {
+	i := bytes.Index(b, []byte{0, 0, 1})
+	if i < 0 {
+		return -1, 0
+	}
+	if i > 0 && b[i-1] == 0 {
+		return i - 1, 4
+	}
+	return i, 3
+}
+
+// ADTS AAC 프레임 하나를 SAMPLE-AES 로 암호화한다. ADTS 헤더와 그 뒤 16 바이트는 평문으로 두고, 나머지 중 16 바이트 단위로 암호화한다.
+func encryptADTS(key, iv, frame []byte) []byte {
+	if len(frame) < 7 {
+		return frame
+	}
+	header := 7
+	if frame[1]&0x01 == 0 {
+		header = 9 // CRC
+	}
+	start := header + 16
+	if len(frame) < start+aes.BlockSize {
+		return frame
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		log.Warning("hls encrypt error: ", err)
+		return frame
+	}
+	out := make([]byte, len(frame))
+	copy(out, frame)
+	n := (len(out) - start) / aes.BlockSize * aes.BlockSize
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out[start:start+n], out[start:start+n])
+	return out
+}
+
+// 스트림 키(<APP>/<NAME>)에 대해 expires 까지 유효한 키 요청 토큰을 만든다. API 의 /control/keytoken 이 사용한다.
+func SignKeyToken(stream string, expires time.Time) (string, error) {
+	secret := configure.Config.GetString("jwt.secret")
+	if secret == "" {
+		return "", ErrNoKeySecret
+	}
+	return auth.Sign(secret, stream, expires), nil
+}
+
+// 키 요청이 jwt.secret 으로 서명한 토큰이나 JWT 를 가지고 있는지 확인한다. 비밀키가 설정되지 않았으면 키를 내주지 않는다.
+func checkKeyToken(r *http.Request, stream string) error {
+	secret := configure.Config.GetString("jwt.secret")
+	query := r.URL.Query()
+	if token := query.Get("token"); token != "" {
+		if auth.VerifySign(secret, stream, token, query.Get("expires")) != nil {
+			return ErrInvalidKeyToken
+		}
+		return nil
+	}
+
+	tokenString := query.Get("jwt")
+	if v := r.Header.Get("Authorization"); tokenString == "" && strings.HasPrefix(v, "Bearer ") {
+		tokenString = strings.TrimPrefix(v, "Bearer ")
+	}
+	if auth.VerifyJWT(secret, tokenString, stream) != nil {
+		return ErrInvalidKeyToken
+	}
+	return nil
+}
+
+// /<APP>/<NAME>/<SEQ>.key 요청에 토큰을 확인하고 키를 보낸다.
+func (server *Server) handleKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	stream, err := server.parseTs(r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkKeyToken(r, stream); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	conn := server.getConn(stream)
+	if conn == nil || conn.GetCacheInc() == nil {
+		http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
+		return
+	}
+	key, err := conn.GetCacheInc().GetKey(r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(key)))
+	w.Write(key)
+}
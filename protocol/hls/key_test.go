@@ -0,0 +1,52 @@
+package hls
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/configure"
+)
+
+func TestKeyToken(t *testing.T) {
+	defer configure.Config.Set("jwt.secret", configure.Config.GetString("jwt.secret"))
+
+	configure.Config.Set("jwt.secret", "")
+	if _, err := SignKeyToken("live/movie", time.Now().Add(time.Hour)); err != ErrNoKeySecret {
+		t.Fatalf("sign without secret = %v, want %v", err, ErrNoKeySecret)
+	}
+
+	configure.Config.Set("jwt.secret", "secret")
+	expires := time.Now().Add(time.Hour)
+	token, err := SignKeyToken("live/movie", expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		stream string
+		query  string
+		ok     bool
+	}{
+		{"valid", "live/movie", fmt.Sprintf("expires=%d&token=%s", expires.Unix(), token), true},
+		{"other stream", "live/other", fmt.Sprintf("expires=%d&token=%s", expires.Unix(), token), false},
+		{"changed expires", "live/movie", fmt.Sprintf("expires=%d&token=%s", expires.Unix()+1, token), false},
+		{"expired", "live/movie", fmt.Sprintf("expires=%d&token=%s", time.Now().Add(-time.Hour).Unix(), mustSign(t, "live/movie", time.Now().Add(-time.Hour))), false},
+		{"no token", "live/movie", "", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/live/movie/1.key?"+test.query, nil)
+		if err := checkKeyToken(r, test.stream); (err == nil) != test.ok {
+			t.Errorf("%s: checkKeyToken = %v, want ok %v", test.name, err, test.ok)
+		}
+	}
+}
+
+func mustSign(t *testing.T, stream string, expires time.Time) string {
+	token, err := SignKeyToken(stream, expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
@@ -0,0 +1,267 @@
+package hls
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/protocol/auth"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	recordPrefix   = "/record/"
+	recordPlaylist = "index.m3u8"
+)
+
+var (
+	ErrInvalidRecordPath = fmt.Errorf("url: /record/<APP>/<NAME>/[<ID>/<FILE>]")
+)
+
+/*
+HLS 녹화(DVR)
+앱에 hls_record 를 켜면 메모리 캐시와 별도로 모든 세그먼트를 hls_record_dir/<APP>/<NAME>/<ID>/ 에 파일로 쓴다.
+방송 중에는 세그먼트를 지우지 않는 EVENT 플레이리스트를 갱신하고, 퍼블리셔가 끝나면 #EXT-X-ENDLIST 를 붙인 VOD 플레이리스트로 마무리한다.
+ID 는 녹화를 시작한 시각이며, /record/<APP>/<NAME>/<ID>/index.m3u8 로 다시 볼 수 있다.
+암호화한 스트림은 키도 함께 녹화하며, 라이브와 같이 토큰이 있어야 키를 받을 수 있다.
+디스크 쓰기는 SendPacket 을 막지 않도록 녹화마다 하나씩 둔 고루틴에서 순서대로 처리한다.
+*/
+type recorder struct {
+	id   string
+	dir  string
+	jobs chan func() error // 쓰기 고루틴이 순서대로 처리할 작업
+
+	// 아래는 쓰기 고루틴만 사용한다.
+	// 플레이리스트 본문은 세그먼트마다 뒤에 덧붙여 두고, 파일을 쓸 때 헤더만 새로 만든다.
+	count       int
+	seq         int
+	maxDuration int
+	tags        tagState
+	body        bytes.Buffer
+}
+
+// 쓰기가 밀려도 이만큼은 SendPacket 을 막지 않고 쌓아 둔다.
+const recordQueueSize = 64
+
+func newRecorder(key string) (*recorder, error) {
+	base := path.Join(configure.Config.GetString("hls_record_dir"), key)
+	if err := os.MkdirAll(base, 0755); err != nil {
+		return nil, err
+	}
+	id := time.Now().Format("20060102-150405")
+	for i := 1; ; i++ {
+		dir := path.Join(base, id)
+		err := os.Mkdir(dir, 0755)
+		if err == nil {
+			log.Debugf("hls record start: %s", dir)
+			rec := &recorder{
+				id:   id,
+				dir:  dir,
+				jobs: make(chan func() error, recordQueueSize),
+			}
+			go rec.run()
+			return rec, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		// 같은 초에 다시 시작한 녹화
+		id = fmt.Sprintf("%s-%d", time.Now().Format("20060102-150405"), i)
+	}
+}
+
+func (rec *recorder) run() {
+	for job := range rec.jobs {
+		if err := job(); err != nil {
+			log.Warningf("hls record %s error: %v", rec.dir, err)
+		}
+	}
+}
+
+// fMP4 init 세그먼트를 쓴다.
+func (rec *recorder) writeMap(item TSItem) {
+	rec.jobs <- func() error {
+		return ioutil.WriteFile(path.Join(rec.dir, path.Base(item.Name)), item.Data, 0644)
+	}
+}
+
+// 세그먼트 암호화 키를 쓴다.
+func (rec *recorder) writeKey(name string, key []byte) {
+	rec.jobs <- func() error {
+		return ioutil.WriteFile(path.Join(rec.dir, path.Base(name)), key, 0600)
+	}
+}
+
+// 세그먼트를 파일로 쓰고 EVENT 플레이리스트를 갱신한다.
+func (rec *recorder) writeSegment(item TSItem) {
+	rec.jobs <- func() error {
+		return rec.addSegment(item)
+	}
+}
+
+// 녹화를 VOD 플레이리스트로 마무리한다. 이후에는 녹화에 쓰지 않는다.
+func (rec *recorder) finish() {
+	rec.jobs <- func() error {
+		log.Debugf("hls record finish: %s", rec.dir)
+		return rec.writePlaylist(true)
+	}
+	close(rec.jobs)
+}
+
+func (rec *recorder) addSegment(item TSItem) error {
+	name := path.Base(item.Name)
+	if err := ioutil.WriteFile(path.Join(rec.dir, name), item.Data, 0644); err != nil {
+		return err
+	}
+	if item.MapName != "" {
+		item.MapName = path.Base(item.MapName)
+	}
+	if item.KeyName != "" {
+		item.KeyName = path.Base(item.KeyName)
+	}
+	if rec.count == 0 {
+		rec.seq = item.SeqNum
+		// 녹화는 이 세그먼트부터 시작하므로 앞과 끊겼다고 표시할 필요가 없다.
+		item.Discontinuity = false
+	}
+	rec.count++
+	if item.Duration > rec.maxDuration {
+		rec.maxDuration = item.Duration
+	}
+	writeTags(&rec.body, item, &rec.tags)
+	fmt.Fprintf(&rec.body, "#EXTINF:%.3f,\n%s\n", float64(item.Duration)/float64(1000), name)
+
+	// 뒤에 세그먼트가 더 밀려 있으면 플레이리스트는 그때 한 번에 쓴다.
+	if len(rec.jobs) > 0 {
+		return nil
+	}
+	return rec.writePlaylist(false)
+}
+
+func (rec *recorder) writePlaylist(end bool) error {
+	playlistType := "EVENT"
+	if end {
+		playlistType = "VOD"
+	}
+
+	w := bytes.NewBuffer(make([]byte, 0, rec.body.Len()+256))
+	fmt.Fprintf(w,
+		"#EXTM3U\n#EXT-X-VERSION:%d\n#EXT-X-PLAYLIST-TYPE:%s\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:%d\n\n",
+		rec.tags.version(), playlistType, rec.maxDuration/1000+1, rec.seq)
+	w.Write(rec.body.Bytes())
+	if end {
+		fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+	}
+
+	// 플레이어가 쓰다 만 플레이리스트를 읽지 않도록 임시 파일에 쓴 뒤 이름을 바꾼다.
+	tmp := path.Join(rec.dir, recordPlaylist+".tmp")
+	if err := ioutil.WriteFile(tmp, w.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path.Join(rec.dir, recordPlaylist))
+}
+
+// 녹화 목록의 항목
+type recordInfo struct {
+	ID   string `json:"id"`
+	Live bool   `json:"live"` // 아직 녹화 중인지 (EVENT 플레이리스트)
+	URL  string `json:"url"`
+}
+
+// /record/<APP>/<NAME>/ 는 녹화 목록을 JSON 으로, /record/<APP>/<NAME>/<ID>/<FILE> 은 녹화 파일을 돌려준다.
+func (server *Server) handleRecord(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	rel := strings.TrimPrefix(r.URL.Path, recordPrefix)
+	if strings.Contains(rel, "..") {
+		http.Error(w, ErrInvalidRecordPath.Error(), http.StatusBadRequest)
+		return
+	}
+	paths := strings.Split(strings.Trim(rel, "/"), "/")
+	root := configure.Config.GetString("hls_record_dir")
+	if len(paths) >= 2 {
+		if err := auth.CheckPlayRequest(r, paths[0]+"/"+paths[1]); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	switch len(paths) {
+	case 2:
+		server.listRecords(w, root, paths[0]+"/"+paths[1])
+	case 4:
+		if err := server.checkViewer(r, paths[0]+"/"+paths[1]); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		w = countRequest(w, paths[0]+"/"+paths[1])
+		file := path.Join(root, rel)
+		switch path.Ext(rel) {
+		case ".m3u8":
+			server.serveRecordPlaylist(w, r, paths[0]+"/"+paths[1], file)
+			return
+		case ".key":
+			if err := checkKeyToken(r, paths[0]+"/"+paths[1]); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("Content-Type", "application/octet-stream")
+			http.ServeFile(w, r, file)
+			return
+		}
+		contentType := segmentContentTypes[path.Ext(rel)]
+		if contentType == "" {
+			http.Error(w, ErrInvalidRecordPath.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		http.ServeFile(w, r, file)
+	default:
+		http.Error(w, ErrInvalidRecordPath.Error(), http.StatusBadRequest)
+	}
+}
+
+// 녹화 플레이리스트를 보낸다. 요청에 붙은 토큰을 세그먼트와 키 URI 에 넘겨준다.
+func (server *Server) serveRecordPlaylist(w http.ResponseWriter, r *http.Request, stream, file string) {
+	body, err := ioutil.ReadFile(file)
+	if err != nil {
+		http.Error(w, "record not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "application/x-mpegURL")
+	w.Write(appendQuery(body, tokenQuery(r, stream, stream)))
+}
+
+func (server *Server) listRecords(w http.ResponseWriter, root, key string) {
+	dirs, err := ioutil.ReadDir(path.Join(root, key))
+	if err != nil {
+		http.Error(w, "record not found", http.StatusNotFound)
+		return
+	}
+	records := []recordInfo{}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		playlist, err := ioutil.ReadFile(path.Join(root, key, dir.Name(), recordPlaylist))
+		if err != nil {
+			continue
+		}
+		records = append(records, recordInfo{
+			ID:   dir.Name(),
+			Live: !bytes.Contains(playlist, []byte("#EXT-X-ENDLIST")),
+			URL:  fmt.Sprintf("%s%s/%s/%s", recordPrefix, key, dir.Name(), recordPlaylist),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(records)
+}
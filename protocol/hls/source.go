@@ -3,22 +3,32 @@ package hls
 import (
 	"bytes"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gwuhaolin/livego/configure"
 
 	"github.com/gwuhaolin/livego/av"
 	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/container/fmp4"
 	"github.com/gwuhaolin/livego/container/ts"
 	"github.com/gwuhaolin/livego/parser"
+	"github.com/gwuhaolin/livego/parser/h264"
+	"github.com/gwuhaolin/livego/parser/h265"
+	"github.com/gwuhaolin/livego/protocol/amf"
+	"github.com/gwuhaolin/livego/protocol/event"
+	"github.com/gwuhaolin/livego/protocol/metrics"
 
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	videoHZ      = 90000
-	aacSampleLen = 1024
-	maxQueueNum  = 512
+	videoHZ     = 90000
+	maxQueueNum = 512
+
+	// onMetaData 없이 이 시간(ms) 동안 비디오 없이 오디오만 오면 오디오 전용 스트림으로 본다.
+	probeDuration = 1000
 
 	h264_default_hz uint64 = 90
 )
@@ -44,10 +54,54 @@ type Source struct {
 	tsparser    *parser.CodecParser // Ts 패킷을 분석하고 코덱 정보를 파싱하는데 사용되는 파서 객체이다. PTS, DTS, 키프레임 여부와 같은 데이터를 TS 패킷으로 변환할떄 사용한다.
 	closed      bool                // 스트리밍 세션이 종료되었는지 여부를 나타내는 플래그. 리소스 해제와 새 데이터 처리를 중단하기 위해 필요하다.
 	packetQueue chan *av.Packet     // 스트리밍 데이터를 처리하기 위한 Go의 채널.
+	videoCodec  byte                // 비디오 코덱 ID (av.VIDEO_H264, av.VIDEO_HEVC). PMT 의 스트림 타입을 정한다.
+	soundFormat byte                // 오디오 코덱 ID (av.SOUND_AAC, av.SOUND_MP3). PMT 의 스트림 타입을 정한다.
+	fmp4        *fmp4.Muxer         // 앱의 hls_segment_format 이 fmp4 일 때 사용하는 muxer. TS 형식이면 nil 이다.
+	mapName     string              // 현재 fMP4 init 세그먼트 이름
+	recorder    *recorder           // 앱의 hls_record 가 켜져 있을 때 세그먼트를 디스크에 녹화한다. 꺼져 있으면 nil 이다.
+	captions    *captionTrack       // 앱의 hls_captions 가 켜져 있을 때 SEI 캡션으로 WebVTT 자막을 만든다. 꺼져 있으면 nil 이다.
+
+	// 트랙 구성. onMetaData 와 처음 받은 패킷으로 정하며, PMT 에는 있는 트랙만 선언한다.
+	hasAudio     bool   // 오디오 트랙이 있는지 여부
+	hasVideo     bool   // 비디오 트랙이 있는지 여부
+	metaTracks   bool   // onMetaData 로 트랙 구성을 받았는지 여부
+	firstAudioTs uint32 // 처음 받은 오디오 패킷의 타임스탬프. onMetaData 가 없을 때 오디오 전용인지 판단하는 데 쓴다.
+
+	// 세그먼트 암호화
+	encryption  string // configure.HLSEncryptionAES128, configure.HLSEncryptionSampleAES. 비어 있으면 암호화하지 않는다.
+	keyRotation int    // 키를 바꾸는 세그먼트 간격
+	key         []byte // 현재 세그먼트를 암호화하는 키
+	keyName     string // 현재 키의 URI
+	audioConfig []byte // AAC AudioSpecificConfig. SAMPLE-AES 의 PMT 에 쓴다.
+
+	// 광고 구간
+	cues      []amf.CuePoint // 아직 세그먼트에 반영하지 않은 큐. 타임스탬프 순서이다.
+	ad        *adBreak       // 진행 중인 광고 구간. 본방송이면 nil 이다.
+	dateRange bool           // 광고 태그를 #EXT-X-DATERANGE 로 쓸지 여부
+	segCue    *CueTag        // 현재 세그먼트의 광고 태그
+
+	lock          sync.RWMutex
+	width, height int // SPS 에서 읽은 화면 크기. 마스터 플레이리스트의 RESOLUTION 으로 쓴다.
+
+	duration         uint32    // 세그먼트 목표 길이(ms)
+	segStart         uint32    // 현재 세그먼트를 시작한 키프레임의 DTS(ms)
+	segTime          time.Time // 현재 세그먼트의 #EXT-X-PROGRAM-DATE-TIME
+	segDiscontinuity bool      // 현재 세그먼트 앞에 #EXT-X-DISCONTINUITY 를 붙일지 여부
+	discontinuity    bool      // 다음 세그먼트 앞에 #EXT-X-DISCONTINUITY 를 붙일지 여부
+	epoch            time.Time // DTS 0 에 해당하는 벽시계 시각. #EXT-X-PROGRAM-DATE-TIME 을 DTS 로 계산한다.
+
+	// LL-HLS
+	partTarget      uint32 // 부분 세그먼트 목표 길이(ms). 0 이면 LL-HLS 를 쓰지 않는다.
+	partStart       uint32 // 현재 부분 세그먼트의 첫 샘플 타임스탬프
+	partNum         int    // 현재 세그먼트에서 만든 부분 세그먼트 수
+	partIndependent bool   // 현재 부분 세그먼트가 키프레임으로 시작했는지 여부
+	lastFrameTs     uint32 // 직전 비디오 프레임(오디오 전용이면 오디오 프레임) 타임스탬프
+	frameGap        uint32 // 직전 프레임 간격(ms). 부분 세그먼트가 목표 길이를 넘기 전에 자르는 데 쓴다.
 }
 
 func NewSource(info av.Info) *Source {
 	info.Inter = true
+	app, _ := configure.GetApplication(strings.SplitN(info.Key, "/", 2)[0])
 	s := &Source{
 		info:        info,
 		align:       &align{},
@@ -56,11 +110,41 @@ func NewSource(info av.Info) *Source {
 		cache:       newAudioCache(),
 		demuxer:     flv.NewDemuxer(),
 		muxer:       ts.NewMuxer(),
-		tsCache:     NewTSCacheItem(info.Key),
+		tsCache:     NewTSCacheItem(info.Key, app.HlsWindow),
 		tsparser:    parser.NewCodecParser(),
 		bwriter:     bytes.NewBuffer(make([]byte, 100*1024)),
 		packetQueue: make(chan *av.Packet, maxQueueNum),
 	}
+	s.duration = uint32(app.HlsDuration)
+	if s.duration == 0 {
+		s.duration = duration
+	}
+	if app.HlsLowLatency {
+		// LL-HLS 는 fMP4 부분 세그먼트를 쓴다.
+		s.partTarget = uint32(app.HlsPartDuration)
+		if s.partTarget == 0 {
+			s.partTarget = configure.DefaultHLSPartDuration
+		}
+		s.tsCache.SetPartTarget(int(s.partTarget))
+		s.fmp4 = fmp4.NewMuxer()
+	} else if segmentFormat(app) == configure.HLSSegmentFormatFMP4 {
+		s.fmp4 = fmp4.NewMuxer()
+	}
+	if app.HlsEncryption != "" {
+		s.setEncryption(app)
+	}
+	s.dateRange = app.HlsAdMarkers == configure.HLSAdMarkersDateRange
+	if app.HlsCaptions {
+		s.captions = newCaptionTrack(info.Key, app.HlsWindow)
+	}
+	if app.HlsRecord {
+		rec, err := newRecorder(info.Key)
+		if err != nil {
+			log.Warningf("[%v] hls record error: %v", info, err)
+		} else {
+			s.recorder = rec
+		}
+	}
 	// 패킷 전송 작업은 별도의 고루틴에서 실행한다.
 	go func() {
 		// SendPacket 함수로 패킷 전송을 수행한다.
@@ -76,6 +160,50 @@ func NewSource(info av.Info) *Source {
 	return s
 }
 
+// 앱 설정에서 HLS 세그먼트 형식을 읽는다. 설정이 없거나 모르는 값이면 TS 를 사용한다.
+func segmentFormat(app configure.Application) string {
+	switch app.HlsSegmentFormat {
+	case "", configure.HLSSegmentFormatTS:
+	case configure.HLSSegmentFormatFMP4:
+		return configure.HLSSegmentFormatFMP4
+	default:
+		log.Warningf("unknown hls_segment_format=%s for app %s, use ts", app.HlsSegmentFormat, app.Appname)
+	}
+	return configure.HLSSegmentFormatTS
+}
+
+// 앱 설정에서 세그먼트 암호화 방식을 정한다.
+// LL-HLS 의 부분 세그먼트는 암호화하지 않으므로 암호화를 끄고, SAMPLE-AES 는 TS 에서만 쓸 수 있으므로 fMP4 는 AES-128 로 바꾼다.
+func (source *Source) setEncryption(app configure.Application) {
+	switch app.HlsEncryption {
+	case configure.HLSEncryptionAES128, configure.HLSEncryptionSampleAES:
+	default:
+		log.Warningf("unknown hls_encryption=%s for app %s, disable encryption", app.HlsEncryption, app.Appname)
+		return
+	}
+	if source.partTarget > 0 {
+		log.Warningf("[%v] hls_encryption is not supported with hls_low_latency, disable encryption", source.info)
+		return
+	}
+	source.encryption = app.HlsEncryption
+	if source.fmp4 != nil && source.encryption == configure.HLSEncryptionSampleAES {
+		log.Warningf("[%v] sample-aes is not supported with fmp4 segments, use aes-128", source.info)
+		source.encryption = configure.HLSEncryptionAES128
+	}
+	source.keyRotation = app.HlsKeyRotation
+	if source.keyRotation <= 0 {
+		source.keyRotation = configure.DefaultHLSKeyRotation
+	}
+	if configure.Config.GetString("jwt.secret") == "" {
+		log.Warningf("[%v] jwt.secret is empty, hls keys will not be served", source.info)
+	}
+}
+
+// LL-HLS 블로킹 요청을 붙잡아 두는 최대 시간. 목표 길이의 세 배가 지나도 없으면 503 으로 답한다.
+func (source *Source) blockingTimeout() time.Duration {
+	return 3 * time.Duration(source.duration) * time.Millisecond
+}
+
 func (source *Source) GetCacheInc() *TSCacheItem {
 	return source.tsCache
 }
@@ -88,6 +216,10 @@ func (source *Source) GetCacheInc() *TSCacheItem {
 // 이 메서드는 2~3 단계에서 동작 한다. 패킷이 큐에 저장 된후 큐가 가득 찬 경우 실행된다. 중요 패킷을 유지하며 덜 중요한 패킷을 삭제한다.
 func (source *Source) DropPacket(pktQue chan *av.Packet, info av.Info) {
 	log.Warningf("[%v] packet queue max!!!", info) // 패킷 큐가 최대 크기를 초과했음을 로그로 경고한다.
+	e := event.New(event.PacketDrop, info.Key, info.UID)
+	e.Protocol = event.ProtocolHLS
+	event.Publish(e)
+	queued := len(pktQue)
 	// i가 84를 넘으면 추가 반복이 이루어 지지 않을 수 있는데.. 이부분은 경험적으로 설정된 값일 가능성이 크다.
 	for i := 0; i < maxQueueNum-84; i++ { // 큐가 초과된 경우, 반복문을 통해 패킷을 제거한다( <- pktQue)
 		tmpPkt, ok := <-pktQue // 패킷 큐에서 한개의 패킷을 꺼냄.
@@ -112,6 +244,8 @@ func (source *Source) DropPacket(pktQue chan *av.Packet, info av.Info) {
 		}
 
 	}
+	// 큐에서 줄어든 패킷과 큐에 넣지 못한 새 패킷
+	metrics.Add(metrics.DroppedPackets, info.Key, event.ProtocolHLS, uint64(queued-len(pktQue)+1))
 	log.Debug("packet queue len: ", len(pktQue))
 }
 
@@ -143,6 +277,7 @@ func (source *Source) SendPacket() error {
 		if r := recover(); r != nil {
 			log.Warning("hls SendPacket panic: ", r)
 		}
+		source.finishRecording()
 	}()
 
 	log.Debugf("[%v] hls sender start", source.info)
@@ -152,70 +287,286 @@ func (source *Source) SendPacket() error {
 		}
 
 		p, ok := <-source.packetQueue
-		if ok {
-			if p.IsMetadata {
-				continue
-			}
-
-			err := source.demuxer.Demux(p)
-			if err == flv.ErrAvcEndSEQ {
-				log.Warning(err)
-				continue
-			} else {
-				if err != nil {
-					log.Warning(err)
-					return err
-				}
-			}
-			compositionTime, isSeq, err := source.parse(p)
-			if err != nil {
-				log.Warning(err)
-			}
-			if err != nil || isSeq {
-				continue
-			}
-			if source.btswriter != nil {
-				source.stat.update(p.IsVideo, p.TimeStamp)
-				source.calcPtsDts(p.IsVideo, p.TimeStamp, uint32(compositionTime))
-				source.tsMux(p)
-			}
-		} else {
+		if !ok {
 			return fmt.Errorf("closed")
 		}
+		if err := source.handlePacket(p); err != nil {
+			return err
+		}
+	}
+}
+
+// 큐에서 꺼낸 패킷 하나를 세그먼트에 쓴다. 에러를 반환하면 SendPacket 이 끝난다.
+func (source *Source) handlePacket(p *av.Packet) error {
+	if p.IsMetadata {
+		// 퍼블리셔가 보냈거나 API 로 넣은 광고 구간 큐
+		if cue, ok := amf.DecodeCuePoint(p.Data, p.TimeStamp); ok {
+			source.addCue(cue)
+		}
+		source.parseMetadata(p)
+		if source.fmp4 == nil {
+			source.muxMetadata(p)
+		}
+		return nil
+	}
+
+	err := source.demuxer.Demux(p)
+	if err == flv.ErrAvcEndSEQ || err == flv.ErrVideoMetadata {
+		log.Warning(err)
+		return nil
+	} else {
+		if err != nil {
+			log.Warning(err)
+			return err
+		}
+	}
+	source.addTrack(p)
+	if source.captions != nil && p.IsVideo {
+		source.writeCaptions(p)
+	}
+	if source.fmp4 != nil {
+		if err := source.fmp4Mux(p); err != nil {
+			log.Warning(err)
+		}
+		return nil
 	}
+	compositionTime, isSeq, err := source.parse(p)
+	if err != nil {
+		log.Warning(err)
+	}
+	if err != nil || isSeq {
+		return nil
+	}
+	if source.btswriter != nil {
+		source.stat.update(p.IsVideo, p.TimeStamp)
+		source.calcPtsDts(p.IsVideo, p.TimeStamp, uint32(compositionTime))
+		source.tsMux(p)
+	}
+	return nil
 }
 
 func (source *Source) Info() (ret av.Info) {
 	return source.info
 }
 
+// 세그먼트 캐시는 퍼블리셔가 곧 다시 들어와 이어받을 수 있으므로 남겨 두고,
+// 스트림이 끝난 뒤에는 서버의 checkStop 이 Source 와 함께 지운다.
 func (source *Source) cleanup() {
 	close(source.packetQueue)
-	source.bwriter = nil
-	source.btswriter = nil
-	source.cache = nil
-	source.tsCache = nil
 }
 
 func (source *Source) Close(err error) {
 	log.Debug("hls source closed: ", source.info)
-	if !source.closed && !configure.Config.GetBool("hls_keep_after_end") {
+	if !source.closed {
 		source.cleanup()
 	}
 	source.closed = true
 }
 
-func (source *Source) cut() {
+// 퍼블리셔가 다시 들어오면 이전 Source 의 세그먼트 캐시와 시퀀스 번호를 이어받아 플레이리스트가 끊기지 않게 한다.
+// 새 퍼블리셔의 타임스탬프는 이전과 이어지지 않으므로 첫 세그먼트 앞에 #EXT-X-DISCONTINUITY 를 붙인다.
+func (source *Source) resume(old *Source) {
+	if old.tsCache == nil {
+		return
+	}
+	source.tsCache = old.tsCache
+	source.seq = old.seq
+	source.discontinuity = true
+	if old.captions != nil && source.captions != nil {
+		source.captions.cache = old.captions.cache
+	}
+	// 이전 퍼블리셔가 끝내지 못한 세그먼트의 부분 세그먼트는 같은 이름으로 다시 만들어지므로 버린다.
+	source.tsCache.DropPending()
+}
+
+// 완성된 세그먼트를 캐시에 넣고, 녹화 중이면 디스크에도 쓴다. 자막을 만들면 같은 구간의 WebVTT 세그먼트도 만든다.
+func (source *Source) setItem(filename string, item TSItem) {
+	source.tsCache.SetItem(filename, item)
+	metrics.Add(metrics.HLSSegments, source.info.Key, event.ProtocolHLS, 1)
+	if source.captions != nil {
+		source.captions.segment(item, source.segStart+uint32(item.Duration), source.discontinuity)
+	}
+	if source.recorder != nil {
+		source.recorder.writeSegment(item)
+	}
+}
+
+func (source *Source) setMap(name string, item TSItem) {
+	source.tsCache.SetMap(name, item)
+	if source.recorder != nil {
+		source.recorder.writeMap(item)
+	}
+}
+
+// 퍼블리셔가 끝나면 아직 자르지 않은 세그먼트를 녹화에 쓰고 플레이리스트를 VOD 로 마무리한다.
+// 라이브 캐시와 시퀀스 번호는 다시 들어올 퍼블리셔가 이어받으므로 건드리지 않는다.
+func (source *Source) finishRecording() {
+	rec := source.recorder
+	if rec == nil {
+		return
+	}
+	if source.btswriter != nil && source.stat.hasSetFirstTs {
+		end := uint32(source.stat.lastTimestamp) + source.frameGap
+		var ext string
+		if source.fmp4 != nil {
+			source.btswriter.Write(source.fmp4.Fragment(end))
+			ext = "m4s"
+		} else {
+			source.flushAudio()
+			ext = "ts"
+		}
+		filename := fmt.Sprintf("/%s/%d.%s", source.info.Key, source.seq+1, ext)
+		item := source.newSegment(filename, source.seq+1, end, source.btswriter.Bytes())
+		item.MapName = source.mapName
+		rec.writeSegment(item)
+	}
+	rec.finish()
+	source.recorder = nil
+}
+
+// 새 세그먼트를 ts(DTS, ms) 에서 시작한다.
+func (source *Source) startSegment(ts uint32) {
+	if source.epoch.IsZero() || source.discontinuity {
+		source.epoch = time.Now().Add(-time.Duration(ts) * time.Millisecond)
+	}
+	source.segStart = ts
+	source.segTime = source.epoch.Add(time.Duration(ts) * time.Millisecond)
+	source.segDiscontinuity = source.discontinuity
+	source.discontinuity = false
+	source.segCue = source.spliceCue(ts)
+	if source.encryption != "" && (source.key == nil || source.seq%source.keyRotation == 0) {
+		source.rotateKey()
+	}
+}
+
+// 새 키를 만든다. 키 이름은 이 키로 처음 암호화하는 세그먼트의 시퀀스 번호로 정한다.
+func (source *Source) rotateKey() {
+	source.key = newKey()
+	source.keyName = fmt.Sprintf("/%s/%d.key", source.info.Key, source.seq+1)
+	source.tsCache.SetKey(source.keyName, source.key)
+	if source.recorder != nil {
+		source.recorder.writeKey(source.keyName, source.key)
+	}
+}
+
+// 키프레임 ts 에서 현재 세그먼트를 끝낼지 정한다.
+// 세그먼트 길이는 벽시계가 아니라 세그먼트를 시작한 키프레임과 ts 의 DTS 차이로 잰다.
+// DTS 가 뒤로 돌아가면 타임스탬프가 끊긴 것이므로 바로 자르고 다음 세그먼트에 #EXT-X-DISCONTINUITY 를 붙인다.
+// 광고 구간의 시작과 끝에서는 목표 길이와 관계없이 자른다.
+func (source *Source) segmentEnd(ts uint32) bool {
+	if ts < source.segStart {
+		source.discontinuity = true
+		return true
+	}
+	return ts-source.segStart >= source.duration || source.spliceDue(ts)
+}
+
+// 진행 중인 광고 구간
+type adBreak struct {
+	id       uint32
+	start    uint32    // 광고를 시작한 세그먼트의 DTS(ms)
+	end      uint32    // 예정된 광고 끝 타임스탬프(ms). 0 이면 CUE-IN 큐를 기다린다.
+	duration uint32    // 예정된 광고 길이(ms)
+	date     time.Time // 광고를 시작한 세그먼트의 #EXT-X-PROGRAM-DATE-TIME
+}
+
+// 광고 시작부터 ts 까지 지난 시간(ms)
+func (ad *adBreak) elapsed(ts uint32) uint32 {
+	if ts < ad.start {
+		return 0
+	}
+	return ts - ad.start
+}
+
+func (source *Source) addCue(cue amf.CuePoint) {
+	log.Debugf("[%v] hls cue point: %+v", source.info, cue)
+	i := len(source.cues)
+	for i > 0 && source.cues[i-1].Time > cue.Time {
+		i--
+	}
+	source.cues = append(source.cues, amf.CuePoint{})
+	copy(source.cues[i+1:], source.cues[i:])
+	source.cues[i] = cue
+}
+
+// 키프레임 ts 에서 광고 구간이 시작하거나 끝나는지 여부
+func (source *Source) spliceDue(ts uint32) bool {
+	if len(source.cues) > 0 && source.cues[0].Time <= ts {
+		return true
+	}
+	return source.ad != nil && source.ad.end > 0 && ts >= source.ad.end
+}
+
+// ts 에서 시작하는 세그먼트의 광고 태그를 정한다. ts 까지 이른 큐를 반영한다.
+// 스플라이스 지점은 큐의 타임스탬프 이후 첫 키프레임이다.
+func (source *Source) spliceCue(ts uint32) *CueTag {
+	var tag *CueTag
+	if ad := source.ad; ad != nil && ad.end > 0 && ts >= ad.end {
+		tag = source.cueInTag(ts)
+	}
+	for len(source.cues) > 0 && source.cues[0].Time <= ts {
+		cue := source.cues[0]
+		source.cues = source.cues[1:]
+		if cue.Out {
+			if source.ad != nil {
+				continue // 광고 중에 온 광고 시작 큐는 무시한다.
+			}
+			source.ad = &adBreak{id: cue.ID, start: ts, duration: cue.Duration, date: source.segTime}
+			if cue.Duration > 0 {
+				source.ad.end = cue.Time + cue.Duration
+			}
+			tag = &CueTag{Type: cueOut, ID: cue.ID, Duration: cue.Duration, Start: source.segTime, DateRange: source.dateRange}
+		} else if source.ad != nil {
+			tag = source.cueInTag(ts)
+		}
+	}
+	if tag == nil && source.ad != nil {
+		ad := source.ad
+		tag = &CueTag{Type: cueCont, ID: ad.id, Duration: ad.duration, Elapsed: ad.elapsed(ts), Start: ad.date, DateRange: source.dateRange}
+	}
+	return tag
+}
+
+// 광고 구간을 끝내고 본방송 복귀 태그를 만든다.
+func (source *Source) cueInTag(ts uint32) *CueTag {
+	ad := source.ad
+	source.ad = nil
+	return &CueTag{Type: cueIn, ID: ad.id, Duration: ad.duration, Elapsed: ad.elapsed(ts), Start: ad.date, DateRange: source.dateRange}
+}
+
+// 끝난 세그먼트의 항목을 만든다. ts 는 다음 세그먼트를 시작하는 키프레임의 DTS 이다.
+// AES-128 이면 세그먼트 전체를 암호화한다. SAMPLE-AES 는 tsMux 에서 샘플을 암호화해 두었다.
+func (source *Source) newSegment(filename string, seq int, ts uint32, data []byte) TSItem {
+	d := int(ts - source.segStart)
+	if ts < source.segStart {
+		d = int(source.stat.durationMs())
+	}
+	item := NewTSItem(filename, d, seq, data)
+	item.Discontinuity = source.segDiscontinuity
+	item.ProgramDateTime = source.segTime
+	item.Cue = source.segCue
+	if source.encryption != "" {
+		item.KeyName = source.keyName
+		item.KeyMethod = keyMethod(source.encryption)
+		if source.encryption == configure.HLSEncryptionAES128 {
+			item.Data = encryptSegment(source.key, seq, item.Data)
+		}
+	}
+	return item
+}
+
+// 키프레임 ts 에서 TS 세그먼트를 자른다. 세그먼트 이름은 시퀀스 번호로 정한다.
+func (source *Source) cut(ts uint32) {
 	newf := true
 	if source.btswriter == nil {
 		source.btswriter = bytes.NewBuffer(nil)
-	} else if source.btswriter != nil && source.stat.durationMs() >= duration {
+	} else if source.segmentEnd(ts) {
 		source.flushAudio()
 
 		source.seq++
-		filename := fmt.Sprintf("/%s/%d.ts", source.info.Key, time.Now().Unix())
-		item := NewTSItem(filename, int(source.stat.durationMs()), source.seq, source.btswriter.Bytes())
-		source.tsCache.SetItem(filename, item)
+		filename := fmt.Sprintf("/%s/%d.ts", source.info.Key, source.seq)
+		item := source.newSegment(filename, source.seq, ts, source.btswriter.Bytes())
+		source.setItem(filename, item)
 
 		source.btswriter.Reset()
 		source.stat.resetAndNew()
@@ -223,9 +574,260 @@ func (source *Source) cut() {
 		newf = false
 	}
 	if newf {
-		source.btswriter.Write(source.muxer.PAT())
-		source.btswriter.Write(source.muxer.PMT(av.SOUND_AAC, true))
+		source.startSegment(ts)
+		source.writeTables()
+	}
+}
+
+// 세그먼트에 PAT 와 PMT 를 쓴다.
+func (source *Source) writeTables() {
+	source.muxer.SetSampleAES(source.encryption == configure.HLSEncryptionSampleAES, source.audioConfig)
+	source.btswriter.Write(source.muxer.PAT())
+	source.btswriter.Write(source.muxer.PMT(source.soundFormat, source.hasAudio, source.videoCodec, source.hasVideo))
+}
+
+// 비디오가 없는 스트림인지 여부. onMetaData 가 없으면 첫 오디오부터 probeDuration 동안 비디오가 오지 않았을 때 오디오 전용으로 본다.
+func (source *Source) audioOnly(ts uint32) bool {
+	if source.hasVideo || !source.hasAudio {
+		return false
+	}
+	return source.metaTracks || ts-source.firstAudioTs >= probeDuration
+}
+
+// 지원하는 코덱의 패킷이 오면 트랙 구성에 반영한다.
+func (source *Source) addTrack(p *av.Packet) {
+	if p.IsVideo {
+		codecID := p.Header.(av.VideoPacketHeader).CodecID()
+		if codecID != av.VIDEO_H264 && codecID != av.VIDEO_HEVC {
+			return
+		}
+		if !source.hasVideo || source.videoCodec != codecID {
+			source.hasVideo, source.videoCodec = true, codecID
+			source.tracksChanged()
+		}
+		return
+	}
+	soundFormat := p.Header.(av.AudioPacketHeader).SoundFormat()
+	if soundFormat != av.SOUND_AAC && soundFormat != av.SOUND_MP3 {
+		return
+	}
+	if !source.hasAudio {
+		source.firstAudioTs = p.TimeStamp
+	}
+	if !source.hasAudio || source.soundFormat != soundFormat {
+		source.hasAudio, source.soundFormat = true, soundFormat
+		source.tracksChanged()
+	}
+}
+
+// 세그먼트 중간에 트랙 구성이 바뀌면 PAT 와 PMT 를 다시 써서 이후 패킷의 PID 를 알린다.
+func (source *Source) tracksChanged() {
+	if source.fmp4 == nil && source.btswriter != nil {
+		source.writeTables()
+	}
+}
+
+// onMetaData 의 audiocodecid 를 FLV 사운드 포맷으로 읽는다. 숫자 또는 FourCC 문자열이다.
+func metaSoundFormat(v interface{}) (byte, bool) {
+	switch v := v.(type) {
+	case float64:
+		return byte(v), byte(v) == av.SOUND_AAC || byte(v) == av.SOUND_MP3
+	case string:
+		switch strings.TrimPrefix(v, ".") {
+		case "mp4a":
+			return av.SOUND_AAC, true
+		case "mp3":
+			return av.SOUND_MP3, true
+		}
+	}
+	return 0, false
+}
+
+// onMetaData 로 트랙 구성을 정하고, fMP4 형식이면 width/height 를 init 세그먼트에 반영한다.
+func (source *Source) parseMetadata(p *av.Packet) {
+	vs, _ := amf.NewDecoder().DecodeBatch(bytes.NewReader(p.Data), amf.AMF0)
+	for i, v := range vs {
+		if v != amf.OnMetaData || i+1 >= len(vs) {
+			continue
+		}
+		obj, ok := vs[i+1].(amf.Object)
+		if !ok {
+			return
+		}
+		_, video := obj["videocodecid"]
+		soundFormat, audio := metaSoundFormat(obj["audiocodecid"])
+		if video || audio {
+			source.metaTracks = true
+			changed := video && !source.hasVideo || audio && !source.hasAudio
+			source.hasVideo = source.hasVideo || video
+			if audio && !source.hasAudio {
+				source.hasAudio, source.soundFormat = true, soundFormat
+			}
+			if changed {
+				source.tracksChanged()
+			}
+		}
+		if source.fmp4 != nil {
+			width, _ := obj["width"].(float64)
+			height, _ := obj["height"].(float64)
+			source.fmp4.SetVideoSize(int(width), int(height))
+		}
+		return
+	}
+}
+
+// fMP4 형식일 때 패킷을 처리한다. TS 와 달리 Annex B/ADTS 로 바꾸지 않고 FLV 의 코덱 데이터를 그대로 샘플로 쓴다.
+func (source *Source) fmp4Mux(p *av.Packet) error {
+	if p.IsVideo {
+		vh := p.Header.(av.VideoPacketHeader)
+		if vh.CodecID() != av.VIDEO_H264 && vh.CodecID() != av.VIDEO_HEVC {
+			return ErrNoSupportVideoCodec
+		}
+		if vh.IsSeq() {
+			source.parseResolution(vh.CodecID(), p.Data)
+			return source.fmp4.SetVideoConfig(vh.CodecID(), p.Data)
+		}
+		if vh.IsKeyFrame() {
+			source.cutFMP4(p.TimeStamp)
+		} else if source.partTarget > 0 && source.btswriter != nil &&
+			p.TimeStamp-source.partStart+source.frameGap > source.partTarget {
+			// 이 프레임까지 넣으면 목표 길이를 넘으므로 앞에서 자른다.
+			source.cutPart(p.TimeStamp, false)
+		}
+		if source.btswriter == nil {
+			return nil
+		}
+		source.updateFrameGap(p.TimeStamp)
+		source.stat.update(true, p.TimeStamp)
+		source.fmp4.WriteVideo(p.TimeStamp, vh.CompositionTime(), vh.IsKeyFrame(), p.Data)
+		return nil
+	}
+
+	ah := p.Header.(av.AudioPacketHeader)
+	if ah.SoundFormat() != av.SOUND_AAC {
+		return ErrNoSupportAudioCodec
+	}
+	if ah.AACPacketType() == av.AAC_SEQHDR {
+		return source.fmp4.SetAudioConfig(p.Data)
+	}
+	if source.audioOnly(p.TimeStamp) {
+		// 오디오 전용 스트림은 어느 프레임에서나 자를 수 있으므로 시간으로 세그먼트와 부분 세그먼트를 자른다.
+		source.cutFMP4(p.TimeStamp)
+		if source.partTarget > 0 && p.TimeStamp-source.partStart+source.frameGap > source.partTarget {
+			source.cutPart(p.TimeStamp, false)
+		}
+		source.updateFrameGap(p.TimeStamp)
+	}
+	if source.btswriter == nil {
+		return nil
+	}
+	source.stat.update(false, p.TimeStamp)
+	source.fmp4.WriteAudio(p.TimeStamp, p.Data)
+	return nil
+}
+
+func (source *Source) updateFrameGap(ts uint32) {
+	if ts > source.lastFrameTs {
+		source.frameGap = ts - source.lastFrameTs
+	}
+	source.lastFrameTs = ts
+}
+
+// fMP4 세그먼트를 자른다. ts 는 새 세그먼트를 시작하는 키프레임의 타임스탬프이다.
+// 코덱 설정이 바뀌었으면 새 init 세그먼트를 만들고, 이후 세그먼트는 이를 #EXT-X-MAP 으로 참조한다.
+// LL-HLS 에서는 세그먼트를 자르지 않더라도 키프레임마다 부분 세그먼트를 잘라, 키프레임이 부분 세그먼트의 시작이 되게 한다.
+// 오디오 전용 스트림은 프레임마다 불리므로 세그먼트가 끝날 때만 자른다.
+func (source *Source) cutFMP4(ts uint32) {
+	if source.btswriter == nil {
+		source.btswriter = bytes.NewBuffer(nil)
+	} else {
+		end := source.segmentEnd(ts)
+		if source.partTarget > 0 && (end || source.hasVideo) {
+			source.cutPart(ts, end)
+		} else if end {
+			source.btswriter.Write(source.fmp4.Fragment(ts))
+		}
+		if !end {
+			source.partIndependent = true
+			return
+		}
+
+		source.seq++
+		filename := fmt.Sprintf("/%s/%d.m4s", source.info.Key, source.seq)
+		item := source.newSegment(filename, source.seq, ts, source.btswriter.Bytes())
+		item.MapName = source.mapName
+		source.setItem(filename, item)
+
+		source.btswriter.Reset()
+		source.stat.resetAndNew()
+	}
+
+	if source.mapName == "" || source.fmp4.Changed() {
+		source.mapName = fmt.Sprintf("/%s/init-%d.mp4", source.info.Key, time.Now().UnixNano())
+		source.setMap(source.mapName, NewTSItem(source.mapName, 0, 0, source.fmp4.InitSegment()))
+	}
+	source.startSegment(ts)
+	source.partNum = 0
+	source.partStart = ts
+	source.partIndependent = true
+}
+
+// 버퍼에 쌓인 샘플로 LL-HLS 부분 세그먼트를 만든다. ts 는 다음 부분 세그먼트의 첫 샘플 타임스탬프이다.
+// 부분 세그먼트는 세그먼트 버퍼에도 이어 붙이므로, 세그먼트가 끝나면 버퍼 전체가 그대로 세그먼트가 된다.
+// last 가 true 면 이 부분 세그먼트로 세그먼트가 끝나므로, 다음 세그먼트의 첫 부분 세그먼트를 힌트로 알린다.
+func (source *Source) cutPart(ts uint32, last bool) {
+	b := source.fmp4.Fragment(ts)
+	if b == nil {
+		return
 	}
+	source.btswriter.Write(b)
+
+	seq := source.seq + 1
+	name := fmt.Sprintf("/%s/%d.part%d.m4s", source.info.Key, seq, source.partNum)
+	part := NewTSItem(name, int(ts-source.partStart), seq, b)
+	part.MapName = source.mapName
+	part.Independent = source.partIndependent || !source.hasVideo
+	if source.partNum == 0 {
+		// 진행 중인 세그먼트의 태그는 첫 부분 세그먼트 앞에 쓴다.
+		part.Discontinuity = source.segDiscontinuity
+		part.ProgramDateTime = source.segTime
+		part.Cue = source.segCue
+	}
+	source.partNum++
+
+	preload := fmt.Sprintf("/%s/%d.part%d.m4s", source.info.Key, seq, source.partNum)
+	if last {
+		preload = fmt.Sprintf("/%s/%d.part0.m4s", source.info.Key, seq+1)
+	}
+	source.tsCache.SetPart(part, preload)
+
+	source.partStart = ts
+	source.partIndependent = false
+}
+
+// 비디오 시퀀스 헤더의 SPS 에서 화면 크기를 읽는다.
+func (source *Source) parseResolution(codecID byte, record []byte) {
+	var width, height int
+	var err error
+	if codecID == av.VIDEO_HEVC {
+		width, height, err = h265.Resolution(record)
+	} else {
+		width, height, err = h264.Resolution(record)
+	}
+	if err != nil {
+		log.Debugf("[%v] parse sps error: %v", source.info, err)
+		return
+	}
+	source.lock.Lock()
+	source.width, source.height = width, height
+	source.lock.Unlock()
+}
+
+// SPS 에서 읽은 화면 크기. 아직 시퀀스 헤더를 받지 못했으면 0 이다.
+func (source *Source) Resolution() (width, height int) {
+	source.lock.RLock()
+	defer source.lock.RUnlock()
+	return source.width, source.height
 }
 
 func (source *Source) parse(p *av.Packet) (int32, bool, error) {
@@ -234,19 +836,29 @@ func (source *Source) parse(p *av.Packet) (int32, bool, error) {
 	var vh av.VideoPacketHeader
 	if p.IsVideo {
 		vh = p.Header.(av.VideoPacketHeader)
-		if vh.CodecID() != av.VIDEO_H264 {
+		if vh.CodecID() != av.VIDEO_H264 && vh.CodecID() != av.VIDEO_HEVC {
 			return compositionTime, false, ErrNoSupportVideoCodec
 		}
 		compositionTime = vh.CompositionTime()
 		if vh.IsKeyFrame() && vh.IsSeq() {
+			source.parseResolution(vh.CodecID(), p.Data)
+			if vh.CodecID() == av.VIDEO_HEVC && source.encryption == configure.HLSEncryptionSampleAES {
+				log.Warningf("[%v] sample-aes is not supported for hevc, use aes-128", source.info)
+				source.encryption = configure.HLSEncryptionAES128
+			}
 			return compositionTime, true, source.tsparser.Parse(p, source.bwriter)
 		}
 	} else {
 		ah = p.Header.(av.AudioPacketHeader)
-		if ah.SoundFormat() != av.SOUND_AAC {
+		if ah.SoundFormat() != av.SOUND_AAC && ah.SoundFormat() != av.SOUND_MP3 {
 			return compositionTime, false, ErrNoSupportAudioCodec
 		}
-		if ah.AACPacketType() == av.AAC_SEQHDR {
+		if ah.SoundFormat() == av.SOUND_MP3 && source.encryption == configure.HLSEncryptionSampleAES {
+			log.Warningf("[%v] sample-aes is not supported for mp3, use aes-128", source.info)
+			source.encryption = configure.HLSEncryptionAES128
+		}
+		if ah.SoundFormat() == av.SOUND_AAC && ah.AACPacketType() == av.AAC_SEQHDR {
+			source.audioConfig = append([]byte(nil), p.Data...)
 			return compositionTime, true, source.tsparser.Parse(p, source.bwriter)
 		}
 	}
@@ -256,8 +868,18 @@ func (source *Source) parse(p *av.Packet) (int32, bool, error) {
 	}
 	p.Data = source.bwriter.Bytes()
 
-	if p.IsVideo && vh.IsKeyFrame() {
-		source.cut()
+	if p.IsVideo {
+		keyFrame := vh.IsKeyFrame()
+		if vh.CodecID() == av.VIDEO_HEVC {
+			// HEVC 는 FLV 프레임 타입 대신 실제 NALU 로 IRAP 여부를 판단한다.
+			keyFrame = h265.HasIRAP(p.Data)
+		}
+		if keyFrame {
+			source.cut(p.TimeStamp)
+		}
+	} else if source.audioOnly(p.TimeStamp) {
+		// 오디오 전용 스트림은 키프레임이 없으므로 오디오 프레임의 타임스탬프로 자른다.
+		source.cut(p.TimeStamp)
 	}
 	return compositionTime, false, nil
 }
@@ -268,10 +890,42 @@ func (source *Source) calcPtsDts(isVideo bool, ts, compositionTs uint32) {
 		source.pts = source.dts + uint64(compositionTs)*h264_default_hz
 	} else {
 		sampleRate, _ := source.tsparser.SampleRate()
-		source.align.align(&source.dts, uint32(videoHZ*aacSampleLen/sampleRate))
+		samples, _ := source.tsparser.SamplesPerFrame()
+		source.align.align(&source.dts, uint32(videoHZ*samples/sampleRate))
 		source.pts = source.dts
 	}
 }
+
+// H.264 프레임의 SEI 에서 캡션을 읽는다. Demux 직후의 p.Data 는 AVCC 형식이다.
+func (source *Source) writeCaptions(p *av.Packet) {
+	vh := p.Header.(av.VideoPacketHeader)
+	if vh.CodecID() != av.VIDEO_H264 || vh.IsSeq() {
+		return
+	}
+	pts := uint32(int64(p.TimeStamp) + int64(vh.CompositionTime()))
+	source.captions.write(p.TimeStamp, pts, p.Data)
+}
+
+// 데이터 메시지를 ID3 태그로 바꿔 현재 세그먼트의 메타데이터 스트림에 쓴다. 첫 세그먼트를 시작하기 전의 메시지는 버린다.
+// 메타데이터 스트림은 첫 메시지가 올 때 PMT 에 선언하며, 그 자리에서 PAT 와 PMT 를 다시 써 세그먼트 중간부터 읽게 한다.
+func (source *Source) muxMetadata(p *av.Packet) {
+	if source.btswriter == nil {
+		return
+	}
+	tag, ok := id3Metadata(p.Data)
+	if !ok {
+		return
+	}
+	if !source.muxer.TimedMetadata() {
+		source.muxer.SetTimedMetadata(true)
+		source.writeTables()
+	}
+	meta := av.Packet{IsMetadata: true, TimeStamp: p.TimeStamp, Data: tag}
+	if err := source.muxer.Mux(&meta, source.btswriter); err != nil {
+		log.Warningf("[%v] hls metadata mux error: %v", source.info, err)
+	}
+}
+
 func (source *Source) flushAudio() error {
 	return source.muxAudio(1)
 }
@@ -287,10 +941,18 @@ func (source *Source) muxAudio(limit byte) error {
 	return source.muxer.Mux(&p, source.btswriter)
 }
 
+// SAMPLE-AES 면 TS 로 묶기 전에 비디오 NALU 와 오디오 프레임을 암호화한다.
 func (source *Source) tsMux(p *av.Packet) error {
+	sampleAES := source.encryption == configure.HLSEncryptionSampleAES
 	if p.IsVideo {
+		if sampleAES {
+			p.Data = encryptNALUs(source.key, segmentIV(source.seq+1), p.Data)
+		}
 		return source.muxer.Mux(p, source.btswriter)
 	} else {
+		if sampleAES {
+			p.Data = encryptADTS(source.key, segmentIV(source.seq+1), p.Data)
+		}
 		source.cache.Cache(p.Data, source.pts)
 		return source.muxAudio(cache_max_frames)
 	}
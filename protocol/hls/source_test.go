@@ -0,0 +1,180 @@
+package hls
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/protocol/amf"
+)
+
+// AVCDecoderConfigurationRecord 를 담은 FLV 비디오 시퀀스 헤더. SPS 4 바이트, PPS 2 바이트
+var testAvcSeq = []byte{0x17, 0x00, 0, 0, 0, 0x01, 0x64, 0x00, 0x1f, 0xff, 0xe1, 0x00, 0x04, 0x67, 0x64, 0x00, 0x1f, 0x01, 0x00, 0x02, 0x68, 0xee}
+
+// 테스트용 Source. SendPacket 고루틴은 빈 큐를 기다리고, 패킷은 handlePacket 으로 바로 넣는다.
+func newTestSource(duration uint32) *Source {
+	s := NewSource(av.Info{Key: "test/movie"})
+	s.duration = duration
+	s.tsCache = NewTSCacheItem(s.info.Key, 10)
+	return s
+}
+
+func avcSeq() *av.Packet {
+	return &av.Packet{IsVideo: true, Data: append([]byte(nil), testAvcSeq...)}
+}
+
+// key 이면 IDR, 아니면 P 슬라이스 하나를 담은 FLV 비디오 태그
+func avcFrame(ts uint32, key bool) *av.Packet {
+	if key {
+		return &av.Packet{IsVideo: true, TimeStamp: ts, Data: []byte{0x17, 0x01, 0, 0, 0, 0, 0, 0, 2, 0x65, 0x88}}
+	}
+	return &av.Packet{IsVideo: true, TimeStamp: ts, Data: []byte{0x27, 0x01, 0, 0, 0, 0, 0, 0, 2, 0x41, 0x9a}}
+}
+
+// 키프레임마다 500ms 뒤의 인터 프레임 하나를 붙여 넣는다.
+func writeGops(t *testing.T, s *Source, keys ...uint32) {
+	for _, ts := range keys {
+		for _, p := range []*av.Packet{avcFrame(ts, true), avcFrame(ts+500, false)} {
+			if err := s.handlePacket(p); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// 캐시에 남은 세그먼트를 순서대로 돌려준다.
+func cachedSegments(s *Source) []TSItem {
+	var items []TSItem
+	c := s.tsCache
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for e := c.ll.Front(); e != nil; e = e.Next() {
+		items = append(items, c.lm[e.Value.(string)])
+	}
+	return items
+}
+
+type segmentSummary struct {
+	seq           int
+	duration      int
+	discontinuity bool
+}
+
+func summarize(items []TSItem) []segmentSummary {
+	var ret []segmentSummary
+	for _, item := range items {
+		ret = append(ret, segmentSummary{item.SeqNum, item.Duration, item.Discontinuity})
+	}
+	return ret
+}
+
+func TestSegmentCutOnDTS(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []uint32
+		want []segmentSummary
+	}{
+		{"every target", []uint32{0, 1000, 2000, 3000, 4000}, []segmentSummary{{1, 2000, false}, {2, 2000, false}}},
+		{"longer gops", []uint32{0, 1500, 3000, 4500}, []segmentSummary{{1, 3000, false}}},
+		{"timestamp wrap", []uint32{10000, 12000, 0, 2000}, []segmentSummary{{1, 2000, false}, {2, 500, false}, {3, 2000, true}}},
+		{"dts goes back", []uint32{0, 2000, 4000, 1000, 3000}, []segmentSummary{{1, 2000, false}, {2, 2000, false}, {3, 500, false}, {4, 2000, true}}},
+	}
+	for _, test := range tests {
+		// 패킷은 곧바로 들어가므로 벽시계로 잘랐다면 세그먼트가 생기지 않는다.
+		s := newTestSource(2000)
+		if err := s.handlePacket(avcSeq()); err != nil {
+			t.Fatal(err)
+		}
+		writeGops(t, s, test.keys...)
+		if got := summarize(cachedSegments(s)); fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: segments = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestResumeDiscontinuity(t *testing.T) {
+	old := newTestSource(2000)
+	old.handlePacket(avcSeq())
+	writeGops(t, old, 10000, 12000, 14000)
+
+	// 다시 들어온 퍼블리셔는 타임스탬프를 0 부터 다시 시작한다.
+	s := newTestSource(2000)
+	s.resume(old)
+	s.handlePacket(avcSeq())
+	writeGops(t, s, 0, 2000, 4000)
+
+	want := []segmentSummary{{1, 2000, false}, {2, 2000, false}, {3, 2000, true}, {4, 2000, false}}
+	if got := summarize(cachedSegments(s)); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("segments = %v, want %v", got, want)
+	}
+	body, err := s.tsCache.GenM3U8PlayList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	playlist := string(body)
+	if n := strings.Count(playlist, "#EXT-X-DISCONTINUITY\n"); n != 1 {
+		t.Errorf("%d discontinuity tags, want 1:\n%s", n, playlist)
+	}
+	i := strings.Index(playlist, "#EXT-X-DISCONTINUITY\n")
+	if j := strings.Index(playlist, "/test/movie/3.ts"); i < 0 || j < i || strings.Contains(playlist[i:j], ".ts") {
+		t.Errorf("discontinuity not directly before segment 3:\n%s", playlist)
+	}
+}
+
+// 오디오 전용 스트림의 FLV 오디오 태그. AAC 는 시퀀스 헤더(AAC-LC, 44.1kHz, 스테레오)부터 보낸다.
+func audioFrames(soundFormat byte, from, to uint32) []*av.Packet {
+	var ps []*av.Packet
+	if soundFormat == av.SOUND_AAC {
+		ps = append(ps, &av.Packet{TimeStamp: from, Data: []byte{0xaf, 0x00, 0x12, 0x10}})
+	}
+	for ts := from; ts <= to; ts += 100 {
+		if soundFormat == av.SOUND_AAC {
+			ps = append(ps, &av.Packet{TimeStamp: ts, Data: []byte{0xaf, 0x01, 0x21, 0x00}})
+		} else {
+			ps = append(ps, &av.Packet{TimeStamp: ts, Data: []byte{0x2f, 0xff, 0xfb, 0x90, 0x64, 0x00}})
+		}
+	}
+	return ps
+}
+
+func TestAudioOnlyCut(t *testing.T) {
+	tests := []struct {
+		name        string
+		soundFormat byte
+		metadata    bool
+		streamType  byte
+		want        []segmentSummary
+	}{
+		// onMetaData 가 없으면 probeDuration 동안은 세그먼트를 시작하지 않는다.
+		{"aac probed", av.SOUND_AAC, false, 0x0f, []segmentSummary{{1, 2000, false}, {2, 2000, false}}},
+		{"aac metadata", av.SOUND_AAC, true, 0x0f, []segmentSummary{{1, 2000, false}, {2, 2000, false}, {3, 2000, false}}},
+		{"mp3 probed", av.SOUND_MP3, false, 0x04, []segmentSummary{{1, 2000, false}, {2, 2000, false}}},
+	}
+	for _, test := range tests {
+		s := newTestSource(2000)
+		if test.metadata {
+			data := amf0(t, amf.SetDataFrame, amf.OnMetaData, amf.Object{"audiocodecid": float64(test.soundFormat)})
+			s.handlePacket(&av.Packet{IsMetadata: true, Data: data})
+		}
+		for _, p := range audioFrames(test.soundFormat, 0, 6000) {
+			if err := s.handlePacket(p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		items := cachedSegments(s)
+		if got := summarize(items); fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: segments = %v, want %v", test.name, got, test.want)
+			continue
+		}
+		// 세그먼트는 PAT, PMT 순으로 시작하고 PMT 에는 오디오 스트림 하나만 있으며 PCR 도 오디오 PID 에 싣는다.
+		// 스트림이 하나면 section_length 는 9 + 5 + CRC 4 바이트이다.
+		pmt := items[0].Data[188+5:]
+		if length := int(pmt[1]&0x0f)<<8 | int(pmt[2]); length != 18 || pmt[12] != test.streamType {
+			t.Errorf("%s: pmt = %x, want a single stream of type %x", test.name, pmt[:22], test.streamType)
+		}
+		if pcr := int(pmt[8]&0x1f)<<8 | int(pmt[9]); pcr != 0x101 {
+			t.Errorf("%s: PCR_PID = %x, want audio PID", test.name, pcr)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package hls
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gwuhaolin/livego/protocol/event"
+	"github.com/gwuhaolin/livego/protocol/webhook"
+	"github.com/gwuhaolin/livego/utils/uid"
+)
+
+/*
+HLS 시청자 세션
+HLS 는 요청마다 연결이 끝나므로 클라이언트 IP 와 스트림 키로 시청자를 구분해 웹훅과 이벤트 세션을 만든다.
+처음 보는 시청자의 요청에서 on_play 와 player_join 을 보내고, viewerTimeout 동안 요청이 없으면 on_stop 과 player_leave 를 보낸다.
+*/
+
+const viewerTimeout = 30 * time.Second
+
+type viewer struct {
+	id    string
+	last  int64         // 마지막 요청 시각(UnixNano)
+	ready chan struct{} // on_play 응답을 받으면 닫는다.
+	err   error         // on_play 결과
+}
+
+// 요청한 시청자의 세션을 확인한다. on_play 로 거절된 시청자면 에러를 반환한다.
+// 같은 시청자가 동시에 보낸 요청은 첫 요청의 on_play 응답을 함께 기다린다.
+func (server *Server) checkViewer(r *http.Request, stream string) error {
+	if stream == "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	v := &viewer{id: uid.NewId(), last: time.Now().UnixNano(), ready: make(chan struct{})}
+	if old, loaded := server.viewers.LoadOrStore(host+"|"+stream, v); loaded {
+		v = old.(*viewer)
+		<-v.ready
+		atomic.StoreInt64(&v.last, time.Now().UnixNano())
+		return v.err
+	}
+
+	session := webhook.NewSession(event.ProtocolHLS, v.id, stream, r.RemoteAddr, r.URL.Query())
+	v.err = webhook.Play(session)
+	close(v.ready)
+	if v.err != nil {
+		// 거절한 시청자는 기억하지 않고 다음 요청에서 다시 묻는다.
+		server.viewers.Delete(host + "|" + stream)
+		return v.err
+	}
+	e := event.New(event.PlayerJoin, stream, v.id)
+	e.Protocol, e.ClientIP = session.Protocol, session.ClientIP
+	event.Open(e)
+	return nil
+}
+
+// viewerTimeout 동안 요청이 없는 시청자의 세션을 닫는다.
+func (server *Server) expireViewers() {
+	deadline := time.Now().Add(-viewerTimeout).UnixNano()
+	server.viewers.Range(func(key, val interface{}) bool {
+		v := val.(*viewer)
+		select {
+		case <-v.ready:
+		default:
+			return true
+		}
+		if atomic.LoadInt64(&v.last) < deadline {
+			server.viewers.Delete(key)
+			webhook.Stop(v.id)
+			event.Close(v.id)
+		}
+		return true
+	})
+}
@@ -7,7 +7,11 @@ import (
 	"strings"
 
 	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/protocol/auth"
+	"github.com/gwuhaolin/livego/protocol/event"
 	"github.com/gwuhaolin/livego/protocol/rtmp"
+	"github.com/gwuhaolin/livego/protocol/webhook"
+	"github.com/gwuhaolin/livego/utils/uid"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -114,6 +118,12 @@ func (server *Server) handleConn(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := auth.CheckPlayRequest(r, path); err != nil {
+		log.Error("CheckPlay err: ", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
 	// 判断视屏流是否发布,如果没有发布,直接返回404
 	msgs := server.getStreams(w, r)
 	if msgs == nil || len(msgs.Publishers) == 0 {
@@ -133,8 +143,27 @@ func (server *Server) handleConn(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// 웹훅과 이벤트 세션은 재생이 끝나 핸들러가 돌아올 때 닫는다. 세션 ID 는 FLVWriter 의 Uid 로 쓴다.
+	session := webhook.NewSession(event.ProtocolHTTPFLV, uid.NewId(), path, r.RemoteAddr, r.URL.Query())
+	if err := webhook.Play(session); err != nil {
+		log.Error("play rejected: ", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	defer webhook.Stop(session.ID)
+	e := event.New(event.PlayerJoin, path, session.ID)
+	e.Protocol, e.ClientIP = session.Protocol, session.ClientIP
+	event.Open(e)
+	defer event.Close(session.ID)
+
+	if isWebSocket(r) {
+		server.serveWebSocket(w, r, paths[0], paths[1], session.ID)
+		return
+	}
+
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	writer := NewFLVWriter(paths[0], paths[1], url, w)
+	writer.Uid = session.ID
 
 	server.handler.HandleWriter(writer)
 	writer.Wait()
@@ -0,0 +1,38 @@
+package httpflv
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/websocket"
+)
+
+/*
+WebSocket-FLV
+HTTP-FLV 와 같은 주소(/APP/NAME.flv)로 WebSocket 업그레이드 요청이 오면, 같은 FLV 태그를 바이너리 프레임으로 보낸다.
+첫 프레임은 FLV 헤더이고, 이후 프레임마다 태그 하나(태그 헤더, 데이터, PreviousTagSize)가 실린다.
+긴 chunked 응답을 끊는 프록시 뒤의 시청자를 위한 것으로, flv.js 와 mpegts.js 가 바로 재생할 수 있다.
+*/
+
+func isWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// 다른 도메인의 플레이어도 붙을 수 있도록 Origin 은 확인하지 않는다.
+func (server *Server) serveWebSocket(w http.ResponseWriter, r *http.Request, app, title, id string) {
+	url := r.URL.String()
+	websocket.Server{Handler: func(conn *websocket.Conn) {
+		conn.PayloadType = websocket.BinaryFrame
+		writer := NewFLVWriter(app, title, url, conn)
+		writer.Uid = id
+		// 클라이언트가 보내는 메시지는 버리고, 연결이 끊기면 바로 정리한다.
+		go func() {
+			io.Copy(ioutil.Discard, conn)
+			writer.Close(nil)
+		}()
+		server.handler.HandleWriter(writer)
+		writer.Wait()
+	}}.ServeHTTP(w, r)
+}
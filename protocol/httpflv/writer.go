@@ -2,11 +2,15 @@ package httpflv
 
 import (
 	"fmt"
-	"net/http"
+	"io"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gwuhaolin/livego/av"
 	"github.com/gwuhaolin/livego/protocol/amf"
+	"github.com/gwuhaolin/livego/protocol/event"
+	"github.com/gwuhaolin/livego/protocol/metrics"
 	"github.com/gwuhaolin/livego/utils/pio"
 	"github.com/gwuhaolin/livego/utils/uid"
 
@@ -23,13 +27,15 @@ type FLVWriter struct {
 	av.RWBaser
 	app, title, url string
 	buf             []byte
-	closed          bool
+	closed          int32 // 1 이면 닫힘. SendPacket 고루틴, 핸들러, 스트림 정리에서 함께 읽으므로 atomic 으로 다룬다.
 	closedChan      chan struct{}
-	ctx             http.ResponseWriter
+	closeOnce       sync.Once
+	ctx             io.Writer // HTTP 응답 또는 WebSocket 연결. 태그 하나를 한 번의 Write 로 쓴다.
 	packetQueue     chan *av.Packet
+	egress          *metrics.Counter
 }
 
-func NewFLVWriter(app, title, url string, ctx http.ResponseWriter) *FLVWriter {
+func NewFLVWriter(app, title, url string, ctx io.Writer) *FLVWriter {
 	ret := &FLVWriter{
 		Uid:         uid.NewId(),
 		app:         app,
@@ -40,22 +46,20 @@ func NewFLVWriter(app, title, url string, ctx http.ResponseWriter) *FLVWriter {
 		closedChan:  make(chan struct{}),
 		buf:         make([]byte, headerLen),
 		packetQueue: make(chan *av.Packet, maxQueueNum),
+		egress:      metrics.GetCounter(metrics.EgressBytes, app+"/"+title, event.ProtocolHTTPFLV),
 	}
 
-	if _, err := ret.ctx.Write([]byte{0x46, 0x4c, 0x56, 0x01, 0x05, 0x00, 0x00, 0x00, 0x09}); err != nil {
+	// FLV 헤더와 첫 PreviousTagSize(0)
+	// 쓰기에 실패하면 Close 로 닫아 Wait 에서 기다리는 핸들러가 돌아가 웹훅과 이벤트 세션을 정리하게 한다.
+	if _, err := ret.ctx.Write([]byte{0x46, 0x4c, 0x56, 0x01, 0x05, 0x00, 0x00, 0x00, 0x09, 0x00, 0x00, 0x00, 0x00}); err != nil {
 		log.Errorf("Error on response writer")
-		ret.closed = true
-	}
-	pio.PutI32BE(ret.buf[:4], 0)
-	if _, err := ret.ctx.Write(ret.buf[:4]); err != nil {
-		log.Errorf("Error on response writer")
-		ret.closed = true
+		ret.Close(err)
 	}
 	go func() {
 		err := ret.SendPacket()
 		if err != nil {
 			log.Debug("SendPacket error: ", err)
-			ret.closed = true
+			ret.Close(err)
 		}
 
 	}()
@@ -64,6 +68,10 @@ func NewFLVWriter(app, title, url string, ctx http.ResponseWriter) *FLVWriter {
 
 func (flvWriter *FLVWriter) DropPacket(pktQue chan *av.Packet, info av.Info) {
 	log.Warningf("[%v] packet queue max!!!", info)
+	e := event.New(event.PacketDrop, info.Key, info.UID)
+	e.Protocol = event.ProtocolHTTPFLV
+	event.Publish(e)
+	queued := len(pktQue)
 	for i := 0; i < maxQueueNum-84; i++ {
 		tmpPkt, ok := <-pktQue
 		if ok && tmpPkt.IsVideo {
@@ -86,12 +94,14 @@ func (flvWriter *FLVWriter) DropPacket(pktQue chan *av.Packet, info av.Info) {
 			pktQue <- tmpPkt
 		}
 	}
+	// 큐에서 줄어든 패킷과 큐에 넣지 못한 새 패킷
+	metrics.Add(metrics.DroppedPackets, info.Key, event.ProtocolHTTPFLV, uint64(queued-len(pktQue)+1))
 	log.Debug("packet queue len: ", len(pktQue))
 }
 
 func (flvWriter *FLVWriter) Write(p *av.Packet) (err error) {
 	err = nil
-	if flvWriter.closed {
+	if atomic.LoadInt32(&flvWriter.closed) == 1 {
 		err = fmt.Errorf("flvwrite source closed")
 		return
 	}
@@ -144,18 +154,15 @@ func (flvWriter *FLVWriter) SendPacket() error {
 			pio.PutI24BE(h[4:7], int32(timestampbase))
 			pio.PutU8(h[7:8], uint8(timestampExt))
 
-			if _, err := flvWriter.ctx.Write(h); err != nil {
-				return err
-			}
-
-			if _, err := flvWriter.ctx.Write(p.Data); err != nil {
-				return err
-			}
-
-			pio.PutI32BE(h[:4], int32(preDataLen))
-			if _, err := flvWriter.ctx.Write(h[:4]); err != nil {
+			// 태그 헤더, 데이터, PreviousTagSize 를 이어 붙여 한 번에 쓴다. WebSocket 에서는 태그 하나가 프레임 하나가 된다.
+			tag := append(h, p.Data...)
+			tag = append(tag, 0, 0, 0, 0)
+			pio.PutI32BE(tag[len(tag)-4:], int32(preDataLen))
+			flvWriter.buf = tag
+			if _, err := flvWriter.ctx.Write(tag); err != nil {
 				return err
 			}
+			flvWriter.egress.Add(uint64(len(tag)))
 		} else {
 			return fmt.Errorf("closed")
 		}
@@ -170,13 +177,14 @@ func (flvWriter *FLVWriter) Wait() {
 	}
 }
 
-func (flvWriter *FLVWriter) Close(error) {
-	log.Debug("http flv closed")
-	if !flvWriter.closed {
+// WebSocket 읽기 고루틴, 스트림 정리, 전송 오류에서 함께 불러도 한 번만 닫는다.
+func (flvWriter *FLVWriter) Close(err error) {
+	flvWriter.closeOnce.Do(func() {
+		log.Debug("http flv closed: ", err)
+		atomic.StoreInt32(&flvWriter.closed, 1)
 		close(flvWriter.packetQueue)
 		close(flvWriter.closedChan)
-	}
-	flvWriter.closed = true
+	})
 }
 
 func (flvWriter *FLVWriter) Info() (ret av.Info) {
@@ -0,0 +1,52 @@
+package httpflv
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+)
+
+// okWrites 번까지만 쓰고 그 뒤로는 실패하는 연결
+type failWriter struct {
+	okWrites int
+	writes   int
+}
+
+func (w *failWriter) Write(b []byte) (int, error) {
+	w.writes++
+	if w.writes > w.okWrites {
+		return 0, fmt.Errorf("connection reset")
+	}
+	return len(b), nil
+}
+
+func TestFLVWriterClosesOnWriteError(t *testing.T) {
+	tests := []struct {
+		name     string
+		okWrites int
+	}{
+		{"header", 0},
+		{"tag", 1},
+	}
+	for _, test := range tests {
+		writer := NewFLVWriter("live", "test", "", &failWriter{okWrites: test.okWrites})
+		writer.Write(&av.Packet{IsAudio: true, Data: []byte{0xaf, 0x01, 0x00}})
+
+		done := make(chan struct{})
+		go func() {
+			writer.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: Wait did not return after a write error", test.name)
+		}
+		if err := writer.Write(&av.Packet{IsAudio: true}); err == nil {
+			t.Errorf("%s: Write after close succeeded", test.name)
+		}
+		writer.Close(nil)
+	}
+}
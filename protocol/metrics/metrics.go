@@ -0,0 +1,310 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+메트릭
+Prometheus 텍스트 형식으로 내보낼 스트림별, 프로토콜별 카운터와 게이지를 모은다.
+시리즈의 레이블은 스트림 키(<APP>/<NAME>)에서 나눈 app, stream 과 protocol 이며, 값이 없는 레이블은 쓰지 않는다.
+카운터는 보내는 쪽이 Default 에 더하고, 퍼블리셔나 시청자 수처럼 지금 상태를 나타내는 게이지는 내보낼 때 계산한다.
+시리즈가 끝없이 늘지 않도록 스트림이 끝나면 그 스트림의 시리즈를 지우고, 값이 idleTimeout 동안 바뀌지 않은 시리즈도 ExpireLoop 에서 지운다.
+지운 카운터를 들고 있던 쪽이 다시 더하면 그 시리즈는 다시 등록된다.
+*/
+
+// 값이 바뀌지 않은 시리즈를 지우기까지의 시간
+const idleTimeout = 10 * time.Minute
+
+// 카운터
+const (
+	IngressBytes      = "livego_ingress_bytes_total"
+	EgressBytes       = "livego_egress_bytes_total"
+	DroppedPackets    = "livego_dropped_packets_total"
+	HLSSegments       = "livego_hls_segments_total"
+	HLSRequests       = "livego_hls_requests_total"
+	DASHRequests      = "livego_dash_requests_total"
+	RelayReconnects   = "livego_relay_reconnects_total"
+	HandshakeFailures = "livego_handshake_failures_total"
+)
+
+// 게이지
+const (
+	Publishers      = "livego_publishers"
+	Viewers         = "livego_viewers"
+	GOPCachePackets = "livego_gop_cache_packets"
+	GOPCacheBytes   = "livego_gop_cache_bytes"
+)
+
+// 내보내는 순서대로 둔다.
+var counterNames = []string{
+	IngressBytes,
+	EgressBytes,
+	DroppedPackets,
+	HLSSegments,
+	HLSRequests,
+	DASHRequests,
+	RelayReconnects,
+	HandshakeFailures,
+}
+
+var help = map[string]string{
+	IngressBytes:      "Bytes received from publishers.",
+	EgressBytes:       "Bytes sent to viewers.",
+	DroppedPackets:    "Packets dropped because a queue was full.",
+	HLSSegments:       "HLS segments produced.",
+	HLSRequests:       "HLS playlist, segment, key and subtitle requests.",
+	DASHRequests:      "DASH MPD, init and media segment requests.",
+	RelayReconnects:   "Relay connections made again to a target that was connected before.",
+	HandshakeFailures: "Connections that failed before the session was established.",
+	Publishers:        "Streams with a publisher.",
+	Viewers:           "Connected viewers.",
+	GOPCachePackets:   "Packets held in the GOP cache.",
+	GOPCacheBytes:     "Bytes held in the GOP cache.",
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type series struct {
+	key      string // 스트림 키 <APP>/<NAME>
+	protocol string
+}
+
+// 레이블을 {app="live",stream="movie",protocol="rtmp"} 형식으로 쓴다.
+func (s series) labels() string {
+	var labels []string
+	if s.key != "" {
+		paths := strings.SplitN(s.key, "/", 2)
+		labels = append(labels, fmt.Sprintf(`app="%s"`, labelEscaper.Replace(paths[0])))
+		if len(paths) == 2 {
+			labels = append(labels, fmt.Sprintf(`stream="%s"`, labelEscaper.Replace(paths[1])))
+		}
+	}
+	if s.protocol != "" {
+		labels = append(labels, fmt.Sprintf(`protocol="%s"`, labelEscaper.Replace(s.protocol)))
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+func sortSeries(list []series) {
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].key != list[j].key {
+			return list[i].key < list[j].key
+		}
+		return list[i].protocol < list[j].protocol
+	})
+}
+
+func writeHeader(w io.Writer, name, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help[name], name, typ)
+}
+
+type Counter struct {
+	value   uint64
+	removed int32 // 레지스트리에서 지워졌으면 1
+	reg     *Registry
+	name    string
+	s       series
+
+	// 아래는 reg.lock 을 잡고 다룬다.
+	seen  uint64    // 마지막으로 정리할 때의 값
+	since time.Time // 값이 seen 에서 바뀌지 않은 첫 시각
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+	if atomic.LoadInt32(&c.removed) == 1 {
+		c.reg.restore(c)
+	}
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+type Registry struct {
+	lock     sync.Mutex
+	counters map[string]map[series]*Counter // 메트릭 이름 → 시리즈 → 카운터
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		counters: map[string]map[series]*Counter{},
+	}
+}
+
+// 서버 전체가 함께 쓰는 레지스트리
+var Default = NewRegistry()
+
+// 시리즈의 카운터를 돌려준다. 패킷마다 더하는 쪽은 한 번 받아 두고 Add 를 부른다.
+func (reg *Registry) Counter(name, key, protocol string) *Counter {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	m, ok := reg.counters[name]
+	if !ok {
+		m = map[series]*Counter{}
+		reg.counters[name] = m
+	}
+	s := series{key: key, protocol: protocol}
+	c, ok := m[s]
+	if !ok {
+		c = &Counter{reg: reg, name: name, s: s, since: time.Now()}
+		m[s] = c
+	}
+	return c
+}
+
+// 지워진 카운터에 값이 더해지면 다시 등록한다. 그 사이 같은 시리즈가 새로 생겼으면 그 카운터로 값을 옮긴다.
+func (reg *Registry) restore(c *Counter) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	if atomic.LoadInt32(&c.removed) == 0 {
+		return
+	}
+	m, ok := reg.counters[c.name]
+	if !ok {
+		m = map[series]*Counter{}
+		reg.counters[c.name] = m
+	}
+	if other, ok := m[c.s]; ok {
+		other.Add(atomic.SwapUint64(&c.value, 0))
+		return
+	}
+	c.seen, c.since = 0, time.Now()
+	m[c.s] = c
+	atomic.StoreInt32(&c.removed, 0)
+}
+
+func (reg *Registry) remove(m map[series]*Counter, s series) {
+	atomic.StoreInt32(&m[s].removed, 1)
+	delete(m, s)
+}
+
+// 스트림 키의 시리즈를 모두 지운다. 스트림이 끝났을 때 부른다.
+func (reg *Registry) Delete(key string) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	for _, m := range reg.counters {
+		for s := range m {
+			if s.key == key {
+				reg.remove(m, s)
+			}
+		}
+	}
+}
+
+// now 까지 idle 동안 값이 바뀌지 않은 시리즈를 지운다.
+func (reg *Registry) expire(now time.Time, idle time.Duration) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	for _, m := range reg.counters {
+		for s, c := range m {
+			if v := c.Value(); v != c.seen {
+				c.seen, c.since = v, now
+			} else if now.Sub(c.since) >= idle {
+				reg.remove(m, s)
+			}
+		}
+	}
+}
+
+// idleTimeout 동안 바뀌지 않은 시리즈를 1 분마다 지운다. 레지스트리를 쓰는 쪽이 고루틴으로 돌린다.
+func (reg *Registry) ExpireLoop() {
+	for {
+		<-time.After(time.Minute)
+		reg.expire(time.Now(), idleTimeout)
+	}
+}
+
+func (reg *Registry) Add(name, key, protocol string, n uint64) {
+	reg.Counter(name, key, protocol).Add(n)
+}
+
+// 모든 카운터를 Prometheus 텍스트 형식으로 쓴다.
+func (reg *Registry) Export(w io.Writer) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	for _, name := range counterNames {
+		writeHeader(w, name, "counter")
+		m := reg.counters[name]
+		list := make([]series, 0, len(m))
+		for s := range m {
+			list = append(list, s)
+		}
+		sortSeries(list)
+		for _, s := range list {
+			fmt.Fprintf(w, "%s%s %d\n", name, s.labels(), m[s].Value())
+		}
+	}
+}
+
+func GetCounter(name, key, protocol string) *Counter {
+	return Default.Counter(name, key, protocol)
+}
+
+func Add(name, key, protocol string, n uint64) {
+	Default.Add(name, key, protocol, n)
+}
+
+func Delete(key string) {
+	Default.Delete(key)
+}
+
+func ExpireLoop() {
+	Default.ExpireLoop()
+}
+
+// 응답으로 보낸 바이트를 counter 에 더하는 ResponseWriter
+type ResponseWriter struct {
+	http.ResponseWriter
+	counter *Counter
+}
+
+func NewResponseWriter(w http.ResponseWriter, counter *Counter) *ResponseWriter {
+	return &ResponseWriter{ResponseWriter: w, counter: counter}
+}
+
+func (w *ResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.counter.Add(uint64(n))
+	return n, err
+}
+
+// 내보낼 때마다 새로 계산하는 게이지
+type Gauge struct {
+	name   string
+	values map[series]int64
+}
+
+func NewGauge(name string) *Gauge {
+	return &Gauge{
+		name:   name,
+		values: map[series]int64{},
+	}
+}
+
+func (g *Gauge) Add(key, protocol string, n int64) {
+	g.values[series{key: key, protocol: protocol}] += n
+}
+
+func (g *Gauge) Export(w io.Writer) {
+	writeHeader(w, g.name, "gauge")
+	list := make([]series, 0, len(g.values))
+	for s := range g.values {
+		list = append(list, s)
+	}
+	sortSeries(list)
+	for _, s := range list {
+		fmt.Fprintf(w, "%s%s %d\n", g.name, s.labels(), g.values[s])
+	}
+}
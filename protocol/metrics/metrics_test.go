@@ -0,0 +1,135 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 내보낸 결과에서 name 으로 시작하는 시리즈 줄만 고른다.
+func seriesLines(out, name string) []string {
+	var lines []string
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, name+"{") || strings.HasPrefix(line, name+" ") {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func export(reg *Registry) string {
+	var buf bytes.Buffer
+	reg.Export(&buf)
+	return buf.String()
+}
+
+func TestSeriesLabels(t *testing.T) {
+	tests := []struct {
+		s    series
+		want string
+	}{
+		{series{}, ""},
+		{series{protocol: "rtmp"}, `{protocol="rtmp"}`},
+		{series{key: "live"}, `{app="live"}`},
+		{series{key: "live/movie", protocol: "hls"}, `{app="live",stream="movie",protocol="hls"}`},
+		{series{key: "live/a/b"}, `{app="live",stream="a/b"}`},
+		{series{key: `li"ve/mo\vie`, protocol: "x\ny"}, `{app="li\"ve",stream="mo\\vie",protocol="x\ny"}`},
+	}
+	for _, test := range tests {
+		if got := test.s.labels(); got != test.want {
+			t.Errorf("labels(%+v) = %s, want %s", test.s, got, test.want)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	reg := NewRegistry()
+	reg.Add(IngressBytes, "live/b", "rtmp", 10)
+	reg.Add(IngressBytes, "live/a", "webrtc", 5)
+	reg.Add(IngressBytes, "live/a", "rtmp", 7)
+	c := reg.Counter(IngressBytes, "live/a", "rtmp")
+	c.Add(3)
+	reg.Add(HandshakeFailures, "", "rtmp", 1)
+
+	out := export(reg)
+	for _, name := range counterNames {
+		header := "# HELP " + name + " " + help[name] + "\n# TYPE " + name + " counter\n"
+		if !strings.Contains(out, header) {
+			t.Errorf("missing header for %s", name)
+		}
+	}
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{IngressBytes, []string{
+			`livego_ingress_bytes_total{app="live",stream="a",protocol="rtmp"} 10`,
+			`livego_ingress_bytes_total{app="live",stream="a",protocol="webrtc"} 5`,
+			`livego_ingress_bytes_total{app="live",stream="b",protocol="rtmp"} 10`,
+		}},
+		{HandshakeFailures, []string{`livego_handshake_failures_total{protocol="rtmp"} 1`}},
+		{EgressBytes, nil},
+	}
+	for _, test := range tests {
+		got := seriesLines(out, test.name)
+		if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("%s:\n%s\nwant\n%s", test.name, strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+		}
+	}
+}
+
+func TestGaugeExport(t *testing.T) {
+	g := NewGauge(Viewers)
+	g.Add("live/b", "hls", 1)
+	g.Add("live/a", "rtmp", 1)
+	g.Add("live/a", "rtmp", 1)
+	var buf bytes.Buffer
+	g.Export(&buf)
+	want := "# HELP livego_viewers Connected viewers.\n# TYPE livego_viewers gauge\n" +
+		`livego_viewers{app="live",stream="a",protocol="rtmp"} 2` + "\n" +
+		`livego_viewers{app="live",stream="b",protocol="hls"} 1` + "\n"
+	if buf.String() != want {
+		t.Errorf("gauge export:\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestDeleteAndExpire(t *testing.T) {
+	reg := NewRegistry()
+	held := reg.Counter(EgressBytes, "live/a", "rtmp")
+	held.Add(1)
+	reg.Add(EgressBytes, "live/b", "rtmp", 1)
+	reg.Add(HLSRequests, "live/a", "hls", 1)
+
+	reg.Delete("live/a")
+	if got := seriesLines(export(reg), EgressBytes); len(got) != 1 || !strings.Contains(got[0], `stream="b"`) {
+		t.Fatalf("after delete: %v", got)
+	}
+	if got := seriesLines(export(reg), HLSRequests); len(got) != 0 {
+		t.Fatalf("after delete: %v", got)
+	}
+
+	// 지운 카운터를 들고 있던 쪽이 더하면 다시 나타난다.
+	held.Add(2)
+	if got := seriesLines(export(reg), EgressBytes); len(got) != 2 || got[0] != `livego_egress_bytes_total{app="live",stream="a",protocol="rtmp"} 3` {
+		t.Fatalf("after restore: %v", got)
+	}
+
+	// 그 사이 같은 시리즈가 새로 생겼으면 들고 있던 카운터의 값을 그쪽으로 옮긴다.
+	reg.Delete("live/a")
+	reg.Add(EgressBytes, "live/a", "rtmp", 10)
+	held.Add(5)
+	if got := seriesLines(export(reg), EgressBytes); got[0] != `livego_egress_bytes_total{app="live",stream="a",protocol="rtmp"} 18` {
+		t.Fatalf("after merge: %v", got)
+	}
+
+	now := time.Now()
+	reg.expire(now, time.Minute)
+	reg.Add(EgressBytes, "live/b", "rtmp", 1)
+	reg.expire(now.Add(30*time.Second), time.Minute)
+	reg.expire(now.Add(80*time.Second), time.Minute)
+	got := seriesLines(export(reg), EgressBytes)
+	if len(got) != 1 || got[0] != `livego_egress_bytes_total{app="live",stream="b",protocol="rtmp"} 2` {
+		t.Fatalf("after expire: %v", got)
+	}
+}
@@ -1,11 +1,15 @@
 package cache
 
 import (
+	"sync"
+
 	"github.com/gwuhaolin/livego/av"
 	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/protocol/amf"
 )
 
 type Cache struct {
+	lock     sync.Mutex // TransStart 밖(WebRTC 키프레임 재전송 등)에서 캐시를 읽을 때를 위한 잠금
 	gop      *GopCache
 	videoSeq *SpecialCache
 	audioSeq *SpecialCache
@@ -22,8 +26,15 @@ func NewCache() *Cache {
 }
 
 func (cache *Cache) Write(p av.Packet) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
 	if p.IsMetadata {
-		cache.metadata.Write(&p)
+		// onCuePoint 같은 타임드 메타데이터는 그 시점에만 의미가 있으므로 캐시하지 않는다.
+		// 캐시하면 onMetaData 를 덮어써서 새로 들어온 시청자가 코덱 정보를 받지 못한다.
+		if amf.DataEventName(p.Data) == amf.OnMetaData {
+			cache.metadata.Write(&p)
+		}
 		return
 	} else {
 		if !p.IsVideo {
@@ -55,6 +66,9 @@ func (cache *Cache) Write(p av.Packet) {
 }
 
 func (cache *Cache) Send(w av.WriteCloser) error {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
 	if err := cache.metadata.Send(w); err != nil {
 		return err
 	}
@@ -73,3 +87,28 @@ func (cache *Cache) Send(w av.WriteCloser) error {
 
 	return nil
 }
+
+// 비디오 시퀀스 헤더와 가장 최근 GOP(키프레임부터 지금까지)의 복사본을 돌려준다.
+// 시청자가 키프레임을 다시 요청했을 때 퍼블리셔에게 묻지 않고 캐시에서 바로 디코딩을 복구하기 위해 사용한다.
+func (cache *Cache) KeyFrameSnapshot() []*av.Packet {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	var ret []*av.Packet
+	if cache.videoSeq.full {
+		newPacket := *cache.videoSeq.p
+		ret = append(ret, &newPacket)
+	}
+	for _, p := range cache.gop.lastGop() {
+		newPacket := *p
+		ret = append(ret, &newPacket)
+	}
+	return ret
+}
+
+// GOP 캐시에 담긴 패킷 수와 바이트 수를 돌려준다.
+func (cache *Cache) GopSize() (packets, bytes int) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return cache.gop.size()
+}
@@ -54,6 +54,7 @@ type GopCache struct {
 	num       int
 	count     int
 	nextindex int
+	curindex  int // 지금 채우고 있는(가장 최근에 시작된) GOP 의 위치
 	gops      []*array
 }
 
@@ -75,9 +76,10 @@ func (gopCache *GopCache) writeToArray(chunk *av.Packet, startNew bool) error {
 		} else {
 			ginc.reset()
 		}
+		gopCache.curindex = gopCache.nextindex
 		gopCache.nextindex = (gopCache.nextindex + 1) % gopCache.count
 	} else {
-		ginc = gopCache.gops[(gopCache.nextindex+1)%gopCache.count]
+		ginc = gopCache.gops[gopCache.curindex]
 	}
 	ginc.write(chunk)
 
@@ -88,7 +90,8 @@ func (gopCache *GopCache) Write(p *av.Packet) {
 	var ok bool
 	if p.IsVideo {
 		vh := p.Header.(av.VideoPacketHeader)
-		if vh.IsKeyFrame() && !vh.IsSeq() {
+		// 시퀀스 종료 신호는 새 GOP 의 시작이 아니다.
+		if vh.IsKeyFrame() && !vh.IsSeq() && !vh.IsSeqEnd() {
 			ok = true
 		}
 	}
@@ -100,9 +103,9 @@ func (gopCache *GopCache) Write(p *av.Packet) {
 
 func (gopCache *GopCache) sendTo(w av.WriteCloser) error {
 	var err error
-	pos := (gopCache.nextindex + 1) % gopCache.count
+	// 오래된 GOP 부터 지금 채우고 있는 GOP 까지 보낸다.
 	for i := 0; i < gopCache.num; i++ {
-		index := (pos - gopCache.num + 1) + i
+		index := (gopCache.curindex - gopCache.num + 1) + i
 		if index < 0 {
 			index += gopCache.count
 		}
@@ -118,3 +121,29 @@ func (gopCache *GopCache) sendTo(w av.WriteCloser) error {
 func (gopCache *GopCache) Send(w av.WriteCloser) error {
 	return gopCache.sendTo(w)
 }
+
+// 캐시에 담긴 패킷 수와 바이트 수
+func (gopCache *GopCache) size() (packets, bytes int) {
+	for _, g := range gopCache.gops {
+		if g == nil {
+			continue
+		}
+		for _, p := range g.packets[:g.index] {
+			packets++
+			bytes += len(p.Data)
+		}
+	}
+	return
+}
+
+// 가장 최근에 시작된 GOP 의 패킷 목록을 돌려준다.
+func (gopCache *GopCache) lastGop() []*av.Packet {
+	if gopCache.num == 0 {
+		return nil
+	}
+	g := gopCache.gops[gopCache.curindex]
+	if g == nil {
+		return nil
+	}
+	return g.packets[:g.index]
+}
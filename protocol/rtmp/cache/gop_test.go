@@ -0,0 +1,100 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/container/flv"
+)
+
+// 패킷의 타임스탬프만 기록하는 writer
+type recordWriter struct {
+	av.RWBaser
+	ts []uint32
+}
+
+func (w *recordWriter) Info() av.Info { return av.Info{} }
+func (w *recordWriter) Close(error)   {}
+func (w *recordWriter) Write(p *av.Packet) error {
+	w.ts = append(w.ts, p.TimeStamp)
+	return nil
+}
+
+// key 이면 키프레임, 아니면 인터 프레임인 H.264 비디오 태그를 만든다.
+func videoPacket(t *testing.T, ts uint32, key bool) *av.Packet {
+	frameType := byte(0x27)
+	if key {
+		frameType = 0x17
+	}
+	p := &av.Packet{IsVideo: true, TimeStamp: ts, Data: []byte{frameType, 0x01, 0, 0, 0, 0xaa}}
+	if err := flv.NewDemuxer().DemuxH(p); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestGopCache(t *testing.T) {
+	tests := []struct {
+		name     string
+		num      int
+		frames   []uint32 // 1000 의 배수는 키프레임
+		wantLast []uint32
+		wantSend []uint32
+	}{
+		{
+			name:     "single gop",
+			num:      1,
+			frames:   []uint32{1000, 1040, 2000, 2040, 2080},
+			wantLast: []uint32{2000, 2040, 2080},
+			wantSend: []uint32{2000, 2040, 2080},
+		},
+		{
+			name:     "three gops not full",
+			num:      3,
+			frames:   []uint32{10, 1000, 1040, 2000, 2040, 2080},
+			wantLast: []uint32{2000, 2040, 2080},
+			wantSend: []uint32{1000, 1040, 2000, 2040, 2080},
+		},
+		{
+			name:     "three gops wrapped",
+			num:      3,
+			frames:   []uint32{1000, 1040, 2000, 2040, 3000, 3040, 4000, 4040, 4080},
+			wantLast: []uint32{4000, 4040, 4080},
+			wantSend: []uint32{2000, 2040, 3000, 3040, 4000, 4040, 4080},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gop := NewGopCache(tt.num)
+			for _, ts := range tt.frames {
+				gop.Write(videoPacket(t, ts, ts%1000 == 0))
+			}
+			var last []uint32
+			for _, p := range gop.lastGop() {
+				last = append(last, p.TimeStamp)
+			}
+			if !equal(last, tt.wantLast) {
+				t.Errorf("lastGop = %v, want %v", last, tt.wantLast)
+			}
+			w := &recordWriter{}
+			if err := gop.Send(w); err != nil {
+				t.Fatal(err)
+			}
+			if !equal(w.ts, tt.wantSend) {
+				t.Errorf("Send = %v, want %v", w.ts, tt.wantSend)
+			}
+		})
+	}
+}
+
+func equal(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
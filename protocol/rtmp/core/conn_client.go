@@ -158,6 +158,8 @@ func (connClient *ConnClient) writeConnectMsg() error {
 	event["type"] = "nonprivate"
 	event["flashVer"] = "FMS.3.1"
 	event["tcUrl"] = connClient.tcurl
+	// 중계하는 스트림이 HEVC/AV1/VP9 일 수 있으므로 Enhanced RTMP 를 지원한다고 알린다.
+	event["fourCcList"] = []string{av.FOURCC_AVC, av.FOURCC_HEVC, av.FOURCC_AV1, av.FOURCC_VP9}
 	connClient.curcmdName = cmdConnect
 
 	log.Debugf("writeConnectMsg: connClient.transID=%d, event=%v", connClient.transID, event)
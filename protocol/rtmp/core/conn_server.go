@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"net/url"
+	"strings"
 
 	"github.com/gwuhaolin/livego/av"
 	"github.com/gwuhaolin/livego/protocol/amf"
@@ -43,6 +45,8 @@ type ConnectInfo struct {
 	VideoFunction  int    `amf:"videoFunction" json:"videoFunction"`
 	PageUrl        string `amf:"pageUrl" json:"pageUrl"`
 	ObjectEncoding int    `amf:"objectEncoding" json:"objectEncoding"`
+	// Enhanced RTMP 클라이언트가 지원하는 비디오 FourCC 목록. 레거시 클라이언트는 보내지 않는다.
+	FourCcList []string `amf:"fourCcList" json:"fourCcList"`
 }
 
 type ConnectResp struct {
@@ -62,6 +66,16 @@ type PublishInfo struct {
 	Type string
 }
 
+// 이름 뒤에 붙은 쿼리를 떼어 낸다. ex) movie?expires=1&sign=ab
+func splitQuery(s string) (string, url.Values) {
+	pos := strings.Index(s, "?")
+	if pos < 0 {
+		return s, url.Values{}
+	}
+	query, _ := url.ParseQuery(s[pos+1:])
+	return s[:pos], query
+}
+
 type ConnServer struct {
 	done          bool
 	streamID      int
@@ -70,6 +84,8 @@ type ConnServer struct {
 	transactionID int
 	ConnInfo      ConnectInfo
 	PublishInfo   PublishInfo
+	Query         url.Values  // tcUrl 의 앱 이름과 스트림 이름 뒤에 붙은 쿼리 파라미터
+	playChunk     ChunkStream // 응답을 미뤄 둔 play 명령
 	decoder       *amf.Decoder
 	encoder       *amf.Encoder
 	bytesw        *bytes.Buffer
@@ -79,6 +95,7 @@ func NewConnServer(conn *Conn) *ConnServer {
 	return &ConnServer{
 		conn:     conn,
 		streamID: 1,
+		Query:    url.Values{},
 		bytesw:   bytes.NewBuffer(nil),
 		decoder:  &amf.Decoder{},
 		encoder:  &amf.Encoder{},
@@ -119,7 +136,9 @@ func (connServer *ConnServer) connect(vs []interface{}) error {
 		case amf.Object:
 			obimap := v.(amf.Object)
 			if app, ok := obimap["app"]; ok {
-				connServer.ConnInfo.App = app.(string)
+				var query url.Values
+				connServer.ConnInfo.App, query = splitQuery(app.(string))
+				connServer.addQuery(query)
 			}
 			if flashVer, ok := obimap["flashVer"]; ok {
 				connServer.ConnInfo.Flashver = flashVer.(string)
@@ -130,6 +149,13 @@ func (connServer *ConnServer) connect(vs []interface{}) error {
 			if encoding, ok := obimap["objectEncoding"]; ok {
 				connServer.ConnInfo.ObjectEncoding = int(encoding.(float64))
 			}
+			if list, ok := obimap["fourCcList"].(amf.Array); ok {
+				for _, v := range list {
+					if fourCC, ok := v.(string); ok {
+						connServer.ConnInfo.FourCcList = append(connServer.ConnInfo.FourCcList, fourCC)
+					}
+				}
+			}
 		}
 	}
 	return nil
@@ -154,6 +180,10 @@ func (connServer *ConnServer) connectResp(cur *ChunkStream) error {
 	resp := make(amf.Object)
 	resp["fmsVer"] = "FMS/3,0,1,123"
 	resp["capabilities"] = 31
+	// Enhanced RTMP 클라이언트에는 서버가 받을 수 있는 FourCC 를 알려준다.
+	if fourCcList := connServer.fourCcList(); len(fourCcList) > 0 {
+		resp["fourCcList"] = fourCcList
+	}
 
 	event := make(amf.Object)
 	event["level"] = "status"
@@ -163,6 +193,20 @@ func (connServer *ConnServer) connectResp(cur *ChunkStream) error {
 	return connServer.writeMsg(cur.CSID, cur.StreamID, "_result", connServer.transactionID, resp, event)
 }
 
+// 클라이언트가 보낸 fourCcList 중 서버가 해석할 수 있는 것만 돌려준다. "*" 는 모든 코덱을 뜻한다.
+func (connServer *ConnServer) fourCcList() []string {
+	var ret []string
+	for _, fourCC := range connServer.ConnInfo.FourCcList {
+		if fourCC == "*" {
+			return []string{av.FOURCC_AVC, av.FOURCC_HEVC, av.FOURCC_AV1, av.FOURCC_VP9}
+		}
+		if _, ok := av.VideoFourCC[fourCC]; ok {
+			ret = append(ret, fourCC)
+		}
+	}
+	return ret
+}
+
 func (connServer *ConnServer) createStream(vs []interface{}) error {
 	for _, v := range vs {
 		switch v.(type) {
@@ -184,7 +228,9 @@ func (connServer *ConnServer) publishOrPlay(vs []interface{}) error {
 		switch v.(type) {
 		case string:
 			if k == 2 {
-				connServer.PublishInfo.Name = v.(string)
+				var query url.Values
+				connServer.PublishInfo.Name, query = splitQuery(v.(string))
+				connServer.addQuery(query)
 			} else if k == 3 {
 				connServer.PublishInfo.Type = v.(string)
 			}
@@ -198,6 +244,12 @@ func (connServer *ConnServer) publishOrPlay(vs []interface{}) error {
 	return nil
 }
 
+func (connServer *ConnServer) addQuery(query url.Values) {
+	for k, v := range query {
+		connServer.Query[k] = v
+	}
+}
+
 func (connServer *ConnServer) publishResp(cur *ChunkStream) error {
 	event := make(amf.Object)
 	event["level"] = "status"
@@ -241,6 +293,20 @@ func (connServer *ConnServer) playResp(cur *ChunkStream) error {
 	return connServer.conn.Flush()
 }
 
+// 미뤄 둔 play 명령에 재생을 시작한다고 응답한다.
+func (connServer *ConnServer) PlayResp() error {
+	return connServer.playResp(&connServer.playChunk)
+}
+
+// 미뤄 둔 play 명령에 NetStream.Play.Failed 로 재생을 거절한다.
+func (connServer *ConnServer) PlayFailed(description string) error {
+	event := make(amf.Object)
+	event["level"] = "error"
+	event["code"] = "NetStream.Play.Failed"
+	event["description"] = description
+	return connServer.writeMsg(connServer.playChunk.CSID, connServer.playChunk.StreamID, "onStatus", 0, nil, event)
+}
+
 func (connServer *ConnServer) handleCmdMsg(c *ChunkStream) error {
 	amfType := amf.AMF0
 	if c.TypeID == 17 {
@@ -283,9 +349,8 @@ func (connServer *ConnServer) handleCmdMsg(c *ChunkStream) error {
 			if err = connServer.publishOrPlay(vs[1:]); err != nil {
 				return err
 			}
-			if err = connServer.playResp(c); err != nil {
-				return err
-			}
+			// 재생 인증을 마친 뒤 PlayResp 나 PlayFailed 로 응답한다.
+			connServer.playChunk = ChunkStream{CSID: c.CSID, StreamID: c.StreamID}
 			connServer.done = true
 			connServer.isPublisher = false
 			log.Debug("handle play req done")
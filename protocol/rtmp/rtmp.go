@@ -13,7 +13,11 @@ import (
 	"github.com/gwuhaolin/livego/av"
 	"github.com/gwuhaolin/livego/configure"
 	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/protocol/auth"
+	"github.com/gwuhaolin/livego/protocol/event"
+	"github.com/gwuhaolin/livego/protocol/metrics"
 	"github.com/gwuhaolin/livego/protocol/rtmp/core"
+	"github.com/gwuhaolin/livego/protocol/webhook"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -65,15 +69,16 @@ func (c *Client) GetHandle() av.Handler {
 	return c.handler
 }
 
+// getters 는 퍼블리셔가 들어올 때 함께 붙일 writer(HLS, DASH 등)를 만든다.
 type Server struct {
 	handler av.Handler
-	getter  av.GetWriter
+	getters []av.GetWriter
 }
 
-func NewRtmpServer(h av.Handler, getter av.GetWriter) *Server {
+func NewRtmpServer(h av.Handler, getters ...av.GetWriter) *Server {
 	return &Server{
 		handler: h,
-		getter:  getter,
+		getters: getters,
 	}
 }
 
@@ -100,6 +105,7 @@ func (s *Server) Serve(listener net.Listener) (err error) {
 func (s *Server) handleConn(conn *core.Conn) error {
 	if err := conn.HandshakeServer(); err != nil {
 		conn.Close()
+		metrics.Add(metrics.HandshakeFailures, "", event.ProtocolRTMP, 1)
 		log.Error("handleConn HandshakeServer err: ", err)
 		return err
 	}
@@ -144,13 +150,19 @@ func (s *Server) handleConn(conn *core.Conn) error {
 			log.Debugf("GetStaticPushUrlList: %v", pushlist)
 		}
 		reader := NewVirReader(connServer)
+		session := webhook.NewSession(event.ProtocolRTMP, reader.Uid, appname+"/"+channel, conn.RemoteAddr().String(), connServer.Query)
+		if err := webhook.Publish(session); err != nil {
+			conn.Close()
+			log.Error("on_publish err: ", err)
+			return err
+		}
 		s.handler.HandleReader(reader)
 		log.Debugf("new publisher: %+v", reader.Info())
 
-		if s.getter != nil {
-			writeType := reflect.TypeOf(s.getter)
+		for _, getter := range s.getters {
+			writeType := reflect.TypeOf(getter)
 			log.Debugf("handleConn:writeType=%v", writeType)
-			writer := s.getter.GetWriter(reader.Info())
+			writer := getter.GetWriter(reader.Info())
 			s.handler.HandleWriter(writer)
 		}
 		if configure.Config.GetBool("flv_archive") {
@@ -159,6 +171,25 @@ func (s *Server) handleConn(conn *core.Conn) error {
 		}
 	} else {
 		writer := NewVirWriter(connServer)
+		session := webhook.NewSession(event.ProtocolRTMP, writer.Uid, appname+"/"+name, conn.RemoteAddr().String(), connServer.Query)
+		err := auth.CheckPlay(appname+"/"+name, connServer.Query, "")
+		if err == nil {
+			err = webhook.Play(session)
+		}
+		if err != nil {
+			connServer.PlayFailed(err.Error())
+			writer.Close(err)
+			log.Error("play rejected: ", err)
+			return err
+		}
+		if err := connServer.PlayResp(); err != nil {
+			writer.Close(err)
+			log.Error("handleConn play resp err: ", err)
+			return err
+		}
+		e := event.New(event.PlayerJoin, appname+"/"+name, writer.Uid)
+		e.Protocol, e.ClientIP = session.Protocol, session.ClientIP
+		event.Open(e)
 		log.Debugf("new player: %+v", writer.Info())
 		s.handler.HandleWriter(writer)
 	}
@@ -197,6 +228,7 @@ type VirWriter struct {
 	conn        StreamReadWriteCloser
 	packetQueue chan *av.Packet
 	WriteBWInfo StaticsBW
+	egress      *metrics.Counter
 }
 
 func NewVirWriter(conn StreamReadWriteCloser) *VirWriter {
@@ -222,6 +254,10 @@ func (v *VirWriter) SaveStatics(streamid uint32, length uint64, isVideoFlag bool
 	nowInMS := int64(time.Now().UnixNano() / 1e6)
 
 	v.WriteBWInfo.StreamId = streamid
+	if v.egress == nil {
+		v.egress = metrics.GetCounter(metrics.EgressBytes, v.Info().Key, event.ProtocolRTMP)
+	}
+	v.egress.Add(length)
 	if isVideoFlag {
 		v.WriteBWInfo.VideoDatainBytes = v.WriteBWInfo.VideoDatainBytes + length
 	} else {
@@ -254,6 +290,10 @@ func (v *VirWriter) Check() {
 
 func (v *VirWriter) DropPacket(pktQue chan *av.Packet, info av.Info) {
 	log.Warningf("[%v] packet queue max!!!", info)
+	e := event.New(event.PacketDrop, info.Key, info.UID)
+	e.Protocol = event.ProtocolRTMP
+	event.Publish(e)
+	queued := len(pktQue)
 	for i := 0; i < maxQueueNum-84; i++ {
 		tmpPkt, ok := <-pktQue
 		// try to don't drop audio
@@ -280,6 +320,8 @@ func (v *VirWriter) DropPacket(pktQue chan *av.Packet, info av.Info) {
 		}
 
 	}
+	// 큐에서 줄어든 패킷과 큐에 넣지 못한 새 패킷
+	metrics.Add(metrics.DroppedPackets, info.Key, event.ProtocolRTMP, uint64(queued-len(pktQue)+1))
 	log.Debug("packet queue len: ", len(pktQue))
 }
 
@@ -362,6 +404,8 @@ func (v *VirWriter) Close(err error) {
 	}
 	v.closed = true
 	v.conn.Close(err)
+	webhook.Stop(v.Uid)
+	event.Close(v.Uid)
 }
 
 type VirReader struct {
@@ -370,6 +414,7 @@ type VirReader struct {
 	demuxer    *flv.Demuxer
 	conn       StreamReadWriteCloser
 	ReadBWInfo StaticsBW
+	ingress    *metrics.Counter
 }
 
 func NewVirReader(conn StreamReadWriteCloser) *VirReader {
@@ -386,6 +431,10 @@ func (v *VirReader) SaveStatics(streamid uint32, length uint64, isVideoFlag bool
 	nowInMS := int64(time.Now().UnixNano() / 1e6)
 
 	v.ReadBWInfo.StreamId = streamid
+	if v.ingress == nil {
+		v.ingress = metrics.GetCounter(metrics.IngressBytes, v.Info().Key, event.ProtocolRTMP)
+	}
+	v.ingress.Add(length)
 	if isVideoFlag {
 		v.ReadBWInfo.VideoDatainBytes = v.ReadBWInfo.VideoDatainBytes + length
 	} else {
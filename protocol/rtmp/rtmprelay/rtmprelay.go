@@ -4,9 +4,15 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gwuhaolin/livego/av"
 	"github.com/gwuhaolin/livego/protocol/amf"
+	"github.com/gwuhaolin/livego/protocol/event"
+	"github.com/gwuhaolin/livego/protocol/metrics"
 	"github.com/gwuhaolin/livego/protocol/rtmp/core"
 
 	log "github.com/sirupsen/logrus"
@@ -16,6 +22,74 @@ var (
 	STOP_CTRL = "RTMPRELAY_STOP"
 )
 
+// relay_state 이벤트의 kind 와 state
+const (
+	relayKindPull   = "relay"
+	relayKindStatic = "static_push"
+
+	relayStarted = "started"
+	relayFailed  = "failed"
+	relayStopped = "stopped"
+	relayClosed  = "closed" // 원본 스트림이 끝났다.
+)
+
+// 릴레이 상태 변화를 이벤트 버스에 알린다.
+func publishState(kind, state, playURL, publishURL string, err error) {
+	e := event.New(event.RelayState, "", "")
+	e.Data = map[string]interface{}{
+		"kind":        kind,
+		"state":       state,
+		"play_url":    playURL,
+		"publish_url": publishURL,
+	}
+	if err != nil {
+		e.Data["error"] = err.Error()
+	}
+	event.Publish(e)
+}
+
+// 연결을 끊은 대상에 이 시간 안에 다시 연결하면 재연결로 센다.
+const reconnectWindow = 10 * time.Minute
+
+// 연결한 적 있는 릴레이 대상. kind + " " + 보낼 URL -> 연결을 끊은 시각. 연결 중이면 zero 이다.
+// 끊은 지 reconnectWindow 가 지난 대상은 잊는다.
+var (
+	connectedLock sync.Mutex
+	connected     = map[string]time.Time{}
+)
+
+// 릴레이가 대상에 연결되었음을 기록한다. 연결 중이거나 reconnectWindow 안에 끊은 대상이면 재연결로 센다.
+// 레이블은 릴레이가 보내는 URL 의 스트림 키(<APP>/<NAME>)이다.
+func countConnect(kind, publishURL string) {
+	now := time.Now()
+	connectedLock.Lock()
+	for target, closed := range connected {
+		if !closed.IsZero() && now.Sub(closed) >= reconnectWindow {
+			delete(connected, target)
+		}
+	}
+	_, again := connected[kind+" "+publishURL]
+	connected[kind+" "+publishURL] = time.Time{}
+	connectedLock.Unlock()
+	if !again {
+		return
+	}
+	key := ""
+	if u, err := url.Parse(publishURL); err == nil {
+		key = strings.TrimLeft(u.Path, "/")
+	}
+	metrics.Add(metrics.RelayReconnects, key, "", 1)
+}
+
+// 릴레이가 대상과의 연결을 끊었음을 기록한다.
+func countDisconnect(kind, publishURL string) {
+	connectedLock.Lock()
+	if _, ok := connected[kind+" "+publishURL]; ok {
+		connected[kind+" "+publishURL] = time.Now()
+	}
+	connectedLock.Unlock()
+}
+
 // 릴레이 기능을 구현하기 위해 설계되었다. 릴레이는 RTMP의 스트림을 특정 URL에서 읽어 다른 URL로 재전송 하거나 변환하는 역할을 한다.
 // 릴레이 기능은 동일한 라이브 스트림을 여러 플랫폼으로 동시 전송 하거나, (단일 업로드)
 // 부하 분산, 원본 스트림 재가공, 보안, 백업 경로, CDN 등의 기능에서 사용된다.
@@ -58,6 +132,8 @@ func (self *RtmpRelay) rcvPlayChunkStream() {
 		err := self.connectPlayClient.Read(&rc)
 
 		if err != nil && err == io.EOF {
+			publishState(relayKindPull, relayClosed, self.PlayUrl, self.PublishUrl, err)
+			countDisconnect(relayKindPull, self.PublishUrl)
 			break
 		}
 		//log.Debugf("connectPlayClient.Read return rc.TypeID=%v length=%d, err=%v", rc.TypeID, len(rc.Data), err)
@@ -104,6 +180,7 @@ func (self *RtmpRelay) Start() error {
 	err := self.connectPlayClient.Start(self.PlayUrl, av.PLAY)
 	if err != nil {
 		log.Debugf("connectPlayClient.Start url=%v error", self.PlayUrl)
+		publishState(relayKindPull, relayFailed, self.PlayUrl, self.PublishUrl, err)
 		return err
 	}
 
@@ -112,10 +189,13 @@ func (self *RtmpRelay) Start() error {
 	if err != nil {
 		log.Debugf("connectPublishClient.Start url=%v error", self.PublishUrl)
 		self.connectPlayClient.Close(nil)
+		publishState(relayKindPull, relayFailed, self.PlayUrl, self.PublishUrl, err)
 		return err
 	}
 
 	self.startflag = true
+	publishState(relayKindPull, relayStarted, self.PlayUrl, self.PublishUrl, nil)
+	countConnect(relayKindPull, self.PublishUrl)
 	go self.rcvPlayChunkStream()
 	go self.sendPublishChunkStream()
 
@@ -130,4 +210,6 @@ func (self *RtmpRelay) Stop() {
 
 	self.startflag = false
 	self.sndctrl_chan <- STOP_CTRL
+	publishState(relayKindPull, relayStopped, self.PlayUrl, self.PublishUrl, nil)
+	countDisconnect(relayKindPull, self.PublishUrl)
 }
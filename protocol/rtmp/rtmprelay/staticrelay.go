@@ -111,12 +111,15 @@ func (self *StaticPush) Start() error {
 	err := self.connectClient.Start(self.RtmpUrl, "publish")
 	if err != nil {
 		log.Debugf("connectClient.Start url=%v error", self.RtmpUrl)
+		publishState(relayKindStatic, relayFailed, "", self.RtmpUrl, err)
 		return err
 	}
 	log.Debugf("static publish server addr:%v started, streamid=%d", self.RtmpUrl, self.connectClient.GetStreamId())
 	go self.HandleAvPacket()
 
 	self.startflag = true
+	publishState(relayKindStatic, relayStarted, "", self.RtmpUrl, nil)
+	countConnect(relayKindStatic, self.RtmpUrl)
 	return nil
 }
 
@@ -128,6 +131,8 @@ func (self *StaticPush) Stop() {
 	log.Debugf("StaticPush Stop: %s", self.RtmpUrl)
 	self.sndctrl_chan <- STATIC_RELAY_STOP_CTRL
 	self.startflag = false
+	publishState(relayKindStatic, relayStopped, "", self.RtmpUrl, nil)
+	countDisconnect(relayKindStatic, self.RtmpUrl)
 }
 
 func (self *StaticPush) WriteAvPacket(packet *av.Packet) {
@@ -7,14 +7,20 @@ import (
 	"time"
 
 	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/protocol/amf"
+	"github.com/gwuhaolin/livego/protocol/event"
+	"github.com/gwuhaolin/livego/protocol/metrics"
 	"github.com/gwuhaolin/livego/protocol/rtmp/cache"
 	"github.com/gwuhaolin/livego/protocol/rtmp/rtmprelay"
+	"github.com/gwuhaolin/livego/protocol/webhook"
 
 	log "github.com/sirupsen/logrus"
 )
 
 var (
 	EmptyID = ""
+
+	ErrStreamNotFound = fmt.Errorf("stream not found")
 )
 
 // streams 는 sync.Map 타입으로 RTMP 스트림 데이터를 안전하게 저장하고 관리하기 위한 동시성 맵입니다.
@@ -57,6 +63,7 @@ func (rs *RtmpStream) HandleReader(r av.ReadCloser) {
 	}
 
 	stream.AddReader(r)
+	event.Open(event.New(event.PublishStart, info.Key, info.UID))
 }
 
 func (rs *RtmpStream) HandleWriter(w av.WriteCloser) {
@@ -80,6 +87,35 @@ func (rs *RtmpStream) GetStreams() *sync.Map {
 	return rs.streams
 }
 
+// 퍼블리셔의 ReadBWInfo 에서 측정한 비디오와 오디오 비트레이트의 합을 bps 로 반환한다.
+func (rs *RtmpStream) GetBandwidth(key string) (int, bool) {
+	i, ok := rs.streams.Load(key)
+	if !ok {
+		return 0, false
+	}
+	r, ok := i.(*Stream).GetReader().(*VirReader)
+	if !ok {
+		return 0, false
+	}
+	// SpeedInBytesperMS 는 이름과 달리 kbps 단위이다.
+	kbps := r.ReadBWInfo.VideoSpeedInBytesperMS + r.ReadBWInfo.AudioSpeedInBytesperMS
+	if kbps == 0 {
+		return 0, false
+	}
+	return int(kbps) * 1000, true
+}
+
+// 퍼블리셔가 있는 스트림에 광고 구간 큐를 예약한다.
+// cue.Time 이 0 이면 다음 패킷에, 아니면 그 타임스탬프에 이르렀을 때 onCuePoint 데이터 메시지로 모든 시청자에게 보낸다.
+func (rs *RtmpStream) InjectCue(key string, cue amf.CuePoint) error {
+	i, ok := rs.streams.Load(key)
+	if !ok || i.(*Stream).GetReader() == nil {
+		return ErrStreamNotFound
+	}
+	i.(*Stream).scheduleCue(cue)
+	return nil
+}
+
 // RTMP 스트림 객체 내에서 비활성화된 스트림을 정리하기 위해 동작합니다.
 // 일정 시간 간격으로 활성 스트림 상태를 확인하고, 활성화되지 않은 스트림을 삭제합니다.
 func (rs *RtmpStream) CheckAlive() {
@@ -99,8 +135,10 @@ func (rs *RtmpStream) CheckAlive() {
 			v := val.(*Stream)
 
 			// 반환값이 0 이라면 살아있는 웹소켓도, 스트림리더도 없다는 뜻이니 정리한다.
+			// 스트림의 메트릭 시리즈도 함께 지운다.
 			if v.CheckAlive() == 0 {
 				rs.streams.Delete(key)
+				metrics.Delete(key.(string))
 			}
 			return true
 		})
@@ -119,6 +157,9 @@ type Stream struct {
 	r       av.ReadCloser // 스트림 데이터를 읽는 인터페이스
 	ws      *sync.Map     // 연결된 클라이언트 관리(웹 소켓 등))
 	info    av.Info       // 스트림 메타 데이터
+
+	cueLock sync.Mutex
+	cues    []amf.CuePoint // API 로 예약한 광고 구간 큐. 타임스탬프 순서이다.
 }
 
 // 스트림에 연결된 클라이언트의 writer를 관리하는 구조체
@@ -149,6 +190,10 @@ func (s *Stream) GetReader() av.ReadCloser {
 	return s.r
 }
 
+func (s *Stream) GetCache() *cache.Cache {
+	return s.cache
+}
+
 func (s *Stream) GetWs() *sync.Map {
 	return s.ws
 }
@@ -341,6 +386,34 @@ func (s *Stream) SendStaticPush(packet av.Packet) {
 	}
 }
 
+func (s *Stream) scheduleCue(cue amf.CuePoint) {
+	s.cueLock.Lock()
+	defer s.cueLock.Unlock()
+	i := len(s.cues)
+	for i > 0 && s.cues[i-1].Time > cue.Time {
+		i--
+	}
+	s.cues = append(s.cues, amf.CuePoint{})
+	copy(s.cues[i+1:], s.cues[i:])
+	s.cues[i] = cue
+}
+
+// ts 에 이른 예약 큐를 꺼낸다. 바로 보내는 큐(Time 0)는 ts 를 스플라이스 지점으로 정한다.
+func (s *Stream) dueCues(ts uint32) []amf.CuePoint {
+	s.cueLock.Lock()
+	defer s.cueLock.Unlock()
+	n := 0
+	for n < len(s.cues) && s.cues[n].Time <= ts {
+		if s.cues[n].Time == 0 {
+			s.cues[n].Time = ts
+		}
+		n++
+	}
+	due := s.cues[:n:n]
+	s.cues = s.cues[n:]
+	return due
+}
+
 func (s *Stream) TransStart() {
 	s.isStart = true
 	var p av.Packet
@@ -361,34 +434,50 @@ func (s *Stream) TransStart() {
 			return
 		}
 
-		if s.IsSendStaticPush() {
-			s.SendStaticPush(p)
+		// 예약한 광고 구간 큐는 스플라이스 지점의 패킷보다 먼저 보낸다.
+		for _, cue := range s.dueCues(p.TimeStamp) {
+			log.Debugf("[%s] inject cue point: %+v", s.info.Key, cue)
+			s.dispatch(av.Packet{
+				IsMetadata: true,
+				StreamID:   p.StreamID,
+				TimeStamp:  cue.Time,
+				Data:       amf.EncodeCuePoint(cue),
+			})
 		}
+		s.dispatch(p)
+	}
+}
 
-		s.cache.Write(p)
-		//sync.Map
-		s.ws.Range(func(key, val interface{}) bool {
-			v := val.(*PackWriterCloser)
-			if !v.init {
-				//log.Debugf("cache.send: %v", v.w.Info())
-				if err = s.cache.Send(v.w); err != nil {
-					log.Debugf("[%s] send cache packet error: %v, remove", v.w.Info(), err)
-					s.ws.Delete(key)
-					return true
-				}
-				v.init = true
-			} else {
-				newPacket := p
-				//writeType := reflect.TypeOf(v.w)
-				//log.Debugf("w.Write: type=%v, %v", writeType, v.w.Info())
-				if err = v.w.Write(&newPacket); err != nil {
-					log.Debugf("[%s] write packet error: %v, remove", v.w.Info(), err)
-					s.ws.Delete(key)
-				}
-			}
-			return true
-		})
+// 패킷을 정적 푸시, 캐시, 모든 시청자에게 보낸다.
+func (s *Stream) dispatch(p av.Packet) {
+	var err error
+	if s.IsSendStaticPush() {
+		s.SendStaticPush(p)
 	}
+
+	s.cache.Write(p)
+	//sync.Map
+	s.ws.Range(func(key, val interface{}) bool {
+		v := val.(*PackWriterCloser)
+		if !v.init {
+			//log.Debugf("cache.send: %v", v.w.Info())
+			if err = s.cache.Send(v.w); err != nil {
+				log.Debugf("[%s] send cache packet error: %v, remove", v.w.Info(), err)
+				s.ws.Delete(key)
+				return true
+			}
+			v.init = true
+		} else {
+			newPacket := p
+			//writeType := reflect.TypeOf(v.w)
+			//log.Debugf("w.Write: type=%v, %v", writeType, v.w.Info())
+			if err = v.w.Write(&newPacket); err != nil {
+				log.Debugf("[%s] write packet error: %v, remove", v.w.Info(), err)
+				s.ws.Delete(key)
+			}
+		}
+		return true
+	})
 }
 
 func (s *Stream) TransStop() {
@@ -442,6 +531,8 @@ func (s *Stream) CheckAlive() (n int) {
 func (s *Stream) closeInter() {
 	if s.r != nil {
 		s.StopStaticPush()
+		webhook.Unpublish(s.r.Info().UID)
+		event.Close(s.r.Info().UID)
 		log.Debugf("[%v] publisher closed", s.r.Info())
 	}
 
@@ -0,0 +1,161 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gwuhaolin/livego/configure"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+웹훅
+퍼블리시와 재생 세션의 시작과 끝을 hooks 에 설정한 URL 로 알린다. 요청은 세션 정보를 담은 JSON POST 이다.
+  on_publish, on_play      응답을 기다리며, 2xx 가 아니면 연결을 거절한다.
+  on_unpublish, on_stop    응답을 기다리지 않는다. 시작을 알린 세션에만 보낸다.
+연결 오류와 5xx 응답은 hooks.retries 번까지 다시 보내고, 요청마다 hooks.timeout(ms)이 지나면 실패로 본다.
+*/
+
+const (
+	OnPublish   = "on_publish"
+	OnUnpublish = "on_unpublish"
+	OnPlay      = "on_play"
+	OnStop      = "on_stop"
+
+	defaultTimeout = 3000 // ms
+	retryInterval  = 500 * time.Millisecond
+)
+
+type Session struct {
+	Action   string            `json:"action"`
+	ID       string            `json:"session_id"`
+	App      string            `json:"app"`
+	Stream   string            `json:"stream"`
+	ClientIP string            `json:"client_ip"`
+	Protocol string            `json:"protocol"`
+	Query    map[string]string `json:"query"`
+}
+
+// key 는 스트림 키(<APP>/<NAME>), addr 는 클라이언트 주소(host:port)이다. 쿼리 파라미터는 첫 값만 쓴다.
+func NewSession(protocol, id, key, addr string, query url.Values) Session {
+	s := Session{
+		ID:       id,
+		ClientIP: addr,
+		Protocol: protocol,
+		Query:    map[string]string{},
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		s.ClientIP = host
+	}
+	paths := strings.SplitN(key, "/", 2)
+	s.App = paths[0]
+	if len(paths) == 2 {
+		s.Stream = paths[1]
+	}
+	for k := range query {
+		s.Query[k] = query.Get(k)
+	}
+	return s
+}
+
+// 시작을 알린 세션. 세션 ID → 끝날 때 보낼 Session
+var (
+	sessionsLock sync.Mutex
+	sessions     = map[string]Session{}
+)
+
+// 웹훅 URL 이 설정되어 있는지
+func Enabled(action string) bool {
+	return configure.Config.GetString("hooks."+action) != ""
+}
+
+// 퍼블리시 시작을 알린다. 거절되면 에러를 반환한다.
+func Publish(s Session) error {
+	return start(OnPublish, OnUnpublish, s)
+}
+
+// 퍼블리시 종료를 알린다.
+func Unpublish(id string) {
+	stop(id)
+}
+
+// 재생 시작을 알린다. 거절되면 에러를 반환한다.
+func Play(s Session) error {
+	return start(OnPlay, OnStop, s)
+}
+
+// 재생 종료를 알린다.
+func Stop(id string) {
+	stop(id)
+}
+
+func start(action, end string, s Session) error {
+	s.Action = action
+	if err := send(s); err != nil {
+		return err
+	}
+	if Enabled(end) {
+		s.Action = end
+		sessionsLock.Lock()
+		sessions[s.ID] = s
+		sessionsLock.Unlock()
+	}
+	return nil
+}
+
+// 같은 세션에 여러 곳에서 불러도 한 번만 보낸다.
+func stop(id string) {
+	sessionsLock.Lock()
+	s, ok := sessions[id]
+	delete(sessions, id)
+	sessionsLock.Unlock()
+	if ok {
+		go send(s)
+	}
+}
+
+func send(s Session) error {
+	hookURL := configure.Config.GetString("hooks." + s.Action)
+	if hookURL == "" {
+		return nil
+	}
+	timeout := configure.Config.GetInt("hooks.timeout")
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	client := &http.Client{Timeout: time.Duration(timeout) * time.Millisecond}
+	body, _ := json.Marshal(s)
+
+	var err error
+	for i := 0; i <= configure.Config.GetInt("hooks.retries"); i++ {
+		if i > 0 {
+			time.Sleep(retryInterval)
+		}
+		var resp *http.Response
+		resp, err = client.Post(hookURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return nil
+		}
+		err = fmt.Errorf("%s rejected: %s", s.Action, resp.Status)
+		if resp.StatusCode < 500 {
+			break
+		}
+	}
+	log.Warningf("webhook %s [%s/%s %s] error: %v", s.Action, s.App, s.Stream, s.ID, err)
+	return err
+}
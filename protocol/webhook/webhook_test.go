@@ -0,0 +1,212 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/protocol/event"
+)
+
+// 웹훅 설정을 바꾼다. 돌려준 함수로 설정을 되돌린다.
+func setHooks(hooks map[string]interface{}) (restore func()) {
+	old := map[string]interface{}{}
+	for _, k := range []string{OnPublish, OnUnpublish, OnPlay, OnStop, "timeout", "retries"} {
+		old[k] = configure.Config.Get("hooks." + k)
+		configure.Config.Set("hooks."+k, hooks[k])
+	}
+	return func() {
+		for k, v := range old {
+			configure.Config.Set("hooks."+k, v)
+		}
+	}
+}
+
+// 받은 요청을 세고, status 가 돌려주는 상태 코드로 응답하는 스텁 서버
+type stub struct {
+	*httptest.Server
+	requests int32
+	sessions chan Session
+}
+
+func newStub(status func(n int32) int) *stub {
+	s := &stub{sessions: make(chan Session, 16)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&s.requests, 1)
+		var session Session
+		json.NewDecoder(r.Body).Decode(&session)
+		s.sessions <- session
+		w.WriteHeader(status(n))
+	}))
+	return s
+}
+
+func testSession(id string) Session {
+	return NewSession(event.ProtocolRTMP, id, "live/movie", "10.0.0.1:5000", url.Values{"token": {"abc"}})
+}
+
+func TestStartStatus(t *testing.T) {
+	tests := []struct {
+		status int
+		ok     bool
+	}{
+		{http.StatusOK, true},
+		{http.StatusNoContent, true},
+		{http.StatusForbidden, false},
+		{http.StatusNotFound, false},
+		{http.StatusInternalServerError, false},
+	}
+	starts := []struct {
+		action string
+		start  func(Session) error
+	}{
+		{OnPublish, Publish},
+		{OnPlay, Play},
+	}
+	for _, test := range tests {
+		for _, start := range starts {
+			status := test.status
+			server := newStub(func(int32) int { return status })
+			restore := setHooks(map[string]interface{}{start.action: server.URL})
+			err := start.start(testSession("status"))
+			restore()
+			server.Close()
+			if (err == nil) != test.ok {
+				t.Errorf("%s %d: err = %v, want ok %v", start.action, test.status, err, test.ok)
+			}
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		retries  int
+		status   func(n int32) int
+		requests int32
+		ok       bool
+	}{
+		{"5xx retried", 2, func(int32) int { return http.StatusServiceUnavailable }, 3, false},
+		{"5xx then 2xx", 2, func(n int32) int {
+			if n < 2 {
+				return http.StatusBadGateway
+			}
+			return http.StatusOK
+		}, 2, true},
+		{"no retries", 0, func(int32) int { return http.StatusInternalServerError }, 1, false},
+		{"4xx not retried", 2, func(int32) int { return http.StatusForbidden }, 1, false},
+	}
+	for _, test := range tests {
+		server := newStub(test.status)
+		restore := setHooks(map[string]interface{}{OnPublish: server.URL, "retries": test.retries})
+		err := Publish(testSession("retry"))
+		restore()
+		server.Close()
+		if (err == nil) != test.ok {
+			t.Errorf("%s: err = %v, want ok %v", test.name, err, test.ok)
+		}
+		if n := atomic.LoadInt32(&server.requests); n != test.requests {
+			t.Errorf("%s: %d requests, want %d", test.name, n, test.requests)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	defer setHooks(map[string]interface{}{OnPlay: server.URL, "timeout": 100})()
+
+	begin := time.Now()
+	if err := Play(testSession("timeout")); err == nil {
+		t.Fatal("Play succeeded without a response")
+	}
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Fatalf("Play took %v with a 100ms timeout", elapsed)
+	}
+}
+
+func TestStopOnce(t *testing.T) {
+	tests := []struct {
+		start, end string
+		startFunc  func(Session) error
+		stopFunc   func(string)
+	}{
+		{OnPublish, OnUnpublish, Publish, Unpublish},
+		{OnPlay, OnStop, Play, Stop},
+	}
+	for _, test := range tests {
+		server := newStub(func(int32) int { return http.StatusOK })
+		restore := setHooks(map[string]interface{}{test.start: server.URL, test.end: server.URL})
+
+		id := "once-" + test.end
+		if err := test.startFunc(testSession(id)); err != nil {
+			t.Fatalf("%s: %v", test.start, err)
+		}
+		<-server.sessions
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				test.stopFunc(id)
+			}()
+		}
+		wg.Wait()
+
+		select {
+		case got := <-server.sessions:
+			want := Session{
+				Action:   test.end,
+				ID:       id,
+				App:      "live",
+				Stream:   "movie",
+				ClientIP: "10.0.0.1",
+				Protocol: event.ProtocolRTMP,
+				Query:    map[string]string{"token": "abc"},
+			}
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("%s body = %+v, want %+v", test.end, got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s not sent", test.end)
+		}
+		select {
+		case got := <-server.sessions:
+			t.Errorf("%s sent again: %+v", test.end, got)
+		case <-time.After(100 * time.Millisecond):
+		}
+		restore()
+		server.Close()
+	}
+}
+
+func TestStopWithoutStart(t *testing.T) {
+	server := newStub(func(int32) int { return http.StatusForbidden })
+	defer server.Close()
+	defer setHooks(map[string]interface{}{OnPlay: server.URL, OnStop: server.URL})()
+
+	// 거절된 세션과 시작을 알리지 않은 세션에는 on_stop 을 보내지 않는다.
+	if err := Play(testSession("rejected")); err == nil {
+		t.Fatal("Play succeeded on 403")
+	}
+	<-server.sessions
+	Stop("rejected")
+	Stop("unknown")
+	select {
+	case got := <-server.sessions:
+		t.Fatalf("on_stop sent for %+v", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,281 @@
+package webrtc
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"sync"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/parser/aac"
+	"github.com/gwuhaolin/livego/transcode"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	opusClockRate = 48 // 48kHz 클럭을 밀리초 단위로 바꾸기 위한 값
+	aacFrameSize  = 1024
+
+	// FLV 오디오 태그 헤더: AAC, 44kHz(AAC 는 항상 이 값을 쓴다), 16bit, 스테레오
+	aacTagHeader = av.SOUND_AAC<<4 | av.SOUND_44Khz<<2 | av.SOUND_16BIT<<1 | av.SOUND_STEREO
+)
+
+// WHIP 퍼블리셔의 Opus 트랙을 AAC 로 변환해 FLV 오디오 태그로 reader 에 전달한다.
+// 변환기를 만들 수 없으면(인코더가 설치되지 않은 경우 등) 오디오는 버리고 비디오만 전달한다.
+func handleOpusTrack(track *webrtc.TrackRemote, reader *Reader) {
+	t, err := transcode.New(transcode.Config{
+		From:       transcode.Opus,
+		To:         transcode.AAC,
+		SampleRate: int(track.Codec().ClockRate),
+		Channels:   int(track.Codec().Channels),
+	})
+	if err != nil {
+		log.Warningf("[%v] opus to aac transcoder unavailable, audio dropped: %v", reader.Info(), err)
+		drainTrack(track)
+		return
+	}
+	defer t.Close()
+
+	var startOnce sync.Once
+	baseMs := make(chan uint32, 1)
+	go writeAACFrames(t, reader, baseMs)
+
+	for {
+		rtpPacket, _, err := track.ReadRTP()
+		if err != nil {
+			log.Debugf("Error reading RTP packet: %v", err)
+			reader.Close(err)
+			return
+		}
+		if len(rtpPacket.Payload) == 0 {
+			continue
+		}
+		startOnce.Do(func() {
+			baseMs <- reader.sinceStart()
+		})
+		if err := t.Write(rtpPacket.Payload); err != nil {
+			log.Debugf("[%v] opus transcoder write error: %v", reader.Info(), err)
+			reader.Close(err)
+			return
+		}
+	}
+}
+
+// 변환기가 출력한 ADTS 프레임을 AAC 시퀀스 헤더와 AAC 로우 태그로 바꿔 reader 에 넣는다.
+// 타임스탬프는 첫 오디오 패킷의 시각에 출력 프레임 수만큼의 재생 시간을 더해 계산한다.
+func writeAACFrames(t transcode.Transcoder, reader *Reader, baseMs chan uint32) {
+	var (
+		specific []byte
+		frames   uint64
+		base     uint32
+		hasBase  bool
+	)
+	for {
+		frame, err := t.Read()
+		if err != nil {
+			if err != io.EOF {
+				log.Debugf("[%v] opus transcoder read error: %v", reader.Info(), err)
+			}
+			return
+		}
+		if !hasBase {
+			base = <-baseMs
+			hasBase = true
+		}
+
+		asc, headerLen, err := aac.ParseADTSHeader(frame)
+		if err != nil || headerLen >= len(frame) {
+			continue
+		}
+		timestamp := base + uint32(frames*aacFrameSize*1000/transcode.OutputSampleRate)
+		frames++
+
+		if !bytes.Equal(specific, asc) {
+			specific = asc
+			reader.writePacket(&av.Packet{
+				IsAudio:   true,
+				TimeStamp: timestamp,
+				Data:      append([]byte{aacTagHeader, av.AAC_SEQHDR}, asc...),
+			})
+		}
+		reader.writePacket(&av.Packet{
+			IsAudio:   true,
+			TimeStamp: timestamp,
+			Data:      append([]byte{aacTagHeader, av.AAC_RAW}, frame[headerLen:]...),
+		})
+	}
+}
+
+// WHEP 시청자에게 보낼 AAC 오디오를 Opus 로 바꿔 오디오 트랙에 쓴다.
+// 변환은 스트림 키마다 한 번만 하고, 같은 스트림의 시청자들이 브리지를 함께 쓴다. 시청자마다 변환기를 띄우면 시청자 수만큼 인코더 프로세스가 늘기 때문이다.
+// 시청자의 Writer 가 붙을 때 참조를 세고, 마지막 시청자가 떠나면 변환기를 닫고 브리지를 지운다.
+// 변환기 입력은 붙어 있는 시청자 중 하나(feeder)의 SendPacket 고루틴만 넣고, 그 시청자가 떠나면 다음 시청자가 이어받는다.
+// 변환된 패킷은 별도의 고루틴에서 RTP 로 만들어 모든 시청자의 트랙에 쓴다.
+type opusBridge struct {
+	key      string
+	sequence uint16
+	tsOffset uint32
+
+	feedLock sync.Mutex // 아래 둘은 feeder 가 바뀌는 동안에도 한 고루틴만 쓰도록 잡는다.
+	parser   *aac.Parser
+	buf      bytes.Buffer
+
+	lock        sync.Mutex
+	tracks      map[*Writer]*webrtc.TrackLocalStaticRTP
+	feeder      *Writer
+	transcoder  transcode.Transcoder
+	unavailable bool
+	closed      bool
+}
+
+// 스트림 키 → 그 스트림의 시청자들이 함께 쓰는 브리지
+var (
+	bridgesLock sync.Mutex
+	bridges     = map[string]*opusBridge{}
+)
+
+func newOpusBridge(key string) *opusBridge {
+	return &opusBridge{
+		key:      key,
+		parser:   aac.NewParser(),
+		sequence: uint16(rand.Uint32()),
+		tsOffset: rand.Uint32(),
+		tracks:   map[*Writer]*webrtc.TrackLocalStaticRTP{},
+	}
+}
+
+// 시청자의 오디오 트랙을 스트림의 브리지에 붙인다. 브리지가 없으면 만든다.
+func attachOpusBridge(w *Writer, track *webrtc.TrackLocalStaticRTP) *opusBridge {
+	key := w.Info().Key
+	bridgesLock.Lock()
+	defer bridgesLock.Unlock()
+	b, ok := bridges[key]
+	if !ok {
+		b = newOpusBridge(key)
+		bridges[key] = b
+	}
+	b.lock.Lock()
+	b.tracks[w] = track
+	if b.feeder == nil {
+		b.feeder = w
+	}
+	b.lock.Unlock()
+	return b
+}
+
+// 시청자를 브리지에서 뗀다. 마지막 시청자였으면 변환기를 닫고 브리지를 지운다.
+func (b *opusBridge) detach(w *Writer) {
+	bridgesLock.Lock()
+	defer bridgesLock.Unlock()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, ok := b.tracks[w]; !ok {
+		return
+	}
+	delete(b.tracks, w)
+	if b.feeder == w {
+		b.feeder = nil
+		for next := range b.tracks {
+			b.feeder = next
+			break
+		}
+	}
+	if len(b.tracks) > 0 {
+		return
+	}
+	b.closed = true
+	if b.transcoder != nil {
+		b.transcoder.Close()
+	}
+	if bridges[b.key] == b {
+		delete(bridges, b.key)
+	}
+}
+
+// 시청자 w 가 받은 FLV 오디오 태그 하나를 변환기에 넣는다. feeder 가 아닌 시청자의 태그와 AAC 가 아닌 오디오는 무시한다.
+func (b *opusBridge) write(w *Writer, p *av.Packet, timestamp uint32) {
+	audioPkt, ok := p.Header.(av.AudioPacketHeader)
+	if !ok || audioPkt.SoundFormat() != av.SOUND_AAC || len(p.Data) < 2 {
+		return
+	}
+
+	b.feedLock.Lock()
+	defer b.feedLock.Unlock()
+	b.lock.Lock()
+	feeder := b.feeder
+	b.lock.Unlock()
+	if feeder != w {
+		return
+	}
+
+	if audioPkt.AACPacketType() == av.AAC_SEQHDR {
+		b.parser.Parse(p.Data[2:], av.AAC_SEQHDR, nil)
+		return
+	}
+
+	t := b.start(timestamp)
+	if t == nil {
+		return
+	}
+	b.buf.Reset()
+	if err := b.parser.Parse(p.Data[2:], av.AAC_RAW, &b.buf); err != nil {
+		return
+	}
+	if err := t.Write(b.buf.Bytes()); err != nil {
+		log.Debugf("[%v] aac transcoder write error: %v", b.key, err)
+	}
+}
+
+// 첫 AAC 프레임을 받을 때 변환기를 띄운다.
+func (b *opusBridge) start(timestamp uint32) transcode.Transcoder {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.transcoder != nil || b.unavailable || b.closed {
+		return b.transcoder
+	}
+
+	t, err := transcode.New(transcode.Config{
+		From:       transcode.AAC,
+		To:         transcode.Opus,
+		SampleRate: b.parser.SampleRate(),
+		Channels:   transcode.OutputChannels,
+	})
+	if err != nil {
+		log.Warningf("[%v] aac to opus transcoder unavailable, audio disabled: %v", b.key, err)
+		b.unavailable = true
+		return nil
+	}
+	b.transcoder = t
+	go b.sendLoop(t, b.tsOffset+timestamp*opusClockRate)
+	return t
+}
+
+func (b *opusBridge) sendLoop(t transcode.Transcoder, rtpTs uint32) {
+	for {
+		frame, err := t.Read()
+		if err != nil {
+			return
+		}
+		packet := &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				SequenceNumber: b.sequence,
+				Timestamp:      rtpTs,
+			},
+			Payload: frame,
+		}
+		b.sequence++
+		rtpTs += uint32(transcode.OpusPacketSamples(frame))
+
+		b.lock.Lock()
+		for w, track := range b.tracks {
+			if err := track.WriteRTP(packet); err != nil {
+				log.Debugf("[%v] opus write error: %v", w.Info(), err)
+			}
+		}
+		b.lock.Unlock()
+	}
+}
@@ -0,0 +1,228 @@
+package webrtc
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/parser/aac"
+	"github.com/gwuhaolin/livego/transcode"
+	"github.com/pion/webrtc/v3"
+)
+
+// AAC-LC, 44.1kHz, 스테레오
+var testASC = []byte{0x12, 0x10}
+
+// 입력을 모아 두고, out 에 넣은 프레임을 그대로 출력하는 변환기
+type fakeTranscoder struct {
+	cfg transcode.Config
+	out chan []byte
+
+	lock   sync.Mutex
+	in     [][]byte
+	closed bool
+}
+
+func newFakeTranscoder(cfg transcode.Config) *fakeTranscoder {
+	return &fakeTranscoder{cfg: cfg, out: make(chan []byte, 16)}
+}
+
+func (f *fakeTranscoder) Write(frame []byte) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return io.ErrClosedPipe
+	}
+	f.in = append(f.in, append([]byte(nil), frame...))
+	return nil
+}
+
+func (f *fakeTranscoder) Read() ([]byte, error) {
+	frame, ok := <-f.out
+	if !ok {
+		return nil, io.EOF
+	}
+	return frame, nil
+}
+
+func (f *fakeTranscoder) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if !f.closed {
+		f.closed = true
+		close(f.out)
+	}
+	return nil
+}
+
+func audioPacket(t *testing.T, data []byte) *av.Packet {
+	p := &av.Packet{IsAudio: true, Data: data}
+	if err := flv.NewDemuxer().DemuxH(p); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func adtsFrame(t *testing.T, payload []byte) []byte {
+	parser := aac.NewParser()
+	parser.Parse(testASC, av.AAC_SEQHDR, nil)
+	var buf bytes.Buffer
+	if err := parser.Parse(payload, av.AAC_RAW, &buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// transcode.New 를 가짜 변환기로 바꾼다. 돌려준 함수로 되돌린다.
+func fakeTranscode(started *[]*fakeTranscoder) (restore func()) {
+	old := transcode.New
+	transcode.New = func(cfg transcode.Config) (transcode.Transcoder, error) {
+		fake := newFakeTranscoder(cfg)
+		*started = append(*started, fake)
+		return fake, nil
+	}
+	return func() { transcode.New = old }
+}
+
+func newAudioTrack(t *testing.T) *webrtc.TrackLocalStaticRTP {
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return track
+}
+
+func TestOpusBridge(t *testing.T) {
+	var started []*fakeTranscoder
+	defer fakeTranscode(&started)()
+
+	w := &Writer{app: "live", title: "test"}
+	b := attachOpusBridge(w, newAudioTrack(t))
+
+	b.write(w, audioPacket(t, append([]byte{aacTagHeader, av.AAC_SEQHDR}, testASC...)), 0)
+	if len(started) != 0 {
+		t.Fatal("transcoder started before the first raw frame")
+	}
+
+	payloads := [][]byte{{0x01, 0x02, 0x03}, {0x04, 0x05}}
+	for i, payload := range payloads {
+		b.write(w, audioPacket(t, append([]byte{aacTagHeader, av.AAC_RAW}, payload...)), uint32(i*23))
+	}
+	if len(started) != 1 {
+		t.Fatalf("started %d transcoders, want 1", len(started))
+	}
+	fake := started[0]
+	want := transcode.Config{From: transcode.AAC, To: transcode.Opus, SampleRate: 44100, Channels: transcode.OutputChannels}
+	if fake.cfg != want {
+		t.Fatalf("config = %+v, want %+v", fake.cfg, want)
+	}
+	if len(fake.in) != len(payloads) {
+		t.Fatalf("transcoder got %d frames, want %d", len(fake.in), len(payloads))
+	}
+	for i, payload := range payloads {
+		if want := adtsFrame(t, payload); !bytes.Equal(fake.in[i], want) {
+			t.Errorf("frame %d = %x, want %x", i, fake.in[i], want)
+		}
+	}
+
+	b.detach(w)
+	if !fake.closed {
+		t.Fatal("transcoder not closed")
+	}
+}
+
+func TestOpusBridgeShared(t *testing.T) {
+	var started []*fakeTranscoder
+	defer fakeTranscode(&started)()
+
+	first := &Writer{app: "live", title: "shared"}
+	second := &Writer{app: "live", title: "shared"}
+	other := &Writer{app: "live", title: "other"}
+	b := attachOpusBridge(first, newAudioTrack(t))
+	if attachOpusBridge(second, newAudioTrack(t)) != b {
+		t.Fatal("viewers of one stream got different bridges")
+	}
+	ob := attachOpusBridge(other, newAudioTrack(t))
+	if ob == b {
+		t.Fatal("viewers of different streams share a bridge")
+	}
+	defer ob.detach(other)
+
+	seq := audioPacket(t, append([]byte{aacTagHeader, av.AAC_SEQHDR}, testASC...))
+	raw := audioPacket(t, append([]byte{aacTagHeader, av.AAC_RAW}, 0x01, 0x02))
+	// 두 시청자가 같은 패킷을 받아도 변환기에는 한 번만 들어간다.
+	for _, w := range []*Writer{first, second} {
+		b.write(w, seq, 0)
+		b.write(w, raw, 0)
+	}
+	if len(started) != 1 {
+		t.Fatalf("started %d transcoders, want 1", len(started))
+	}
+	fake := started[0]
+	if len(fake.in) != 1 {
+		t.Fatalf("transcoder got %d frames, want 1", len(fake.in))
+	}
+
+	// feeder 가 떠나면 남은 시청자가 이어서 넣고, 변환기는 그대로 쓴다.
+	b.detach(first)
+	if fake.closed {
+		t.Fatal("transcoder closed while a viewer is left")
+	}
+	b.write(first, raw, 0)
+	b.write(second, raw, 0)
+	if len(fake.in) != 2 {
+		t.Fatalf("transcoder got %d frames, want 2", len(fake.in))
+	}
+
+	b.detach(second)
+	if !fake.closed {
+		t.Fatal("transcoder not closed after the last viewer left")
+	}
+	bridgesLock.Lock()
+	_, ok := bridges["live/shared"]
+	bridgesLock.Unlock()
+	if ok {
+		t.Fatal("bridge not removed after the last viewer left")
+	}
+	if len(started) != 1 {
+		t.Fatalf("started %d transcoders, want 1", len(started))
+	}
+}
+
+func TestWriteAACFrames(t *testing.T) {
+	fake := newFakeTranscoder(transcode.Config{From: transcode.Opus, To: transcode.AAC})
+	reader := NewReader("live", "test", "", nil)
+	defer reader.Close(nil)
+
+	payloads := [][]byte{{0x01, 0x02, 0x03}, {0x04, 0x05}}
+	for _, payload := range payloads {
+		fake.out <- adtsFrame(t, payload)
+	}
+	fake.Close()
+
+	baseMs := make(chan uint32, 1)
+	baseMs <- 100
+	writeAACFrames(fake, reader, baseMs)
+
+	frameMs := uint32(aacFrameSize * 1000 / transcode.OutputSampleRate)
+	tests := []struct {
+		timestamp uint32
+		data      []byte
+	}{
+		{100, append([]byte{aacTagHeader, av.AAC_SEQHDR}, testASC...)},
+		{100, append([]byte{aacTagHeader, av.AAC_RAW}, payloads[0]...)},
+		{100 + frameMs, append([]byte{aacTagHeader, av.AAC_RAW}, payloads[1]...)},
+	}
+	if len(reader.packetQueue) != len(tests) {
+		t.Fatalf("queued %d packets, want %d", len(reader.packetQueue), len(tests))
+	}
+	for i, test := range tests {
+		p := <-reader.packetQueue
+		if p.TimeStamp != test.timestamp || !bytes.Equal(p.Data, test.data) {
+			t.Errorf("packet %d = %d %x, want %d %x", i, p.TimeStamp, p.Data, test.timestamp, test.data)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package webrtc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+
+	"github.com/pion/webrtc/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// 데이터 채널로 주고받는 메시지 종류
+	dataMessageChat     = "chat"     // 시청자/퍼블리셔가 보낸 채팅
+	dataMessageServer   = "server"   // API 로 서버가 보낸 공지
+	dataMessageMetadata = "metadata" // 퍼블리셔가 보낸 onTextData/onCuePoint
+
+	// 채팅 한 건의 최대 길이. 넘으면 버린다.
+	maxChatLength = 1024
+)
+
+var (
+	ErrRoomNotFound = fmt.Errorf("webrtc room not found")
+	ErrEmptyMessage = fmt.Errorf("empty message")
+)
+
+// 타임드 메타데이터로 전달하는 AMF 데이터 이벤트 이름. onMetaData 는 코덱 정보이므로 보내지 않는다.
+var timedMetadataEvents = map[string]bool{
+	"onTextData": true,
+	"onCuePoint": true,
+}
+
+// 데이터 채널로 주고받는 JSON 메시지이다.
+// 클라이언트는 {"type":"chat","name":"...","text":"..."} 형태로 보내고, 서버가 from/time 을 채워 방 전체에 돌려준다.
+type DataMessage struct {
+	Type      string      `json:"type"`
+	From      string      `json:"from,omitempty"` // 보낸 세션 ID
+	Name      string      `json:"name,omitempty"` // 클라이언트가 정한 표시 이름
+	Text      string      `json:"text,omitempty"`
+	Event     string      `json:"event,omitempty"`     // 메타데이터 이벤트 이름 (onTextData, onCuePoint)
+	Data      interface{} `json:"data,omitempty"`      // 메타데이터 내용
+	Timestamp uint32      `json:"timestamp,omitempty"` // 메타데이터가 실린 미디어 타임스탬프(ms)
+	Time      int64       `json:"time"`                // 서버 시각(ms)
+}
+
+// 스트림 키(app/name) 하나에 붙은 데이터 채널 모음이다.
+// WHIP 퍼블리셔와 WHEP 시청자가 같은 방에 들어가 채팅을 주고받는다.
+type room map[string]*webrtc.DataChannel // 세션 ID -> 데이터 채널
+
+// 세션의 PeerConnection 에 데이터 채널 처리기를 등록한다.
+// 클라이언트가 만든 데이터 채널이 열리면 스트림 키의 방에 들어가고, 닫히면 방에서 빠진다.
+func (s *Session) handleDataChannel() {
+	if s.stream == nil {
+		return
+	}
+	key := s.stream.Info().Key
+
+	s.pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		dc.OnOpen(func() {
+			log.Debugf("[%s] webrtc data channel %q opened: %s", s.ID, dc.Label(), key)
+			s.lock.Lock()
+			s.dataChannel = dc
+			s.lock.Unlock()
+			s.server.joinRoom(key, s.ID, dc)
+			// 시청자에게는 같은 채널로 타임드 메타데이터도 보낸다.
+			if writer, ok := s.stream.(*Writer); ok {
+				writer.setDataChannel(dc)
+			}
+		})
+		dc.OnClose(func() {
+			s.server.leaveRoom(key, s.ID, dc)
+		})
+		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+			s.onChat(key, msg)
+		})
+	})
+}
+
+// 클라이언트가 보낸 채팅을 방 전체에 보낸다. JSON 이 아니면 본문 전체를 채팅 내용으로 본다.
+func (s *Session) onChat(key string, msg webrtc.DataChannelMessage) {
+	var chat DataMessage
+	if !msg.IsString || json.Unmarshal(msg.Data, &chat) != nil {
+		chat = DataMessage{Text: string(msg.Data)}
+	}
+	chat.Text = strings.TrimSpace(chat.Text)
+	if chat.Text == "" || len(chat.Text) > maxChatLength {
+		return
+	}
+
+	s.lock.Lock()
+	s.lastActive = time.Now()
+	s.lock.Unlock()
+
+	s.server.broadcast(key, DataMessage{
+		Type: dataMessageChat,
+		From: s.ID,
+		Name: chat.Name,
+		Text: chat.Text,
+		Time: time.Now().UnixNano() / 1e6,
+	})
+}
+
+func (server *Server) joinRoom(key, id string, dc *webrtc.DataChannel) {
+	server.roomLock.Lock()
+	defer server.roomLock.Unlock()
+	r, ok := server.rooms[key]
+	if !ok {
+		r = room{}
+		server.rooms[key] = r
+	}
+	r[id] = dc
+}
+
+// 세션을 방에서 뺀다. 그 사이 같은 세션이 새 채널로 다시 들어왔으면 그대로 둔다.
+// 마지막 세션이 빠지면 방도 지운다.
+func (server *Server) leaveRoom(key, id string, dc *webrtc.DataChannel) {
+	server.roomLock.Lock()
+	defer server.roomLock.Unlock()
+	r, ok := server.rooms[key]
+	if !ok || r[id] != dc {
+		return
+	}
+	delete(r, id)
+	if len(r) == 0 {
+		delete(server.rooms, key)
+	}
+}
+
+// 방에 있는 모든 데이터 채널로 메시지를 보낸다. 방이 없으면 ErrRoomNotFound 를 돌려준다.
+func (server *Server) broadcast(key string, msg DataMessage) error {
+	server.roomLock.Lock()
+	r, ok := server.rooms[key]
+	channels := make([]*webrtc.DataChannel, 0, len(r))
+	for _, dc := range r {
+		channels = append(channels, dc)
+	}
+	server.roomLock.Unlock()
+	if !ok {
+		return ErrRoomNotFound
+	}
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	for _, dc := range channels {
+		if err := dc.SendText(string(b)); err != nil {
+			log.Debugf("webrtc data channel send error: %v", err)
+		}
+	}
+	return nil
+}
+
+// 서버 공지를 방(app/name)에 보낸다. API 서버의 /control/message 에서 사용한다.
+func (server *Server) PostMessage(key, text string) error {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return ErrEmptyMessage
+	}
+	return server.broadcast(key, DataMessage{
+		Type: dataMessageServer,
+		Text: text,
+		Time: time.Now().UnixNano() / 1e6,
+	})
+}
+
+// AMF0 데이터 태그에서 onTextData/onCuePoint 이벤트를 꺼낸다.
+// RTMP 퍼블리셔는 @setDataFrame 을 앞에 붙여 보내기도 하므로 건너뛴다.
+func decodeTimedMetadata(b []byte) (event string, data interface{}, ok bool) {
+	vs, _ := amf.NewDecoder().DecodeBatch(bytes.NewReader(b), amf.AMF0)
+	if len(vs) > 0 && vs[0] == amf.SetDataFrame {
+		vs = vs[1:]
+	}
+	if len(vs) < 2 {
+		return "", nil, false
+	}
+	event, _ = vs[0].(string)
+	if !timedMetadataEvents[event] {
+		return "", nil, false
+	}
+	return event, vs[1], true
+}
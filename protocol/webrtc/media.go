@@ -1,22 +1,217 @@
 package webrtc
 
 import (
-	"log"
+	"bytes"
+	"time"
 
+	"github.com/gwuhaolin/livego/av"
+
+	"github.com/pion/rtp/codecs"
 	"github.com/pion/webrtc/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	h264ClockRate = 90 // 90kHz 클럭을 밀리초 단위로 바꾸기 위한 값
+
+	naluTypeIDR = 5
+	naluTypeSPS = 7
+	naluTypePPS = 8
+	naluTypeAUD = 9
+
+	// 브라우저 인코더는 키프레임을 아주 드물게 만들기 때문에, 주기적으로 PLI 를 보내 GOP 캐시와 HLS 세그먼트가 채워지도록 한다.
+	pliInterval = 2 * time.Second
 )
 
 // 원격 피어에서 보내주는 트랙을 수신해, 해당 트랙의 RTP 패킷을 계속해 읽어들인다.(수신 전용 트랙)
 // 트랙은 오디오, 비디오 같은 미디어 스트림의 하나로, 전송 수신을 위한 논리적인 채널이라 할 수 있다.
 // RTP 프로토콜은 UDP 기반의 실시간 미디어 전송 프로토콜이다
-func HandleTrack(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-	log.Printf("Track received: %s", track.Kind().String())
+// H.264 비디오 트랙은 프레임 단위로 조립해 FLV 비디오 태그로 만든 뒤 reader 에 전달한다.
+// Opus 오디오 트랙은 AAC 로 변환해 전달하므로, HLS/RTMP/HTTP-FLV 시청자도 오디오를 받을 수 있다.
+func HandleTrack(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver, pc *webrtc.PeerConnection, reader *Reader) {
+	log.Debugf("Track received: %s %s", track.Kind().String(), track.Codec().MimeType)
+
+	if track.Kind() == webrtc.RTPCodecTypeAudio && track.Codec().MimeType == webrtc.MimeTypeOpus {
+		handleOpusTrack(track, reader)
+		return
+	}
+
+	if track.Kind() != webrtc.RTPCodecTypeVideo || track.Codec().MimeType != webrtc.MimeTypeH264 {
+		// 아직 변환할 수 없는 트랙은 버퍼가 쌓이지 않도록 읽어서 버린다.
+		drainTrack(track)
+		return
+	}
+
+	reader.setVideoSSRC(uint32(track.SSRC()))
+	go requestKeyFrames(reader)
+
+	assembler := newH264Assembler(reader)
 	for {
 		rtpPacket, _, err := track.ReadRTP()
 		if err != nil {
-			log.Printf("Error reading RTP packet: %v", err)
-			break
+			log.Debugf("Error reading RTP packet: %v", err)
+			reader.Close(err)
+			return
+		}
+		assembler.push(rtpPacket.Timestamp, rtpPacket.Marker, rtpPacket.Payload)
+	}
+}
+
+func drainTrack(track *webrtc.TrackRemote) {
+	for {
+		if _, _, err := track.ReadRTP(); err != nil {
+			return
+		}
+	}
+}
+
+// 퍼블리셔 측에 주기적으로 PLI 를 보내 키프레임을 요청한다.
+func requestKeyFrames(reader *Reader) {
+	ticker := time.NewTicker(pliInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			reader.RequestKeyFrame()
+		case <-reader.closedChan:
+			return
+		}
+	}
+}
+
+// RTP 패킷을 프레임(액세스 유닛) 단위로 모아 AVCC 형태의 FLV 비디오 태그로 변환한다.
+// 같은 RTP 타임스탬프를 가진 패킷은 하나의 프레임이며, 마커 비트나 타임스탬프 변화로 프레임의 끝을 판단한다.
+type h264Assembler struct {
+	reader    *Reader
+	depacket  codecs.H264Packet
+	frame     []byte // 4바이트 길이 프리픽스 NALU 의 모음
+	keyFrame  bool
+	frameTs   uint32
+	hasFrame  bool
+	baseTs    uint32
+	baseMs    uint32 // 첫 프레임의 reader 기준 시각(ms)
+	hasBase   bool
+	sps, pps  []byte
+	seqDirty  bool // sps/pps 가 바뀌어 시퀀스 헤더를 다시 보내야 하는가?
+	gotKey    bool // 첫 키프레임을 받기 전까지는 인터 프레임을 버린다.
+	seqHeader []byte
+}
+
+func newH264Assembler(reader *Reader) *h264Assembler {
+	return &h264Assembler{
+		reader:   reader,
+		depacket: codecs.H264Packet{IsAVC: true},
+	}
+}
+
+func (a *h264Assembler) push(ts uint32, marker bool, payload []byte) {
+	if a.hasFrame && ts != a.frameTs {
+		// 마커 비트를 잃어버린 경우 타임스탬프가 바뀌는 시점에 이전 프레임을 내보낸다.
+		a.flush()
+	}
+	a.frameTs = ts
+	a.hasFrame = true
+
+	nalus, err := a.depacket.Unmarshal(payload)
+	if err != nil {
+		log.Debug("h264 depacketize error: ", err)
+		return
+	}
+	a.appendNalus(nalus)
+
+	if marker {
+		a.flush()
+	}
+}
+
+// 길이 프리픽스 NALU 를 순회하며 SPS/PPS 는 따로 보관하고 나머지는 프레임에 덧붙인다.
+func (a *h264Assembler) appendNalus(b []byte) {
+	for len(b) > 4 {
+		size := int(b[0])<<24 | int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+		if size <= 0 || size > len(b)-4 {
+			return
+		}
+		nalu := b[4 : 4+size]
+		switch nalu[0] & 0x1f {
+		case naluTypeSPS:
+			if !bytes.Equal(a.sps, nalu) {
+				a.sps = append([]byte(nil), nalu...)
+				a.seqDirty = true
+			}
+		case naluTypePPS:
+			if !bytes.Equal(a.pps, nalu) {
+				a.pps = append([]byte(nil), nalu...)
+				a.seqDirty = true
+			}
+		case naluTypeAUD:
+		default:
+			if nalu[0]&0x1f == naluTypeIDR {
+				a.keyFrame = true
+			}
+			a.frame = append(a.frame, b[:4+size]...)
 		}
-		log.Printf("Received RTP packet: %v", rtpPacket)
+		b = b[4+size:]
+	}
+}
+
+func (a *h264Assembler) flush() {
+	defer func() {
+		a.frame = a.frame[:0]
+		a.keyFrame = false
+		a.hasFrame = false
+	}()
+
+	if !a.hasBase {
+		a.baseTs = a.frameTs
+		a.baseMs = a.reader.sinceStart()
+		a.hasBase = true
+	}
+	timestamp := a.baseMs + (a.frameTs-a.baseTs)/h264ClockRate
+
+	if a.seqDirty && len(a.sps) >= 4 && a.pps != nil {
+		a.seqDirty = false
+		a.seqHeader = avcSequenceHeader(a.sps, a.pps)
+		a.reader.writePacket(&av.Packet{
+			IsVideo:   true,
+			TimeStamp: timestamp,
+			Data:      a.seqHeader,
+		})
+	}
+
+	if len(a.frame) == 0 || a.seqHeader == nil {
+		return
 	}
+	if !a.gotKey && !a.keyFrame {
+		return
+	}
+	a.gotKey = true
+
+	// FLV 비디오 태그 헤더: 프레임 타입/코덱 ID, AVC 패킷 타입(NALU), 컴포지션 타임(0)
+	data := make([]byte, 5+len(a.frame))
+	if a.keyFrame {
+		data[0] = av.FRAME_KEY<<4 | av.VIDEO_H264
+	} else {
+		data[0] = av.FRAME_INTER<<4 | av.VIDEO_H264
+	}
+	data[1] = av.AVC_NALU
+	copy(data[5:], a.frame)
+
+	a.reader.writePacket(&av.Packet{
+		IsVideo:   true,
+		TimeStamp: timestamp,
+		Data:      data,
+	})
+}
+
+// SPS/PPS 로 AVCDecoderConfigurationRecord 를 만들어 FLV 시퀀스 헤더 태그로 감싼다.
+func avcSequenceHeader(sps, pps []byte) []byte {
+	b := bytes.NewBuffer(nil)
+	b.Write([]byte{av.FRAME_KEY<<4 | av.VIDEO_H264, av.AVC_SEQHDR, 0, 0, 0})
+	// configurationVersion, profile, compatibility, level, lengthSizeMinusOne(3)
+	b.Write([]byte{0x01, sps[1], sps[2], sps[3], 0xff})
+	b.Write([]byte{0xe1, byte(len(sps) >> 8), byte(len(sps))})
+	b.Write(sps)
+	b.Write([]byte{0x01, byte(len(pps) >> 8), byte(len(pps))})
+	b.Write(pps)
+	return b.Bytes()
 }
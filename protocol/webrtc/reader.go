@@ -0,0 +1,146 @@
+package webrtc
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/protocol/event"
+	"github.com/gwuhaolin/livego/protocol/metrics"
+	"github.com/gwuhaolin/livego/utils/uid"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	maxQueueNum = 1024
+
+	// 여러 시청자의 PLI 가 한꺼번에 몰려도 퍼블리셔에게는 이 간격 이상으로 키프레임을 요청하지 않는다.
+	pliMinInterval = 500 * time.Millisecond
+)
+
+// WHIP 로 들어온 브라우저 퍼블리셔를 RtmpStream 에 연결하기 위한 av.ReadCloser 구현체이다.
+// RTP 트랙에서 조립한 FLV 태그를 큐에 쌓아두면, Stream.TransStart 가 Read 를 통해 하나씩 꺼내간다.
+// RTMP 퍼블리셔의 VirReader 와 동일한 위치에 놓이므로, HLS, HTTP-FLV, RTMP 플레이어는 퍼블리셔의 종류를 구분하지 않는다.
+type Reader struct {
+	Uid string
+	av.RWBaser
+	app, title, url string
+	demuxer         *flv.Demuxer
+	pc              *webrtc.PeerConnection
+	packetQueue     chan *av.Packet
+	ingress         *metrics.Counter
+	closed          int32 // 트랙 고루틴과 스트림 고루틴이 함께 읽으므로 atomic 으로 다룬다.
+	closedChan      chan struct{}
+	closeOnce       sync.Once
+
+	startOnce sync.Once
+	startTime time.Time // 어느 트랙이든 첫 미디어 패킷을 받은 시각. 오디오/비디오 타임스탬프의 공통 기준이다.
+
+	pliLock   sync.Mutex
+	videoSSRC uint32 // 퍼블리셔 비디오 트랙의 SSRC. 트랙을 받기 전에는 0 이다.
+	lastPLI   time.Time
+}
+
+func NewReader(app, title, url string, pc *webrtc.PeerConnection) *Reader {
+	return &Reader{
+		Uid:         uid.NewId(),
+		app:         app,
+		title:       title,
+		url:         url,
+		pc:          pc,
+		RWBaser:     av.NewRWBaser(time.Second * 10),
+		demuxer:     flv.NewDemuxer(),
+		packetQueue: make(chan *av.Packet, maxQueueNum),
+		ingress:     metrics.GetCounter(metrics.IngressBytes, app+"/"+title, event.ProtocolWebRTC),
+		closedChan:  make(chan struct{}),
+	}
+}
+
+// 트랙 핸들러가 조립한 패킷을 큐에 넣는다. 큐가 가득 찬 경우 해당 패킷은 버린다.
+func (r *Reader) writePacket(p *av.Packet) {
+	if r.isClosed() {
+		return
+	}
+	r.ingress.Add(uint64(len(p.Data)))
+	select {
+	case r.packetQueue <- p:
+	default:
+		log.Warningf("[%v] webrtc packet queue max!!!", r.Info())
+		metrics.Add(metrics.DroppedPackets, r.Info().Key, event.ProtocolWebRTC, 1)
+	}
+}
+
+// 첫 미디어 패킷 이후 지난 시간(ms)을 돌려준다.
+// 트랙마다 RTP 타임스탬프의 시작값이 제각각이므로, 각 트랙의 첫 패킷 도착 시각으로 오디오와 비디오를 맞춘다.
+func (r *Reader) sinceStart() uint32 {
+	r.startOnce.Do(func() {
+		r.startTime = time.Now()
+	})
+	return uint32(time.Since(r.startTime) / time.Millisecond)
+}
+
+func (r *Reader) setVideoSSRC(ssrc uint32) {
+	r.pliLock.Lock()
+	r.videoSSRC = ssrc
+	r.pliLock.Unlock()
+}
+
+// 퍼블리셔에게 PLI 를 보내 키프레임을 요청한다. pliMinInterval 안에 들어온 요청은 무시한다.
+func (r *Reader) RequestKeyFrame() {
+	r.pliLock.Lock()
+	if r.isClosed() || r.videoSSRC == 0 || time.Since(r.lastPLI) < pliMinInterval {
+		r.pliLock.Unlock()
+		return
+	}
+	r.lastPLI = time.Now()
+	ssrc := r.videoSSRC
+	r.pliLock.Unlock()
+
+	pli := &rtcp.PictureLossIndication{MediaSSRC: ssrc}
+	if err := r.pc.WriteRTCP([]rtcp.Packet{pli}); err != nil {
+		log.Debugf("[%v] send pli error: %v", r.Info(), err)
+	}
+}
+
+func (r *Reader) Read(p *av.Packet) error {
+	select {
+	case pkt, ok := <-r.packetQueue:
+		if !ok {
+			return fmt.Errorf("webrtc reader closed")
+		}
+		r.SetPreTime()
+		*p = *pkt
+		return r.demuxer.DemuxH(p)
+	case <-r.closedChan:
+		return fmt.Errorf("webrtc reader closed")
+	}
+}
+
+func (r *Reader) Info() (ret av.Info) {
+	ret.UID = r.Uid
+	ret.URL = r.url
+	ret.Key = r.app + "/" + r.title
+	return
+}
+
+func (r *Reader) isClosed() bool {
+	return atomic.LoadInt32(&r.closed) == 1
+}
+
+// 트랙 고루틴, 세션, 스트림 정리에서 동시에 불러도 한 번만 닫는다.
+func (r *Reader) Close(err error) {
+	r.closeOnce.Do(func() {
+		log.Debug("webrtc publisher ", r.Info(), " closed: ", err)
+		atomic.StoreInt32(&r.closed, 1)
+		close(r.closedChan)
+		if r.pc != nil {
+			r.pc.Close()
+		}
+	})
+}
@@ -1,38 +1,144 @@
 package webrtc
 
 import (
-	"log"
+	"net"
 	"net/http"
+	"sync"
 
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/nack"
 	"github.com/pion/webrtc/v3"
+	log "github.com/sirupsen/logrus"
 )
 
-func StartWebRTCServer(addr string) error {
-	config := webrtc.Configuration{
-		// ICE 는 interactive connectivity Establishment라는 알고리즘이며. 해당 알고리즘이 사용할 서버 정보 목록이다.
-		// Web RTC는 P2P 통신시 여러 경로를 동시에 시도해 가장 빠르고 안정적인 경로를 찾는다.
-		// STUN (Session Traversal Utilities for NAT) 자신의 외부 공인 IP:포트를 찾는과정
-		// 시그널링은 찾은 공인 IP:포트로 SDP/ICE Candidate을 교환하는 과정이다.
-		// NAT는 사설 네트워크에서 공인 네트워크로 나가는 IP주소를 변환하는 기능을 한다.
-		ICEServers: []webrtc.ICEServer{
-			// 스턴서버는 인터넷 어딘가에 존재하는 공용서버로, 구글은 무료 스턴서버를 운영한다.
-			{URLs: []string{"stun:stun.l.google.com:19302"}},
-		},
+// WHIP 퍼블리셔와 WHEP 시청자의 시그널링을 처리하는 HTTP 서버이다.
+// handler 는 퍼블리셔/시청자가 붙을 RtmpStream 이며, 퍼블리시 시점에 getters 로 HLS, DASH 같은 writer 도 함께 붙인다.
+type Server struct {
+	handler  av.Handler
+	getters  []av.GetWriter
+	api      *webrtc.API
+	config   webrtc.Configuration
+	sessions sync.Map // 세션 ID -> *Session
+	roomLock sync.Mutex
+	rooms    map[string]room // 스트림 키(app/name) -> 데이터 채널 방
+}
+
+func NewServer(h av.Handler, getters ...av.GetWriter) (*Server, error) {
+	api, err := newAPI()
+	if err != nil {
+		return nil, err
 	}
+	return &Server{
+		handler: h,
+		getters: getters,
+		api:     api,
+		config:  newConfiguration(),
+		rooms:   make(map[string]room),
+	}, nil
+}
 
-	// 엔드 포인트로 요청을 보내면 핸들러가 실행된다.
-	http.HandleFunc("/webrtc", func(w http.ResponseWriter, r *http.Request) {
-		
-		// stunserver 설정을 통해 peer Connection 객체 생성한다.
-		peerConnection, err := webrtc.NewPeerConnection(config)
-		if err != nil {
-			http.Error(w, "Failed to create peer connection", http.StatusInternalServerError)
-			return
+// 설정 파일의 ICE 서버 목록으로 PeerConnection 설정을 만든다.
+func newConfiguration() webrtc.Configuration {
+	// ICE 는 interactive connectivity Establishment라는 알고리즘이며. 해당 알고리즘이 사용할 서버 정보 목록이다.
+	// Web RTC는 P2P 통신시 여러 경로를 동시에 시도해 가장 빠르고 안정적인 경로를 찾는다.
+	// STUN (Session Traversal Utilities for NAT) 자신의 외부 공인 IP:포트를 찾는과정
+	// 시그널링은 찾은 공인 IP:포트로 SDP/ICE Candidate을 교환하는 과정이다.
+	// NAT는 사설 네트워크에서 공인 네트워크로 나가는 IP주소를 변환하는 기능을 한다.
+	// 외부 STUN 서버에 접근할 수 없는 환경도 있으므로, 목록이 비어 있으면 호스트 후보(와 NAT 1:1 IP)만 사용한다.
+	servers := []configure.ICEServer{}
+	configure.Config.UnmarshalKey("webrtc_ice_servers", &servers)
+
+	config := webrtc.Configuration{}
+	for _, s := range servers {
+		iceServer := webrtc.ICEServer{
+			URLs:     s.URLs,
+			Username: s.Username,
+		}
+		if s.Credential != "" {
+			iceServer.Credential = s.Credential
+			iceServer.CredentialType = webrtc.ICECredentialTypePassword
 		}
+		config.ICEServers = append(config.ICEServers, iceServer)
+	}
+	return config
+}
+
+// UDP 포트 범위, NAT 1:1 IP, ICE-lite 설정을 반영한 webrtc.API 를 만든다.
+func newAPI() (*webrtc.API, error) {
+	settingEngine := webrtc.SettingEngine{}
+
+	portMin := configure.Config.GetInt("webrtc_udp_port_min")
+	portMax := configure.Config.GetInt("webrtc_udp_port_max")
+	if portMin > 0 || portMax > 0 {
+		if err := settingEngine.SetEphemeralUDPPortRange(uint16(portMin), uint16(portMax)); err != nil {
+			return nil, err
+		}
+	}
+
+	if ips := configure.Config.GetStringSlice("webrtc_nat_1to1_ips"); len(ips) > 0 {
+		settingEngine.SetNAT1To1IPs(ips, webrtc.ICECandidateTypeHost)
+	}
+
+	if configure.Config.GetBool("webrtc_ice_lite") {
+		settingEngine.SetLite(true)
+	}
 
-		handleSignaling(w, r, peerConnection)
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+
+	// NACK 응답은 Writer 가 시청자별 RTP 기록으로 직접 처리하므로, 기본 인터셉터 중 응답기는 빼고 생성기만 등록한다.
+	// 생성기는 WHIP 퍼블리셔에게서 잃어버린 패킷의 재전송을 요청한다.
+	registry := &interceptor.Registry{}
+	generator, err := nack.NewGeneratorInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	registry.Add(generator)
+	if err := webrtc.ConfigureRTCPReports(registry); err != nil {
+		return nil, err
+	}
+	if err := webrtc.ConfigureTWCCSender(mediaEngine, registry); err != nil {
+		return nil, err
+	}
+
+	return webrtc.NewAPI(
+		webrtc.WithSettingEngine(settingEngine),
+		webrtc.WithMediaEngine(mediaEngine),
+		webrtc.WithInterceptorRegistry(registry),
+	), nil
+}
+
+func (server *Server) newPeerConnection() (*webrtc.PeerConnection, error) {
+	return server.api.NewPeerConnection(server.config)
+}
+
+func (server *Server) Serve(l net.Listener) error {
+	go server.reapSessions()
+
+	mux := http.NewServeMux()
+
+	// 엔드 포인트로 요청을 보내면 핸들러가 실행된다.
+	mux.HandleFunc("/webrtc", func(w http.ResponseWriter, r *http.Request) {
+		server.handleSignaling(w, r)
+	})
+
+	// 브라우저 퍼블리셔(WHIP)의 엔드포인트이다.
+	mux.Handle(whipPrefix, &whipHandler{server: server})
+	// 브라우저 시청자(WHEP)의 엔드포인트이다.
+	mux.Handle(whepPrefix, &whepHandler{server: server})
+	// POST 응답의 Location 으로 알려준 세션 리소스이다. 트리클 ICE 와 종료를 처리한다.
+	mux.HandleFunc(sessionPrefix, func(w http.ResponseWriter, r *http.Request) {
+		server.handleSession(w, r)
 	})
 
-	log.Printf("WebRTC Server started at %s", addr)
-	return http.ListenAndServe(addr, nil)
+	if err := http.Serve(l, mux); err != nil {
+		log.Error("WebRTC server err: ", err)
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,385 @@
+package webrtc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/protocol/event"
+	"github.com/gwuhaolin/livego/protocol/metrics"
+
+	"github.com/pion/webrtc/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	sessionPrefix = "/session/"
+
+	sessionKindWHIP   = "whip"
+	sessionKindWHEP   = "whep"
+	sessionKindSignal = "signal"
+
+	sdpFragContentType = "application/trickle-ice-sdpfrag"
+
+	// answer 를 보내기 전에 ICE 후보 수집을 기다리는 최대 시간. 나머지 후보는 PATCH 로 전달한다.
+	answerGatherTimeout = 2 * time.Second
+	// 연결되지 않은 상태로 이 시간이 지난 세션은 리퍼가 정리한다. webrtc_session_timeout 으로 바꿀 수 있다.
+	defaultSessionTimeout = 30 * time.Second
+	reapInterval          = 5 * time.Second
+)
+
+var (
+	ErrSessionNotFound = fmt.Errorf("webrtc session not found")
+	ErrICERestart      = fmt.Errorf("ice restart is not supported")
+)
+
+// WHIP/WHEP 로 만들어진 PeerConnection 하나를 나타내는 세션 리소스이다.
+// POST 응답의 Location(/session/<id>) 으로 PATCH(트리클 ICE), DELETE(종료) 요청을 받는다.
+// 세션이 닫히면 연결된 Reader/Writer 도 함께 닫혀 RtmpStream 에서 빠진다.
+type Session struct {
+	ID        string
+	Kind      string // sessionKindWHIP, sessionKindWHEP, sessionKindSignal
+	server    *Server
+	pc        *webrtc.PeerConnection
+	stream    av.Closer // 세션에 연결된 Reader 또는 Writer. 없을 수도 있다.
+	createdAt time.Time
+
+	lock         sync.Mutex
+	connected    bool
+	established  bool // 한 번이라도 연결되었는지
+	lastActive   time.Time
+	candidates   []string // answer 이후 수집되어 아직 PATCH 응답으로 보내지 않은 로컬 후보
+	gatherDone   bool
+	gatherSent   bool
+	closed       bool
+	remoteUfrag  string
+	localUfrag   string
+	localPwd     string
+	localMLine   string
+	localMid     string
+	gatherNotify chan struct{}
+	dataChannel  *webrtc.DataChannel // 채팅 방에 들어간 데이터 채널. 없으면 nil 이다.
+}
+
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	Kind       string    `json:"kind"`
+	Key        string    `json:"key"`
+	URL        string    `json:"url"`
+	State      string    `json:"state"`
+	ICEState   string    `json:"ice_state"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastActive time.Time `json:"last_active"`
+}
+
+func newSession(server *Server, kind, id string, pc *webrtc.PeerConnection, stream av.Closer) *Session {
+	now := time.Now()
+	s := &Session{
+		ID:           id,
+		Kind:         kind,
+		server:       server,
+		pc:           pc,
+		stream:       stream,
+		createdAt:    now,
+		lastActive:   now,
+		gatherNotify: make(chan struct{}),
+	}
+
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if c == nil {
+			if !s.gatherDone {
+				s.gatherDone = true
+				close(s.gatherNotify)
+			}
+			return
+		}
+		s.candidates = append(s.candidates, c.ToJSON().Candidate)
+	})
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Debugf("[%s] webrtc %s session state: %s", s.ID, s.Kind, state)
+		s.lock.Lock()
+		s.lastActive = time.Now()
+		s.connected = state == webrtc.PeerConnectionStateConnected
+		if s.connected {
+			s.established = true
+		}
+		established := s.established
+		s.lock.Unlock()
+
+		switch state {
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			// 연결된 적 없이 실패했으면 ICE/DTLS 핸드셰이크 실패로 센다.
+			if state == webrtc.PeerConnectionStateFailed && !established {
+				key := ""
+				if s.stream != nil {
+					key = s.stream.Info().Key
+				}
+				metrics.Add(metrics.HandshakeFailures, key, event.ProtocolWebRTC, 1)
+			}
+			s.Close(fmt.Errorf("peer connection %s", state))
+		}
+	})
+	s.handleDataChannel()
+
+	return s
+}
+
+// offer 를 적용하고 answer SDP 를 돌려준다.
+// 후보 수집이 끝나거나 answerGatherTimeout 이 지나면 그때까지 모인 후보를 포함해 응답하고, 이후의 후보는 PATCH 로 보낸다.
+func (s *Session) negotiate(offer string) (string, error) {
+	if err := s.pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offer,
+	}); err != nil {
+		return "", err
+	}
+
+	answer, err := s.pc.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+	if err := s.pc.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+
+	select {
+	case <-s.gatherNotify:
+	case <-time.After(answerGatherTimeout):
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	local := s.pc.LocalDescription().SDP
+	// 이미 answer 에 담긴 후보는 다시 보내지 않는다.
+	s.candidates = nil
+	s.gatherSent = s.gatherDone
+	s.remoteUfrag = sdpAttribute(offer, "ice-ufrag")
+	s.localUfrag = sdpAttribute(local, "ice-ufrag")
+	s.localPwd = sdpAttribute(local, "ice-pwd")
+	s.localMLine = sdpLine(local, "m=")
+	s.localMid = sdpAttribute(local, "mid")
+	return local, nil
+}
+
+// PATCH 로 받은 SDP 조각의 원격 후보를 추가하고, 그동안 수집된 로컬 후보를 SDP 조각으로 돌려준다.
+// 돌려줄 후보가 없으면 빈 문자열을 돌려준다.
+func (s *Session) trickle(frag string) (string, error) {
+	mid := ""
+	for _, line := range strings.Split(frag, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			s.lock.Lock()
+			restart := strings.TrimPrefix(line, "a=ice-ufrag:") != s.remoteUfrag
+			s.lock.Unlock()
+			if restart {
+				return "", ErrICERestart
+			}
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = strings.TrimPrefix(line, "a=mid:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidate := webrtc.ICECandidateInit{Candidate: strings.TrimPrefix(line, "a=")}
+			if mid != "" {
+				m := mid
+				candidate.SDPMid = &m
+			}
+			if err := s.pc.AddICECandidate(candidate); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lastActive = time.Now()
+	endOfCandidates := s.gatherDone && !s.gatherSent
+	if len(s.candidates) == 0 && !endOfCandidates {
+		return "", nil
+	}
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "a=ice-ufrag:%s\r\n", s.localUfrag)
+	fmt.Fprintf(b, "a=ice-pwd:%s\r\n", s.localPwd)
+	// 번들로 묶여 있으므로 첫 번째 미디어 섹션에만 후보를 싣는다.
+	fmt.Fprintf(b, "%s\r\n", s.localMLine)
+	fmt.Fprintf(b, "a=mid:%s\r\n", s.localMid)
+	for _, c := range s.candidates {
+		fmt.Fprintf(b, "a=%s\r\n", c)
+	}
+	if endOfCandidates {
+		b.WriteString("a=end-of-candidates\r\n")
+		s.gatherSent = true
+	}
+	s.candidates = nil
+	return b.String(), nil
+}
+
+// 세션을 닫는다. 여러 번 호출해도 안전하다.
+func (s *Session) Close(err error) {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return
+	}
+	s.closed = true
+	dc := s.dataChannel
+	s.lock.Unlock()
+
+	log.Debugf("[%s] webrtc %s session closed: %v", s.ID, s.Kind, err)
+	s.server.sessions.Delete(s.ID)
+	if s.stream != nil {
+		if dc != nil {
+			s.server.leaveRoom(s.stream.Info().Key, s.ID, dc)
+		}
+		s.stream.Close(err)
+	}
+	s.pc.Close()
+}
+
+// 연결되지 않은 상태로 timeout 이상 지났는지 확인한다.
+func (s *Session) idle(timeout time.Duration) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return !s.connected && time.Now().Sub(s.lastActive) >= timeout
+}
+
+func (s *Session) Info() SessionInfo {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ret := SessionInfo{
+		ID:         s.ID,
+		Kind:       s.Kind,
+		State:      s.pc.ConnectionState().String(),
+		ICEState:   s.pc.ICEConnectionState().String(),
+		CreatedAt:  s.createdAt,
+		LastActive: s.lastActive,
+	}
+	if s.stream != nil {
+		info := s.stream.Info()
+		ret.Key = info.Key
+		ret.URL = info.URL
+	}
+	return ret
+}
+
+// SDP 에서 처음 나오는 a=<name>:<value> 속성값을 찾는다.
+func sdpAttribute(sdp, name string) string {
+	prefix := "a=" + name + ":"
+	return strings.TrimPrefix(sdpLine(sdp, prefix), prefix)
+}
+
+// SDP 에서 prefix 로 시작하는 첫 번째 줄을 찾는다.
+func sdpLine(sdp, prefix string) string {
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, prefix) {
+			return line
+		}
+	}
+	return ""
+}
+
+func (server *Server) addSession(s *Session) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// 응답을 보내기 전에 이미 연결이 실패한 세션은 등록하지 않는다.
+	if !s.closed {
+		server.sessions.Store(s.ID, s)
+	}
+}
+
+func (server *Server) getSession(id string) (*Session, error) {
+	v, ok := server.sessions.Load(id)
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return v.(*Session), nil
+}
+
+// 현재 살아있는 세션 목록을 돌려준다. API 서버의 /stat/webrtc 에서 사용한다.
+func (server *Server) Sessions() []SessionInfo {
+	ret := []SessionInfo{}
+	server.sessions.Range(func(key, val interface{}) bool {
+		ret = append(ret, val.(*Session).Info())
+		return true
+	})
+	return ret
+}
+
+// 연결이 맺어지지 않거나 끊긴 채로 방치된 세션을 주기적으로 정리한다.
+func (server *Server) reapSessions() {
+	timeout := time.Duration(configure.Config.GetInt("webrtc_session_timeout")) * time.Second
+	if timeout <= 0 {
+		timeout = defaultSessionTimeout
+	}
+
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		server.sessions.Range(func(key, val interface{}) bool {
+			if s := val.(*Session); s.idle(timeout) {
+				s.Close(fmt.Errorf("idle timeout"))
+			}
+			return true
+		})
+	}
+}
+
+// /session/<id> 리소스에 대한 PATCH(트리클 ICE), DELETE(종료) 요청을 처리한다.
+func (server *Server) handleSession(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "PATCH, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	s, err := server.getSession(strings.TrimPrefix(r.URL.Path, sessionPrefix))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPatch:
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), sdpFragContentType) {
+			http.Error(w, "content type must be "+sdpFragContentType, http.StatusUnsupportedMediaType)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		frag, err := s.trickle(string(body))
+		if err == ErrICERestart {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if frag == "" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", sdpFragContentType)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(frag))
+	case http.MethodDelete:
+		s.Close(fmt.Errorf("deleted by client"))
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
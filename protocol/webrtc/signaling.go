@@ -4,16 +4,18 @@ import (
 	"encoding/json"
 	"net/http"
 
-	"github.com/pion/webrtc/v3"
+	"github.com/gwuhaolin/livego/utils/uid"
 )
 
 type SignalMessage struct {
 	Type string `json:"type"`
 	SDP  string `json:"sdp"`
+	ID   string `json:"id,omitempty"` // answer 에 담아 보내는 세션 ID. /session/<id> 로 트리클 ICE 와 종료를 요청한다.
 }
 
 // 시그널링을 수행한다. WEBRTC 연결을 위한 SDP/ICE candidate 교환 과정이다.
-func handleSignaling(w http.ResponseWriter, r *http.Request, peerConnection *webrtc.PeerConnection) {
+// 만들어진 PeerConnection 은 세션으로 등록되어, 연결이 끊기거나 방치되면 정리된다.
+func (server *Server) handleSignaling(w http.ResponseWriter, r *http.Request) {
 	var msg SignalMessage
 	// 요청이 들어옴.
 	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
@@ -23,32 +25,31 @@ func handleSignaling(w http.ResponseWriter, r *http.Request, peerConnection *web
 
 	switch msg.Type {
 	case "offer":
-		if err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{
-			// 서버는 클라이언트가 어떤 코덱을 지원하는지, 어떤 ICE 후보를 사용할지 등의 정보가 담긴 offer 를 받는다.
-			Type: webrtc.SDPTypeOffer, // SDP 메시지 유형
-			SDP:  msg.SDP,             // 코덱, ICE후보 연결 정보등의 실제 세션 정보
-		}); err != nil {
-			http.Error(w, "Failed to set remote description", http.StatusInternalServerError)
+		// 설정된 ICE 서버로 peer Connection 객체 생성한다.
+		peerConnection, err := server.newPeerConnection()
+		if err != nil {
+			http.Error(w, "Failed to create peer connection", http.StatusInternalServerError)
 			return
 		}
 
-		// offer 를 기반으로 응답을 생성한다.
-		answer, err := peerConnection.CreateAnswer(nil) // 서버가 지원하는 코덱, ICE 후보등의 답변을 생성한다.
+		// 서버는 클라이언트가 어떤 코덱을 지원하는지, 어떤 ICE 후보를 사용할지 등의 정보가 담긴 offer 를 받고,
+		// 서버가 지원하는 코덱, ICE 후보등의 답변을 생성해 자신의 WEBRTC 연결을 설정한다.
+		session := newSession(server, sessionKindSignal, uid.NewId(), peerConnection, nil)
+		answer, err := session.negotiate(msg.SDP)
 		if err != nil {
-			http.Error(w, "Failed to create answer", http.StatusInternalServerError)
+			session.Close(err)
+			http.Error(w, "Failed to negotiate: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		server.addSession(session)
 
-		// 응답을 기준으로 자신의 WEBRTC 연결을 설정한다.
-		if err := peerConnection.SetLocalDescription(answer); err != nil {
-			http.Error(w, "Failed to set local description", http.StatusInternalServerError)
-			return
-		}
 		// 응답을 기준으로 리스폰스를 생성한다.
 		resp := SignalMessage{
 			Type: "answer",
-			SDP:  answer.SDP,
+			SDP:  answer,
+			ID:   session.ID,
 		}
+		w.Header().Set("Location", sessionPrefix+session.ID)
 		json.NewEncoder(w).Encode(resp)
 
 	default:
@@ -0,0 +1,123 @@
+package webrtc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/protocol/auth"
+	"github.com/gwuhaolin/livego/protocol/event"
+	"github.com/gwuhaolin/livego/protocol/rtmp"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	whepPrefix = "/whep/"
+)
+
+var (
+	ErrInvalidWHEPPath = fmt.Errorf("url: /whep/<APP>/<NAME>")
+)
+
+// WHEP(WebRTC-HTTP Egress Protocol) 요청을 처리한다.
+// 시청자가 보낸 recvonly offer 에 H.264 송신 트랙을 붙인 answer 를 돌려주고,
+// RtmpStream 에 Writer 를 등록해 RTMP/WHIP 로 들어온 스트림을 WebRTC 로 내보낸다.
+type whepHandler struct {
+	server *Server
+}
+
+func (h *whepHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	w.Header().Set("Access-Control-Expose-Headers", "Location")
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPost:
+		h.play(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *whepHandler) play(w http.ResponseWriter, r *http.Request) {
+	paths := strings.SplitN(strings.TrimPrefix(r.URL.Path, whepPrefix), "/", 2)
+	if len(paths) != 2 || paths[0] == "" || paths[1] == "" {
+		http.Error(w, ErrInvalidWHEPPath.Error(), http.StatusBadRequest)
+		return
+	}
+	app, title := paths[0], paths[1]
+
+	if ret := configure.CheckAppName(app); !ret {
+		log.Error("CheckAppName err: ", fmt.Errorf("application name=%s is not configured", app))
+		http.Error(w, "application not found", http.StatusNotFound)
+		return
+	}
+
+	if err := auth.CheckPlayRequest(r, app+"/"+title); err != nil {
+		log.Error("CheckPlay err: ", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	offer, err := ioutil.ReadAll(r.Body)
+	if err != nil || len(offer) == 0 {
+		http.Error(w, "invalid sdp offer", http.StatusBadRequest)
+		return
+	}
+
+	pc, err := h.server.newPeerConnection()
+	if err != nil {
+		http.Error(w, "Failed to create peer connection", http.StatusInternalServerError)
+		return
+	}
+
+	videoTrack, videoSender, err := AddTrack(pc, "video", "video", app+"-"+title)
+	if err != nil {
+		pc.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// RTMP 퍼블리셔의 AAC 는 Opus 로 변환해 이 트랙으로 보낸다.
+	audioTrack, _, err := AddTrack(pc, "audio", "audio", app+"-"+title)
+	if err != nil {
+		pc.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	url := fmt.Sprintf("http://%s%s%s/%s", r.Host, whepPrefix, app, title)
+	// 키프레임 요청에 캐시된 GOP 로 답하거나 WHIP 퍼블리셔에게 전달하기 위해 스트림을 넘긴다.
+	source, _ := h.server.handler.(*rtmp.RtmpStream)
+	writer := NewWriter(app, title, url, pc, videoTrack, audioTrack, videoSender, source)
+
+	session := newSession(h.server, sessionKindWHEP, writer.Uid, pc, writer)
+	answer, err := session.negotiate(string(offer))
+	if err != nil {
+		session.Close(err)
+		log.Error("whep negotiate err: ", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.server.addSession(session)
+
+	e := event.New(event.PlayerJoin, app+"/"+title, writer.Uid)
+	e.Protocol, e.ClientIP = event.ProtocolWebRTC, r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		e.ClientIP = host
+	}
+	event.Open(e)
+	log.Debugf("new webrtc player: %+v", writer.Info())
+	h.server.handler.HandleWriter(writer)
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", sessionPrefix+session.ID)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(answer))
+}
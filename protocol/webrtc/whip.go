@@ -0,0 +1,137 @@
+package webrtc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/container/flv"
+
+	"github.com/pion/webrtc/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	whipPrefix = "/whip/"
+)
+
+var (
+	ErrInvalidWHIPPath = fmt.Errorf("url: /whip/<APP>/<KEY>")
+)
+
+// WHIP(WebRTC-HTTP Ingestion Protocol) 요청을 처리한다.
+// 브라우저는 SDP offer 를 POST 로 보내고, 서버는 SDP answer 를 201 응답 본문으로 돌려준다.
+// 스트림 키 인증은 rtmp.Server.handleConn 과 동일하게 configure.RoomKeys 를 이용한다.
+type whipHandler struct {
+	server *Server
+}
+
+func (h *whipHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	w.Header().Set("Access-Control-Expose-Headers", "Location")
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPost:
+		h.publish(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// 요청 경로와 Authorization 헤더에서 앱 이름과 스트림 키를 꺼낸다.
+// /whip/<app>/<key> 또는 /whip/<app> + "Authorization: Bearer <key>" 두 가지 형태를 지원한다.
+func parseWHIPPath(r *http.Request) (app, key string, err error) {
+	paths := strings.SplitN(strings.TrimPrefix(r.URL.Path, whipPrefix), "/", 2)
+	app = paths[0]
+	if len(paths) == 2 {
+		key = paths[1]
+	}
+	if key == "" {
+		key = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if app == "" || key == "" {
+		err = ErrInvalidWHIPPath
+	}
+	return
+}
+
+func (h *whipHandler) publish(w http.ResponseWriter, r *http.Request) {
+	app, name, err := parseWHIPPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if ret := configure.CheckAppName(app); !ret {
+		log.Error("CheckAppName err: ", fmt.Errorf("application name=%s is not configured", app))
+		http.Error(w, "application not found", http.StatusNotFound)
+		return
+	}
+
+	if configure.Config.GetBool("rtmp_noauth") {
+		key, err := configure.RoomKeys.GetKey(name)
+		if err != nil {
+			log.Error("GetKey err: ", err)
+			http.Error(w, "cannot create key", http.StatusInternalServerError)
+			return
+		}
+		name = key
+	}
+	channel, err := configure.RoomKeys.GetChannel(name)
+	if err != nil {
+		log.Error("CheckKey err: ", err)
+		http.Error(w, "invalid key", http.StatusForbidden)
+		return
+	}
+
+	offer, err := ioutil.ReadAll(r.Body)
+	if err != nil || len(offer) == 0 {
+		http.Error(w, "invalid sdp offer", http.StatusBadRequest)
+		return
+	}
+
+	pc, err := h.server.newPeerConnection()
+	if err != nil {
+		http.Error(w, "Failed to create peer connection", http.StatusInternalServerError)
+		return
+	}
+
+	url := fmt.Sprintf("http://%s%s%s/%s", r.Host, whipPrefix, app, channel)
+	reader := NewReader(app, channel, url, pc)
+
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		go HandleTrack(track, receiver, pc, reader)
+	})
+	session := newSession(h.server, sessionKindWHIP, reader.Uid, pc, reader)
+	answer, err := session.negotiate(string(offer))
+	if err != nil {
+		session.Close(err)
+		log.Error("whip negotiate err: ", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.server.addSession(session)
+
+	h.server.handler.HandleReader(reader)
+	log.Debugf("new webrtc publisher: %+v", reader.Info())
+
+	for _, getter := range h.server.getters {
+		writer := getter.GetWriter(reader.Info())
+		h.server.handler.HandleWriter(writer)
+	}
+	if configure.Config.GetBool("flv_archive") {
+		flvWriter := new(flv.FlvDvr)
+		h.server.handler.HandleWriter(flvWriter.GetWriter(reader.Info()))
+	}
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", sessionPrefix+session.ID)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(answer))
+}
@@ -0,0 +1,538 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/protocol/event"
+	"github.com/gwuhaolin/livego/protocol/metrics"
+	"github.com/gwuhaolin/livego/protocol/rtmp"
+	"github.com/gwuhaolin/livego/utils/uid"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// RTP 패킷 하나에 담을 최대 페이로드 크기. 일반적인 MTU(1500) 에서 IP/UDP/SRTP 헤더를 뺀 여유값이다.
+	rtpMTU = 1200
+
+	// NACK 재전송을 위해 시청자별로 보관하는 최근 RTP 패킷 수
+	rtpHistorySize = 1024
+	// 캐시된 GOP 재전송은 대역폭을 많이 쓰므로 이 간격 안의 키프레임 요청은 한 번만 처리한다.
+	replayMinInterval = time.Second
+)
+
+var annexBStartCode = []byte{0x00, 0x00, 0x00, 0x01}
+
+// WHEP 시청자에게 RtmpStream 의 패킷을 RTP 로 내보내는 av.WriteCloser 구현체이다.
+// RTMP 플레이어의 VirWriter 와 같은 위치에 놓이며, GOP 캐시부터 시작하는 FLV 태그를 받아
+// AVCC 형태의 H.264 를 Annex B 로 바꾼 뒤 RTP 로 패킷화한다.
+type Writer struct {
+	Uid string
+	av.RWBaser
+	app, title, url string
+	pc              *webrtc.PeerConnection
+	videoTrack      *webrtc.TrackLocalStaticRTP
+	audio           *opusBridge // 스트림의 시청자들이 함께 쓰는 오디오 변환. 오디오 트랙이 없으면 nil 이다.
+	packetQueue     chan *av.Packet
+	closed          int32 // 1 이면 닫힘. atomic 으로 다룬다.
+	closeOnce       sync.Once
+	WriteBWInfo     rtmp.StaticsBW
+	egress          *metrics.Counter
+	source          *rtmp.RtmpStream // 키프레임 요청을 처리할 스트림. nil 이면 키프레임 요청을 무시한다.
+	sender          *webrtc.RTPSender
+	keyFrameChan    chan struct{}
+
+	payloader   codecs.H264Payloader
+	sequence    uint16
+	tsOffset    uint32 // RTP 타임스탬프의 시작값. RFC 3550 권고에 따라 임의의 값에서 시작한다.
+	naluLenSize int    // AVCDecoderConfigurationRecord 의 lengthSizeMinusOne + 1
+	sps, pps    [][]byte
+	gotKey      bool
+	keyLost     int32 // DropPacket 이 프레임을 버리면 1. SendPacket 이 읽고 gotKey 를 되돌린다.
+
+	lastRtpTs     uint32
+	lastReplay    time.Time
+	replaying     bool
+	replayedUntil uint32 // 재전송한 GOP 의 마지막 타임스탬프. 큐에 남아 있던 그 이전 프레임은 건너뛴다.
+
+	historyLock sync.Mutex
+	history     [rtpHistorySize]*rtp.Packet
+
+	dataLock    sync.Mutex
+	dataChannel *webrtc.DataChannel // 타임드 메타데이터를 보낼 데이터 채널. 시청자가 열지 않았으면 nil 이다.
+}
+
+func NewWriter(app, title, url string, pc *webrtc.PeerConnection, videoTrack, audioTrack *webrtc.TrackLocalStaticRTP, sender *webrtc.RTPSender, source *rtmp.RtmpStream) *Writer {
+	ret := &Writer{
+		Uid:          uid.NewId(),
+		app:          app,
+		title:        title,
+		url:          url,
+		pc:           pc,
+		videoTrack:   videoTrack,
+		sender:       sender,
+		source:       source,
+		keyFrameChan: make(chan struct{}, 1),
+		RWBaser:      av.NewRWBaser(time.Second * 10),
+		packetQueue:  make(chan *av.Packet, maxQueueNum),
+		WriteBWInfo:  rtmp.StaticsBW{},
+		egress:       metrics.GetCounter(metrics.EgressBytes, app+"/"+title, event.ProtocolWebRTC),
+		sequence:     uint16(rand.Uint32()),
+		tsOffset:     rand.Uint32(),
+		naluLenSize:  4,
+	}
+
+	if audioTrack != nil {
+		ret.audio = attachOpusBridge(ret, audioTrack)
+	}
+
+	go ret.readRTCP()
+	go func() {
+		err := ret.SendPacket()
+		if err != nil {
+			log.Debug("webrtc SendPacket error: ", err)
+			ret.Close(err)
+		}
+	}()
+	return ret
+}
+
+// 시청자가 보낸 RTCP 를 읽어 PLI/FIR 에는 키프레임을, NACK 에는 보관된 RTP 패킷을 다시 보낸다.
+func (w *Writer) readRTCP() {
+	if w.sender == nil {
+		return
+	}
+	for {
+		packets, _, err := w.sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, packet := range packets {
+			switch pkt := packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				w.requestKeyFrame()
+			case *rtcp.TransportLayerNack:
+				for _, pair := range pkt.Nacks {
+					for _, seq := range pair.PacketList() {
+						w.retransmit(seq)
+					}
+				}
+			}
+		}
+	}
+}
+
+// 퍼블리셔가 WHIP 이면 PLI 를 퍼블리셔에게 전달하고, 그 외(RTMP 등)에는 캐시된 GOP 를 이 시청자에게 다시 보낸다.
+func (w *Writer) requestKeyFrame() {
+	if w.source == nil {
+		return
+	}
+	if v, ok := w.source.GetStreams().Load(w.Info().Key); ok {
+		if reader, ok := v.(*rtmp.Stream).GetReader().(*Reader); ok {
+			reader.RequestKeyFrame()
+			return
+		}
+	}
+	select {
+	case w.keyFrameChan <- struct{}{}:
+	default:
+	}
+}
+
+func (w *Writer) retransmit(seq uint16) {
+	w.historyLock.Lock()
+	packet := w.history[seq%rtpHistorySize]
+	w.historyLock.Unlock()
+	if packet == nil || packet.SequenceNumber != seq {
+		return
+	}
+	if err := w.videoTrack.WriteRTP(packet); err != nil {
+		log.Debugf("[%v] retransmit error: %v", w.Info(), err)
+	}
+}
+
+func (w *Writer) SaveStatics(streamid uint32, length uint64, isVideoFlag bool) {
+	nowInMS := int64(time.Now().UnixNano() / 1e6)
+
+	w.WriteBWInfo.StreamId = streamid
+	w.egress.Add(length)
+	if isVideoFlag {
+		w.WriteBWInfo.VideoDatainBytes = w.WriteBWInfo.VideoDatainBytes + length
+	} else {
+		w.WriteBWInfo.AudioDatainBytes = w.WriteBWInfo.AudioDatainBytes + length
+	}
+
+	if w.WriteBWInfo.LastTimestamp == 0 {
+		w.WriteBWInfo.LastTimestamp = nowInMS
+	} else if (nowInMS - w.WriteBWInfo.LastTimestamp) >= rtmp.SAVE_STATICS_INTERVAL {
+		diffTimestamp := (nowInMS - w.WriteBWInfo.LastTimestamp) / 1000
+
+		w.WriteBWInfo.VideoSpeedInBytesperMS = (w.WriteBWInfo.VideoDatainBytes - w.WriteBWInfo.LastVideoDatainBytes) * 8 / uint64(diffTimestamp) / 1000
+		w.WriteBWInfo.AudioSpeedInBytesperMS = (w.WriteBWInfo.AudioDatainBytes - w.WriteBWInfo.LastAudioDatainBytes) * 8 / uint64(diffTimestamp) / 1000
+
+		w.WriteBWInfo.LastVideoDatainBytes = w.WriteBWInfo.VideoDatainBytes
+		w.WriteBWInfo.LastAudioDatainBytes = w.WriteBWInfo.AudioDatainBytes
+		w.WriteBWInfo.LastTimestamp = nowInMS
+	}
+}
+
+func (w *Writer) DropPacket(pktQue chan *av.Packet, info av.Info) {
+	log.Warningf("[%v] packet queue max!!!", info)
+	e := event.New(event.PacketDrop, info.Key, info.UID)
+	e.Protocol = event.ProtocolWebRTC
+	event.Publish(e)
+	queued := len(pktQue)
+	for i := 0; i < maxQueueNum-84; i++ {
+		tmpPkt, ok := <-pktQue
+		if ok && tmpPkt.IsVideo {
+			videoPkt, ok := tmpPkt.Header.(av.VideoPacketHeader)
+			// dont't drop sps config and dont't drop key frame
+			if ok && (videoPkt.IsSeq() || videoPkt.IsKeyFrame()) {
+				pktQue <- tmpPkt
+			}
+			if len(pktQue) > maxQueueNum-10 {
+				<-pktQue
+			}
+		}
+	}
+	// 큐에서 줄어든 패킷과 큐에 넣지 못한 새 패킷
+	metrics.Add(metrics.DroppedPackets, info.Key, event.ProtocolWebRTC, uint64(queued-len(pktQue)+1))
+	// 중간 프레임이 빠졌으므로 다음 키프레임부터 다시 보낸다. gotKey 는 SendPacket 고루틴만 건드린다.
+	atomic.StoreInt32(&w.keyLost, 1)
+	log.Debug("packet queue len: ", len(pktQue))
+}
+
+func (w *Writer) Write(p *av.Packet) (err error) {
+	err = nil
+	if atomic.LoadInt32(&w.closed) == 1 {
+		err = fmt.Errorf("webrtc writer closed")
+		return
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("webrtc writer has already been closed:%v", e)
+		}
+	}()
+
+	if len(w.packetQueue) >= maxQueueNum-24 {
+		w.DropPacket(w.packetQueue, w.Info())
+	} else {
+		w.packetQueue <- p
+	}
+
+	return
+}
+
+func (w *Writer) SendPacket() error {
+	for {
+		var p *av.Packet
+		var ok bool
+		select {
+		case p, ok = <-w.packetQueue:
+		case <-w.keyFrameChan:
+			if err := w.replayGop(); err != nil {
+				return err
+			}
+			continue
+		}
+		if !ok {
+			return fmt.Errorf("closed")
+		}
+		if atomic.CompareAndSwapInt32(&w.keyLost, 1, 0) {
+			w.gotKey = false
+		}
+		w.SetPreTime()
+
+		timestamp := p.TimeStamp + w.BaseTimeStamp()
+		if p.IsVideo {
+			w.RecTimeStamp(timestamp, av.TAG_VIDEO)
+		} else if p.IsAudio {
+			w.RecTimeStamp(timestamp, av.TAG_AUDIO)
+		}
+
+		if p.IsMetadata {
+			w.writeMetadata(p, timestamp)
+			continue
+		}
+		if p.IsAudio && w.audio != nil {
+			w.audio.write(w, p, timestamp)
+			w.SaveStatics(p.StreamID, uint64(len(p.Data)), p.IsVideo)
+			continue
+		}
+		if !p.IsVideo {
+			continue
+		}
+		if w.replaying {
+			if p.TimeStamp <= w.replayedUntil {
+				continue
+			}
+			w.replaying = false
+		}
+		if err := w.writeVideo(p, timestamp); err != nil {
+			return err
+		}
+		w.SaveStatics(p.StreamID, uint64(len(p.Data)), p.IsVideo)
+	}
+}
+
+func (w *Writer) setDataChannel(dc *webrtc.DataChannel) {
+	w.dataLock.Lock()
+	defer w.dataLock.Unlock()
+	w.dataChannel = dc
+}
+
+// 퍼블리셔가 보낸 onTextData/onCuePoint 를 데이터 채널로 보낸다.
+// 미디어 패킷과 같은 큐를 거치므로 앞선 프레임을 보낸 뒤에 전달되고, 미디어 타임스탬프를 함께 실어 화면과 맞출 수 있게 한다.
+func (w *Writer) writeMetadata(p *av.Packet, timestamp uint32) {
+	w.dataLock.Lock()
+	dc := w.dataChannel
+	w.dataLock.Unlock()
+	if dc == nil {
+		return
+	}
+
+	event, data, ok := decodeTimedMetadata(p.Data)
+	if !ok {
+		return
+	}
+	b, err := json.Marshal(DataMessage{
+		Type:      dataMessageMetadata,
+		Event:     event,
+		Data:      data,
+		Timestamp: timestamp,
+		Time:      time.Now().UnixNano() / 1e6,
+	})
+	if err != nil {
+		log.Debugf("[%v] marshal %s error: %v", w.Info(), event, err)
+		return
+	}
+	if err := dc.SendText(string(b)); err != nil {
+		log.Debugf("[%v] send %s error: %v", w.Info(), event, err)
+	}
+}
+
+// FLV 비디오 태그 하나를 RTP 패킷들로 나눠 트랙에 쓴다.
+// 패킷은 여러 writer 가 공유하므로 p.Data 는 읽기만 한다.
+func (w *Writer) writeVideo(p *av.Packet, timestamp uint32) error {
+	videoPkt, data, ok := h264Payload(p)
+	if !ok {
+		return nil
+	}
+	if videoPkt.IsSeq() {
+		w.parseSequenceHeader(data)
+		return nil
+	}
+	if !w.gotKey {
+		if !videoPkt.IsKeyFrame() || w.sps == nil {
+			return nil
+		}
+		w.gotKey = true
+	}
+
+	// WebRTC 의 RTP 타임스탬프는 표시 시점(PTS) 기준이므로 컴포지션 타임을 더한다.
+	pts := int64(timestamp) + int64(videoPkt.CompositionTime())
+	return w.writeFrame(w.annexB(data, videoPkt.IsKeyFrame()), w.tsOffset+uint32(pts)*h264ClockRate)
+}
+
+// H.264 비디오 태그에서 헤더와 코덱 데이터를 꺼낸다.
+// Enhanced RTMP 의 'avc1' 태그도 처리하며, 시퀀스 종료와 메타데이터처럼 프레임이 아닌 태그는 건너뛴다.
+func h264Payload(p *av.Packet) (av.VideoPacketHeader, []byte, bool) {
+	videoPkt, ok := p.Header.(av.VideoPacketHeader)
+	if !p.IsVideo || !ok || videoPkt.CodecID() != av.VIDEO_H264 || len(p.Data) <= videoPkt.HeaderLen() {
+		return nil, nil, false
+	}
+	if videoPkt.IsSeqEnd() || (videoPkt.IsExHeader() && videoPkt.PacketType() == av.PKTTYPE_METADATA) {
+		return nil, nil, false
+	}
+	return videoPkt, p.Data[videoPkt.HeaderLen():], true
+}
+
+// 캐시된 시퀀스 헤더와 최근 GOP 를 이 시청자에게 곧바로 다시 보낸다.
+// 이미 보낸 프레임보다 타임스탬프가 뒤로 가지 않도록, 재전송 프레임에는 마지막 RTP 타임스탬프에서 1 씩 증가한 값을 쓴다.
+func (w *Writer) replayGop() error {
+	if time.Since(w.lastReplay) < replayMinInterval {
+		return nil
+	}
+	v, ok := w.source.GetStreams().Load(w.Info().Key)
+	if !ok {
+		return nil
+	}
+	packets := v.(*rtmp.Stream).GetCache().KeyFrameSnapshot()
+	w.lastReplay = time.Now()
+
+	rtpTs := w.lastRtpTs
+	for _, p := range packets {
+		videoPkt, data, ok := h264Payload(p)
+		if !ok {
+			continue
+		}
+		if videoPkt.IsSeq() {
+			w.parseSequenceHeader(data)
+			continue
+		}
+		if !w.gotKey {
+			if !videoPkt.IsKeyFrame() || w.sps == nil {
+				continue
+			}
+			w.gotKey = true
+		}
+		rtpTs++
+		if err := w.writeFrame(w.annexB(data, videoPkt.IsKeyFrame()), rtpTs); err != nil {
+			return err
+		}
+		w.replaying = true
+		w.replayedUntil = p.TimeStamp
+	}
+	return nil
+}
+
+// Annex B 프레임 하나를 RTP 패킷으로 나눠 보내고, NACK 재전송을 위해 보관한다.
+func (w *Writer) writeFrame(frame []byte, rtpTs uint32) error {
+	if len(frame) == 0 {
+		return nil
+	}
+
+	payloads := w.payloader.Payload(rtpMTU, frame)
+	for i, payload := range payloads {
+		packet := &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         i == len(payloads)-1,
+				SequenceNumber: w.sequence,
+				Timestamp:      rtpTs,
+			},
+			Payload: payload,
+		}
+		w.sequence++
+
+		w.historyLock.Lock()
+		w.history[packet.SequenceNumber%rtpHistorySize] = packet
+		w.historyLock.Unlock()
+
+		if err := w.videoTrack.WriteRTP(packet); err != nil {
+			return err
+		}
+	}
+	w.lastRtpTs = rtpTs
+	return nil
+}
+
+// AVCDecoderConfigurationRecord 에서 NALU 길이 필드 크기와 SPS/PPS 목록을 꺼낸다.
+func (w *Writer) parseSequenceHeader(b []byte) {
+	if len(b) < 6 {
+		return
+	}
+	naluLenSize := int(b[4]&0x03) + 1
+	var sps, pps [][]byte
+
+	numSps := int(b[5] & 0x1f)
+	b = b[6:]
+	for i := 0; i < numSps; i++ {
+		if len(b) < 2 {
+			return
+		}
+		size := int(b[0])<<8 | int(b[1])
+		if len(b) < 2+size {
+			return
+		}
+		sps = append(sps, b[2:2+size])
+		b = b[2+size:]
+	}
+
+	if len(b) < 1 {
+		return
+	}
+	numPps := int(b[0])
+	b = b[1:]
+	for i := 0; i < numPps; i++ {
+		if len(b) < 2 {
+			return
+		}
+		size := int(b[0])<<8 | int(b[1])
+		if len(b) < 2+size {
+			return
+		}
+		pps = append(pps, b[2:2+size])
+		b = b[2+size:]
+	}
+
+	w.naluLenSize = naluLenSize
+	w.sps, w.pps = sps, pps
+	// 시퀀스 헤더가 바뀌면 새 SPS/PPS 로 시작하는 키프레임부터 다시 보낸다.
+	w.gotKey = false
+}
+
+// 길이 프리픽스 NALU 들을 Annex B 바이트 스트림으로 바꾼다.
+// IDR 프레임 앞에는 항상 SPS/PPS 를 붙여, 중간에 들어온 시청자나 패킷을 잃은 시청자도 디코딩을 시작할 수 있게 한다.
+func (w *Writer) annexB(b []byte, keyFrame bool) []byte {
+	var out []byte
+	if keyFrame {
+		for _, sps := range w.sps {
+			out = append(out, annexBStartCode...)
+			out = append(out, sps...)
+		}
+		for _, pps := range w.pps {
+			out = append(out, annexBStartCode...)
+			out = append(out, pps...)
+		}
+	}
+
+	for len(b) > w.naluLenSize {
+		size := 0
+		for i := 0; i < w.naluLenSize; i++ {
+			size = size<<8 | int(b[i])
+		}
+		b = b[w.naluLenSize:]
+		if size <= 0 || size > len(b) {
+			break
+		}
+		switch b[0] & 0x1f {
+		case naluTypeSPS, naluTypePPS:
+			// 시퀀스 헤더의 SPS/PPS 를 이미 붙였으므로 키프레임 안의 것은 건너뛴다.
+			if !keyFrame {
+				out = append(out, annexBStartCode...)
+				out = append(out, b[:size]...)
+			}
+		default:
+			out = append(out, annexBStartCode...)
+			out = append(out, b[:size]...)
+		}
+		b = b[size:]
+	}
+	return out
+}
+
+func (w *Writer) Info() (ret av.Info) {
+	ret.UID = w.Uid
+	ret.URL = w.url
+	ret.Key = w.app + "/" + w.title
+	ret.Inter = true
+	return
+}
+
+// 전송 오류, 세션 정리, 스트림 정리에서 함께 불러도 한 번만 닫는다.
+func (w *Writer) Close(err error) {
+	w.closeOnce.Do(func() {
+		log.Debug("webrtc player ", w.Info(), " closed: ", err)
+		atomic.StoreInt32(&w.closed, 1)
+		close(w.packetQueue)
+		event.Close(w.Uid)
+		if w.audio != nil {
+			w.audio.detach(w)
+		}
+		if w.pc != nil {
+			w.pc.Close()
+		}
+	})
+}
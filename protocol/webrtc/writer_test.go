@@ -0,0 +1,25 @@
+package webrtc
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/gwuhaolin/livego/av"
+)
+
+func TestWriterCloseOnce(t *testing.T) {
+	w := NewWriter("live", "test", "", nil, nil, nil, nil, nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w.Close(fmt.Errorf("close %d", i))
+		}(i)
+	}
+	wg.Wait()
+	if err := w.Write(&av.Packet{IsVideo: true}); err == nil {
+		t.Fatal("Write after close succeeded")
+	}
+}
@@ -0,0 +1,208 @@
+package transcode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+/*
+외부 인코더와 Opus 를 주고받기 위한 최소한의 Ogg 컨테이너(RFC 3533, RFC 7845) 구현이다.
+ffmpeg 는 날(raw) Opus 패킷 스트림을 읽고 쓸 수 없기 때문에 Ogg 페이지로 감싸서 주고받는다.
+*/
+
+const (
+	oggPageHeaderLen = 27
+	oggMaxSegment    = 255
+
+	oggHeaderTypeBOS = 0x02 // 스트림의 첫 페이지
+
+	oggSerial = 0x6c697665 // "live"
+)
+
+var (
+	oggCapturePattern = []byte("OggS")
+	ErrInvalidOggPage = fmt.Errorf("invalid ogg page")
+	oggCRCTable       = makeOggCRCTable()
+)
+
+// Ogg 는 반사(reflect) 하지 않는 CRC-32 (다항식 0x04c11db7, 초기값 0) 를 쓴다.
+func makeOggCRCTable() (table [256]uint32) {
+	for i := range table {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = (r << 1) ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		table[i] = r
+	}
+	return
+}
+
+func oggCRC(b []byte) (crc uint32) {
+	for _, v := range b {
+		crc = (crc << 8) ^ oggCRCTable[byte(crc>>24)^v]
+	}
+	return
+}
+
+// Opus 패킷 하나를 Ogg 페이지 하나로 감싸 쓰는 writer 이다.
+type oggWriter struct {
+	w        io.Writer
+	pageSeq  uint32
+	granule  uint64
+	channels int
+}
+
+func newOggWriter(w io.Writer, sampleRate, channels int) (*oggWriter, error) {
+	ow := &oggWriter{w: w, channels: channels}
+
+	// 식별 헤더 (RFC 7845 5.1)
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1 // version
+	head[9] = byte(channels)
+	binary.LittleEndian.PutUint16(head[10:], 0) // pre-skip
+	binary.LittleEndian.PutUint32(head[12:], uint32(sampleRate))
+	binary.LittleEndian.PutUint16(head[16:], 0) // output gain
+	head[18] = 0                                // channel mapping family
+	if err := ow.writePage(head, 0, oggHeaderTypeBOS); err != nil {
+		return nil, err
+	}
+
+	// 주석 헤더 (RFC 7845 5.2)
+	vendor := "livego"
+	tags := make([]byte, 8+4+len(vendor)+4)
+	copy(tags, "OpusTags")
+	binary.LittleEndian.PutUint32(tags[8:], uint32(len(vendor)))
+	copy(tags[12:], vendor)
+	if err := ow.writePage(tags, 0, 0); err != nil {
+		return nil, err
+	}
+	return ow, nil
+}
+
+func (ow *oggWriter) writePacket(packet []byte) error {
+	ow.granule += uint64(OpusPacketSamples(packet))
+	return ow.writePage(packet, ow.granule, 0)
+}
+
+func (ow *oggWriter) writePage(packet []byte, granule uint64, headerType byte) error {
+	nsegs := len(packet)/oggMaxSegment + 1
+	if nsegs > oggMaxSegment {
+		return fmt.Errorf("ogg packet too big: %d", len(packet))
+	}
+
+	page := make([]byte, oggPageHeaderLen+nsegs+len(packet))
+	copy(page, oggCapturePattern)
+	page[4] = 0 // version
+	page[5] = headerType
+	binary.LittleEndian.PutUint64(page[6:], granule)
+	binary.LittleEndian.PutUint32(page[14:], oggSerial)
+	binary.LittleEndian.PutUint32(page[18:], ow.pageSeq)
+	page[26] = byte(nsegs)
+	// 레이싱 값: 255 로 채우고 마지막 세그먼트는 255 보다 작게 해 패킷의 끝을 표시한다.
+	for i := 0; i < nsegs-1; i++ {
+		page[oggPageHeaderLen+i] = oggMaxSegment
+	}
+	page[oggPageHeaderLen+nsegs-1] = byte(len(packet) % oggMaxSegment)
+	copy(page[oggPageHeaderLen+nsegs:], packet)
+	binary.LittleEndian.PutUint32(page[22:], oggCRC(page))
+
+	ow.pageSeq++
+	_, err := ow.w.Write(page)
+	return err
+}
+
+// Ogg 스트림에서 패킷을 하나씩 꺼내는 reader 이다. 여러 페이지에 걸친 패킷도 이어 붙인다.
+type oggReader struct {
+	r       io.Reader
+	header  []byte
+	partial []byte
+	packets [][]byte
+}
+
+func newOggReader(r io.Reader) *oggReader {
+	return &oggReader{
+		r:      r,
+		header: make([]byte, oggPageHeaderLen),
+	}
+}
+
+func (or *oggReader) readPacket() ([]byte, error) {
+	for len(or.packets) == 0 {
+		if err := or.readPage(); err != nil {
+			return nil, err
+		}
+	}
+	packet := or.packets[0]
+	or.packets = or.packets[1:]
+	return packet, nil
+}
+
+func (or *oggReader) readPage() error {
+	if _, err := io.ReadFull(or.r, or.header); err != nil {
+		return err
+	}
+	if !bytes.Equal(or.header[:4], oggCapturePattern) {
+		return ErrInvalidOggPage
+	}
+
+	segments := make([]byte, or.header[26])
+	if _, err := io.ReadFull(or.r, segments); err != nil {
+		return err
+	}
+	size := 0
+	for _, s := range segments {
+		size += int(s)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(or.r, data); err != nil {
+		return err
+	}
+
+	for _, s := range segments {
+		or.partial = append(or.partial, data[:s]...)
+		data = data[s:]
+		if s < oggMaxSegment {
+			or.packets = append(or.packets, or.partial)
+			or.partial = nil
+		}
+	}
+	return nil
+}
+
+// Opus 패킷의 TOC 바이트(RFC 6716 3.1)로 48kHz 기준 샘플 수를 계산한다. RTP 타임스탬프와 Ogg 그래뉼 계산에 사용한다.
+func OpusPacketSamples(packet []byte) int {
+	if len(packet) < 1 {
+		return 0
+	}
+	toc := packet[0]
+	config := int(toc >> 3)
+
+	var frameSize int
+	switch {
+	case config < 12: // SILK: 10, 20, 40, 60ms
+		frameSize = []int{480, 960, 1920, 2880}[config%4]
+	case config < 16: // Hybrid: 10, 20ms
+		frameSize = []int{480, 960}[config%2]
+	default: // CELT: 2.5, 5, 10, 20ms
+		frameSize = []int{120, 240, 480, 960}[config%4]
+	}
+
+	frames := 1
+	switch toc & 0x03 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0
+		}
+		frames = int(packet[1] & 0x3f)
+	}
+	return frameSize * frames
+}
@@ -0,0 +1,224 @@
+package transcode
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"sync"
+
+	"github.com/gwuhaolin/livego/configure"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultTranscoderPath = "ffmpeg"
+	processQueueNum       = 256
+	adtsHeaderLen         = 7
+)
+
+var (
+	ErrInvalidADTS = fmt.Errorf("invalid adts frame")
+)
+
+// 외부 인코더(ffmpeg) 프로세스를 띄워 stdin/stdout 파이프로 프레임을 주고받는 변환기이다.
+// 인코더 경로는 audio_transcoder 설정으로 바꿀 수 있다.
+type processTranscoder struct {
+	cfg    Config
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	ogg    *oggWriter // 입력이 Opus 일 때 패킷을 Ogg 로 감싼다.
+	out    chan []byte
+	lock   sync.Mutex
+	closed bool
+
+	// stdout, stderr 를 읽는 고루틴. cmd.Wait 는 파이프를 닫으므로 이들이 끝난 뒤에 불러야 한다.
+	readers sync.WaitGroup
+}
+
+func newProcessTranscoder(cfg Config) (Transcoder, error) {
+	if cfg.From == cfg.To || (cfg.From != AAC && cfg.From != Opus) || (cfg.To != AAC && cfg.To != Opus) {
+		return nil, ErrUnsupportedCodec
+	}
+
+	path := configure.Config.GetString("audio_transcoder")
+	if path == "" {
+		path = defaultTranscoderPath
+	}
+	path, err := exec.LookPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(path, processArgs(cfg)...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	t := &processTranscoder{
+		cfg:   cfg,
+		cmd:   cmd,
+		stdin: stdin,
+		out:   make(chan []byte, processQueueNum),
+	}
+	if cfg.From == Opus {
+		if t.ogg, err = newOggWriter(stdin, cfg.SampleRate, cfg.Channels); err != nil {
+			t.Close()
+			return nil, err
+		}
+	}
+
+	t.readers.Add(2)
+	go func() {
+		defer t.readers.Done()
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			log.Debugf("transcoder %s->%s: %s", cfg.From, cfg.To, scanner.Text())
+		}
+	}()
+	go func() {
+		defer t.readers.Done()
+		t.readLoop(stdout)
+	}()
+
+	return t, nil
+}
+
+// 입력 형식과 출력 형식에 맞는 ffmpeg 인자를 만든다.
+// 지연을 줄이기 위해 입력 분석을 최소화하고, 출력은 패킷마다 바로 내보내도록 한다.
+func processArgs(cfg Config) []string {
+	args := []string{"-hide_banner", "-loglevel", "error",
+		"-fflags", "nobuffer", "-probesize", "32", "-analyzeduration", "0"}
+
+	switch cfg.From {
+	case AAC:
+		args = append(args, "-f", "aac")
+	case Opus:
+		args = append(args, "-f", "ogg")
+	}
+	args = append(args, "-i", "pipe:0", "-vn",
+		"-ar", strconv.Itoa(OutputSampleRate), "-ac", strconv.Itoa(OutputChannels))
+
+	switch cfg.To {
+	case AAC:
+		args = append(args, "-c:a", "aac", "-b:a", "128k", "-f", "adts")
+	case Opus:
+		// 20ms 프레임을 페이지 하나씩 내보낸다.
+		args = append(args, "-c:a", "libopus", "-b:a", "64k", "-application", "lowdelay",
+			"-frame_duration", "20", "-page_duration", "20000", "-f", "ogg")
+	}
+	return append(args, "-flush_packets", "1", "pipe:1")
+}
+
+func (t *processTranscoder) Write(frame []byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return ErrTranscoderClosed
+	}
+
+	if t.ogg != nil {
+		return t.ogg.writePacket(frame)
+	}
+	_, err := t.stdin.Write(frame)
+	return err
+}
+
+func (t *processTranscoder) Read() ([]byte, error) {
+	frame, ok := <-t.out
+	if !ok {
+		return nil, io.EOF
+	}
+	return frame, nil
+}
+
+// 인코더 출력에서 프레임을 하나씩 잘라 out 채널로 보낸다. 읽는 쪽이 밀리면 오래된 프레임 대신 새 프레임을 버린다.
+func (t *processTranscoder) readLoop(stdout io.Reader) {
+	defer close(t.out)
+
+	var next func() ([]byte, error)
+	switch t.cfg.To {
+	case AAC:
+		r := bufio.NewReader(stdout)
+		next = func() ([]byte, error) { return readADTSFrame(r) }
+	case Opus:
+		r := newOggReader(stdout)
+		headers := 0
+		next = func() ([]byte, error) {
+			// 앞의 두 패킷은 OpusHead, OpusTags 헤더이다.
+			for ; headers < 2; headers++ {
+				if _, err := r.readPacket(); err != nil {
+					return nil, err
+				}
+			}
+			return r.readPacket()
+		}
+	}
+
+	for {
+		frame, err := next()
+		if err != nil {
+			if err != io.EOF {
+				log.Debugf("transcoder %s->%s read error: %v", t.cfg.From, t.cfg.To, err)
+			}
+			return
+		}
+		select {
+		case t.out <- frame:
+		default:
+			log.Warningf("transcoder %s->%s output queue max!!!", t.cfg.From, t.cfg.To)
+		}
+	}
+}
+
+func (t *processTranscoder) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+
+	t.stdin.Close()
+	if t.cmd.Process != nil {
+		t.cmd.Process.Kill()
+	}
+	// 프로세스가 끝나 파이프가 EOF 가 되면 읽는 고루틴도 끝난다.
+	t.readers.Wait()
+	return t.cmd.Wait()
+}
+
+// ADTS 헤더를 포함한 AAC 프레임 하나를 읽는다.
+func readADTSFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, adtsHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != 0xff || header[1]&0xf0 != 0xf0 {
+		return nil, ErrInvalidADTS
+	}
+	frameLen := int(header[3]&0x03)<<11 | int(header[4])<<3 | int(header[5])>>5
+	if frameLen < adtsHeaderLen {
+		return nil, ErrInvalidADTS
+	}
+	frame := make([]byte, frameLen)
+	copy(frame, header)
+	if _, err := io.ReadFull(r, frame[adtsHeaderLen:]); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
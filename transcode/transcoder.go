@@ -0,0 +1,50 @@
+package transcode
+
+import (
+	"fmt"
+)
+
+/*
+오디오 코덱 변환 단계이다.
+RTMP 퍼블리셔는 AAC 를, 브라우저(WebRTC) 는 Opus 를 쓰기 때문에 프로토콜 사이에서 오디오를 주고받으려면 변환이 필요하다.
+기본 구현은 외부 인코더 프로세스(ffmpeg)를 띄워 파이프로 프레임을 주고받으며,
+New 변수를 바꿔 끼우면 다른 구현(가짜 변환기, 라이브러리 바인딩 등)을 쓸 수 있다.
+*/
+
+type Codec string
+
+const (
+	AAC  Codec = "aac"  // 프레임 단위는 ADTS 헤더를 포함한 AAC 프레임이다.
+	Opus Codec = "opus" // 프레임 단위는 Opus 패킷 하나이다.
+)
+
+var (
+	ErrUnsupportedCodec = fmt.Errorf("unsupported transcode codec")
+	ErrTranscoderClosed = fmt.Errorf("transcoder closed")
+)
+
+// 변환기를 만들 때 쓰는 설정이다.
+// SampleRate, Channels 는 입력 스트림의 값이며, 출력은 항상 48kHz 스테레오이다. (Opus 의 기준 클럭이자 AAC 가 지원하는 레이트)
+type Config struct {
+	From       Codec
+	To         Codec
+	SampleRate int
+	Channels   int
+}
+
+const (
+	OutputSampleRate = 48000
+	OutputChannels   = 2
+)
+
+// 오디오 프레임 변환기이다. Write 로 넣은 프레임은 비동기로 변환되고, 변환된 프레임은 Read 로 꺼낸다.
+// 인코더의 지연 때문에 Write 와 Read 의 횟수는 일치하지 않으므로, Read 는 별도의 고루틴에서 호출해야 한다.
+type Transcoder interface {
+	Write(frame []byte) error
+	// 변환된 프레임을 하나 꺼낸다. 변환기가 닫히면 io.EOF 를 돌려준다.
+	Read() ([]byte, error)
+	Close() error
+}
+
+// 변환기를 만드는 함수이다. 기본값은 외부 프로세스를 쓰는 구현이다.
+var New func(cfg Config) (Transcoder, error) = newProcessTranscoder
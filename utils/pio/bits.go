@@ -0,0 +1,99 @@
+package pio
+
+// 비트 단위로 읽는 리더. H.264/HEVC 의 SPS 처럼 Exp-Golomb 로 부호화된 필드를 읽을 때 사용한다.
+// 버퍼 끝을 넘어 읽으면 0 을 돌려주고 Overflow 가 true 가 되므로, 다 읽은 뒤 한 번만 확인하면 된다.
+type BitReader struct {
+	buf      []byte
+	pos      int // 다음에 읽을 비트 위치
+	Overflow bool
+}
+
+func NewBitReader(b []byte) *BitReader {
+	return &BitReader{buf: b}
+}
+
+func (r *BitReader) ReadBit() uint {
+	if r.pos >= len(r.buf)*8 {
+		r.Overflow = true
+		return 0
+	}
+	bit := uint(r.buf[r.pos/8]>>(7-uint(r.pos%8))) & 1
+	r.pos++
+	return bit
+}
+
+// n 비트(최대 32)를 읽는다.
+func (r *BitReader) ReadBits(n int) uint {
+	var v uint
+	for i := 0; i < n; i++ {
+		v = v<<1 | r.ReadBit()
+	}
+	return v
+}
+
+func (r *BitReader) Skip(n int) {
+	r.pos += n
+	if r.pos > len(r.buf)*8 {
+		r.Overflow = true
+	}
+}
+
+// ue(v). 앞의 0 비트 개수만큼 뒤의 비트를 더 읽는다.
+func (r *BitReader) ReadUE() uint {
+	zeros := 0
+	for r.ReadBit() == 0 {
+		if r.Overflow || zeros >= 32 {
+			r.Overflow = true
+			return 0
+		}
+		zeros++
+	}
+	return (1<<uint(zeros) - 1) + r.ReadBits(zeros)
+}
+
+// se(v). ue 값 k 를 1, -1, 2, -2 ... 순서로 바꾼다.
+func (r *BitReader) ReadSE() int {
+	k := r.ReadUE()
+	if k%2 == 1 {
+		return int((k + 1) / 2)
+	}
+	return -int(k / 2)
+}
+
+// NALU 의 에뮬레이션 방지 바이트(00 00 03 의 03)를 지워 RBSP 로 만든다.
+func RBSP(nalu []byte) []byte {
+	rbsp := make([]byte, 0, len(nalu))
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return rbsp
+}
+
+// RBSP 에 에뮬레이션 방지 바이트를 다시 넣는다. 00 00 뒤에 00~03 이 오면 그 앞에 03 을 넣는다.
+func EBSP(rbsp []byte) []byte {
+	nalu := make([]byte, 0, len(rbsp)+len(rbsp)/64)
+	zeros := 0
+	for _, b := range rbsp {
+		if zeros >= 2 && b <= 3 {
+			nalu = append(nalu, 3)
+			zeros = 0
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		nalu = append(nalu, b)
+	}
+	return nalu
+}